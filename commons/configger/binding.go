@@ -0,0 +1,293 @@
+package configger
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ValidationError points at the offending key of the configuration
+type ValidationError struct {
+	Key     string // e.g. "entry.port"
+	Source  string // file path, environment variable or flag which set the key, blank if the key is absent
+	Line    int    // zero if the key is absent or was not set by a file
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	switch {
+	case "" != e.Source && 0 != e.Line:
+		return fmt.Sprintf("'%s' (%s LINE %d): %s", e.Key, e.Source, e.Line, e.Message)
+	case "" != e.Source:
+		return fmt.Sprintf("'%s' (%s): %s", e.Key, e.Source, e.Message)
+	case 0 != e.Line:
+		return fmt.Sprintf("'%s' (LINE %d): %s", e.Key, e.Line, e.Message)
+	default:
+		return fmt.Sprintf("'%s': %s", e.Key, e.Message)
+	}
+}
+
+// ValidationErrors collects all problems found while binding the configuration
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, validationError := range e {
+		messages = append(messages, validationError.Error())
+	}
+
+	return "INVALID CONFIGURATION:\n" + strings.Join(messages, "\n")
+}
+
+// Bind decodes the configuration file which was loaded by Load into "target", a pointer to struct.
+// Fields are matched by the "yaml" tag and validated by the following tags:
+// "default" is the value of an absent key, "required" makes the key mandatory,
+// "min" and "max" limit numbers, "enum" is a comma-separated list of accepted strings.
+// Keys which match no field are reported as unknown, all problems are returned at once by ValidationErrors
+func Bind(target interface{}) error {
+	if "" == loadedPath {
+		return fmt.Errorf("NO CONFIGURATION FILE WAS LOADED")
+	}
+
+	_, err := BindSources(Sources{File: loadedPath}, target)
+	return err
+}
+
+// BindBytes is the same as Bind but decodes YAML "data"
+func BindBytes(data []byte, target interface{}) error {
+	tree := newTree()
+	err := tree.mergeBytes(data, "")
+	if nil != err {
+		return err
+	}
+
+	_, err = tree.bind(target)
+	return err
+}
+
+// Marshal returns the YAML form of "target", e.g. for printing the effective configuration
+func Marshal(target interface{}) (string, error) {
+	data, err := yaml.Marshal(target)
+	if nil != err {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// binder decodes a merged tree into a struct
+type binder struct {
+	sourceMap        map[*yaml.Node]string // pair< node, source >
+	origins          Origins
+	validationErrors ValidationErrors
+}
+
+func (binder *binder) report(key string, node *yaml.Node, message string) {
+	validationError := ValidationError{Key: key, Message: message}
+	if nil != node {
+		validationError.Source = binder.sourceMap[node]
+		validationError.Line = node.Line
+	}
+
+	binder.validationErrors = append(binder.validationErrors, validationError)
+}
+
+// bind the mapping "node" into the struct "value", "node" is nil if the key of the struct is absent
+// "parent" is the key node of the struct for reporting absent keys, it is nil for the root
+func (binder *binder) bindStruct(node *yaml.Node, parent *yaml.Node, value reflect.Value, prefix string) {
+	if nil != node && "!!null" == node.Tag {
+		node = nil
+	}
+
+	if nil != node && yaml.MappingNode != node.Kind {
+		binder.report(strings.TrimSuffix(prefix, "."), node, "MAPPING IS EXPECTED")
+		return
+	}
+
+	// key nodes in the order of the tree, and pair< key, key node / value node >
+	keyNodes := make([]*yaml.Node, 0)
+	keyNodeMap := make(map[string]*yaml.Node)
+	children := make(map[string]*yaml.Node)
+	if nil != node {
+		for idx := 0; idx+1 < len(node.Content); idx += 2 {
+			keyNodes = append(keyNodes, node.Content[idx])
+			keyNodeMap[node.Content[idx].Value] = node.Content[idx]
+			children[node.Content[idx].Value] = node.Content[idx+1]
+		}
+	}
+
+	known := make(map[string]bool)
+	valueType := value.Type()
+	for idx := 0; idx < valueType.NumField(); idx++ {
+		field := valueType.Field(idx)
+		name := fieldName(field)
+		if "" == name {
+			continue
+		}
+		known[name] = true
+
+		key := prefix + name
+		child := children[name]
+		if nil != child && "!!null" == child.Tag {
+			child = nil
+		}
+
+		keyNode, ok := keyNodeMap[name]
+		if false == ok {
+			keyNode = parent
+		}
+
+		if reflect.Struct == field.Type.Kind() {
+			binder.bindStruct(child, keyNode, value.Field(idx), key+".")
+			continue
+		}
+
+		if reflect.Map == field.Type.Kind() && reflect.String == field.Type.Key().Kind() && reflect.Struct == field.Type.Elem().Kind() {
+			binder.bindMap(child, keyNode, field, value.Field(idx), key)
+			continue
+		}
+
+		binder.bindField(child, keyNode, field, value.Field(idx), key)
+	}
+
+	for _, keyNode := range keyNodes {
+		name := keyNode.Value
+		if known[name] {
+			continue
+		}
+
+		message := "UNKNOWN KEY"
+		for candidate := range known {
+			if strings.EqualFold(candidate, name) {
+				message = fmt.Sprintf("UNKNOWN KEY, DID YOU MEAN '%s%s'?", prefix, candidate)
+				break
+			}
+		}
+
+		binder.report(prefix+name, keyNode, message)
+	}
+}
+
+// bind the mapping "node" into the map field whose values are structs, every value is bound as a struct
+// so that its keys are checked and validated the same as other structs
+func (binder *binder) bindMap(node *yaml.Node, keyNode *yaml.Node, field reflect.StructField, value reflect.Value, key string) {
+	if nil == node {
+		binder.bindField(node, keyNode, field, value, key)
+		return
+	}
+
+	if yaml.MappingNode != node.Kind {
+		binder.report(key, node, "MAPPING IS EXPECTED")
+		return
+	}
+
+	mapValue := reflect.MakeMapWithSize(field.Type, len(node.Content)/2)
+	for idx := 0; idx+1 < len(node.Content); idx += 2 {
+		name := node.Content[idx].Value
+		element := reflect.New(field.Type.Elem()).Elem()
+		binder.bindStruct(node.Content[idx+1], node.Content[idx], element, key+"."+name+".")
+		mapValue.SetMapIndex(reflect.ValueOf(name).Convert(field.Type.Key()), element)
+	}
+
+	value.Set(mapValue)
+	binder.origins[key] = binder.sourceMap[node]
+}
+
+// bind the scalar or sequence "node" into the field, "keyNode" is the key of the field, or its parent if the key is absent
+func (binder *binder) bindField(node *yaml.Node, keyNode *yaml.Node, field reflect.StructField, value reflect.Value, key string) {
+	if nil == node {
+		if "true" == field.Tag.Get("required") {
+			binder.report(key, keyNode, "REQUIRED KEY IS MISSING")
+			return
+		}
+
+		defaultValue, ok := field.Tag.Lookup("default")
+		if false == ok {
+			// zero value is kept and never validated
+			return
+		}
+
+		err := yaml.Unmarshal([]byte(defaultValue), value.Addr().Interface())
+		if nil != err {
+			binder.report(key, nil, fmt.Sprintf("INVALID DEFAULT VALUE '%s': %+v", defaultValue, err))
+			return
+		}
+
+		binder.origins[key] = SourceDefault
+		keyNode = nil
+	} else {
+		err := node.Decode(value.Addr().Interface())
+		if nil != err {
+			binder.report(key, node, fmt.Sprintf("%s IS EXPECTED BUT '%s' IS GIVEN", strings.ToUpper(field.Type.String()), node.Value))
+			return
+		}
+
+		binder.origins[key] = binder.sourceMap[node]
+		keyNode = node
+	}
+
+	if message := validateRange(field, value); "" != message {
+		binder.report(key, keyNode, message)
+	}
+
+	if message := validateEnum(field, value); "" != message {
+		binder.report(key, keyNode, message)
+	}
+}
+
+// name of the key which the field is bound to, blank if the field is not bound
+func fieldName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+	if "-" == name {
+		return ""
+	}
+
+	return name
+}
+
+func validateRange(field reflect.StructField, value reflect.Value) string {
+	var number float64
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		number = float64(value.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		number = float64(value.Uint())
+	case reflect.Float32, reflect.Float64:
+		number = value.Float()
+	default:
+		return ""
+	}
+
+	if minimum, ok := field.Tag.Lookup("min"); ok {
+		if limit, err := strconv.ParseFloat(minimum, 64); nil == err && number < limit {
+			return fmt.Sprintf("%v IS LESS THAN THE MINIMUM %s", number, minimum)
+		}
+	}
+
+	if maximum, ok := field.Tag.Lookup("max"); ok {
+		if limit, err := strconv.ParseFloat(maximum, 64); nil == err && number > limit {
+			return fmt.Sprintf("%v IS GREATER THAN THE MAXIMUM %s", number, maximum)
+		}
+	}
+
+	return ""
+}
+
+func validateEnum(field reflect.StructField, value reflect.Value) string {
+	enum, ok := field.Tag.Lookup("enum")
+	if false == ok || reflect.String != value.Kind() {
+		return ""
+	}
+
+	candidates := strings.Split(enum, ",")
+	for _, candidate := range candidates {
+		if value.String() == candidate {
+			return ""
+		}
+	}
+
+	return fmt.Sprintf("UNSUPPORTED VALUE '%s', EXPECTED ONE OF %v", value.String(), candidates)
+}
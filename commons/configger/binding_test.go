@@ -0,0 +1,123 @@
+package configger
+
+import (
+	"strings"
+	"testing"
+)
+
+type testClient struct {
+	Rate  float64 `yaml:"rate" min:"0" max:"1000" default:"10"`
+	Burst int     `yaml:"burst" min:"1"`
+	Mode  string  `yaml:"mode" enum:"notify,request" default:"notify"`
+}
+
+type testConfig struct {
+	Name    string                `yaml:"name" required:"true"`
+	Clients map[string]testClient `yaml:"clients"`
+	Labels  map[string]string     `yaml:"labels"`
+}
+
+func TestBindMapOfStructs(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		errors  []string // keys of expected validation errors
+		clients map[string]testClient
+	}{
+		{
+			"valid",
+			"name: agent\nclients:\n  monitor:\n    rate: 5\n    burst: 2\n    mode: request\n",
+			nil,
+			map[string]testClient{"monitor": {Rate: 5, Burst: 2, Mode: "request"}},
+		},
+		{
+			"defaults of values",
+			"name: agent\nclients:\n  monitor:\n    burst: 1\n  empty:\n",
+			nil,
+			map[string]testClient{"monitor": {Rate: 10, Burst: 1, Mode: "notify"}, "empty": {Rate: 10, Mode: "notify"}},
+		},
+		{
+			"absent map",
+			"name: agent\n",
+			nil,
+			map[string]testClient{},
+		},
+		{
+			"unknown key of a value",
+			"name: agent\nclients:\n  monitor:\n    rates: 5\n",
+			[]string{"'clients.monitor.rates'"},
+			nil,
+		},
+		{
+			"out of range",
+			"name: agent\nclients:\n  monitor:\n    rate: 5000\n    burst: 0\n",
+			[]string{"'clients.monitor.rate'", "'clients.monitor.burst'"},
+			nil,
+		},
+		{
+			"unsupported enum",
+			"name: agent\nclients:\n  monitor:\n    mode: stream\n",
+			[]string{"'clients.monitor.mode'"},
+			nil,
+		},
+		{
+			"value is not a mapping",
+			"name: agent\nclients:\n  monitor: 5\n",
+			[]string{"'clients.monitor'"},
+			nil,
+		},
+		{
+			"map is not a mapping",
+			"name: agent\nclients: [monitor]\n",
+			[]string{"'clients'"},
+			nil,
+		},
+	}
+
+	for _, test := range tests {
+		var config testConfig
+		err := BindBytes([]byte(test.yaml), &config)
+
+		if 0 == len(test.errors) {
+			if nil != err {
+				t.Errorf("%s: unexpected error %v", test.name, err)
+				continue
+			}
+
+			if len(test.clients) != len(config.Clients) {
+				t.Errorf("%s: expected %v but got %v", test.name, test.clients, config.Clients)
+			}
+
+			for name, client := range test.clients {
+				if config.Clients[name] != client {
+					t.Errorf("%s: expected %+v but got %+v", test.name, client, config.Clients[name])
+				}
+			}
+			continue
+		}
+
+		validationErrors, ok := err.(ValidationErrors)
+		if false == ok || len(test.errors) != len(validationErrors) {
+			t.Errorf("%s: expected errors of %v but got %v", test.name, test.errors, err)
+			continue
+		}
+
+		for _, key := range test.errors {
+			if false == strings.Contains(err.Error(), key) {
+				t.Errorf("%s: no error of %s in %v", test.name, key, err)
+			}
+		}
+	}
+}
+
+func TestBindMapOfScalars(t *testing.T) {
+	var config testConfig
+	err := BindBytes([]byte("name: agent\nlabels:\n  site: lab\n"), &config)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	if "lab" != config.Labels["site"] {
+		t.Fatalf("unexpected labels %v", config.Labels)
+	}
+}
@@ -5,8 +5,16 @@ import (
 	"github.com/micro/go-micro/config/reader"
 )
 
+// path of the configuration file which was loaded by Load
+var loadedPath string
+
 func Load(filePath string) error {
-	return config.LoadFile(filePath)
+	err := config.LoadFile(filePath)
+	if nil == err {
+		loadedPath = filePath
+	}
+
+	return err
 }
 
 func GetValue(configPath ...string) reader.Value {
@@ -0,0 +1,105 @@
+package configger
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ReadOverrides returns the "key=value" pairs of a YAML file which was written by WriteOverrides,
+// nested mappings are flattened into dotted keys and an absent file has no overrides
+func ReadOverrides(path string) (Overrides, error) {
+	overrides := make(Overrides)
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return overrides, nil
+	}
+
+	tree := newTree()
+	err := tree.mergeFile(path)
+	if nil != err {
+		return nil, err
+	}
+
+	flatten(tree.root, "", overrides)
+
+	return overrides, nil
+}
+
+// WriteOverrides replaces the YAML file at "path" by "overrides" atomically,
+// the file is written aside and renamed so readers never see a partial file
+func WriteOverrides(path string, overrides Overrides) error {
+	keys := make([]string, 0, len(overrides))
+	for key := range overrides {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	tree := newTree()
+	for _, key := range keys {
+		tree.set(key, overrides[key], "")
+	}
+
+	data, err := yaml.Marshal(tree.root)
+	if nil != err {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if nil != err {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(data)
+	if nil == err {
+		err = file.Sync()
+	}
+
+	if closeErr := file.Close(); nil == err {
+		err = closeErr
+	}
+
+	if nil != err {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// Values maps each bound key of "target" to its value, e.g. for reporting the effective configuration in JSON
+func Values(target interface{}) map[string]interface{} {
+	value := reflect.Indirect(reflect.ValueOf(target))
+
+	values := make(map[string]interface{})
+	for _, key := range boundKeys(value.Type(), "") {
+		fieldValue := value
+		for _, name := range strings.Split(key, ".") {
+			fieldValue = fieldByName(fieldValue, name)
+		}
+
+		values[key] = fieldValue.Interface()
+	}
+
+	return values
+}
+
+// collect scalar values of the mapping "node" into "overrides"
+func flatten(node *yaml.Node, prefix string, overrides Overrides) {
+	for idx := 0; idx+1 < len(node.Content); idx += 2 {
+		key := prefix + node.Content[idx].Value
+		child := node.Content[idx+1]
+
+		switch child.Kind {
+		case yaml.MappingNode:
+			flatten(child, key+".", overrides)
+		case yaml.ScalarNode:
+			overrides[key] = child.Value
+		}
+	}
+}
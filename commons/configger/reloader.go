@@ -0,0 +1,208 @@
+package configger
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"sercomm.com/demeter/commons/logger"
+)
+
+// ReloadCallback is notified with the keys whose values were changed by a reload and the new configuration,
+// "config" is a pointer to a new instance of the struct given to NewReloader
+type ReloadCallback func(changedKeys []string, config interface{})
+
+// Reloader binds the sources again on demand (e.g. SIGHUP) or when the files change,
+// invalid configurations are rejected and the current one is kept
+type Reloader struct {
+	sources     Sources
+	targetType  reflect.Type
+	reloading   sync.Mutex // serializes reloads, so that subscribers are notified in the order of the swaps
+	locker      sync.Mutex
+	current     interface{}
+	origins     Origins
+	subscribers []ReloadCallback
+	terminated  chan bool
+}
+
+// NewReloader binds "sources" into "target" (a pointer to struct) as BindSources does,
+// "target" is the initial configuration, later reloads bind into new instances
+func NewReloader(sources Sources, target interface{}) (*Reloader, error) {
+	origins, err := BindSources(sources, target)
+	if nil != err {
+		return nil, err
+	}
+
+	return &Reloader{
+		sources:     sources,
+		targetType:  reflect.TypeOf(target).Elem(),
+		current:     target,
+		origins:     origins,
+		subscribers: make([]ReloadCallback, 0),
+	}, nil
+}
+
+// GetCurrent returns the current configuration and the sources of its values
+func (reloader *Reloader) GetCurrent() (interface{}, Origins) {
+	reloader.locker.Lock()
+	defer reloader.locker.Unlock()
+
+	return reloader.current, reloader.origins
+}
+
+// GetSources returns the sources given to NewReloader
+func (reloader *Reloader) GetSources() Sources {
+	return reloader.sources
+}
+
+// Subscribe registers "callback" which is invoked after each reload which changed any key
+func (reloader *Reloader) Subscribe(callback ReloadCallback) {
+	reloader.locker.Lock()
+	defer reloader.locker.Unlock()
+
+	reloader.subscribers = append(reloader.subscribers, callback)
+}
+
+// Reload binds the sources again, the changed keys are returned and notified to subscribers.
+// If the new configuration is invalid, it is rejected by the error and the current one is kept.
+// Subscribers must not invoke Reload since reloads wait for the notifications of the previous one
+func (reloader *Reloader) Reload() ([]string, error) {
+	reloader.reloading.Lock()
+	defer reloader.reloading.Unlock()
+
+	reloader.locker.Lock()
+
+	target := reflect.New(reloader.targetType).Interface()
+	origins, err := BindSources(reloader.sources, target)
+	if nil != err {
+		reloader.locker.Unlock()
+		return nil, fmt.Errorf("RELOAD REJECTED: %+v", err)
+	}
+
+	changedKeys := DiffKeys(reloader.current, target)
+	if 0 == len(changedKeys) {
+		reloader.locker.Unlock()
+		return changedKeys, nil
+	}
+
+	reloader.current = target
+	reloader.origins = origins
+	subscribers := make([]ReloadCallback, len(reloader.subscribers))
+	copy(subscribers, reloader.subscribers)
+	reloader.locker.Unlock()
+
+	for _, subscriber := range subscribers {
+		subscriber(changedKeys, target)
+	}
+
+	return changedKeys, nil
+}
+
+// Watch polls the configuration file, the drop-in directory and the override file every "interval", and reloads once any of them changed
+func (reloader *Reloader) Watch(interval time.Duration) {
+	reloader.locker.Lock()
+	if nil != reloader.terminated {
+		reloader.locker.Unlock()
+		return
+	}
+	terminated := make(chan bool)
+	reloader.terminated = terminated
+	reloader.locker.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		fingerprint := reloader.fingerprint()
+		for {
+			select {
+			case <-terminated:
+				return
+			case <-ticker.C:
+			}
+
+			latest := reloader.fingerprint()
+			if latest == fingerprint {
+				continue
+			}
+			fingerprint = latest
+
+			changedKeys, err := reloader.Reload()
+			if nil != err {
+				logger.New().Warn("config: "+err.Error(), zap.String("file", reloader.sources.File))
+				continue
+			}
+
+			logger.New().Info("config: RELOADED", zap.String("file", reloader.sources.File), zap.Strings("changedKeys", changedKeys))
+		}
+	}()
+}
+
+// StopWatching stops the polling started by Watch
+func (reloader *Reloader) StopWatching() {
+	reloader.locker.Lock()
+	defer reloader.locker.Unlock()
+
+	if nil != reloader.terminated {
+		close(reloader.terminated)
+		reloader.terminated = nil
+	}
+}
+
+// paths, sizes and modification times of all configuration files
+func (reloader *Reloader) fingerprint() string {
+	paths := make([]string, 0)
+	if "" != reloader.sources.File {
+		paths = append(paths, reloader.sources.File)
+	}
+
+	if "" != reloader.sources.DropInDir {
+		dropIns, _ := filepath.Glob(filepath.Join(reloader.sources.DropInDir, "*.yaml"))
+		sort.Strings(dropIns)
+		paths = append(paths, dropIns...)
+	}
+
+	if "" != reloader.sources.OverrideFile {
+		paths = append(paths, reloader.sources.OverrideFile)
+	}
+
+	parts := make([]string, 0, len(paths))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if nil != err {
+			parts = append(parts, path+":ABSENT")
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s:%d:%d", path, info.Size(), info.ModTime().UnixNano()))
+	}
+
+	return strings.Join(parts, "|")
+}
+
+// DiffKeys returns the bound keys whose values differ between two instances of the same struct
+func DiffKeys(former interface{}, latter interface{}) []string {
+	formerValue := reflect.Indirect(reflect.ValueOf(former))
+	latterValue := reflect.Indirect(reflect.ValueOf(latter))
+
+	changedKeys := make([]string, 0)
+	for _, key := range boundKeys(formerValue.Type(), "") {
+		formerField := formerValue
+		latterField := latterValue
+		for _, name := range strings.Split(key, ".") {
+			formerField = fieldByName(formerField, name)
+			latterField = fieldByName(latterField, name)
+		}
+
+		if false == reflect.DeepEqual(formerField.Interface(), latterField.Interface()) {
+			changedKeys = append(changedKeys, key)
+		}
+	}
+
+	return changedKeys
+}
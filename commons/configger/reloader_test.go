@@ -0,0 +1,75 @@
+package configger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testReloadConfig struct {
+	Generation int `yaml:"generation"`
+}
+
+func TestReloaderNotifiesInOrder(t *testing.T) {
+	directory, err := ioutil.TempDir("", "reloader")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "config.yaml")
+	write := func(generation int) {
+		err := ioutil.WriteFile(path, []byte(fmt.Sprintf("generation: %d\n", generation)), 0644)
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+	write(0)
+
+	reloader, err := NewReloader(Sources{File: path}, &testReloadConfig{})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	// the first notification is held until the second reload has started, and the configurations are applied in order
+	entered := make(chan bool)
+	release := make(chan bool)
+	applied := make(chan int, 2)
+	reloader.Subscribe(func(changedKeys []string, config interface{}) {
+		generation := config.(*testReloadConfig).Generation
+		if 1 == generation {
+			entered <- true
+			<-release
+		}
+		applied <- generation
+	})
+
+	write(1)
+	go reloader.Reload()
+	<-entered
+
+	write(2)
+	go reloader.Reload()
+
+	time.Sleep(time.Millisecond * 100)
+	close(release)
+
+	for _, expected := range []int{1, 2} {
+		select {
+		case generation := <-applied:
+			if expected != generation {
+				t.Fatalf("expected generation %d but got %d", expected, generation)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("reload was not notified")
+		}
+	}
+
+	current, _ := reloader.GetCurrent()
+	if 2 != current.(*testReloadConfig).Generation {
+		t.Fatalf("unexpected configuration %+v", current)
+	}
+}
@@ -0,0 +1,296 @@
+package configger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SourceDefault is the source of values which come from the "default" tags
+const SourceDefault string = "DEFAULT"
+
+// Sources are merged by BindSources in the order of precedence:
+// defaults < File < DropInDir/*.yaml (in lexical order) < OverrideFile < environment variables < Overrides
+type Sources struct {
+	File         string    // main YAML file, it can be blank
+	DropInDir    string    // e.g. "/etc/cpe_agent/conf.d", it is skipped if it does not exist
+	OverrideFile string    // YAML file written by WriteOverrides (e.g. pushed by the server), it is skipped if it does not exist
+	EnvPrefix    string    // e.g. "CPE_AGENT" maps "entry.host" to CPE_AGENT_ENTRY_HOST, blank to ignore environment variables
+	Overrides    Overrides // e.g. given by command-line flags
+}
+
+// Origins maps each bound key (e.g. "entry.host") to the source of its effective value
+type Origins map[string]string
+
+// Overrides are "key=value" pairs, e.g. "entry.host=10.0.0.1", it can be used as a repeatable flag.Value
+type Overrides map[string]string
+
+func (overrides *Overrides) String() string {
+	pairs := make([]string, 0, len(*overrides))
+	for key, value := range *overrides {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
+
+func (overrides *Overrides) Set(pair string) error {
+	idx := strings.Index(pair, "=")
+	if idx <= 0 {
+		return fmt.Errorf("'%s' IS NOT IN FORM OF KEY=VALUE", pair)
+	}
+
+	if nil == *overrides {
+		*overrides = make(Overrides)
+	}
+	(*overrides)[strings.TrimSpace(pair[:idx])] = strings.TrimSpace(pair[idx+1:])
+
+	return nil
+}
+
+// BindSources merges "sources" and binds the result into "target" the same as Bind,
+// the source of each effective value is returned for inspecting
+func BindSources(sources Sources, target interface{}) (Origins, error) {
+	value := reflect.ValueOf(target)
+	if value.Kind() != reflect.Ptr || value.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("INVALID TARGET: POINTER TO STRUCT IS EXPECTED")
+	}
+
+	tree := newTree()
+
+	if "" != sources.File {
+		err := tree.mergeFile(sources.File)
+		if nil != err {
+			return nil, err
+		}
+	}
+
+	if "" != sources.DropInDir {
+		paths, err := filepath.Glob(filepath.Join(sources.DropInDir, "*.yaml"))
+		if nil != err {
+			return nil, err
+		}
+		sort.Strings(paths)
+
+		for _, path := range paths {
+			err = tree.mergeFile(path)
+			if nil != err {
+				return nil, err
+			}
+		}
+	}
+
+	if "" != sources.OverrideFile {
+		if _, err := os.Stat(sources.OverrideFile); false == os.IsNotExist(err) {
+			err = tree.mergeFile(sources.OverrideFile)
+			if nil != err {
+				return nil, err
+			}
+		}
+	}
+
+	if "" != sources.EnvPrefix {
+		for _, key := range boundKeys(value.Elem().Type(), "") {
+			name := EnvName(sources.EnvPrefix, key)
+			if envValue, ok := os.LookupEnv(name); ok {
+				tree.set(key, envValue, "ENV "+name)
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(sources.Overrides))
+	for key := range sources.Overrides {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		tree.set(key, sources.Overrides[key], "FLAG "+key)
+	}
+
+	return tree.bind(target)
+}
+
+// EnvName returns the environment variable of the key, e.g. "entry.enableSSL" is CPE_AGENT_ENTRY_ENABLESSL
+func EnvName(prefix string, key string) string {
+	return strings.ToUpper(prefix + "_" + strings.Replace(key, ".", "_", -1))
+}
+
+// Explain lists the effective value and its source of each bound key, e.g. "entry.host = localhost (DEFAULT)"
+func Explain(target interface{}, origins Origins) string {
+	value := reflect.Indirect(reflect.ValueOf(target))
+
+	lines := make([]string, 0)
+	for _, key := range boundKeys(value.Type(), "") {
+		fieldValue := value
+		for _, name := range strings.Split(key, ".") {
+			fieldValue = fieldByName(fieldValue, name)
+		}
+
+		origin, ok := origins[key]
+		if false == ok {
+			origin = "UNSET"
+		}
+
+		lines = append(lines, fmt.Sprintf("%s = %v (%s)", key, fieldValue.Interface(), origin))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// keys of all fields which are bound by "yaml" tags, nested structs are flattened
+func boundKeys(valueType reflect.Type, prefix string) []string {
+	keys := make([]string, 0)
+	for idx := 0; idx < valueType.NumField(); idx++ {
+		field := valueType.Field(idx)
+		name := fieldName(field)
+		if "" == name {
+			continue
+		}
+
+		if reflect.Struct == field.Type.Kind() {
+			keys = append(keys, boundKeys(field.Type, prefix+name+".")...)
+			continue
+		}
+
+		keys = append(keys, prefix+name)
+	}
+
+	return keys
+}
+
+func fieldByName(value reflect.Value, name string) reflect.Value {
+	for idx := 0; idx < value.NumField(); idx++ {
+		if fieldName(value.Type().Field(idx)) == name {
+			return value.Field(idx)
+		}
+	}
+
+	return reflect.Value{}
+}
+
+// tree is the mapping merged from all sources, every node remembers the source which set it
+type tree struct {
+	root      *yaml.Node
+	sourceMap map[*yaml.Node]string // pair< node, source >
+}
+
+func newTree() *tree {
+	return &tree{
+		root:      &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"},
+		sourceMap: make(map[*yaml.Node]string),
+	}
+}
+
+func (tree *tree) mergeFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if nil != err {
+		return err
+	}
+
+	return tree.mergeBytes(data, path)
+}
+
+func (tree *tree) mergeBytes(data []byte, source string) error {
+	var document yaml.Node
+	err := yaml.Unmarshal(data, &document)
+	if nil != err {
+		if "" == source {
+			return fmt.Errorf("INVALID CONFIGURATION: %+v", err)
+		}
+		return fmt.Errorf("INVALID CONFIGURATION %s: %+v", source, err)
+	}
+
+	// empty document
+	if yaml.DocumentNode != document.Kind || 0 == len(document.Content) || "!!null" == document.Content[0].Tag {
+		return nil
+	}
+
+	root := document.Content[0]
+	if yaml.MappingNode != root.Kind {
+		return fmt.Errorf("INVALID CONFIGURATION %s: MAPPING IS EXPECTED", source)
+	}
+
+	tree.mark(root, source)
+	tree.merge(tree.root, root)
+
+	return nil
+}
+
+// set the scalar value of the dotted key, mappings on the path are created if they are absent
+func (tree *tree) set(key string, value string, source string) {
+	overlay := &yaml.Node{Kind: yaml.ScalarNode, Value: value}
+
+	names := strings.Split(key, ".")
+	for idx := len(names) - 1; idx >= 0; idx-- {
+		keyNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: names[idx]}
+		overlay = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: []*yaml.Node{keyNode, overlay}}
+	}
+
+	tree.mark(overlay, source)
+	tree.merge(tree.root, overlay)
+}
+
+// remember the source of the node and its descendants
+func (tree *tree) mark(node *yaml.Node, source string) {
+	tree.sourceMap[node] = source
+	for _, child := range node.Content {
+		tree.mark(child, source)
+	}
+}
+
+// merge the mapping "overlay" into the mapping "base", mappings are merged recursively and other values are replaced
+func (tree *tree) merge(base *yaml.Node, overlay *yaml.Node) {
+	for idx := 0; idx+1 < len(overlay.Content); idx += 2 {
+		keyNode := overlay.Content[idx]
+		valueNode := overlay.Content[idx+1]
+
+		found := false
+		for baseIdx := 0; baseIdx+1 < len(base.Content); baseIdx += 2 {
+			if base.Content[baseIdx].Value != keyNode.Value {
+				continue
+			}
+			found = true
+
+			baseValue := base.Content[baseIdx+1]
+			if yaml.MappingNode == baseValue.Kind && yaml.MappingNode == valueNode.Kind {
+				tree.merge(baseValue, valueNode)
+			} else {
+				base.Content[baseIdx] = keyNode
+				base.Content[baseIdx+1] = valueNode
+			}
+			break
+		}
+
+		if false == found {
+			base.Content = append(base.Content, keyNode, valueNode)
+		}
+	}
+}
+
+func (tree *tree) bind(target interface{}) (Origins, error) {
+	value := reflect.ValueOf(target)
+	if value.Kind() != reflect.Ptr || value.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("INVALID TARGET: POINTER TO STRUCT IS EXPECTED")
+	}
+
+	binder := &binder{
+		sourceMap:        tree.sourceMap,
+		origins:          make(Origins),
+		validationErrors: make(ValidationErrors, 0),
+	}
+	binder.bindStruct(tree.root, nil, value.Elem(), "")
+
+	if 0 != len(binder.validationErrors) {
+		return binder.origins, binder.validationErrors
+	}
+
+	return binder.origins, nil
+}
@@ -0,0 +1,598 @@
+package kafkaex
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+	"gopkg.in/yaml.v3"
+	"sercomm.com/demeter/commons/logger"
+)
+
+// durations are defined by Cloud
+const (
+	defaultAdminTimeout       = (time.Second * 5)
+	defaultDeleteTopicTimeout = (time.Second * 60)
+)
+
+// TopicSpec describes a topic to be created or reconciled,
+// it can be a field of a configuration bound by configger or loaded from YAML by LoadTopicSpecs
+type TopicSpec struct {
+	Name              string            `json:"name" yaml:"name"`
+	PartitionCount    int               `json:"partitions" yaml:"partitions"`
+	ReplicationFactor int               `json:"replicationFactor" yaml:"replicationFactor"` // 1 for creation and not reconciled if it is 0
+	Configs           map[string]string `json:"configs" yaml:"configs"`                     // e.g. "retention.ms": "86400000"
+}
+
+// TopicInfo is the metadata of a topic returned by KafkaAdmin.ListTopics
+type TopicInfo struct {
+	Name              string
+	ReplicationFactor int
+	Partitions        []PartitionInfo
+}
+
+// PartitionInfo is the metadata of a partition
+type PartitionInfo struct {
+	ID       int32
+	Leader   int32
+	Replicas []int32
+	Isrs     []int32
+}
+
+// PartitionLag is the consuming progress of a consumer group on a partition
+type PartitionLag struct {
+	Topic           string
+	Partition       int32
+	CommittedOffset int64 // -1 if the group has never committed on the partition
+	LowWatermark    int64
+	HighWatermark   int64
+	Lag             int64
+}
+
+// KafkaAdmin manages topics and inspects consumer groups of the cluster
+type KafkaAdmin struct {
+	adminClient *kafka.AdminClient
+	configMap   kafka.ConfigMap // nil if the admin client shares the connection of a producer or consumer
+	timeout     time.Duration   // zero for the default duration of each operation
+}
+
+func NewKafkaAdmin(brokerAddr string) (*KafkaAdmin, error) {
+	return NewKafkaAdminWithOptions(brokerAddr, ClientOptions{})
+}
+
+// NewKafkaAdminWithOptions creates an admin client with the security "options",
+// ClientOptions.AdminTimeoutMs overrides the durations of all admin operations
+func NewKafkaAdminWithOptions(brokerAddr string, options ClientOptions) (*KafkaAdmin, error) {
+	configMap, err := options.commonConfigMap(brokerAddr)
+	if nil != err {
+		return nil, fmt.Errorf("FAILED TO CREATE ADMIN: %+v", err)
+	}
+
+	err = options.applyExtra(configMap)
+	if nil != err {
+		return nil, fmt.Errorf("FAILED TO CREATE ADMIN: %+v", err)
+	}
+
+	if options.AdminTimeoutMs < 0 {
+		return nil, fmt.Errorf("FAILED TO CREATE ADMIN: INVALID OPTION 'AdminTimeoutMs': %d IS NEGATIVE", options.AdminTimeoutMs)
+	}
+
+	// the admin client owns a copy since librdkafka may modify the map
+	adminConfigMap := kafka.ConfigMap{}
+	for key, value := range configMap {
+		adminConfigMap[key] = value
+	}
+
+	adminClient, err := kafka.NewAdminClient(&adminConfigMap)
+	if nil != err {
+		return nil, fmt.Errorf("FAILED TO CREATE ADMIN: %+v", err)
+	}
+
+	return &KafkaAdmin{
+		adminClient: adminClient,
+		configMap:   configMap,
+		timeout:     time.Duration(options.AdminTimeoutMs) * time.Millisecond,
+	}, nil
+}
+
+func newKafkaAdminFromProducer(producer *kafka.Producer) (*KafkaAdmin, error) {
+	if nil == producer {
+		return nil, fmt.Errorf("INVALID INSTANCE")
+	}
+
+	adminClient, err := kafka.NewAdminClientFromProducer(producer)
+	if nil != err {
+		return nil, err
+	}
+
+	return &KafkaAdmin{adminClient: adminClient}, nil
+}
+
+func newKafkaAdminFromConsumer(consumer *kafka.Consumer) (*KafkaAdmin, error) {
+	if nil == consumer {
+		return nil, fmt.Errorf("INVALID INSTANCE")
+	}
+
+	adminClient, err := kafka.NewAdminClientFromConsumer(consumer)
+	if nil != err {
+		return nil, err
+	}
+
+	return &KafkaAdmin{adminClient: adminClient}, nil
+}
+
+func (admin *KafkaAdmin) Close() {
+	if nil != admin.adminClient {
+		admin.adminClient.Close()
+	}
+}
+
+func (admin *KafkaAdmin) duration(defaultDuration time.Duration) time.Duration {
+	if 0 != admin.timeout {
+		return admin.timeout
+	}
+
+	return defaultDuration
+}
+
+func (admin *KafkaAdmin) durationMs(defaultDuration time.Duration) int {
+	return int(admin.duration(defaultDuration) / time.Millisecond)
+}
+
+// CreateTopic creates a topic whose replication factor is 1
+func (admin *KafkaAdmin) CreateTopic(topic string, partitionCount int) error {
+	return admin.CreateTopics([]TopicSpec{{Name: topic, PartitionCount: partitionCount, ReplicationFactor: 1}})
+}
+
+// CreateTopics creates multiple topics simultaneously
+func (admin *KafkaAdmin) CreateTopics(specs []TopicSpec) error {
+	specifications := make([]kafka.TopicSpecification, 0, len(specs))
+	for _, spec := range specs {
+		err := spec.validate()
+		if nil != err {
+			return fmt.Errorf("FAILED TO CREATE TOPIC: %+v", err)
+		}
+
+		specifications = append(specifications, kafka.TopicSpecification{
+			Topic:             spec.Name,
+			NumPartitions:     spec.PartitionCount,
+			ReplicationFactor: spec.replicationFactor(),
+			Config:            spec.Configs,
+		})
+	}
+
+	// contexts are used to abort or limit the amount of time
+	// the admin-call blocks waiting for a result
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results, err := admin.adminClient.CreateTopics(
+		ctx,
+		specifications,
+		kafka.SetAdminOperationTimeout(admin.duration(defaultAdminTimeout)))
+
+	if nil != err {
+		return fmt.Errorf("FAILED TO CREATE TOPIC: %+v", err)
+	}
+
+	for _, result := range results {
+		if result.Error.Code() != kafka.ErrNoError {
+			return fmt.Errorf("ERROR RETURNED WHEN CREATING TOPIC: %+v", result.Error)
+		}
+	}
+
+	return nil
+}
+
+// DescribeTopic returns configurations of the topic
+func (admin *KafkaAdmin) DescribeTopic(topic string) (map[string]kafka.ConfigEntryResult, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// query cluster for the resource's current configuration
+	results, err := admin.adminClient.DescribeConfigs(
+		ctx,
+		[]kafka.ConfigResource{{Type: kafka.ResourceTopic, Name: topic}},
+		kafka.SetAdminRequestTimeout(admin.duration(defaultAdminTimeout)))
+
+	if nil != err {
+		return nil, fmt.Errorf("FAILED TO DESCRIBE TOPIC: %+v", err)
+	}
+
+	for _, result := range results {
+		if result.Error.Code() != kafka.ErrNoError {
+			return nil, fmt.Errorf("ERROR RETURNED WHEN DESCRIBING TOPIC: %+v", result.Error)
+		}
+
+		return result.Config, nil
+	}
+
+	return nil, fmt.Errorf("FAILED TO DESCRIBE TOPIC: RESULTS IS EMPTY")
+}
+
+func (admin *KafkaAdmin) DeleteTopic(topic string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results, err := admin.adminClient.DeleteTopics(
+		ctx,
+		[]string{topic},
+		kafka.SetAdminOperationTimeout(admin.duration(defaultDeleteTopicTimeout)))
+
+	if nil != err {
+		return fmt.Errorf("FAILED TO DELETE TOPIC: %+v", err)
+	}
+
+	for _, result := range results {
+		if result.Error.Code() != kafka.ErrNoError {
+			return fmt.Errorf("ERROR RETURNED WHEN DELETING TOPIC: %+v", result.Error)
+		}
+	}
+
+	return nil
+}
+
+// ListTopics returns topics and their partitions sorted by name, internal topics (e.g. "__consumer_offsets") are excluded
+func (admin *KafkaAdmin) ListTopics() ([]TopicInfo, error) {
+	metadata, err := admin.adminClient.GetMetadata(nil, true, admin.durationMs(defaultAdminTimeout))
+	if nil != err {
+		return nil, fmt.Errorf("FAILED TO LIST TOPICS: %+v", err)
+	}
+
+	topics := make([]TopicInfo, 0, len(metadata.Topics))
+	for name, topicMetadata := range metadata.Topics {
+		if strings.HasPrefix(name, "__") {
+			continue
+		}
+
+		if topicMetadata.Error.Code() != kafka.ErrNoError {
+			return nil, fmt.Errorf("ERROR RETURNED WHEN LISTING TOPIC '%s': %+v", name, topicMetadata.Error)
+		}
+
+		topics = append(topics, newTopicInfo(topicMetadata))
+	}
+
+	sort.Slice(topics, func(i, j int) bool {
+		return topics[i].Name < topics[j].Name
+	})
+
+	return topics, nil
+}
+
+// GetTopic returns the metadata of the topic
+func (admin *KafkaAdmin) GetTopic(topic string) (*TopicInfo, error) {
+	metadata, err := admin.adminClient.GetMetadata(&topic, false, admin.durationMs(defaultAdminTimeout))
+	if nil != err {
+		return nil, fmt.Errorf("FAILED TO GET TOPIC: %+v", err)
+	}
+
+	topicMetadata, ok := metadata.Topics[topic]
+	if false == ok {
+		return nil, fmt.Errorf("FAILED TO GET TOPIC: '%s' IS NOT FOUND", topic)
+	}
+
+	if topicMetadata.Error.Code() != kafka.ErrNoError {
+		return nil, fmt.Errorf("ERROR RETURNED WHEN GETTING TOPIC: %+v", topicMetadata.Error)
+	}
+
+	topicInfo := newTopicInfo(topicMetadata)
+	return &topicInfo, nil
+}
+
+// IncreasePartitions increases partitions of the topic to "partitionCount" in total,
+// note that messages with the same key may land on another partition afterward
+func (admin *KafkaAdmin) IncreasePartitions(topic string, partitionCount int) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results, err := admin.adminClient.CreatePartitions(
+		ctx,
+		[]kafka.PartitionsSpecification{{Topic: topic, IncreaseTo: partitionCount}},
+		kafka.SetAdminOperationTimeout(admin.duration(defaultAdminTimeout)))
+
+	if nil != err {
+		return fmt.Errorf("FAILED TO INCREASE PARTITIONS: %+v", err)
+	}
+
+	for _, result := range results {
+		if result.Error.Code() != kafka.ErrNoError {
+			return fmt.Errorf("ERROR RETURNED WHEN INCREASING PARTITIONS: %+v", result.Error)
+		}
+	}
+
+	return nil
+}
+
+// AlterTopicConfigs sets "configs" of the topic, other configurations which were set to the topic are kept
+func (admin *KafkaAdmin) AlterTopicConfigs(topic string, configs map[string]string) error {
+	// AlterConfigs replaces all configurations of the topic, hence the ones set before are merged
+	current, err := admin.DescribeTopic(topic)
+	if nil != err {
+		return fmt.Errorf("FAILED TO ALTER TOPIC CONFIGS: %+v", err)
+	}
+
+	entries := make([]kafka.ConfigEntry, 0)
+	for name, entry := range current {
+		if _, ok := configs[name]; ok {
+			continue
+		}
+
+		if entry.Source == kafka.ConfigSourceDynamicTopic {
+			entries = append(entries, kafka.ConfigEntry{Name: name, Value: entry.Value, Operation: kafka.AlterOperationSet})
+		}
+	}
+
+	for name, value := range configs {
+		entries = append(entries, kafka.ConfigEntry{Name: name, Value: value, Operation: kafka.AlterOperationSet})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results, err := admin.adminClient.AlterConfigs(
+		ctx,
+		[]kafka.ConfigResource{{Type: kafka.ResourceTopic, Name: topic, Config: entries}},
+		kafka.SetAdminRequestTimeout(admin.duration(defaultAdminTimeout)))
+
+	if nil != err {
+		return fmt.Errorf("FAILED TO ALTER TOPIC CONFIGS: %+v", err)
+	}
+
+	for _, result := range results {
+		if result.Error.Code() != kafka.ErrNoError {
+			return fmt.Errorf("ERROR RETURNED WHEN ALTERING TOPIC CONFIGS: %+v", result.Error)
+		}
+	}
+
+	return nil
+}
+
+// GetConsumerGroupLag returns the lag of the consumer group on each partition of "topics",
+// it is only available for the admin client created by NewKafkaAdmin or NewKafkaAdminWithOptions
+func (admin *KafkaAdmin) GetConsumerGroupLag(groupName string, topics []string) ([]PartitionLag, error) {
+	if nil == admin.configMap {
+		return nil, fmt.Errorf("FAILED TO GET CONSUMER GROUP LAG: NOT SUPPORTED BY SHARED ADMIN CLIENT")
+	}
+
+	timeoutMs := admin.durationMs(defaultAdminTimeout)
+
+	partitions := make([]kafka.TopicPartition, 0)
+	for _, topic := range topics {
+		topicInfo, err := admin.GetTopic(topic)
+		if nil != err {
+			return nil, fmt.Errorf("FAILED TO GET CONSUMER GROUP LAG: %+v", err)
+		}
+
+		for idx := range topicInfo.Partitions {
+			partitions = append(partitions, kafka.TopicPartition{Topic: &topicInfo.Name, Partition: topicInfo.Partitions[idx].ID})
+		}
+	}
+
+	// committed offsets can be queried by a consumer of the group which never subscribes, hence it never joins the group
+	configMap := kafka.ConfigMap{}
+	for key, value := range admin.configMap {
+		configMap[key] = value
+	}
+	configMap["group.id"] = groupName
+	configMap["enable.auto.commit"] = false
+
+	consumer, err := kafka.NewConsumer(&configMap)
+	if nil != err {
+		return nil, fmt.Errorf("FAILED TO GET CONSUMER GROUP LAG: %+v", err)
+	}
+	defer consumer.Close()
+
+	committed, err := consumer.Committed(partitions, timeoutMs)
+	if nil != err {
+		return nil, fmt.Errorf("FAILED TO QUERY COMMITTED OFFSETS: %+v", err)
+	}
+
+	lags := make([]PartitionLag, 0, len(committed))
+	for _, position := range committed {
+		low, high, err := consumer.QueryWatermarkOffsets(*position.Topic, position.Partition, timeoutMs)
+		if nil != err {
+			return nil, fmt.Errorf("FAILED TO QUERY WATERMARK OFFSETS: %+v", err)
+		}
+
+		lag := PartitionLag{
+			Topic:           *position.Topic,
+			Partition:       position.Partition,
+			CommittedOffset: -1,
+			LowWatermark:    low,
+			HighWatermark:   high,
+			Lag:             high - low,
+		}
+
+		// offset is invalid if the group has never committed on the partition
+		if position.Offset >= 0 {
+			lag.CommittedOffset = int64(position.Offset)
+			lag.Lag = high - int64(position.Offset)
+		}
+
+		lags = append(lags, lag)
+	}
+
+	return lags, nil
+}
+
+// EnsureTopics reconciles the topics of the cluster with "specs":
+// missing topics are created, partitions are increased and the configs given by the specs are altered if they differ.
+// Differences which cannot be reconciled (fewer partitions or another replication factor) are reported by the error,
+// after all other topics were reconciled. The clients of this package never invoke it, services do on startup
+func (admin *KafkaAdmin) EnsureTopics(specs []TopicSpec) error {
+	for _, spec := range specs {
+		err := spec.validate()
+		if nil != err {
+			return fmt.Errorf("FAILED TO ENSURE TOPICS: %+v", err)
+		}
+	}
+
+	topics, err := admin.ListTopics()
+	if nil != err {
+		return fmt.Errorf("FAILED TO ENSURE TOPICS: %+v", err)
+	}
+
+	topicMap := make(map[string]TopicInfo)
+	for _, topicInfo := range topics {
+		topicMap[topicInfo.Name] = topicInfo
+	}
+
+	problems := make([]string, 0)
+	for _, spec := range specs {
+		topicInfo, ok := topicMap[spec.Name]
+		if false == ok {
+			logger.New().Info("kafka: CREATING TOPIC", zap.String("topic", spec.Name), zap.Int("partitions", spec.PartitionCount))
+
+			err = admin.CreateTopics([]TopicSpec{spec})
+			if nil != err {
+				problems = append(problems, err.Error())
+			}
+			continue
+		}
+
+		problems = append(problems, spec.mismatches(topicInfo)...)
+
+		if spec.PartitionCount > len(topicInfo.Partitions) {
+			logger.New().Info("kafka: INCREASING PARTITIONS", zap.String("topic", spec.Name), zap.Int("partitions", spec.PartitionCount))
+
+			err = admin.IncreasePartitions(spec.Name, spec.PartitionCount)
+			if nil != err {
+				problems = append(problems, err.Error())
+			}
+		}
+
+		if 0 == len(spec.Configs) {
+			continue
+		}
+
+		current, err := admin.DescribeTopic(spec.Name)
+		if nil != err {
+			problems = append(problems, err.Error())
+			continue
+		}
+
+		changed := make(map[string]string)
+		for name, value := range spec.Configs {
+			if entry, ok := current[name]; false == ok || entry.Value != value {
+				changed[name] = value
+			}
+		}
+
+		if 0 != len(changed) {
+			logger.New().Info("kafka: ALTERING TOPIC CONFIGS", zap.String("topic", spec.Name), zap.Any("configs", changed))
+
+			err = admin.AlterTopicConfigs(spec.Name, changed)
+			if nil != err {
+				problems = append(problems, err.Error())
+			}
+		}
+	}
+
+	if 0 != len(problems) {
+		return fmt.Errorf("FAILED TO ENSURE TOPICS: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// LoadTopicSpecs decodes and validates topic specs of the YAML sequence "node", e.g. the node of "topics" in
+//
+//	kafka:
+//	  topics:
+//	    - name: cpe-uplink
+//	      partitions: 12
+//	      replicationFactor: 3
+//	      configs:
+//	        retention.ms: "86400000"
+//
+// a nil node has no specs
+func LoadTopicSpecs(node *yaml.Node) ([]TopicSpec, error) {
+	specs := make([]TopicSpec, 0)
+	if nil == node {
+		return specs, nil
+	}
+
+	err := node.Decode(&specs)
+	if nil != err {
+		return nil, fmt.Errorf("FAILED TO LOAD TOPIC SPECS: %+v", err)
+	}
+
+	for _, spec := range specs {
+		err = spec.validate()
+		if nil != err {
+			return nil, fmt.Errorf("FAILED TO LOAD TOPIC SPECS: %+v", err)
+		}
+	}
+
+	return specs, nil
+}
+
+func (spec *TopicSpec) validate() error {
+	if "" == spec.Name {
+		return fmt.Errorf("INVALID TOPIC SPEC: NAME CANNOT BE BLANK")
+	}
+
+	if spec.PartitionCount < 1 {
+		return fmt.Errorf("INVALID TOPIC SPEC '%s': PARTITIONS MUST BE POSITIVE", spec.Name)
+	}
+
+	if spec.ReplicationFactor < 0 {
+		return fmt.Errorf("INVALID TOPIC SPEC '%s': REPLICATION FACTOR CANNOT BE NEGATIVE", spec.Name)
+	}
+
+	return nil
+}
+
+// mismatches returns differences from the existing topic which cannot be reconciled,
+// the replication factor is not compared if it is 0
+func (spec *TopicSpec) mismatches(topicInfo TopicInfo) []string {
+	problems := make([]string, 0)
+
+	if 0 != spec.ReplicationFactor && spec.ReplicationFactor != topicInfo.ReplicationFactor {
+		problems = append(problems, fmt.Sprintf("REPLICATION FACTOR OF '%s' IS %d BUT %d IS EXPECTED", spec.Name, topicInfo.ReplicationFactor, spec.ReplicationFactor))
+	}
+
+	if spec.PartitionCount < len(topicInfo.Partitions) {
+		problems = append(problems, fmt.Sprintf("PARTITIONS OF '%s' ARE %d AND CANNOT BE DECREASED TO %d", spec.Name, len(topicInfo.Partitions), spec.PartitionCount))
+	}
+
+	return problems
+}
+
+func (spec *TopicSpec) replicationFactor() int {
+	if 0 == spec.ReplicationFactor {
+		return 1
+	}
+
+	return spec.ReplicationFactor
+}
+
+func newTopicInfo(topicMetadata kafka.TopicMetadata) TopicInfo {
+	topicInfo := TopicInfo{
+		Name:       topicMetadata.Topic,
+		Partitions: make([]PartitionInfo, 0, len(topicMetadata.Partitions)),
+	}
+
+	for _, partition := range topicMetadata.Partitions {
+		topicInfo.Partitions = append(topicInfo.Partitions, PartitionInfo{
+			ID:       partition.ID,
+			Leader:   partition.Leader,
+			Replicas: partition.Replicas,
+			Isrs:     partition.Isrs,
+		})
+
+		if len(partition.Replicas) > topicInfo.ReplicationFactor {
+			topicInfo.ReplicationFactor = len(partition.Replicas)
+		}
+	}
+
+	sort.Slice(topicInfo.Partitions, func(i, j int) bool {
+		return topicInfo.Partitions[i].ID < topicInfo.Partitions[j].ID
+	})
+
+	return topicInfo
+}
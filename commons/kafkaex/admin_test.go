@@ -0,0 +1,95 @@
+package kafkaex
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestLoadTopicSpecs(t *testing.T) {
+	tests := []struct {
+		name     string
+		document string
+		invalid  bool
+		expected []TopicSpec
+	}{
+		{"empty", "", false, []TopicSpec{}},
+		{"specs", "- name: uplink\n  partitions: 12\n  replicationFactor: 3\n  configs:\n    retention.ms: \"86400000\"\n- name: command\n  partitions: 1\n", false, []TopicSpec{
+			{Name: "uplink", PartitionCount: 12, ReplicationFactor: 3, Configs: map[string]string{"retention.ms": "86400000"}},
+			{Name: "command", PartitionCount: 1},
+		}},
+		{"blank name", "- partitions: 1\n", true, nil},
+		{"no partitions", "- name: uplink\n", true, nil},
+		{"negative replication factor", "- name: uplink\n  partitions: 1\n  replicationFactor: -1\n", true, nil},
+		{"not a sequence", "name: uplink\n", true, nil},
+	}
+
+	for _, test := range tests {
+		var node *yaml.Node
+		if "" != test.document {
+			document := yaml.Node{}
+			err := yaml.Unmarshal([]byte(test.document), &document)
+			if nil != err {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			node = document.Content[0]
+		}
+
+		specs, err := LoadTopicSpecs(node)
+		if test.invalid != (nil != err) {
+			t.Errorf("%s: unexpected result %v", test.name, err)
+			continue
+		}
+
+		if test.invalid {
+			continue
+		}
+
+		if len(test.expected) != len(specs) {
+			t.Errorf("%s: expected %d specs but got %d", test.name, len(test.expected), len(specs))
+			continue
+		}
+
+		for idx, expected := range test.expected {
+			spec := specs[idx]
+			if expected.Name != spec.Name || expected.PartitionCount != spec.PartitionCount || expected.ReplicationFactor != spec.ReplicationFactor || len(expected.Configs) != len(spec.Configs) {
+				t.Errorf("%s: expected %+v but got %+v", test.name, expected, spec)
+				continue
+			}
+
+			for key, value := range expected.Configs {
+				if spec.Configs[key] != value {
+					t.Errorf("%s: expected '%s' to be %s but got %s", test.name, key, value, spec.Configs[key])
+				}
+			}
+		}
+	}
+}
+
+func TestTopicSpecMismatches(t *testing.T) {
+	topicInfo := TopicInfo{
+		Name:              "uplink",
+		ReplicationFactor: 3,
+		Partitions:        []PartitionInfo{{ID: 0}, {ID: 1}, {ID: 2}, {ID: 3}},
+	}
+
+	tests := []struct {
+		name     string
+		spec     TopicSpec
+		expected int
+	}{
+		{"same", TopicSpec{Name: "uplink", PartitionCount: 4, ReplicationFactor: 3}, 0},
+		{"replication factor is not cared", TopicSpec{Name: "uplink", PartitionCount: 4}, 0},
+		{"more partitions", TopicSpec{Name: "uplink", PartitionCount: 8, ReplicationFactor: 3}, 0},
+		{"another replication factor", TopicSpec{Name: "uplink", PartitionCount: 4, ReplicationFactor: 1}, 1},
+		{"fewer partitions", TopicSpec{Name: "uplink", PartitionCount: 2}, 1},
+		{"both", TopicSpec{Name: "uplink", PartitionCount: 2, ReplicationFactor: 2}, 2},
+	}
+
+	for _, test := range tests {
+		problems := test.spec.mismatches(topicInfo)
+		if test.expected != len(problems) {
+			t.Errorf("%s: expected %d problems but got %+v", test.name, test.expected, problems)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package kafkaex
+
+import (
+	"context"
+
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+)
+
+// Producer is implemented by KafkaProducer and MemoryProducer
+type Producer interface {
+	Close()
+	CreateTopic(topic string, partitionCount int) error
+	DescribeTopic(topic string) (map[string]kafka.ConfigEntryResult, error)
+	DeleteTopic(topic string) error
+	DeliverMessage(
+		topic string,
+		partition int32,
+		senderID string,
+		receiverID string,
+		messageType MessageType,
+		message string,
+		expirationInterval int64) error
+	DeliverCorrelatedMessage(
+		topic string,
+		partition int32,
+		key string,
+		senderID string,
+		receiverID string,
+		messageType MessageType,
+		correlationID string,
+		replyTopic string,
+		message string,
+		expirationInterval int64) error
+	DeliverKeyedMessage(
+		topic string,
+		key string,
+		senderID string,
+		receiverID string,
+		messageType MessageType,
+		message string,
+		expirationInterval int64) error
+	DeliverAsync(message OutboundMessage, callback func(report DeliveryReport)) (*DeliveryFuture, error)
+	DeliverBatch(messages []OutboundMessage, callback func(report DeliveryReport)) ([]*DeliveryFuture, error)
+	Flush(ctx context.Context) ([]OutboundMessage, error)
+}
+
+// Consumer is implemented by KafkaConsumer and MemoryConsumer
+type Consumer interface {
+	Close() error
+	CreateTopic(topic string, partitionCount int) error
+	DescribeTopic(topic string) (map[string]kafka.ConfigEntryResult, error)
+	DeleteTopic(topic string) error
+	SubscribeTopics(topics []string) error
+	Unsubscribe() error
+	GetSubscriptions() ([]string, error)
+	EnforceExpiration(enabled bool, deadLetterTopic string) error
+	GetExpiredCount() (expired uint64, deadLettered uint64)
+	Pause(topic string, partition int32) error
+	Resume(topic string, partition int32) error
+	SeekToOffset(topic string, partition int32, offset int64) error
+	SeekToTimestamp(topic string, timestamp int64) error
+}
+
+// ClientFactory creates producers and consumers which are connected to the same cluster
+type ClientFactory interface {
+	NewProducer(kafkaProducerHandler ProducerHandler) (Producer, error)
+	NewConsumer(groupName string, kafkaConsumerHandler ConsumerHandler) (Consumer, error)
+}
+
+// kafkaClientFactory creates KafkaProducer and KafkaConsumer
+type kafkaClientFactory struct {
+	brokerAddr string
+	options    ClientOptions
+}
+
+// NewClientFactory returns the factory of KafkaProducer and KafkaConsumer which are connected to "brokerAddr"
+func NewClientFactory(brokerAddr string) ClientFactory {
+	return &kafkaClientFactory{brokerAddr: brokerAddr}
+}
+
+// NewClientFactoryWithOptions returns the factory of KafkaProducer and KafkaConsumer which are created with "options"
+func NewClientFactoryWithOptions(brokerAddr string, options ClientOptions) ClientFactory {
+	return &kafkaClientFactory{brokerAddr: brokerAddr, options: options}
+}
+
+func (factory *kafkaClientFactory) NewProducer(kafkaProducerHandler ProducerHandler) (Producer, error) {
+	kafkaProducer, err := NewKafkaProducerWithOptions(factory.brokerAddr, kafkaProducerHandler, factory.options)
+	if nil != err {
+		return nil, err
+	}
+
+	return kafkaProducer, nil
+}
+
+func (factory *kafkaClientFactory) NewConsumer(groupName string, kafkaConsumerHandler ConsumerHandler) (Consumer, error) {
+	kafkaConsumer, err := NewKafkaConsumerWithOptions(factory.brokerAddr, groupName, kafkaConsumerHandler, factory.options)
+	if nil != err {
+		return nil, err
+	}
+
+	return kafkaConsumer, nil
+}
@@ -1,19 +1,93 @@
 package kafkaex
 
 import (
-	"context"
 	"fmt"
 	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
-	"time"
+	"sercomm.com/demeter/commons/datetime"
+	"strconv"
+	"sync"
+	"sync/atomic"
 )
 
 type KafkaConsumer struct {
 	terminated           bool
+	deadLetterConfigMap  kafka.ConfigMap
 	consumer             *kafka.Consumer
-	kafkaConsumerHandler KafkaConsumerHandler
+	kafkaConsumerHandler ConsumerHandler
 	Properties           map[string]interface{}
+	metrics              Metrics
+	name                 string // name of the librdkafka instance, for labelling metrics
+
+	// expiration enforcement, "expirationEnforced" and "deadLetter" are guarded by "expirationLocker"
+	// since EnforceExpiration may be invoked while messages are being polled
+	expirationLocker   *sync.Mutex
+	expirationEnforced bool
+	deadLetter         *deadLetterWriter
+	expiredCount       uint64 // count of expired messages
+	deadLetteredCount  uint64 // count of expired messages which were routed to the dead-letter topic
+
+	// at-least-once processing, they are only available if the consumer was created with a CommitPolicy
+	committer         *committer
+	failureDeadLetter *deadLetterWriter
+	closed            chan bool
 }
 
+// ConsumerHandler receives messages and events of a Consumer, it is the handler of consumers created by a ClientFactory
+// or NewKafkaConsumerWithOptions. Handlers written for NewKafkaConsumer implement KafkaConsumerHandler instead
+type ConsumerHandler interface {
+	// receive message
+	MessageReceived(
+		kafkaConsumer Consumer,
+		topic string,
+		partition int32,
+		offset string,
+		senderID string,
+		receiverID string,
+		deliveryTime int64,
+		expirationTime int64,
+		messageType MessageType,
+		correlationID string,
+		replyTopic string,
+		message string)
+	// message was expired before being consumed, it is only raised if EnforceExpiration was enabled
+	// "deadLettered" indicates if the message was routed to the dead-letter topic
+	MessageExpired(
+		kafkaConsumer Consumer,
+		topic string,
+		partition int32,
+		offset string,
+		senderID string,
+		receiverID string,
+		deliveryTime int64,
+		expirationTime int64,
+		messageType MessageType,
+		message string,
+		deadLettered bool)
+	// partitions were assigned to the consumer, it is raised before consuming from them
+	PartitionsAssigned(
+		kafkaConsumer Consumer,
+		partitions []kafka.TopicPartition)
+	// partitions are going to be revoked from the consumer, states of them should be flushed
+	PartitionsRevoked(
+		kafkaConsumer Consumer,
+		partitions []kafka.TopicPartition)
+	// end of the partition
+	PartitionEOF(
+		kafkaConsumer Consumer,
+		topic string,
+		partition int32,
+		offset string)
+	// errors should generally be considered informational
+	// the client will try to automatically recover
+	ErrorOccurred(
+		kafkaConsumer Consumer,
+		errorCode kafka.ErrorCode,
+		errorMessage string)
+	// kafka session was terminated
+	Closed(kafkaConsumer Consumer)
+}
+
+// KafkaConsumerHandler is the handler of NewKafkaConsumer and MemoryBroker.NewConsumerWithKafkaHandler
 type KafkaConsumerHandler interface {
 	// receive message
 	MessageReceived(
@@ -44,15 +118,47 @@ type KafkaConsumerHandler interface {
 }
 
 func NewKafkaConsumer(brokerAddr string, groupName string, kafkaConsumerHandler KafkaConsumerHandler) (*KafkaConsumer, error) {
+	var handler ConsumerHandler
+	if nil != kafkaConsumerHandler {
+		handler = &legacyConsumerHandler{kafkaConsumerHandler}
+	}
+
+	return NewKafkaConsumerWithOptions(brokerAddr, groupName, handler, ClientOptions{})
+}
+
+// NewKafkaConsumerWithCommitPolicy creates a consumer which processes messages at least once,
+// offsets are committed according to "commitPolicy" instead of being committed automatically
+func NewKafkaConsumerWithCommitPolicy(
+	brokerAddr string,
+	groupName string,
+	kafkaConsumerHandler ConsumerHandler,
+	commitPolicy CommitPolicy) (*KafkaConsumer, error) {
+
+	return NewKafkaConsumerWithOptions(brokerAddr, groupName, kafkaConsumerHandler, ClientOptions{CommitPolicy: &commitPolicy})
+}
+
+// NewKafkaConsumerWithOptions creates a consumer with security and tuning "options",
+// invalid options are reported before connecting to the broker
+func NewKafkaConsumerWithOptions(
+	brokerAddr string,
+	groupName string,
+	kafkaConsumerHandler ConsumerHandler,
+	options ClientOptions) (*KafkaConsumer, error) {
+
+	configMap, err := options.consumerConfigMap(brokerAddr, groupName)
+	if nil != err {
+		return nil, fmt.Errorf("FAILED TO CREATE CONSUMER: %+v", err)
+	}
+
+	// dead-letter producers share the connection settings of the consumer
+	deadLetterConfigMap, err := options.deadLetterConfigMap(brokerAddr)
+	if nil != err {
+		return nil, fmt.Errorf("FAILED TO CREATE CONSUMER: %+v", err)
+	}
+	commitPolicy := options.CommitPolicy
+
 	// create kafka.Consumer
-	consumer, err := kafka.NewConsumer(&kafka.ConfigMap{
-		"bootstrap.servers":               brokerAddr,
-		"group.id":                        groupName,
-		"session.timeout.ms":              6000,
-		"go.application.rebalance.enable": true,
-		"enable.partition.eof":            true, // enable generation of PartitionEOF when the end of a partition is reached.
-		"auto.offset.reset":               "latest",
-	})
+	consumer, err := kafka.NewConsumer(&configMap)
 
 	if nil != err {
 		return nil, fmt.Errorf("FAILED TO CREATE CONSUMER: %+v", err)
@@ -60,9 +166,28 @@ func NewKafkaConsumer(brokerAddr string, groupName string, kafkaConsumerHandler
 
 	kafkaConsumer := &KafkaConsumer{
 		terminated:           false,
+		deadLetterConfigMap:  deadLetterConfigMap,
 		consumer:             consumer,
 		kafkaConsumerHandler: kafkaConsumerHandler,
 		Properties:           make(map[string]interface{}),
+		expirationLocker:     &sync.Mutex{},
+		closed:               make(chan bool),
+		metrics:              options.Metrics,
+		name:                 consumer.String(),
+	}
+
+	if nil != commitPolicy {
+		var deadLetter func(message *kafka.Message, reason string) error
+		if "" != commitPolicy.DeadLetterTopic {
+			kafkaConsumer.failureDeadLetter, err = newDeadLetterWriter(deadLetterConfigMap, commitPolicy.DeadLetterTopic)
+			if nil != err {
+				_ = consumer.Close()
+				return nil, err
+			}
+			deadLetter = kafkaConsumer.failureDeadLetter.write
+		}
+
+		kafkaConsumer.committer = newCommitter(kafkaConsumer, kafkaConsumerHandler, commitPolicy, deadLetter, kafkaConsumer.closed)
 	}
 
 	// goruntime: handle events
@@ -74,6 +199,12 @@ func NewKafkaConsumer(brokerAddr string, groupName string, kafkaConsumerHandler
 		}()
 
 		for kafkaConsumer.terminated == false {
+			// retry failed messages and commit acknowledged offsets
+			if nil != kafkaConsumer.committer {
+				kafkaConsumer.committer.drainRetryQueue()
+				kafkaConsumer.commit(false)
+			}
+
 			event := consumer.Poll(100)
 			if nil == event {
 				continue
@@ -89,9 +220,31 @@ func NewKafkaConsumer(brokerAddr string, groupName string, kafkaConsumerHandler
 						entity.Offset.String())
 				}
 			case kafka.AssignedPartitions:
+				if nil != kafkaConsumer.kafkaConsumerHandler {
+					kafkaConsumer.kafkaConsumerHandler.PartitionsAssigned(
+						kafkaConsumer,
+						entity.Partitions)
+				}
 				kafkaConsumer.consumer.Assign(entity.Partitions)
 			case kafka.RevokedPartitions:
+				if nil != kafkaConsumer.kafkaConsumerHandler {
+					kafkaConsumer.kafkaConsumerHandler.PartitionsRevoked(
+						kafkaConsumer,
+						entity.Partitions)
+				}
+				if nil != kafkaConsumer.committer {
+					kafkaConsumer.commit(true)
+					kafkaConsumer.committer.tracker.forget(entity.Partitions)
+				}
 				kafkaConsumer.consumer.Unassign()
+			case *kafka.Stats:
+				err := handleStatistics(entity.String(), kafkaConsumer.metrics, kafkaConsumer.kafkaConsumerHandler)
+				if nil != err && nil != kafkaConsumer.kafkaConsumerHandler {
+					kafkaConsumer.kafkaConsumerHandler.ErrorOccurred(
+						kafkaConsumer,
+						kafka.ErrBadMsg,
+						err.Error())
+				}
 			case kafka.Error:
 				if nil != kafkaConsumer.kafkaConsumerHandler {
 					kafkaConsumer.kafkaConsumerHandler.ErrorOccurred(
@@ -100,45 +253,69 @@ func NewKafkaConsumer(brokerAddr string, groupName string, kafkaConsumerHandler
 						entity.Error())
 				}
 			case *kafka.Message:
-				if nil != kafkaConsumer.kafkaConsumerHandler {
+				countMetric(kafkaConsumer.metrics, MetricMessagesIn, map[string]string{"client": kafkaConsumer.name, "topic": *entity.TopicPartition.Topic})
 
-					var senderID, receiverID string
-					var deliveryTime int64 = 0
-					var expirationTime int64 = 0
-					var messageType MessageType = MessageTypeInvalid
-
-					for _, header := range entity.Headers {
-						switch header.Key {
-						case HeaderSenderID:
-							senderID = string(header.Value)
-						case HeaderReceiverID:
-							receiverID = string(header.Value)
-						case HeaderDeliveryTime:
-							deliveryTime = bytesToInt64(header.Value)
-						case HeaderExpirationTime:
-							expirationTime = bytesToInt64(header.Value)
-						case HeaderMessageType:
-							messageType = ParseMessageTypeString(string(header.Value))
-						}
+				var acknowledgement *Acknowledgement
+				if nil != kafkaConsumer.committer {
+					acknowledgement = kafkaConsumer.committer.track(entity)
+				}
+
+				if kafkaConsumer.isExpirationEnforced() && isMessageExpired(entity) {
+					kafkaConsumer.expire(entity)
+					if nil != acknowledgement {
+						acknowledgement.Ack()
 					}
+					continue
+				}
+
+				if nil != acknowledgement {
+					kafkaConsumer.committer.dispatch(acknowledgement)
+					continue
+				}
+
+				if nil != kafkaConsumer.kafkaConsumerHandler {
+					if dispatchDatagram(kafkaConsumer, kafkaConsumer.kafkaConsumerHandler, entity, nil) {
+						continue
+					}
+
+					headers := parseHeaders(entity)
 
 					kafkaConsumer.kafkaConsumerHandler.MessageReceived(
 						kafkaConsumer,
 						*entity.TopicPartition.Topic,
 						entity.TopicPartition.Partition,
 						entity.TopicPartition.Offset.String(),
-						senderID,
-						receiverID,
-						deliveryTime,
-						expirationTime,
-						messageType,
+						headers.senderID,
+						headers.receiverID,
+						headers.deliveryTime,
+						headers.expirationTime,
+						headers.messageType,
+						headers.correlationID,
+						headers.replyTopic,
 						string(entity.Value))
 				}
 			}
 		}
 
+		// commit offsets which were acknowledged before closing
+		kafkaConsumer.commit(true)
+		close(kafkaConsumer.closed)
+
 		_ = kafkaConsumer.consumer.Close()
 		kafkaConsumer.consumer = nil
+
+		kafkaConsumer.expirationLocker.Lock()
+		deadLetter := kafkaConsumer.deadLetter
+		kafkaConsumer.deadLetter = nil
+		kafkaConsumer.expirationLocker.Unlock()
+
+		if nil != deadLetter {
+			deadLetter.close()
+		}
+
+		if nil != kafkaConsumer.failureDeadLetter {
+			kafkaConsumer.failureDeadLetter.close()
+		}
 	}()
 
 	return kafkaConsumer, nil
@@ -153,126 +330,148 @@ func (kafkaConsumer *KafkaConsumer) Close() error {
 	return nil
 }
 
-func (kafkaConsumer *KafkaConsumer) CreateTopic(topic string, partitionCount int) error {
+// EnforceExpiration enables or disables dropping of messages whose "X-Expiration-Time" has passed.
+// Expired messages are routed to "deadLetterTopic" unless it is blank, and
+// ConsumerHandler.MessageExpired is raised instead of MessageReceived.
+// It should be invoked before subscribing topics
+func (kafkaConsumer *KafkaConsumer) EnforceExpiration(enabled bool, deadLetterTopic string) error {
 	if nil == kafkaConsumer.consumer {
 		return fmt.Errorf("INVALID INSTANCE")
 	}
 
-	adminClient, err := kafka.NewAdminClientFromConsumer(kafkaConsumer.consumer)
-	if nil != err {
-		return err
-	}
-	defer adminClient.Close()
-
-	// contexts are used to abort or limit the amount of time
-	// the admin-call blocks waiting for a result
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	// duration is 5s defined by Cloud
-	maxDuration := (time.Second * 5)
-
-	results, err := adminClient.CreateTopics(
-		ctx,
-		// multiple topics can be created simultaneously
-		// by providing more TopicSpecification structs here.
-		[]kafka.TopicSpecification{{
-			Topic:             topic,
-			NumPartitions:     partitionCount,
-			ReplicationFactor: 1}},
-		kafka.SetAdminOperationTimeout(maxDuration))
-
-	if err != nil {
-		return fmt.Errorf("FAILED TO CREATE TOPIC: %+v", err)
+	var deadLetter *deadLetterWriter
+	if enabled && "" != deadLetterTopic {
+		var err error
+		deadLetter, err = newDeadLetterWriter(kafkaConsumer.deadLetterConfigMap, deadLetterTopic)
+		if nil != err {
+			return err
+		}
 	}
 
-	for _, result := range results {
-		if result.Error.Code() != kafka.ErrNoError {
-			err = fmt.Errorf("ERROR RETURNED WHEN CREATING TOPIC: %+v", result.Error)
-			return err
+	kafkaConsumer.expirationLocker.Lock()
+	select {
+	case <-kafkaConsumer.closed:
+		kafkaConsumer.expirationLocker.Unlock()
+		if nil != deadLetter {
+			deadLetter.close()
 		}
+		return fmt.Errorf("INVALID INSTANCE")
+	default:
 	}
 
-	return nil
-}
+	previous := kafkaConsumer.deadLetter
+	kafkaConsumer.deadLetter = deadLetter
+	kafkaConsumer.expirationEnforced = enabled
+	kafkaConsumer.expirationLocker.Unlock()
 
-func (kafkaConsumer *KafkaConsumer) DescribeTopic(topic string) (map[string]kafka.ConfigEntryResult, error) {
-	if nil == kafkaConsumer.consumer {
-		return nil, fmt.Errorf("INVALID INSTANCE")
+	// dead-letters are written while holding the locker, hence the previous writer is no longer in use
+	if nil != previous {
+		previous.close()
 	}
 
-	adminClient, err := kafka.NewAdminClientFromConsumer(kafkaConsumer.consumer)
-	if nil != err {
-		return nil, err
-	}
-	defer adminClient.Close()
+	return nil
+}
 
-	// contexts are used to abort or limit the amount of time
-	// the admin-call blocks waiting for a result
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+func (kafkaConsumer *KafkaConsumer) isExpirationEnforced() bool {
+	kafkaConsumer.expirationLocker.Lock()
+	defer kafkaConsumer.expirationLocker.Unlock()
 
-	// duration is 5s defined by Cloud
-	maxDuration := (time.Second * 5)
+	return kafkaConsumer.expirationEnforced
+}
 
-	// query cluster for the resource's current configuration
-	results, err := adminClient.DescribeConfigs(
-		ctx,
-		[]kafka.ConfigResource{{Type: kafka.ResourceTopic, Name: topic}},
-		kafka.SetAdminRequestTimeout(maxDuration))
+// GetExpiredCount returns the count of expired messages and the count of those routed to the dead-letter topic
+func (kafkaConsumer *KafkaConsumer) GetExpiredCount() (expired uint64, deadLettered uint64) {
+	return atomic.LoadUint64(&kafkaConsumer.expiredCount), atomic.LoadUint64(&kafkaConsumer.deadLetteredCount)
+}
 
-	if nil != err {
-		return nil, fmt.Errorf("FAILED TO DESCRIBE TOPIC: %+v", err)
+// check if "X-Expiration-Time" of the message has passed
+// messages without expiration time never expire
+func isMessageExpired(message *kafka.Message) bool {
+	headers := parseHeaders(message)
+	if 0 == headers.expirationTime {
+		return false
 	}
 
-	for _, result := range results {
-		if result.Error.Code() != kafka.ErrNoError {
-			err = fmt.Errorf("ERROR RETURNED WHEN DESCRIBING TOPIC: %+v", result.Error)
-			return nil, err
-		}
+	dateTime := datetime.Now()
+	return headers.expirationTime < dateTime.UnixTimestamp()
+}
 
-		return result.Config, nil
+// drop the expired message or route it to the dead-letter topic
+func (kafkaConsumer *KafkaConsumer) expire(message *kafka.Message) {
+	atomic.AddUint64(&kafkaConsumer.expiredCount, 1)
+
+	deadLettered := false
+	var err error
+	kafkaConsumer.expirationLocker.Lock()
+	if nil != kafkaConsumer.deadLetter {
+		err = kafkaConsumer.deadLetter.write(message, "EXPIRED")
+		deadLettered = nil == err
+	}
+	kafkaConsumer.expirationLocker.Unlock()
+
+	if deadLettered {
+		atomic.AddUint64(&kafkaConsumer.deadLetteredCount, 1)
+	} else if nil != err && nil != kafkaConsumer.kafkaConsumerHandler {
+		kafkaConsumer.kafkaConsumerHandler.ErrorOccurred(
+			kafkaConsumer,
+			kafka.ErrFail,
+			err.Error())
 	}
 
-	return nil, fmt.Errorf("FAILED TO DESCRIBE TOPIC: RESULTS IS EMPTY")
-}
+	countMetric(kafkaConsumer.metrics, MetricExpirationsDropped, map[string]string{
+		"client":       kafkaConsumer.name,
+		"topic":        *message.TopicPartition.Topic,
+		"deadLettered": strconv.FormatBool(deadLettered),
+	})
 
-func (kafkaConsumer *KafkaConsumer) DeleteTopic(topic string) error {
-	if nil == kafkaConsumer.consumer {
-		return fmt.Errorf("INVALID INSTANCE")
+	if nil == kafkaConsumer.kafkaConsumerHandler {
+		return
 	}
 
-	adminClient, err := kafka.NewAdminClientFromConsumer(kafkaConsumer.consumer)
+	headers := parseHeaders(message)
+
+	kafkaConsumer.kafkaConsumerHandler.MessageExpired(
+		kafkaConsumer,
+		*message.TopicPartition.Topic,
+		message.TopicPartition.Partition,
+		message.TopicPartition.Offset.String(),
+		headers.senderID,
+		headers.receiverID,
+		headers.deliveryTime,
+		headers.expirationTime,
+		headers.messageType,
+		string(message.Value),
+		deadLettered)
+}
+
+func (kafkaConsumer *KafkaConsumer) CreateTopic(topic string, partitionCount int) error {
+	admin, err := newKafkaAdminFromConsumer(kafkaConsumer.consumer)
 	if nil != err {
 		return err
 	}
-	defer adminClient.Close()
-
-	// contexts are used to abort or limit the amount of time
-	// the admin-call blocks waiting for a result
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	defer admin.Close()
 
-	// duration is 60s defined by Cloud
-	maxDuration := (time.Second * 60)
+	return admin.CreateTopic(topic, partitionCount)
+}
 
-	topics := []string{
-		topic,
+func (kafkaConsumer *KafkaConsumer) DescribeTopic(topic string) (map[string]kafka.ConfigEntryResult, error) {
+	admin, err := newKafkaAdminFromConsumer(kafkaConsumer.consumer)
+	if nil != err {
+		return nil, err
 	}
+	defer admin.Close()
 
-	results, err := adminClient.DeleteTopics(ctx, topics, kafka.SetAdminOperationTimeout(maxDuration))
-	if err != nil {
-		return fmt.Errorf("FAILED TO DELETE TOPIC: %+v", err)
-	}
+	return admin.DescribeTopic(topic)
+}
 
-	for _, result := range results {
-		if result.Error.Code() != kafka.ErrNoError {
-			err = fmt.Errorf("ERROR RETURNED WHEN CREATING TOPIC: %+v", result.Error)
-			return err
-		}
+func (kafkaConsumer *KafkaConsumer) DeleteTopic(topic string) error {
+	admin, err := newKafkaAdminFromConsumer(kafkaConsumer.consumer)
+	if nil != err {
+		return err
 	}
+	defer admin.Close()
 
-	return nil
+	return admin.DeleteTopic(topic)
 }
 
 func (kafkaConsumer *KafkaConsumer) SubscribeTopics(topics []string) error {
@@ -313,3 +512,81 @@ func (kafkaConsumer *KafkaConsumer) GetSubscriptions() ([]string, error) {
 
 	return topics, nil
 }
+
+// legacyConsumerHandler adapts a KafkaConsumerHandler to ConsumerHandler,
+// the events which KafkaConsumerHandler does not know are ignored
+type legacyConsumerHandler struct {
+	handler KafkaConsumerHandler
+}
+
+// the KafkaConsumer which raised the event, nil if the Consumer is not a KafkaConsumer, e.g. a MemoryConsumer
+func asKafkaConsumer(kafkaConsumer Consumer) *KafkaConsumer {
+	instance, _ := kafkaConsumer.(*KafkaConsumer)
+	return instance
+}
+
+func (legacy *legacyConsumerHandler) MessageReceived(
+	kafkaConsumer Consumer,
+	topic string,
+	partition int32,
+	offset string,
+	senderID string,
+	receiverID string,
+	deliveryTime int64,
+	expirationTime int64,
+	messageType MessageType,
+	correlationID string,
+	replyTopic string,
+	message string) {
+
+	legacy.handler.MessageReceived(
+		asKafkaConsumer(kafkaConsumer),
+		topic,
+		partition,
+		offset,
+		senderID,
+		receiverID,
+		deliveryTime,
+		expirationTime,
+		messageType,
+		message)
+}
+
+func (legacy *legacyConsumerHandler) MessageExpired(
+	kafkaConsumer Consumer,
+	topic string,
+	partition int32,
+	offset string,
+	senderID string,
+	receiverID string,
+	deliveryTime int64,
+	expirationTime int64,
+	messageType MessageType,
+	message string,
+	deadLettered bool) {
+}
+
+func (legacy *legacyConsumerHandler) PartitionsAssigned(kafkaConsumer Consumer, partitions []kafka.TopicPartition) {
+}
+
+func (legacy *legacyConsumerHandler) PartitionsRevoked(kafkaConsumer Consumer, partitions []kafka.TopicPartition) {
+}
+
+func (legacy *legacyConsumerHandler) PartitionEOF(kafkaConsumer Consumer, topic string, partition int32, offset string) {
+	legacy.handler.PartitionEOF(asKafkaConsumer(kafkaConsumer), topic, partition, offset)
+}
+
+func (legacy *legacyConsumerHandler) ErrorOccurred(kafkaConsumer Consumer, errorCode kafka.ErrorCode, errorMessage string) {
+	legacy.handler.ErrorOccurred(asKafkaConsumer(kafkaConsumer), errorCode, errorMessage)
+}
+
+func (legacy *legacyConsumerHandler) Closed(kafkaConsumer Consumer) {
+	legacy.handler.Closed(asKafkaConsumer(kafkaConsumer))
+}
+
+// StatisticsReceived forwards statistics if the KafkaConsumerHandler implements KafkaStatisticsHandler
+func (legacy *legacyConsumerHandler) StatisticsReceived(statistics *Statistics) {
+	if statisticsHandler, ok := legacy.handler.(KafkaStatisticsHandler); ok {
+		statisticsHandler.StatisticsReceived(statistics)
+	}
+}
@@ -0,0 +1,418 @@
+package kafkaex
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+)
+
+// minimum backoff before retrying a message, it prevents a failing message from being retried in a busy loop
+const minRetryBackoff = (time.Millisecond * 100)
+
+// CommitPolicy enables at-least-once processing of KafkaConsumer.
+// Offsets are no longer committed automatically, the offset of a message is committed
+// only after the message and all messages before it in the same partition were acknowledged.
+// Retries and dead-lettering only apply to handlers which settle messages by themselves,
+// i.e. KafkaAcknowledgeHandler and KafkaDatagramHandler, messages of other handlers are
+// acknowledged once MessageReceived returns and they are never retried
+type CommitPolicy struct {
+	BatchSize       int           // commit once this count of messages were acknowledged, 0 or 1 commits every message
+	BatchInterval   time.Duration // commit acknowledged messages at least at this interval, 0 disables it
+	MaxAttempts     int           // attempts of a message before it is routed to the dead-letter topic, 0 retries forever
+	RetryBackoff    time.Duration // backoff before the 1st retry, it is doubled for every following retry, at least 100ms
+	MaxRetryBackoff time.Duration // upper bound of the backoff, 0 means no bound
+	DeadLetterTopic string        // topic where failed messages will be routed, blank drops them
+}
+
+func (policy *CommitPolicy) validate() error {
+	if policy.BatchSize < 0 {
+		return fmt.Errorf("INVALID COMMIT POLICY 'BatchSize': %d CANNOT BE NEGATIVE", policy.BatchSize)
+	}
+
+	if policy.BatchInterval < 0 {
+		return fmt.Errorf("INVALID COMMIT POLICY 'BatchInterval': %v CANNOT BE NEGATIVE", policy.BatchInterval)
+	}
+
+	if policy.MaxAttempts < 0 {
+		return fmt.Errorf("INVALID COMMIT POLICY 'MaxAttempts': %d CANNOT BE NEGATIVE", policy.MaxAttempts)
+	}
+
+	if policy.RetryBackoff < 0 {
+		return fmt.Errorf("INVALID COMMIT POLICY 'RetryBackoff': %v CANNOT BE NEGATIVE", policy.RetryBackoff)
+	}
+
+	if policy.MaxRetryBackoff < 0 {
+		return fmt.Errorf("INVALID COMMIT POLICY 'MaxRetryBackoff': %v CANNOT BE NEGATIVE", policy.MaxRetryBackoff)
+	}
+
+	return nil
+}
+
+// KafkaAcknowledgeHandler may be implemented by a ConsumerHandler whose consumer was created with a CommitPolicy.
+// MessageAcknowledgeable is raised instead of MessageReceived and the message is considered in-flight
+// until "acknowledgement" is settled, the handler may settle it asynchronously.
+// Handlers which do not implement it acknowledge the message by returning from MessageReceived,
+// hence they can neither retry the message nor route it to CommitPolicy.DeadLetterTopic
+type KafkaAcknowledgeHandler interface {
+	MessageAcknowledgeable(
+		kafkaConsumer Consumer,
+		topic string,
+		partition int32,
+		offset string,
+		senderID string,
+		receiverID string,
+		deliveryTime int64,
+		expirationTime int64,
+		messageType MessageType,
+		correlationID string,
+		replyTopic string,
+		message string,
+		acknowledgement *Acknowledgement)
+}
+
+// committer is the at-least-once processing of a consumer which was created with a CommitPolicy,
+// it is shared by KafkaConsumer and MemoryConsumer which commit the offsets by themselves
+type committer struct {
+	consumer   Consumer // the consumer which dispatches messages
+	handler    ConsumerHandler
+	policy     *CommitPolicy
+	tracker    *offsetTracker
+	retryQueue chan *Acknowledgement                             // messages to be retried
+	deadLetter func(message *kafka.Message, reason string) error // nil if the policy has no dead-letter topic
+	closed     chan bool                                         // closed once the consumer stops dispatching
+}
+
+func newCommitter(
+	consumer Consumer,
+	handler ConsumerHandler,
+	policy *CommitPolicy,
+	deadLetter func(message *kafka.Message, reason string) error,
+	closed chan bool) *committer {
+
+	return &committer{
+		consumer:   consumer,
+		handler:    handler,
+		policy:     policy,
+		tracker:    newOffsetTracker(),
+		retryQueue: make(chan *Acknowledgement, 64),
+		deadLetter: deadLetter,
+		closed:     closed,
+	}
+}
+
+// track the consumed message and return its 1st acknowledgement
+func (committer *committer) track(message *kafka.Message) *Acknowledgement {
+	return &Acknowledgement{
+		committer: committer,
+		message:   message,
+		offsets:   committer.tracker.track(message.TopicPartition),
+		attempt:   1,
+	}
+}
+
+// Acknowledgement settles the processing of a consumed message
+type Acknowledgement struct {
+	committer *committer
+	message   *kafka.Message
+	offsets   *partitionOffsets // tracking of the partition when the message was consumed
+	attempt   int
+	settled   int32
+}
+
+// GetAttempt returns the attempt count of the message, it begins with 1
+func (acknowledgement *Acknowledgement) GetAttempt() int {
+	return acknowledgement.attempt
+}
+
+// Ack marks the message as processed, its offset will be committed with the next batch
+func (acknowledgement *Acknowledgement) Ack() {
+	if false == atomic.CompareAndSwapInt32(&acknowledgement.settled, 0, 1) {
+		return
+	}
+
+	acknowledgement.committer.tracker.ack(acknowledgement.message.TopicPartition, acknowledgement.offsets)
+}
+
+// Nack marks the message as failed, it will be retried after the backoff
+// or routed to the dead-letter topic if it has reached CommitPolicy.MaxAttempts,
+// it is retried again if the dead-letter cannot be delivered
+func (acknowledgement *Acknowledgement) Nack(err error) {
+	if false == atomic.CompareAndSwapInt32(&acknowledgement.settled, 0, 1) {
+		return
+	}
+
+	committer := acknowledgement.committer
+	policy := committer.policy
+
+	if policy.MaxAttempts > 0 && acknowledgement.attempt >= policy.MaxAttempts {
+		if nil != committer.deadLetter {
+			reason := fmt.Sprintf("MAX ATTEMPTS EXCEEDED: %+v", err)
+			deadLetterErr := committer.deadLetter(acknowledgement.message, reason)
+			if nil != deadLetterErr {
+				// keep the message in-flight and retry it, the dead-letter is written again if it still fails
+				if nil != committer.handler {
+					committer.handler.ErrorOccurred(
+						committer.consumer,
+						kafka.ErrFail,
+						deadLetterErr.Error())
+				}
+				acknowledgement.retry(policy.retryBackoff(acknowledgement.attempt))
+				return
+			}
+		}
+
+		committer.tracker.ack(acknowledgement.message.TopicPartition, acknowledgement.offsets)
+		return
+	}
+
+	acknowledgement.retry(policy.retryBackoff(acknowledgement.attempt))
+}
+
+// dispatch the next attempt of the message after "backoff"
+func (acknowledgement *Acknowledgement) retry(backoff time.Duration) {
+	committer := acknowledgement.committer
+
+	retry := &Acknowledgement{
+		committer: committer,
+		message:   acknowledgement.message,
+		offsets:   acknowledgement.offsets,
+		attempt:   acknowledgement.attempt + 1,
+	}
+
+	time.AfterFunc(backoff, func() {
+		select {
+		case committer.retryQueue <- retry:
+		case <-committer.closed:
+		}
+	})
+}
+
+// retryBackoff calculates the backoff before retrying the message which has failed "attempt" times
+func (policy *CommitPolicy) retryBackoff(attempt int) time.Duration {
+	backoff := policy.RetryBackoff
+	for idx := 1; idx < attempt; idx++ {
+		backoff *= 2
+		if policy.MaxRetryBackoff > 0 && backoff >= policy.MaxRetryBackoff {
+			backoff = policy.MaxRetryBackoff
+			break
+		}
+	}
+
+	if backoff < minRetryBackoff {
+		backoff = minRetryBackoff
+	}
+
+	return backoff
+}
+
+// topicPartition identifies a partition of a topic
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// partitionOffsets keeps in-flight offsets of a partition in the consuming order
+type partitionOffsets struct {
+	inflight []kafka.Offset
+	acked    map[kafka.Offset]bool // pair< in-flight offset, acknowledged or not >
+}
+
+// offsetTracker calculates committable offsets of partitions from out of order acknowledgements
+type offsetTracker struct {
+	locker        sync.Mutex
+	partitionMap  map[topicPartition]*partitionOffsets
+	ackedCount    int // count of acknowledged messages since last commit
+	lastCommitted time.Time
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{
+		partitionMap:  make(map[topicPartition]*partitionOffsets),
+		lastCommitted: time.Now(),
+	}
+}
+
+// track registers a consumed message as in-flight, the returned tracking of the partition
+// is required to acknowledge the message
+func (tracker *offsetTracker) track(position kafka.TopicPartition) *partitionOffsets {
+	tracker.locker.Lock()
+	defer tracker.locker.Unlock()
+
+	key := topicPartition{*position.Topic, position.Partition}
+	offsets, ok := tracker.partitionMap[key]
+	if false == ok {
+		offsets = &partitionOffsets{acked: make(map[kafka.Offset]bool)}
+		tracker.partitionMap[key] = offsets
+	}
+
+	if _, ok := offsets.acked[position.Offset]; false == ok {
+		offsets.inflight = append(offsets.inflight, position.Offset)
+		offsets.acked[position.Offset] = false
+	}
+
+	return offsets
+}
+
+// ack marks an in-flight message as acknowledged.
+// It is ignored if the message is no longer in-flight, e.g. the partition has been revoked or seeked
+// since "owner" was tracked, hence stale acknowledgements never commit past unprocessed messages
+func (tracker *offsetTracker) ack(position kafka.TopicPartition, owner *partitionOffsets) {
+	tracker.locker.Lock()
+	defer tracker.locker.Unlock()
+
+	offsets, ok := tracker.partitionMap[topicPartition{*position.Topic, position.Partition}]
+	if false == ok || offsets != owner {
+		return
+	}
+
+	acked, ok := offsets.acked[position.Offset]
+	if false == ok || acked {
+		return
+	}
+
+	offsets.acked[position.Offset] = true
+	tracker.ackedCount++
+}
+
+// due checks if committing is required by the policy
+func (tracker *offsetTracker) due(policy *CommitPolicy) bool {
+	tracker.locker.Lock()
+	defer tracker.locker.Unlock()
+
+	if 0 == tracker.ackedCount {
+		return false
+	}
+
+	if tracker.ackedCount >= policy.BatchSize {
+		return true
+	}
+
+	return policy.BatchInterval > 0 && time.Since(tracker.lastCommitted) >= policy.BatchInterval
+}
+
+// committable pops the leading acknowledged offsets of every partition
+// and returns the positions to be committed, i.e. the next offset to be consumed
+func (tracker *offsetTracker) committable() []kafka.TopicPartition {
+	tracker.locker.Lock()
+	defer tracker.locker.Unlock()
+
+	positions := make([]kafka.TopicPartition, 0)
+	for key, offsets := range tracker.partitionMap {
+		var last kafka.Offset = kafka.OffsetInvalid
+		for len(offsets.inflight) > 0 && offsets.acked[offsets.inflight[0]] {
+			last = offsets.inflight[0]
+			delete(offsets.acked, last)
+			offsets.inflight = offsets.inflight[1:]
+		}
+
+		if last != kafka.OffsetInvalid {
+			topic := key.topic
+			positions = append(positions, kafka.TopicPartition{
+				Topic:     &topic,
+				Partition: key.partition,
+				Offset:    last + 1,
+			})
+		}
+	}
+
+	tracker.ackedCount = 0
+	tracker.lastCommitted = time.Now()
+
+	return positions
+}
+
+// forget drops in-flight offsets of revoked partitions
+func (tracker *offsetTracker) forget(partitions []kafka.TopicPartition) {
+	tracker.locker.Lock()
+	defer tracker.locker.Unlock()
+
+	for _, position := range partitions {
+		delete(tracker.partitionMap, topicPartition{*position.Topic, position.Partition})
+	}
+}
+
+// commit acknowledged offsets if "force" is true or committing is due
+func (kafkaConsumer *KafkaConsumer) commit(force bool) {
+	committer := kafkaConsumer.committer
+	if nil == committer {
+		return
+	}
+
+	if false == force && false == committer.tracker.due(committer.policy) {
+		return
+	}
+
+	positions := committer.tracker.committable()
+	if 0 == len(positions) {
+		return
+	}
+
+	_, err := kafkaConsumer.consumer.CommitOffsets(positions)
+	if nil != err && nil != kafkaConsumer.kafkaConsumerHandler {
+		kafkaConsumer.kafkaConsumerHandler.ErrorOccurred(
+			kafkaConsumer,
+			kafka.ErrFail,
+			fmt.Sprintf("FAILED TO COMMIT OFFSETS: %+v", err))
+	}
+}
+
+// dispatch messages which are due to be retried
+// messages queued by the retries themselves will be dispatched next time
+func (committer *committer) drainRetryQueue() {
+	for count := len(committer.retryQueue); count > 0; count-- {
+		committer.dispatch(<-committer.retryQueue)
+	}
+}
+
+// dispatch a message to the handler and track its acknowledgement
+func (committer *committer) dispatch(acknowledgement *Acknowledgement) {
+	message := acknowledgement.message
+
+	if nil == committer.handler {
+		acknowledgement.Ack()
+		return
+	}
+
+	if dispatchDatagram(committer.consumer, committer.handler, message, acknowledgement) {
+		return
+	}
+
+	headers := parseHeaders(message)
+
+	if acknowledgeHandler, ok := committer.handler.(KafkaAcknowledgeHandler); ok {
+		acknowledgeHandler.MessageAcknowledgeable(
+			committer.consumer,
+			*message.TopicPartition.Topic,
+			message.TopicPartition.Partition,
+			message.TopicPartition.Offset.String(),
+			headers.senderID,
+			headers.receiverID,
+			headers.deliveryTime,
+			headers.expirationTime,
+			headers.messageType,
+			headers.correlationID,
+			headers.replyTopic,
+			string(message.Value),
+			acknowledgement)
+		return
+	}
+
+	committer.handler.MessageReceived(
+		committer.consumer,
+		*message.TopicPartition.Topic,
+		message.TopicPartition.Partition,
+		message.TopicPartition.Offset.String(),
+		headers.senderID,
+		headers.receiverID,
+		headers.deliveryTime,
+		headers.expirationTime,
+		headers.messageType,
+		headers.correlationID,
+		headers.replyTopic,
+		string(message.Value))
+
+	acknowledgement.Ack()
+}
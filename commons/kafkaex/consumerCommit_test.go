@@ -0,0 +1,141 @@
+package kafkaex
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+)
+
+func position(topic string, partition int32, offset int64) kafka.TopicPartition {
+	return kafka.TopicPartition{Topic: &topic, Partition: partition, Offset: kafka.Offset(offset)}
+}
+
+func TestCommitPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  CommitPolicy
+		invalid bool
+	}{
+		{"zero", CommitPolicy{}, false},
+		{"complete", CommitPolicy{BatchSize: 10, BatchInterval: time.Second, MaxAttempts: 3, RetryBackoff: time.Second, MaxRetryBackoff: time.Minute, DeadLetterTopic: "dlq"}, false},
+		{"negative batch size", CommitPolicy{BatchSize: -1}, true},
+		{"negative batch interval", CommitPolicy{BatchInterval: -time.Second}, true},
+		{"negative max attempts", CommitPolicy{MaxAttempts: -1}, true},
+		{"negative retry backoff", CommitPolicy{RetryBackoff: -time.Second}, true},
+		{"negative max retry backoff", CommitPolicy{MaxRetryBackoff: -time.Second}, true},
+	}
+
+	for _, test := range tests {
+		err := test.policy.validate()
+		if test.invalid != (nil != err) {
+			t.Errorf("%s: unexpected result %v", test.name, err)
+		}
+	}
+}
+
+func TestCommitPolicyRetryBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   CommitPolicy
+		attempt  int
+		expected time.Duration
+	}{
+		{"zero backoff is raised to the minimum", CommitPolicy{}, 1, minRetryBackoff},
+		{"zero backoff stays at the minimum", CommitPolicy{}, 5, minRetryBackoff},
+		{"1st retry", CommitPolicy{RetryBackoff: time.Second}, 1, time.Second},
+		{"doubled", CommitPolicy{RetryBackoff: time.Second}, 3, 4 * time.Second},
+		{"bounded", CommitPolicy{RetryBackoff: time.Second, MaxRetryBackoff: 3 * time.Second}, 5, 3 * time.Second},
+		{"bound below the minimum", CommitPolicy{RetryBackoff: time.Millisecond, MaxRetryBackoff: time.Millisecond}, 5, minRetryBackoff},
+	}
+
+	for _, test := range tests {
+		backoff := test.policy.retryBackoff(test.attempt)
+		if backoff != test.expected {
+			t.Errorf("%s: expected %v but got %v", test.name, test.expected, backoff)
+		}
+	}
+}
+
+func TestOffsetTracker(t *testing.T) {
+	tests := []struct {
+		name     string
+		consumed []int64
+		acked    []int64
+		expected int64 // committed offset, 0 if nothing is committable
+	}{
+		{"nothing acknowledged", []int64{0, 1, 2}, nil, 0},
+		{"in order", []int64{0, 1, 2}, []int64{0, 1, 2}, 3},
+		{"gap", []int64{0, 1, 2}, []int64{0, 2}, 1},
+		{"head is pending", []int64{0, 1, 2}, []int64{1, 2}, 0},
+		{"out of order", []int64{5, 6, 7}, []int64{7, 5, 6}, 8},
+		{"duplicated acknowledgements", []int64{0, 1}, []int64{0, 0, 0}, 1},
+		{"untracked offsets are ignored", []int64{0, 1}, []int64{1, 2, 3}, 0},
+	}
+
+	for _, test := range tests {
+		tracker := newOffsetTracker()
+
+		var offsets *partitionOffsets
+		for _, offset := range test.consumed {
+			offsets = tracker.track(position("topic", 0, offset))
+		}
+
+		for _, offset := range test.acked {
+			tracker.ack(position("topic", 0, offset), offsets)
+		}
+
+		positions := tracker.committable()
+		switch {
+		case 0 == test.expected && 0 != len(positions):
+			t.Errorf("%s: unexpected commit %v", test.name, positions)
+		case 0 != test.expected && (1 != len(positions) || kafka.Offset(test.expected) != positions[0].Offset):
+			t.Errorf("%s: expected offset %d but got %v", test.name, test.expected, positions)
+		}
+	}
+}
+
+func TestOffsetTrackerStaleAcknowledgement(t *testing.T) {
+	tracker := newOffsetTracker()
+
+	stale := tracker.track(position("topic", 0, 0))
+	tracker.track(position("topic", 0, 1))
+
+	// the partition is seeked back and consumed again
+	tracker.forget([]kafka.TopicPartition{position("topic", 0, 0)})
+	current := tracker.track(position("topic", 0, 0))
+	tracker.track(position("topic", 0, 1))
+
+	tracker.ack(position("topic", 0, 0), stale)
+	tracker.ack(position("topic", 0, 1), stale)
+	if positions := tracker.committable(); 0 != len(positions) {
+		t.Fatalf("stale acknowledgements were committed: %v", positions)
+	}
+
+	tracker.ack(position("topic", 0, 0), current)
+	positions := tracker.committable()
+	if 1 != len(positions) || 1 != positions[0].Offset {
+		t.Fatalf("expected offset 1 but got %v", positions)
+	}
+}
+
+func TestOffsetTrackerDue(t *testing.T) {
+	policy := &CommitPolicy{BatchSize: 2}
+	tracker := newOffsetTracker()
+
+	offsets := tracker.track(position("topic", 0, 0))
+	tracker.track(position("topic", 0, 1))
+	if tracker.due(policy) {
+		t.Fatal("nothing was acknowledged")
+	}
+
+	tracker.ack(position("topic", 0, 0), offsets)
+	if tracker.due(policy) {
+		t.Fatal("batch is not full")
+	}
+
+	tracker.ack(position("topic", 0, 1), offsets)
+	if false == tracker.due(policy) {
+		t.Fatal("batch is full")
+	}
+}
@@ -0,0 +1,100 @@
+package kafkaex
+
+import (
+	"fmt"
+
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+)
+
+// duration (in milliseconds) to wait for seeking or querying offsets
+const seekTimeout int = 5000
+
+// Pause stops fetching messages from the partition, e.g. for backpressure
+func (kafkaConsumer *KafkaConsumer) Pause(topic string, partition int32) error {
+	if nil == kafkaConsumer.consumer {
+		return fmt.Errorf("INVALID INSTANCE")
+	}
+
+	err := kafkaConsumer.consumer.Pause([]kafka.TopicPartition{{Topic: &topic, Partition: partition}})
+	if nil != err {
+		return fmt.Errorf("FAILED TO PAUSE PARTITION: %+v", err)
+	}
+
+	return nil
+}
+
+// Resume resumes fetching messages from the partition which was paused
+func (kafkaConsumer *KafkaConsumer) Resume(topic string, partition int32) error {
+	if nil == kafkaConsumer.consumer {
+		return fmt.Errorf("INVALID INSTANCE")
+	}
+
+	err := kafkaConsumer.consumer.Resume([]kafka.TopicPartition{{Topic: &topic, Partition: partition}})
+	if nil != err {
+		return fmt.Errorf("FAILED TO RESUME PARTITION: %+v", err)
+	}
+
+	return nil
+}
+
+// SeekToOffset consumes the assigned partition again from "offset"
+func (kafkaConsumer *KafkaConsumer) SeekToOffset(topic string, partition int32, offset int64) error {
+	if nil == kafkaConsumer.consumer {
+		return fmt.Errorf("INVALID INSTANCE")
+	}
+
+	position := kafka.TopicPartition{Topic: &topic, Partition: partition, Offset: kafka.Offset(offset)}
+	return kafkaConsumer.seek([]kafka.TopicPartition{position})
+}
+
+// SeekToTimestamp consumes all assigned partitions of the topic again from the first message
+// whose timestamp is equal to or later than "timestamp" (UNIX epoch time in milliseconds),
+// partitions without such message are consumed from their ends
+func (kafkaConsumer *KafkaConsumer) SeekToTimestamp(topic string, timestamp int64) error {
+	if nil == kafkaConsumer.consumer {
+		return fmt.Errorf("INVALID INSTANCE")
+	}
+
+	assignment, err := kafkaConsumer.consumer.Assignment()
+	if nil != err {
+		return fmt.Errorf("FAILED TO QUERY ASSIGNMENT: %+v", err)
+	}
+
+	times := make([]kafka.TopicPartition, 0)
+	for _, position := range assignment {
+		if *position.Topic == topic {
+			times = append(times, kafka.TopicPartition{Topic: &topic, Partition: position.Partition, Offset: kafka.Offset(timestamp)})
+		}
+	}
+
+	if 0 == len(times) {
+		return fmt.Errorf("FAILED TO SEEK: NO PARTITION OF '%s' IS ASSIGNED", topic)
+	}
+
+	positions, err := kafkaConsumer.consumer.OffsetsForTimes(times, seekTimeout)
+	if nil != err {
+		return fmt.Errorf("FAILED TO QUERY OFFSETS: %+v", err)
+	}
+
+	return kafkaConsumer.seek(positions)
+}
+
+func (kafkaConsumer *KafkaConsumer) seek(positions []kafka.TopicPartition) error {
+	// messages before the new positions will not be acknowledged anymore
+	if nil != kafkaConsumer.committer {
+		kafkaConsumer.committer.tracker.forget(positions)
+	}
+
+	for _, position := range positions {
+		if nil != position.Error {
+			return fmt.Errorf("FAILED TO SEEK: %+v", position.Error)
+		}
+
+		err := kafkaConsumer.consumer.Seek(position, seekTimeout)
+		if nil != err {
+			return fmt.Errorf("FAILED TO SEEK: %+v", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,221 @@
+package kafkaex
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+	"sercomm.com/demeter/commons/packet"
+)
+
+// DatagramSchemaVersion is the version of datagram envelopes published by this package
+const DatagramSchemaVersion int = 1
+
+// versions of datagram envelopes which can be decoded by this package
+var supportedSchemaVersions = []int{1}
+
+// ErrUnsupportedSchemaVersion is returned by DecodeDatagram when the envelope was published by a newer or unknown schema
+var ErrUnsupportedSchemaVersion = errors.New("UNSUPPORTED SCHEMA VERSION")
+
+// DatagramEnvelope carries a packet.Datagram with the standard headers, so that WebSocket and Kafka sides share one message model.
+// The value of the Kafka message is the JSON form of the datagram, the same as it is transferred through WebSocket
+type DatagramEnvelope struct {
+	SenderID      string
+	ReceiverID    string
+	MessageType   MessageType // derived from the type of the datagram if it is blank
+	CorrelationID string      // the ID of the datagram is used if it is blank
+	ReplyTopic    string
+	TraceParent   string // W3C trace context, e.g. "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	TraceState    string
+	Datagram      packet.Datagram
+
+	// they are only available for consumed envelopes
+	SchemaVersion  int
+	DeliveryTime   int64
+	ExpirationTime int64
+	Topic          string
+	Partition      int32
+	Offset         string
+}
+
+// KafkaDatagramHandler may be implemented by a ConsumerHandler whose topics carry datagram envelopes.
+// Messages carrying HeaderSchemaVersion are decoded and raised by DatagramReceived or DatagramRejected
+// instead of MessageReceived or MessageAcknowledgeable, other messages are raised as before
+type KafkaDatagramHandler interface {
+	// "acknowledgement" is nil unless the consumer was created with a CommitPolicy, see KafkaAcknowledgeHandler
+	DatagramReceived(
+		kafkaConsumer Consumer,
+		envelope *DatagramEnvelope,
+		acknowledgement *Acknowledgement)
+	// the envelope cannot be decoded, e.g. ErrUnsupportedSchemaVersion, the message is acknowledged afterward
+	DatagramRejected(
+		kafkaConsumer Consumer,
+		topic string,
+		partition int32,
+		offset string,
+		err error)
+}
+
+// EncodeDatagram builds the outbound message of the envelope, "key" is usually the serial number of the device
+func EncodeDatagram(topic string, key string, envelope *DatagramEnvelope, expirationInterval int64) (OutboundMessage, error) {
+	jsonString, err := packet.String(&envelope.Datagram)
+	if nil != err {
+		return OutboundMessage{}, fmt.Errorf("FAILED TO ENCODE DATAGRAM: %+v", err)
+	}
+
+	messageType := envelope.MessageType
+	if MessageTypeInvalid == messageType {
+		messageType = MessageTypeResponse
+		if envelope.Datagram.Type == packet.T_REQUEST.String() {
+			messageType = MessageTypeRequest
+		}
+	}
+
+	correlationID := envelope.CorrelationID
+	if "" == correlationID {
+		correlationID = envelope.Datagram.ID
+	}
+
+	headers := []kafka.Header{
+		{Key: HeaderSchemaVersion, Value: []byte(strconv.Itoa(DatagramSchemaVersion))},
+		{Key: HeaderFunction, Value: []byte(envelope.Datagram.Function)},
+		{Key: HeaderDatagramID, Value: []byte(envelope.Datagram.ID)},
+	}
+
+	if "" != envelope.TraceParent {
+		headers = append(headers, kafka.Header{Key: HeaderTraceParent, Value: []byte(envelope.TraceParent)})
+	}
+
+	if "" != envelope.TraceState {
+		headers = append(headers, kafka.Header{Key: HeaderTraceState, Value: []byte(envelope.TraceState)})
+	}
+
+	return OutboundMessage{
+		Topic:              topic,
+		Partition:          kafka.PartitionAny,
+		Key:                key,
+		SenderID:           envelope.SenderID,
+		ReceiverID:         envelope.ReceiverID,
+		MessageType:        messageType,
+		CorrelationID:      correlationID,
+		ReplyTopic:         envelope.ReplyTopic,
+		Message:            jsonString,
+		ExpirationInterval: expirationInterval,
+		Headers:            headers,
+	}, nil
+}
+
+// DecodeDatagram parses the envelope carried by the message, envelopes of unknown versions are rejected by ErrUnsupportedSchemaVersion
+func DecodeDatagram(message *kafka.Message) (*DatagramEnvelope, error) {
+	var versionString string
+	var traceParent string
+	var traceState string
+	for _, header := range message.Headers {
+		switch header.Key {
+		case HeaderSchemaVersion:
+			versionString = string(header.Value)
+		case HeaderTraceParent:
+			traceParent = string(header.Value)
+		case HeaderTraceState:
+			traceState = string(header.Value)
+		}
+	}
+
+	version, err := strconv.Atoi(versionString)
+	if nil != err {
+		return nil, fmt.Errorf("%w: '%s'", ErrUnsupportedSchemaVersion, versionString)
+	}
+
+	supported := false
+	for _, candidate := range supportedSchemaVersions {
+		if version == candidate {
+			supported = true
+			break
+		}
+	}
+
+	if false == supported {
+		return nil, fmt.Errorf("%w: '%s'", ErrUnsupportedSchemaVersion, versionString)
+	}
+
+	datagram, err := packet.From(string(message.Value))
+	if nil != err {
+		return nil, fmt.Errorf("FAILED TO DECODE DATAGRAM: %+v", err)
+	}
+
+	headers := parseHeaders(message)
+
+	return &DatagramEnvelope{
+		SenderID:       headers.senderID,
+		ReceiverID:     headers.receiverID,
+		MessageType:    headers.messageType,
+		CorrelationID:  headers.correlationID,
+		ReplyTopic:     headers.replyTopic,
+		TraceParent:    traceParent,
+		TraceState:     traceState,
+		Datagram:       datagram,
+		SchemaVersion:  version,
+		DeliveryTime:   headers.deliveryTime,
+		ExpirationTime: headers.expirationTime,
+		Topic:          *message.TopicPartition.Topic,
+		Partition:      message.TopicPartition.Partition,
+		Offset:         message.TopicPartition.Offset.String(),
+	}, nil
+}
+
+// PublishDatagram delivers the envelope and waits for its delivery result
+func PublishDatagram(producer Producer, topic string, key string, envelope *DatagramEnvelope, expirationInterval int64) error {
+	message, err := EncodeDatagram(topic, key, envelope, expirationInterval)
+	if nil != err {
+		return err
+	}
+
+	future, err := producer.DeliverAsync(message, nil)
+	if nil != err {
+		return err
+	}
+
+	<-future.Done()
+
+	return future.report.Err
+}
+
+// check if the message carries a datagram envelope
+func isDatagramMessage(message *kafka.Message) bool {
+	for _, header := range message.Headers {
+		if HeaderSchemaVersion == header.Key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dispatch the message to KafkaDatagramHandler if "handler" implements it and the message carries a datagram envelope,
+// false is returned if the message should be dispatched as a plain message
+func dispatchDatagram(kafkaConsumer Consumer, handler ConsumerHandler, message *kafka.Message, acknowledgement *Acknowledgement) bool {
+	datagramHandler, ok := handler.(KafkaDatagramHandler)
+	if false == ok || false == isDatagramMessage(message) {
+		return false
+	}
+
+	envelope, err := DecodeDatagram(message)
+	if nil != err {
+		datagramHandler.DatagramRejected(
+			kafkaConsumer,
+			*message.TopicPartition.Topic,
+			message.TopicPartition.Partition,
+			message.TopicPartition.Offset.String(),
+			err)
+
+		// the envelope will never be decoded by this version
+		if nil != acknowledgement {
+			acknowledgement.Ack()
+		}
+		return true
+	}
+
+	datagramHandler.DatagramReceived(kafkaConsumer, envelope, acknowledgement)
+	return true
+}
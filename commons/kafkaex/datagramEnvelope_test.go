@@ -0,0 +1,182 @@
+package kafkaex
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+	"sercomm.com/demeter/commons/packet"
+)
+
+// datagramRecorder is a KafkaDatagramHandler which records decoded and rejected envelopes
+type datagramRecorder struct {
+	*recordingHandler
+
+	envelopes chan *DatagramEnvelope
+	rejected  chan error
+}
+
+func newDatagramRecorder() *datagramRecorder {
+	return &datagramRecorder{
+		recordingHandler: newRecordingHandler(),
+		envelopes:        make(chan *DatagramEnvelope, 64),
+		rejected:         make(chan error, 64),
+	}
+}
+
+func (recorder *datagramRecorder) DatagramReceived(kafkaConsumer Consumer, envelope *DatagramEnvelope, acknowledgement *Acknowledgement) {
+	recorder.envelopes <- envelope
+}
+
+func (recorder *datagramRecorder) DatagramRejected(kafkaConsumer Consumer, topic string, partition int32, offset string, err error) {
+	recorder.rejected <- err
+}
+
+func TestDatagramEnvelopeRoundTrip(t *testing.T) {
+	tests := []struct {
+		name          string
+		envelope      DatagramEnvelope
+		messageType   MessageType
+		correlationID string
+	}{
+		{
+			"request",
+			DatagramEnvelope{SenderID: "serial", Datagram: packet.Datagram{ID: "1", Type: packet.T_REQUEST.String(), Function: packet.F_UBUS.String()}},
+			MessageTypeRequest,
+			"1",
+		},
+		{
+			"result",
+			DatagramEnvelope{SenderID: "serial", Datagram: packet.Datagram{ID: "2", Type: packet.T_RESULT.String(), Function: packet.F_UBUS.String(), Arguments: []interface{}{"ok"}}},
+			MessageTypeResponse,
+			"2",
+		},
+		{
+			"explicit type and correlation",
+			DatagramEnvelope{SenderID: "backend", ReceiverID: "serial", MessageType: MessageTypeResponse, CorrelationID: "correlation", ReplyTopic: "reply", Datagram: packet.Datagram{ID: "3", Type: packet.T_REQUEST.String(), Function: packet.F_CONFIG.String()}},
+			MessageTypeResponse,
+			"correlation",
+		},
+		{
+			"trace context",
+			DatagramEnvelope{SenderID: "serial", TraceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", TraceState: "vendor=value", Datagram: packet.Datagram{ID: "4", Type: packet.T_REQUEST.String(), Function: packet.F_UBUS.String()}},
+			MessageTypeRequest,
+			"4",
+		},
+	}
+
+	broker := NewMemoryBroker(true, 1)
+	broker.CreateTopic("datagrams", 1)
+
+	recorder := newDatagramRecorder()
+	consumer := subscribe(t, broker, "group", recorder, recorder.eof, "datagrams")
+	defer consumer.Close()
+
+	producer := newTestProducer(t, broker)
+	defer producer.Close()
+
+	for _, test := range tests {
+		err := PublishDatagram(producer, "datagrams", "serial", &test.envelope, 60000)
+		if nil != err {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		var envelope *DatagramEnvelope
+		select {
+		case envelope = <-recorder.envelopes:
+		case <-time.After(testTimeout):
+			t.Fatalf("%s: envelope was not received", test.name)
+		}
+
+		if test.messageType != envelope.MessageType || test.correlationID != envelope.CorrelationID {
+			t.Errorf("%s: unexpected type %s or correlation %s", test.name, envelope.MessageType, envelope.CorrelationID)
+		}
+
+		if test.envelope.SenderID != envelope.SenderID || test.envelope.ReceiverID != envelope.ReceiverID || test.envelope.ReplyTopic != envelope.ReplyTopic {
+			t.Errorf("%s: unexpected addresses %+v", test.name, envelope)
+		}
+
+		if test.envelope.TraceParent != envelope.TraceParent || test.envelope.TraceState != envelope.TraceState {
+			t.Errorf("%s: unexpected trace context %+v", test.name, envelope)
+		}
+
+		if test.envelope.Datagram.ID != envelope.Datagram.ID || test.envelope.Datagram.Type != envelope.Datagram.Type || test.envelope.Datagram.Function != envelope.Datagram.Function {
+			t.Errorf("%s: unexpected datagram %+v", test.name, envelope.Datagram)
+		}
+
+		if DatagramSchemaVersion != envelope.SchemaVersion || "datagrams" != envelope.Topic || 0 == envelope.ExpirationTime {
+			t.Errorf("%s: unexpected consumed fields %+v", test.name, envelope)
+		}
+	}
+}
+
+func TestDatagramEnvelopeVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		version  string
+		rejected bool
+	}{
+		{"supported", "1", false},
+		{"newer", "2", true},
+		{"invalid", "one", true},
+		{"blank", "", true},
+	}
+
+	topic := "datagrams"
+	for _, test := range tests {
+		message := &kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic},
+			Value:          []byte(`{"id":"1","type":"T_REQUEST","function":"F_UBUS","arguments":[]}`),
+			Headers:        []kafka.Header{{Key: HeaderSchemaVersion, Value: []byte(test.version)}},
+		}
+
+		_, err := DecodeDatagram(message)
+		if test.rejected != errors.Is(err, ErrUnsupportedSchemaVersion) {
+			t.Errorf("%s: unexpected result %v", test.name, err)
+		}
+	}
+}
+
+func TestDatagramEnvelopeDispatch(t *testing.T) {
+	broker := NewMemoryBroker(true, 1)
+	broker.CreateTopic("datagrams", 1)
+
+	recorder := newDatagramRecorder()
+	consumer := subscribe(t, broker, "group", recorder, recorder.eof, "datagrams")
+	defer consumer.Close()
+
+	producer := newTestProducer(t, broker)
+	defer producer.Close()
+
+	// envelopes of unknown versions are rejected
+	future, err := producer.DeliverAsync(OutboundMessage{
+		Topic:     "datagrams",
+		Partition: kafka.PartitionAny,
+		Message:   `{"id":"1","type":"T_REQUEST","function":"F_UBUS","arguments":[]}`,
+		Headers:   []kafka.Header{{Key: HeaderSchemaVersion, Value: []byte("99")}},
+	}, nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	<-future.Done()
+
+	select {
+	case err = <-recorder.rejected:
+		if false == errors.Is(err, ErrUnsupportedSchemaVersion) {
+			t.Errorf("unexpected rejection %v", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("envelope was not rejected")
+	}
+
+	// plain messages are raised by MessageReceived
+	err = producer.DeliverMessage("datagrams", 0, "sender", "receiver", MessageTypeRequest, "plain", 60000)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	if message := recorder.nextMessage(t); "plain" != message.message {
+		t.Errorf("unexpected message %+v", message)
+	}
+}
@@ -0,0 +1,74 @@
+package kafkaex
+
+import (
+	"fmt"
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+	"time"
+)
+
+// maximum duration to wait for a dead-letter message to be delivered
+const deadLetterTimeout = (time.Second * 5)
+
+// deadLetterWriter routes messages which cannot be processed to a dead-letter topic
+// the original key, value and headers are kept, the original topic and the reason are appended as headers
+type deadLetterWriter struct {
+	topic    string
+	producer *kafka.Producer
+}
+
+// "configMap" holds the connection settings of the consumer which the writer belongs to
+func newDeadLetterWriter(configMap kafka.ConfigMap, topic string) (*deadLetterWriter, error) {
+	producerConfigMap := kafka.ConfigMap{}
+	for key, value := range configMap {
+		producerConfigMap[key] = value
+	}
+
+	producer, err := kafka.NewProducer(&producerConfigMap)
+
+	if nil != err {
+		return nil, fmt.Errorf("FAILED TO CREATE DEAD-LETTER PRODUCER: %+v", err)
+	}
+
+	return &deadLetterWriter{
+		topic:    topic,
+		producer: producer,
+	}, nil
+}
+
+// write delivers the message to the dead-letter topic and waits for the delivery result
+func (deadLetter *deadLetterWriter) write(message *kafka.Message, reason string) error {
+	headers := make([]kafka.Header, 0, len(message.Headers)+2)
+	headers = append(headers, message.Headers...)
+	headers = append(headers,
+		kafka.Header{Key: HeaderOriginalTopic, Value: []byte(*message.TopicPartition.Topic)},
+		kafka.Header{Key: HeaderDeadLetter, Value: []byte(reason)})
+
+	deliveryChan := make(chan kafka.Event, 1)
+	err := deadLetter.producer.Produce(&kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &deadLetter.topic, Partition: kafka.PartitionAny},
+		Key:            message.Key,
+		Value:          message.Value,
+		Headers:        headers,
+	}, deliveryChan)
+
+	if nil != err {
+		return fmt.Errorf("FAILED TO DELIVER DEAD-LETTER: %+v", err)
+	}
+
+	select {
+	case event := <-deliveryChan:
+		result := event.(*kafka.Message)
+		if nil != result.TopicPartition.Error {
+			return fmt.Errorf("FAILED TO DELIVER DEAD-LETTER: %+v", result.TopicPartition.Error)
+		}
+	case <-time.After(deadLetterTimeout):
+		return fmt.Errorf("FAILED TO DELIVER DEAD-LETTER: TIMEOUT")
+	}
+
+	return nil
+}
+
+func (deadLetter *deadLetterWriter) close() {
+	deadLetter.producer.Flush(int(deadLetterTimeout / time.Millisecond))
+	deadLetter.producer.Close()
+}
@@ -0,0 +1,136 @@
+package kafkaex
+
+import (
+	"context"
+	"sync"
+
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+)
+
+// OutboundMessage is a message to be delivered by Producer.DeliverAsync and Producer.DeliverBatch
+type OutboundMessage struct {
+	Topic              string
+	Partition          int32  // kafka.PartitionAny lets the partitioner choose the partition by "Key"
+	Key                string // e.g. device serial number, messages with the same key land on the same partition
+	SenderID           string
+	ReceiverID         string
+	MessageType        MessageType
+	CorrelationID      string
+	ReplyTopic         string
+	Message            string
+	ExpirationInterval int64          // in milliseconds, the message never expires if it is 0 or less
+	Headers            []kafka.Header // additional headers, e.g. headers of a DatagramEnvelope
+}
+
+// DeliveryReport is the delivery result of an OutboundMessage
+type DeliveryReport struct {
+	Message   OutboundMessage
+	Partition int32
+	Offset    string
+	Err       error // nil if the message was delivered successfully
+}
+
+// DeliveryFuture is resolved once the delivery result of a message is known
+type DeliveryFuture struct {
+	message  OutboundMessage
+	callback func(report DeliveryReport)
+	done     chan bool
+	report   DeliveryReport
+}
+
+func newDeliveryFuture(message OutboundMessage, callback func(report DeliveryReport)) *DeliveryFuture {
+	return &DeliveryFuture{
+		message:  message,
+		callback: callback,
+		done:     make(chan bool),
+	}
+}
+
+// Done returns a channel which is closed once the delivery result is known
+func (future *DeliveryFuture) Done() <-chan bool {
+	return future.done
+}
+
+// Wait blocks until the delivery result is known or "ctx" is done
+func (future *DeliveryFuture) Wait(ctx context.Context) (DeliveryReport, error) {
+	select {
+	case <-future.done:
+		return future.report, future.report.Err
+	case <-ctx.Done():
+		return DeliveryReport{Message: future.message}, ctx.Err()
+	}
+}
+
+// resolve the future, it must be invoked only once
+func (future *DeliveryFuture) resolve(partition int32, offset string, err error) {
+	future.report = DeliveryReport{
+		Message:   future.message,
+		Partition: partition,
+		Offset:    offset,
+		Err:       err,
+	}
+
+	close(future.done)
+
+	if nil != future.callback {
+		future.callback(future.report)
+	}
+}
+
+// inflightSet keeps futures whose delivery results are still unknown, for flushing
+type inflightSet struct {
+	locker    sync.Mutex
+	futureMap map[*DeliveryFuture]bool
+}
+
+func newInflightSet() *inflightSet {
+	return &inflightSet{futureMap: make(map[*DeliveryFuture]bool)}
+}
+
+func (inflight *inflightSet) add(future *DeliveryFuture) {
+	inflight.locker.Lock()
+	defer inflight.locker.Unlock()
+
+	inflight.futureMap[future] = true
+}
+
+func (inflight *inflightSet) remove(future *DeliveryFuture) {
+	inflight.locker.Lock()
+	defer inflight.locker.Unlock()
+
+	delete(inflight.futureMap, future)
+}
+
+// pending returns messages which are still in-flight
+func (inflight *inflightSet) pending() []OutboundMessage {
+	inflight.locker.Lock()
+	defer inflight.locker.Unlock()
+
+	messages := make([]OutboundMessage, 0, len(inflight.futureMap))
+	for future := range inflight.futureMap {
+		messages = append(messages, future.message)
+	}
+
+	return messages
+}
+
+// drain removes all futures which are still in-flight and returns them
+func (inflight *inflightSet) drain() []*DeliveryFuture {
+	inflight.locker.Lock()
+	defer inflight.locker.Unlock()
+
+	futures := make([]*DeliveryFuture, 0, len(inflight.futureMap))
+	for future := range inflight.futureMap {
+		futures = append(futures, future)
+	}
+	inflight.futureMap = make(map[*DeliveryFuture]bool)
+
+	return futures
+}
+
+func (inflight *inflightSet) size() int {
+	inflight.locker.Lock()
+	defer inflight.locker.Unlock()
+
+	return len(inflight.futureMap)
+}
@@ -1,9 +1,98 @@
 package kafkaex
 
+import (
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+	"sercomm.com/demeter/commons/datetime"
+)
+
 const (
 	HeaderSenderID       string = "X-Sender-ID"
 	HeaderReceiverID     string = "X-Receiver-ID"
 	HeaderDeliveryTime   string = "X-Delivery-Time"
 	HeaderExpirationTime string = "X-Expiration-Time"
 	HeaderMessageType    string = "X-Message-Type"
+	HeaderCorrelationID  string = "X-Correlation-ID"
+	HeaderReplyTopic     string = "X-Reply-Topic"
+	HeaderOriginalTopic  string = "X-Original-Topic"
+	HeaderDeadLetter     string = "X-Dead-Letter-Reason"
+
+	// headers of datagram envelopes, see DatagramEnvelope
+	HeaderSchemaVersion string = "X-Schema-Version"
+	HeaderFunction      string = "X-Function"
+	HeaderDatagramID    string = "X-Datagram-ID"
+	HeaderTraceParent   string = "traceparent"
+	HeaderTraceState    string = "tracestate"
 )
+
+// messageHeaders is the parsed form of the headers of a message
+type messageHeaders struct {
+	senderID       string
+	receiverID     string
+	deliveryTime   int64
+	expirationTime int64
+	messageType    MessageType
+	correlationID  string
+	replyTopic     string
+}
+
+func parseHeaders(message *kafka.Message) messageHeaders {
+	headers := messageHeaders{messageType: MessageTypeInvalid}
+
+	for _, header := range message.Headers {
+		switch header.Key {
+		case HeaderSenderID:
+			headers.senderID = string(header.Value)
+		case HeaderReceiverID:
+			headers.receiverID = string(header.Value)
+		case HeaderDeliveryTime:
+			headers.deliveryTime = bytesToInt64(header.Value)
+		case HeaderExpirationTime:
+			headers.expirationTime = bytesToInt64(header.Value)
+		case HeaderMessageType:
+			headers.messageType = ParseMessageTypeString(string(header.Value))
+		case HeaderCorrelationID:
+			headers.correlationID = string(header.Value)
+		case HeaderReplyTopic:
+			headers.replyTopic = string(header.Value)
+		}
+	}
+
+	return headers
+}
+
+// buildHeaders stamps the delivery time of a message and calculates its expiration time from "expirationInterval" (in milliseconds)
+// messages with an interval of 0 or less are stamped with expiration time 0 and never expire
+func buildHeaders(
+	senderID string,
+	receiverID string,
+	messageType MessageType,
+	correlationID string,
+	replyTopic string,
+	expirationInterval int64) []kafka.Header {
+
+	dateTime := datetime.Now()
+	deliveryTime := dateTime.UnixTimestamp()
+
+	var expirationTime int64 = 0
+	if expirationInterval > 0 {
+		expirationTime = deliveryTime + expirationInterval
+	}
+
+	headers := []kafka.Header{
+		{Key: HeaderSenderID, Value: []byte(senderID)},
+		{Key: HeaderReceiverID, Value: []byte(receiverID)},
+		{Key: HeaderDeliveryTime, Value: []byte(int64ToBytes(deliveryTime))},
+		{Key: HeaderExpirationTime, Value: []byte(int64ToBytes(expirationTime))},
+		{Key: HeaderMessageType, Value: []byte(messageType.String())},
+	}
+
+	if "" != correlationID {
+		headers = append(headers, kafka.Header{Key: HeaderCorrelationID, Value: []byte(correlationID)})
+	}
+
+	if "" != replyTopic {
+		headers = append(headers, kafka.Header{Key: HeaderReplyTopic, Value: []byte(replyTopic)})
+	}
+
+	return headers
+}
@@ -0,0 +1,1104 @@
+package kafkaex
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+)
+
+// MemoryBroker is an in-memory Kafka cluster for testing code which uses Producer, Consumer,
+// ProducerHandler and ConsumerHandler without librdkafka nor a real broker.
+// It supports topics with partitions, consumer groups with committed offsets, headers, keys,
+// PartitionEOF events and topic administration. Offsets are committed as soon as messages are delivered
+// unless the consumer was created with a CommitPolicy, and new consumer groups begin at the end of partitions,
+// the same as "auto.offset.reset" = "latest"
+type MemoryBroker struct {
+	locker                sync.Mutex
+	autoCreateTopics      bool
+	defaultPartitionCount int
+	topicMap              map[string]*memoryTopic // pair< topic name, topic >
+	groupMap              map[string]*memoryGroup // pair< group name, group >
+	changed               chan bool               // closed and renewed whenever messages or assignments changed
+}
+
+type memoryTopic struct {
+	partitions [][]*kafka.Message
+	configMap  map[string]string
+}
+
+type memoryGroup struct {
+	members   []*MemoryConsumer               // in the joining order
+	offsets   map[topicPartition]kafka.Offset // next offset to be consumed
+	committed map[topicPartition]kafka.Offset // offset to be consumed once the partition is assigned to another member
+}
+
+// interval of committing and retrying messages of consumers with a CommitPolicy, the same as the poll interval of KafkaConsumer
+const memoryCommitInterval = (time.Millisecond * 100)
+
+// NewMemoryBroker creates an empty cluster, topics will be created with "defaultPartitionCount" partitions
+// when messages are delivered to unknown topics if "autoCreateTopics" is true
+func NewMemoryBroker(autoCreateTopics bool, defaultPartitionCount int) *MemoryBroker {
+	if defaultPartitionCount < 1 {
+		defaultPartitionCount = 1
+	}
+
+	return &MemoryBroker{
+		autoCreateTopics:      autoCreateTopics,
+		defaultPartitionCount: defaultPartitionCount,
+		topicMap:              make(map[string]*memoryTopic),
+		groupMap:              make(map[string]*memoryGroup),
+		changed:               make(chan bool),
+	}
+}
+
+// NewProducer is the implementation of ClientFactory.NewProducer()
+func (broker *MemoryBroker) NewProducer(kafkaProducerHandler ProducerHandler) (Producer, error) {
+	return &MemoryProducer{
+		broker:               broker,
+		kafkaProducerHandler: kafkaProducerHandler,
+	}, nil
+}
+
+// NewProducerWithKafkaHandler creates a producer whose events are raised to a KafkaProducerHandler of NewKafkaProducer,
+// the *KafkaProducer of the events is nil since the producer is not a KafkaProducer
+func (broker *MemoryBroker) NewProducerWithKafkaHandler(kafkaProducerHandler KafkaProducerHandler) (Producer, error) {
+	var handler ProducerHandler
+	if nil != kafkaProducerHandler {
+		handler = &legacyProducerHandler{kafkaProducerHandler}
+	}
+
+	return broker.NewProducer(handler)
+}
+
+// NewConsumer is the implementation of ClientFactory.NewConsumer()
+func (broker *MemoryBroker) NewConsumer(groupName string, kafkaConsumerHandler ConsumerHandler) (Consumer, error) {
+	return broker.newConsumer(groupName, kafkaConsumerHandler, nil)
+}
+
+// NewConsumerWithCommitPolicy creates a consumer which processes messages at least once, see NewKafkaConsumerWithCommitPolicy
+func (broker *MemoryBroker) NewConsumerWithCommitPolicy(groupName string, kafkaConsumerHandler ConsumerHandler, commitPolicy CommitPolicy) (Consumer, error) {
+	err := commitPolicy.validate()
+	if nil != err {
+		return nil, fmt.Errorf("FAILED TO CREATE CONSUMER: %+v", err)
+	}
+
+	return broker.newConsumer(groupName, kafkaConsumerHandler, &commitPolicy)
+}
+
+// NewConsumerWithKafkaHandler creates a consumer whose events are raised to a KafkaConsumerHandler of NewKafkaConsumer,
+// the *KafkaConsumer of the events is nil since the consumer is not a KafkaConsumer
+func (broker *MemoryBroker) NewConsumerWithKafkaHandler(groupName string, kafkaConsumerHandler KafkaConsumerHandler) (Consumer, error) {
+	var handler ConsumerHandler
+	if nil != kafkaConsumerHandler {
+		handler = &legacyConsumerHandler{kafkaConsumerHandler}
+	}
+
+	return broker.newConsumer(groupName, handler, nil)
+}
+
+func (broker *MemoryBroker) newConsumer(groupName string, kafkaConsumerHandler ConsumerHandler, commitPolicy *CommitPolicy) (Consumer, error) {
+	if "" == groupName {
+		return nil, fmt.Errorf("FAILED TO CREATE CONSUMER: 'groupName' CANNOT BE BLANK")
+	}
+
+	memoryConsumer := &MemoryConsumer{
+		broker:               broker,
+		groupName:            groupName,
+		kafkaConsumerHandler: kafkaConsumerHandler,
+		eofMap:               make(map[topicPartition]bool),
+		pausedMap:            make(map[topicPartition]bool),
+		terminated:           make(chan bool),
+	}
+
+	if nil != commitPolicy {
+		var deadLetter func(message *kafka.Message, reason string) error
+		if "" != commitPolicy.DeadLetterTopic {
+			deadLetterTopic := commitPolicy.DeadLetterTopic
+			deadLetter = func(message *kafka.Message, reason string) error {
+				return memoryConsumer.writeDeadLetter(deadLetterTopic, message, reason)
+			}
+		}
+
+		memoryConsumer.committer = newCommitter(memoryConsumer, kafkaConsumerHandler, commitPolicy, deadLetter, memoryConsumer.terminated)
+	}
+
+	go memoryConsumer.run()
+
+	return memoryConsumer, nil
+}
+
+// CreateTopic creates a topic with "partitionCount" partitions
+func (broker *MemoryBroker) CreateTopic(topic string, partitionCount int) error {
+	broker.locker.Lock()
+	defer broker.locker.Unlock()
+
+	if partitionCount < 1 {
+		return fmt.Errorf("ERROR RETURNED WHEN CREATING TOPIC: %+v", kafka.NewError(kafka.ErrInvalidPartitions, "Number of partitions must be larger than 0", false))
+	}
+
+	if _, ok := broker.topicMap[topic]; ok {
+		return fmt.Errorf("ERROR RETURNED WHEN CREATING TOPIC: %+v", kafka.NewError(kafka.ErrTopicAlreadyExists, "Topic '"+topic+"' already exists", false))
+	}
+
+	broker.createTopic(topic, partitionCount)
+	return nil
+}
+
+// DescribeTopic returns the configuration of the topic
+func (broker *MemoryBroker) DescribeTopic(topic string) (map[string]kafka.ConfigEntryResult, error) {
+	broker.locker.Lock()
+	defer broker.locker.Unlock()
+
+	memoryTopic, ok := broker.topicMap[topic]
+	if false == ok {
+		return nil, fmt.Errorf("ERROR RETURNED WHEN DESCRIBING TOPIC: %+v", kafka.NewError(kafka.ErrUnknownTopicOrPart, "Broker: Unknown topic or partition", false))
+	}
+
+	results := make(map[string]kafka.ConfigEntryResult)
+	for name, value := range memoryTopic.configMap {
+		results[name] = kafka.ConfigEntryResult{
+			Name:   name,
+			Value:  value,
+			Source: kafka.ConfigSourceDefault,
+		}
+	}
+
+	return results, nil
+}
+
+// DeleteTopic deletes the topic and the committed offsets of its partitions
+func (broker *MemoryBroker) DeleteTopic(topic string) error {
+	broker.locker.Lock()
+	defer broker.locker.Unlock()
+
+	if _, ok := broker.topicMap[topic]; false == ok {
+		return fmt.Errorf("ERROR RETURNED WHEN DELETING TOPIC: %+v", kafka.NewError(kafka.ErrUnknownTopicOrPart, "Broker: Unknown topic or partition", false))
+	}
+
+	delete(broker.topicMap, topic)
+	for _, group := range broker.groupMap {
+		for key := range group.offsets {
+			if key.topic == topic {
+				delete(group.offsets, key)
+				delete(group.committed, key)
+			}
+		}
+	}
+
+	broker.notify()
+	return nil
+}
+
+// GetTopics returns names of all topics
+func (broker *MemoryBroker) GetTopics() []string {
+	broker.locker.Lock()
+	defer broker.locker.Unlock()
+
+	topics := make([]string, 0, len(broker.topicMap))
+	for topic := range broker.topicMap {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	return topics
+}
+
+// GetMessages returns a copy of the messages in the partition of the topic
+func (broker *MemoryBroker) GetMessages(topic string, partition int32) ([]*kafka.Message, error) {
+	broker.locker.Lock()
+	defer broker.locker.Unlock()
+
+	memoryTopic, ok := broker.topicMap[topic]
+	if false == ok || partition < 0 || int(partition) >= len(memoryTopic.partitions) {
+		return nil, kafka.NewError(kafka.ErrUnknownPartition, "Local: Unknown partition", false)
+	}
+
+	messages := make([]*kafka.Message, len(memoryTopic.partitions[partition]))
+	copy(messages, memoryTopic.partitions[partition])
+
+	return messages, nil
+}
+
+// create the topic, the caller must hold the lock
+func (broker *MemoryBroker) createTopic(topic string, partitionCount int) *memoryTopic {
+	memoryTopic := &memoryTopic{
+		partitions: make([][]*kafka.Message, partitionCount),
+		configMap: map[string]string{
+			"cleanup.policy": "delete",
+			"retention.ms":   "604800000",
+		},
+	}
+
+	broker.topicMap[topic] = memoryTopic
+	broker.rebalanceAll()
+	broker.notify()
+
+	return memoryTopic
+}
+
+// append the message to the topic and return the delivered position
+func (broker *MemoryBroker) append(message *kafka.Message) (kafka.TopicPartition, error) {
+	broker.locker.Lock()
+	defer broker.locker.Unlock()
+
+	position := message.TopicPartition
+	if nil == position.Topic || "" == *position.Topic {
+		return position, kafka.NewError(kafka.ErrUnknownTopicOrPart, "Broker: Unknown topic or partition", false)
+	}
+
+	memoryTopic, ok := broker.topicMap[*position.Topic]
+	if false == ok {
+		if false == broker.autoCreateTopics {
+			return position, kafka.NewError(kafka.ErrUnknownTopicOrPart, "Broker: Unknown topic or partition", false)
+		}
+		memoryTopic = broker.createTopic(*position.Topic, broker.defaultPartitionCount)
+	}
+
+	partitionCount := int32(len(memoryTopic.partitions))
+	if position.Partition == kafka.PartitionAny {
+		if 0 != len(message.Key) {
+			hash := fnv.New32a()
+			hash.Write(message.Key)
+			position.Partition = int32(hash.Sum32() % uint32(partitionCount))
+		} else {
+			// the partition of the shortest queue
+			position.Partition = 0
+			for idx := int32(1); idx < partitionCount; idx++ {
+				if len(memoryTopic.partitions[idx]) < len(memoryTopic.partitions[position.Partition]) {
+					position.Partition = idx
+				}
+			}
+		}
+	} else if position.Partition < 0 || position.Partition >= partitionCount {
+		return position, kafka.NewError(kafka.ErrUnknownPartition, "Local: Unknown partition", false)
+	}
+
+	topic := *position.Topic
+	position.Topic = &topic
+	position.Offset = kafka.Offset(len(memoryTopic.partitions[position.Partition]))
+
+	timestamp := time.Now()
+	memoryTopic.partitions[position.Partition] = append(memoryTopic.partitions[position.Partition], &kafka.Message{
+		TopicPartition: position,
+		Key:            message.Key,
+		Value:          message.Value,
+		Headers:        message.Headers,
+		Timestamp:      timestamp,
+		TimestampType:  kafka.TimestampCreateTime,
+	})
+
+	broker.notify()
+
+	return position, nil
+}
+
+// wake up all consumers, the caller must hold the lock
+func (broker *MemoryBroker) notify() {
+	close(broker.changed)
+	broker.changed = make(chan bool)
+}
+
+// the channel which will be closed at the next change
+func (broker *MemoryBroker) watch() chan bool {
+	broker.locker.Lock()
+	defer broker.locker.Unlock()
+
+	return broker.changed
+}
+
+// add or remove a member of the group
+func (broker *MemoryBroker) join(memoryConsumer *MemoryConsumer) {
+	broker.locker.Lock()
+	defer broker.locker.Unlock()
+
+	group, ok := broker.groupMap[memoryConsumer.groupName]
+	if false == ok {
+		group = &memoryGroup{
+			offsets:   make(map[topicPartition]kafka.Offset),
+			committed: make(map[topicPartition]kafka.Offset),
+		}
+		broker.groupMap[memoryConsumer.groupName] = group
+	}
+
+	for _, member := range group.members {
+		if member == memoryConsumer {
+			broker.rebalance(group)
+			return
+		}
+	}
+
+	group.members = append(group.members, memoryConsumer)
+	broker.rebalance(group)
+}
+
+func (broker *MemoryBroker) leave(memoryConsumer *MemoryConsumer) {
+	broker.locker.Lock()
+	defer broker.locker.Unlock()
+
+	group, ok := broker.groupMap[memoryConsumer.groupName]
+	if false == ok {
+		return
+	}
+
+	for idx, member := range group.members {
+		if member == memoryConsumer {
+			group.members = append(group.members[:idx], group.members[idx+1:]...)
+			break
+		}
+	}
+
+	memoryConsumer.commitLocked(true)
+	memoryConsumer.reassign(nil)
+	broker.rebalance(group)
+}
+
+// rebalance all groups, the caller must hold the lock
+func (broker *MemoryBroker) rebalanceAll() {
+	for _, group := range broker.groupMap {
+		broker.rebalance(group)
+	}
+}
+
+// assign partitions of subscribed topics to members of the group in round-robin,
+// the caller must hold the lock
+func (broker *MemoryBroker) rebalance(group *memoryGroup) {
+	assignmentMap := make(map[*MemoryConsumer][]topicPartition)
+
+	// partitions which move to another member are consumed again from the committed offsets
+	ownerMap := make(map[topicPartition]*MemoryConsumer)
+	for _, member := range group.members {
+		member.commitLocked(true)
+		for _, key := range member.assignment {
+			ownerMap[key] = member
+		}
+	}
+
+	topics := make([]string, 0, len(broker.topicMap))
+	for topic := range broker.topicMap {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	for _, topic := range topics {
+		subscribers := make([]*MemoryConsumer, 0, len(group.members))
+		for _, member := range group.members {
+			if member.isSubscribed(topic) {
+				subscribers = append(subscribers, member)
+			}
+		}
+
+		if 0 == len(subscribers) {
+			continue
+		}
+
+		memoryTopic := broker.topicMap[topic]
+		for partition := range memoryTopic.partitions {
+			key := topicPartition{topic, int32(partition)}
+			if _, ok := group.offsets[key]; false == ok {
+				// "auto.offset.reset" = "latest"
+				group.offsets[key] = kafka.Offset(len(memoryTopic.partitions[partition]))
+				group.committed[key] = group.offsets[key]
+			}
+
+			member := subscribers[partition%len(subscribers)]
+			assignmentMap[member] = append(assignmentMap[member], key)
+
+			if ownerMap[key] != member {
+				group.offsets[key] = group.committed[key]
+			}
+		}
+	}
+
+	for _, member := range group.members {
+		member.reassign(assignmentMap[member])
+	}
+
+	broker.notify()
+}
+
+// fetch the next message of the consumer from its assigned partitions and commit its offset
+// unless the consumer commits by a CommitPolicy, or returns the partition which has just reached its end
+func (broker *MemoryBroker) fetch(memoryConsumer *MemoryConsumer) (*kafka.Message, *kafka.TopicPartition) {
+	broker.locker.Lock()
+	defer broker.locker.Unlock()
+
+	group, ok := broker.groupMap[memoryConsumer.groupName]
+	if false == ok {
+		return nil, nil
+	}
+
+	count := len(memoryConsumer.assignment)
+	for idx := 0; idx < count; idx++ {
+		// begin with the partition next to the last fetched one
+		key := memoryConsumer.assignment[(memoryConsumer.cursor+idx)%count]
+
+		memoryTopic, ok := broker.topicMap[key.topic]
+		if false == ok || int(key.partition) >= len(memoryTopic.partitions) {
+			continue
+		}
+
+		if memoryConsumer.pausedMap[key] {
+			continue
+		}
+
+		messages := memoryTopic.partitions[key.partition]
+		offset := group.offsets[key]
+		if int(offset) < len(messages) {
+			group.offsets[key] = offset + 1
+			if nil == memoryConsumer.committer {
+				group.committed[key] = offset + 1
+			}
+			memoryConsumer.cursor = (memoryConsumer.cursor + idx + 1) % count
+			memoryConsumer.eofMap[key] = false
+			return messages[offset], nil
+		}
+
+		if false == memoryConsumer.eofMap[key] {
+			memoryConsumer.eofMap[key] = true
+			topic := key.topic
+			return nil, &kafka.TopicPartition{Topic: &topic, Partition: key.partition, Offset: offset}
+		}
+	}
+
+	return nil, nil
+}
+
+// MemoryProducer is the Producer of MemoryBroker
+type MemoryProducer struct {
+	broker               *MemoryBroker
+	kafkaProducerHandler ProducerHandler
+	closed               int32
+}
+
+// Close is the implementation of Producer.Close()
+func (memoryProducer *MemoryProducer) Close() {
+	if false == atomic.CompareAndSwapInt32(&memoryProducer.closed, 0, 1) {
+		return
+	}
+
+	if nil != memoryProducer.kafkaProducerHandler {
+		memoryProducer.kafkaProducerHandler.Closed(memoryProducer)
+	}
+}
+
+// CreateTopic is the implementation of Producer.CreateTopic()
+func (memoryProducer *MemoryProducer) CreateTopic(topic string, partitionCount int) error {
+	return memoryProducer.broker.CreateTopic(topic, partitionCount)
+}
+
+// DescribeTopic is the implementation of Producer.DescribeTopic()
+func (memoryProducer *MemoryProducer) DescribeTopic(topic string) (map[string]kafka.ConfigEntryResult, error) {
+	return memoryProducer.broker.DescribeTopic(topic)
+}
+
+// DeleteTopic is the implementation of Producer.DeleteTopic()
+func (memoryProducer *MemoryProducer) DeleteTopic(topic string) error {
+	return memoryProducer.broker.DeleteTopic(topic)
+}
+
+// DeliverMessage is the implementation of Producer.DeliverMessage()
+func (memoryProducer *MemoryProducer) DeliverMessage(
+	topic string,
+	partition int32,
+	senderID string,
+	receiverID string,
+	messageType MessageType,
+	message string,
+	expirationInterval int64) error {
+
+	return memoryProducer.DeliverCorrelatedMessage(
+		topic,
+		partition,
+		"",
+		senderID,
+		receiverID,
+		messageType,
+		"",
+		"",
+		message,
+		expirationInterval)
+}
+
+// DeliverCorrelatedMessage is the implementation of Producer.DeliverCorrelatedMessage()
+func (memoryProducer *MemoryProducer) DeliverCorrelatedMessage(
+	topic string,
+	partition int32,
+	key string,
+	senderID string,
+	receiverID string,
+	messageType MessageType,
+	correlationID string,
+	replyTopic string,
+	message string,
+	expirationInterval int64) error {
+
+	future, err := memoryProducer.DeliverAsync(OutboundMessage{
+		Topic:              topic,
+		Partition:          partition,
+		Key:                key,
+		SenderID:           senderID,
+		ReceiverID:         receiverID,
+		MessageType:        messageType,
+		CorrelationID:      correlationID,
+		ReplyTopic:         replyTopic,
+		Message:            message,
+		ExpirationInterval: expirationInterval,
+	}, nil)
+
+	if nil != err {
+		return err
+	}
+
+	return future.report.Err
+}
+
+// DeliverKeyedMessage is the implementation of Producer.DeliverKeyedMessage()
+func (memoryProducer *MemoryProducer) DeliverKeyedMessage(
+	topic string,
+	key string,
+	senderID string,
+	receiverID string,
+	messageType MessageType,
+	message string,
+	expirationInterval int64) error {
+
+	return memoryProducer.DeliverCorrelatedMessage(
+		topic,
+		kafka.PartitionAny,
+		key,
+		senderID,
+		receiverID,
+		messageType,
+		"",
+		"",
+		message,
+		expirationInterval)
+}
+
+// DeliverAsync is the implementation of Producer.DeliverAsync(), the message is delivered before returning
+func (memoryProducer *MemoryProducer) DeliverAsync(message OutboundMessage, callback func(report DeliveryReport)) (*DeliveryFuture, error) {
+	if 0 != atomic.LoadInt32(&memoryProducer.closed) {
+		return nil, fmt.Errorf("INVALID INSTANCE")
+	}
+
+	var keyBytes []byte
+	if "" != message.Key {
+		keyBytes = []byte(message.Key)
+	}
+
+	topic := message.Topic
+	position, err := memoryProducer.broker.append(&kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: message.Partition},
+		Key:            keyBytes,
+		Value:          []byte(message.Message),
+		Headers: append(buildHeaders(
+			message.SenderID,
+			message.ReceiverID,
+			message.MessageType,
+			message.CorrelationID,
+			message.ReplyTopic,
+			message.ExpirationInterval), message.Headers...),
+	})
+
+	if nil != memoryProducer.kafkaProducerHandler {
+		memoryProducer.kafkaProducerHandler.MessageDeliveredResult(
+			memoryProducer,
+			err,
+			topic,
+			position.Partition,
+			position.Offset.String(),
+			message.Message)
+	}
+
+	future := newDeliveryFuture(message, callback)
+	future.resolve(position.Partition, position.Offset.String(), err)
+
+	return future, nil
+}
+
+// DeliverBatch is the implementation of Producer.DeliverBatch()
+func (memoryProducer *MemoryProducer) DeliverBatch(messages []OutboundMessage, callback func(report DeliveryReport)) ([]*DeliveryFuture, error) {
+	futures := make([]*DeliveryFuture, 0, len(messages))
+	for _, message := range messages {
+		future, err := memoryProducer.DeliverAsync(message, callback)
+		if nil != err {
+			return futures, err
+		}
+		futures = append(futures, future)
+	}
+
+	return futures, nil
+}
+
+// Flush is the implementation of Producer.Flush(), nothing is pending since messages are delivered synchronously
+func (memoryProducer *MemoryProducer) Flush(ctx context.Context) ([]OutboundMessage, error) {
+	return nil, nil
+}
+
+// MemoryConsumer is the Consumer of MemoryBroker
+type MemoryConsumer struct {
+	broker               *MemoryBroker
+	groupName            string
+	kafkaConsumerHandler ConsumerHandler
+	terminated           chan bool
+	committer            *committer // nil unless the consumer was created with a CommitPolicy
+
+	// protected by the lock of the broker
+	subscriptions []string
+	assignment    []topicPartition
+	cursor        int
+	eofMap        map[topicPartition]bool
+	pausedMap     map[topicPartition]bool
+	revoked       []kafka.TopicPartition // to be notified by PartitionsRevoked
+	assigned      []kafka.TopicPartition // to be notified by PartitionsAssigned
+
+	// expiration enforcement
+	expirationEnforced int32
+	deadLetterTopic    atomic.Value
+	expiredCount       uint64
+	deadLetteredCount  uint64
+}
+
+// Close is the implementation of Consumer.Close()
+func (memoryConsumer *MemoryConsumer) Close() error {
+	select {
+	case <-memoryConsumer.terminated:
+		return nil
+	default:
+		close(memoryConsumer.terminated)
+	}
+
+	memoryConsumer.broker.leave(memoryConsumer)
+	return nil
+}
+
+// CreateTopic is the implementation of Consumer.CreateTopic()
+func (memoryConsumer *MemoryConsumer) CreateTopic(topic string, partitionCount int) error {
+	return memoryConsumer.broker.CreateTopic(topic, partitionCount)
+}
+
+// DescribeTopic is the implementation of Consumer.DescribeTopic()
+func (memoryConsumer *MemoryConsumer) DescribeTopic(topic string) (map[string]kafka.ConfigEntryResult, error) {
+	return memoryConsumer.broker.DescribeTopic(topic)
+}
+
+// DeleteTopic is the implementation of Consumer.DeleteTopic()
+func (memoryConsumer *MemoryConsumer) DeleteTopic(topic string) error {
+	return memoryConsumer.broker.DeleteTopic(topic)
+}
+
+// SubscribeTopics is the implementation of Consumer.SubscribeTopics()
+func (memoryConsumer *MemoryConsumer) SubscribeTopics(topics []string) error {
+	memoryConsumer.broker.locker.Lock()
+	memoryConsumer.subscriptions = append([]string{}, topics...)
+	memoryConsumer.broker.locker.Unlock()
+
+	memoryConsumer.broker.join(memoryConsumer)
+	return nil
+}
+
+// Unsubscribe is the implementation of Consumer.Unsubscribe()
+func (memoryConsumer *MemoryConsumer) Unsubscribe() error {
+	memoryConsumer.broker.locker.Lock()
+	memoryConsumer.subscriptions = nil
+	memoryConsumer.broker.locker.Unlock()
+
+	memoryConsumer.broker.join(memoryConsumer)
+	return nil
+}
+
+// GetSubscriptions is the implementation of Consumer.GetSubscriptions()
+func (memoryConsumer *MemoryConsumer) GetSubscriptions() ([]string, error) {
+	memoryConsumer.broker.locker.Lock()
+	defer memoryConsumer.broker.locker.Unlock()
+
+	return append([]string{}, memoryConsumer.subscriptions...), nil
+}
+
+// EnforceExpiration is the implementation of Consumer.EnforceExpiration()
+func (memoryConsumer *MemoryConsumer) EnforceExpiration(enabled bool, deadLetterTopic string) error {
+	memoryConsumer.deadLetterTopic.Store(deadLetterTopic)
+
+	if enabled {
+		atomic.StoreInt32(&memoryConsumer.expirationEnforced, 1)
+	} else {
+		atomic.StoreInt32(&memoryConsumer.expirationEnforced, 0)
+	}
+
+	return nil
+}
+
+// GetExpiredCount is the implementation of Consumer.GetExpiredCount()
+func (memoryConsumer *MemoryConsumer) GetExpiredCount() (expired uint64, deadLettered uint64) {
+	return atomic.LoadUint64(&memoryConsumer.expiredCount), atomic.LoadUint64(&memoryConsumer.deadLetteredCount)
+}
+
+// Pause is the implementation of Consumer.Pause()
+func (memoryConsumer *MemoryConsumer) Pause(topic string, partition int32) error {
+	memoryConsumer.broker.locker.Lock()
+	defer memoryConsumer.broker.locker.Unlock()
+
+	memoryConsumer.pausedMap[topicPartition{topic, partition}] = true
+	return nil
+}
+
+// Resume is the implementation of Consumer.Resume()
+func (memoryConsumer *MemoryConsumer) Resume(topic string, partition int32) error {
+	memoryConsumer.broker.locker.Lock()
+	defer memoryConsumer.broker.locker.Unlock()
+
+	delete(memoryConsumer.pausedMap, topicPartition{topic, partition})
+	memoryConsumer.broker.notify()
+	return nil
+}
+
+// SeekToOffset is the implementation of Consumer.SeekToOffset()
+func (memoryConsumer *MemoryConsumer) SeekToOffset(topic string, partition int32, offset int64) error {
+	memoryConsumer.broker.locker.Lock()
+	defer memoryConsumer.broker.locker.Unlock()
+
+	key := topicPartition{topic, partition}
+	if false == memoryConsumer.isAssigned(key) {
+		return fmt.Errorf("FAILED TO SEEK: %+v", kafka.NewError(kafka.ErrUnknownPartition, "Local: Unknown partition", false))
+	}
+
+	messages, ok := memoryConsumer.broker.partitionMessages(key)
+	if false == ok {
+		return fmt.Errorf("FAILED TO SEEK: %+v", kafka.NewError(kafka.ErrUnknownTopicOrPart, "Broker: Unknown topic or partition", false))
+	}
+
+	if offset < 0 || offset > int64(len(messages)) {
+		offset = int64(len(messages))
+	}
+
+	memoryConsumer.seek(key, kafka.Offset(offset))
+	return nil
+}
+
+// SeekToTimestamp is the implementation of Consumer.SeekToTimestamp()
+func (memoryConsumer *MemoryConsumer) SeekToTimestamp(topic string, timestamp int64) error {
+	memoryConsumer.broker.locker.Lock()
+	defer memoryConsumer.broker.locker.Unlock()
+
+	found := false
+	for _, key := range memoryConsumer.assignment {
+		if key.topic != topic {
+			continue
+		}
+
+		messages, ok := memoryConsumer.broker.partitionMessages(key)
+		if false == ok {
+			return fmt.Errorf("FAILED TO SEEK: %+v", kafka.NewError(kafka.ErrUnknownTopicOrPart, "Broker: Unknown topic or partition", false))
+		}
+		found = true
+
+		offset := sort.Search(len(messages), func(idx int) bool {
+			return messages[idx].Timestamp.UnixNano()/int64(time.Millisecond) >= timestamp
+		})
+
+		memoryConsumer.seek(key, kafka.Offset(offset))
+	}
+
+	if false == found {
+		return fmt.Errorf("FAILED TO SEEK: NO PARTITION OF '%s' IS ASSIGNED", topic)
+	}
+
+	return nil
+}
+
+// messages of the partition, the topic may have been deleted after the partition was assigned
+// the caller must hold the lock of the broker
+func (broker *MemoryBroker) partitionMessages(key topicPartition) ([]*kafka.Message, bool) {
+	memoryTopic, ok := broker.topicMap[key.topic]
+	if false == ok || key.partition < 0 || int(key.partition) >= len(memoryTopic.partitions) {
+		return nil, false
+	}
+
+	return memoryTopic.partitions[key.partition], true
+}
+
+// move the offset of the group, the caller must hold the lock of the broker
+func (memoryConsumer *MemoryConsumer) seek(key topicPartition, offset kafka.Offset) {
+	group := memoryConsumer.broker.groupMap[memoryConsumer.groupName]
+	group.offsets[key] = offset
+
+	if nil == memoryConsumer.committer {
+		group.committed[key] = offset
+	} else {
+		// messages before the new offset will not be acknowledged anymore
+		topic := key.topic
+		memoryConsumer.committer.tracker.forget([]kafka.TopicPartition{{Topic: &topic, Partition: key.partition}})
+	}
+
+	memoryConsumer.eofMap[key] = false
+	memoryConsumer.broker.notify()
+}
+
+// commit acknowledged offsets if "force" is true or committing is due, the caller must hold the lock of the broker
+// offsets of partitions which are no longer assigned to the consumer are dropped
+func (memoryConsumer *MemoryConsumer) commitLocked(force bool) {
+	committer := memoryConsumer.committer
+	if nil == committer {
+		return
+	}
+
+	if false == force && false == committer.tracker.due(committer.policy) {
+		return
+	}
+
+	group, ok := memoryConsumer.broker.groupMap[memoryConsumer.groupName]
+	if false == ok {
+		return
+	}
+
+	for _, position := range committer.tracker.committable() {
+		key := topicPartition{*position.Topic, position.Partition}
+		if memoryConsumer.isAssigned(key) {
+			group.committed[key] = position.Offset
+		}
+	}
+}
+
+func (memoryConsumer *MemoryConsumer) commit(force bool) {
+	memoryConsumer.broker.locker.Lock()
+	defer memoryConsumer.broker.locker.Unlock()
+
+	memoryConsumer.commitLocked(force)
+}
+
+// check if the partition is assigned to the consumer, the caller must hold the lock of the broker
+func (memoryConsumer *MemoryConsumer) isAssigned(key topicPartition) bool {
+	for _, assigned := range memoryConsumer.assignment {
+		if assigned == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// replace the assignment and queue the differences to be notified, the caller must hold the lock of the broker
+func (memoryConsumer *MemoryConsumer) reassign(assignment []topicPartition) {
+	contains := func(keys []topicPartition, key topicPartition) bool {
+		for _, candidate := range keys {
+			if candidate == key {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, key := range memoryConsumer.assignment {
+		if false == contains(assignment, key) {
+			topic := key.topic
+			revoked := kafka.TopicPartition{Topic: &topic, Partition: key.partition}
+			memoryConsumer.revoked = append(memoryConsumer.revoked, revoked)
+			delete(memoryConsumer.pausedMap, key)
+			delete(memoryConsumer.eofMap, key)
+
+			if nil != memoryConsumer.committer {
+				memoryConsumer.committer.tracker.forget([]kafka.TopicPartition{revoked})
+			}
+		}
+	}
+
+	for _, key := range assignment {
+		if false == contains(memoryConsumer.assignment, key) {
+			topic := key.topic
+			memoryConsumer.assigned = append(memoryConsumer.assigned, kafka.TopicPartition{Topic: &topic, Partition: key.partition})
+		}
+	}
+
+	memoryConsumer.assignment = assignment
+}
+
+// raise PartitionsRevoked and PartitionsAssigned for the queued differences of the assignment
+func (memoryConsumer *MemoryConsumer) notifyRebalance() {
+	memoryConsumer.broker.locker.Lock()
+	revoked := memoryConsumer.revoked
+	assigned := memoryConsumer.assigned
+	memoryConsumer.revoked = nil
+	memoryConsumer.assigned = nil
+	memoryConsumer.broker.locker.Unlock()
+
+	if nil == memoryConsumer.kafkaConsumerHandler {
+		return
+	}
+
+	if 0 != len(revoked) {
+		memoryConsumer.kafkaConsumerHandler.PartitionsRevoked(memoryConsumer, revoked)
+	}
+
+	if 0 != len(assigned) {
+		memoryConsumer.kafkaConsumerHandler.PartitionsAssigned(memoryConsumer, assigned)
+	}
+}
+
+// check if the consumer subscribed the topic, the caller must hold the lock of the broker
+func (memoryConsumer *MemoryConsumer) isSubscribed(topic string) bool {
+	for _, subscription := range memoryConsumer.subscriptions {
+		if subscription == topic {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dispatch messages to the handler until the consumer is closed
+func (memoryConsumer *MemoryConsumer) run() {
+	defer func() {
+		// partitions were revoked by leaving the group
+		memoryConsumer.notifyRebalance()
+
+		if nil != memoryConsumer.kafkaConsumerHandler {
+			memoryConsumer.kafkaConsumerHandler.Closed(memoryConsumer)
+		}
+	}()
+
+	// acknowledgements may be settled by other routines, hence committing and retrying are checked at intervals
+	var tick <-chan time.Time
+	if nil != memoryConsumer.committer {
+		ticker := time.NewTicker(memoryCommitInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-memoryConsumer.terminated:
+			return
+		default:
+		}
+
+		// watch before fetching, so that changes made in between will not be missed
+		changed := memoryConsumer.broker.watch()
+
+		memoryConsumer.notifyRebalance()
+
+		if nil != memoryConsumer.committer {
+			memoryConsumer.committer.drainRetryQueue()
+			memoryConsumer.commit(false)
+		}
+
+		message, eof := memoryConsumer.broker.fetch(memoryConsumer)
+		if nil != message {
+			memoryConsumer.dispatch(message)
+			continue
+		}
+
+		if nil != eof {
+			if nil != memoryConsumer.kafkaConsumerHandler {
+				memoryConsumer.kafkaConsumerHandler.PartitionEOF(
+					memoryConsumer,
+					*eof.Topic,
+					eof.Partition,
+					eof.Offset.String())
+			}
+			continue
+		}
+
+		select {
+		case <-changed:
+		case <-tick:
+		case <-memoryConsumer.terminated:
+			return
+		}
+	}
+}
+
+func (memoryConsumer *MemoryConsumer) dispatch(message *kafka.Message) {
+	var acknowledgement *Acknowledgement
+	if nil != memoryConsumer.committer {
+		acknowledgement = memoryConsumer.committer.track(message)
+	}
+
+	headers := parseHeaders(message)
+
+	if 0 != atomic.LoadInt32(&memoryConsumer.expirationEnforced) && isMessageExpired(message) {
+		atomic.AddUint64(&memoryConsumer.expiredCount, 1)
+
+		deadLettered := false
+		deadLetterTopic, _ := memoryConsumer.deadLetterTopic.Load().(string)
+		if "" != deadLetterTopic {
+			err := memoryConsumer.writeDeadLetter(deadLetterTopic, message, "EXPIRED")
+			if nil == err {
+				deadLettered = true
+				atomic.AddUint64(&memoryConsumer.deadLetteredCount, 1)
+			}
+		}
+
+		if nil != memoryConsumer.kafkaConsumerHandler {
+			memoryConsumer.kafkaConsumerHandler.MessageExpired(
+				memoryConsumer,
+				*message.TopicPartition.Topic,
+				message.TopicPartition.Partition,
+				message.TopicPartition.Offset.String(),
+				headers.senderID,
+				headers.receiverID,
+				headers.deliveryTime,
+				headers.expirationTime,
+				headers.messageType,
+				string(message.Value),
+				deadLettered)
+		}
+
+		if nil != acknowledgement {
+			acknowledgement.Ack()
+		}
+		return
+	}
+
+	if nil != acknowledgement {
+		memoryConsumer.committer.dispatch(acknowledgement)
+		return
+	}
+
+	if nil != memoryConsumer.kafkaConsumerHandler {
+		if dispatchDatagram(memoryConsumer, memoryConsumer.kafkaConsumerHandler, message, nil) {
+			return
+		}
+
+		memoryConsumer.kafkaConsumerHandler.MessageReceived(
+			memoryConsumer,
+			*message.TopicPartition.Topic,
+			message.TopicPartition.Partition,
+			message.TopicPartition.Offset.String(),
+			headers.senderID,
+			headers.receiverID,
+			headers.deliveryTime,
+			headers.expirationTime,
+			headers.messageType,
+			headers.correlationID,
+			headers.replyTopic,
+			string(message.Value))
+	}
+}
+
+// route the message to "topic", the original topic and "reason" are appended as headers the same as deadLetterWriter
+func (memoryConsumer *MemoryConsumer) writeDeadLetter(topic string, message *kafka.Message, reason string) error {
+	headers := make([]kafka.Header, 0, len(message.Headers)+2)
+	headers = append(headers, message.Headers...)
+	headers = append(headers,
+		kafka.Header{Key: HeaderOriginalTopic, Value: []byte(*message.TopicPartition.Topic)},
+		kafka.Header{Key: HeaderDeadLetter, Value: []byte(reason)})
+
+	_, err := memoryConsumer.broker.append(&kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+		Key:            message.Key,
+		Value:          message.Value,
+		Headers:        headers,
+	})
+
+	if nil != err {
+		return fmt.Errorf("FAILED TO DELIVER DEAD-LETTER: %+v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,583 @@
+package kafkaex
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+	"sercomm.com/demeter/commons/datetime"
+)
+
+// maximum duration to wait for asynchronous events of MemoryBroker
+const testTimeout = (time.Second * 3)
+
+type receivedMessage struct {
+	topic         string
+	senderID      string
+	receiverID    string
+	messageType   MessageType
+	correlationID string
+	replyTopic    string
+	message       string
+	expiration    int64
+}
+
+type expiredMessage struct {
+	topic        string
+	message      string
+	deadLettered bool
+}
+
+// recordingHandler is a ConsumerHandler which records events for assertions
+type recordingHandler struct {
+	messages chan receivedMessage
+	expired  chan expiredMessage
+	eof      chan string
+}
+
+func newRecordingHandler() *recordingHandler {
+	return &recordingHandler{
+		messages: make(chan receivedMessage, 64),
+		expired:  make(chan expiredMessage, 64),
+		eof:      make(chan string, 64),
+	}
+}
+
+func (handler *recordingHandler) MessageReceived(
+	kafkaConsumer Consumer,
+	topic string,
+	partition int32,
+	offset string,
+	senderID string,
+	receiverID string,
+	deliveryTime int64,
+	expirationTime int64,
+	messageType MessageType,
+	correlationID string,
+	replyTopic string,
+	message string) {
+
+	handler.messages <- receivedMessage{topic, senderID, receiverID, messageType, correlationID, replyTopic, message, expirationTime}
+}
+
+func (handler *recordingHandler) MessageExpired(
+	kafkaConsumer Consumer,
+	topic string,
+	partition int32,
+	offset string,
+	senderID string,
+	receiverID string,
+	deliveryTime int64,
+	expirationTime int64,
+	messageType MessageType,
+	message string,
+	deadLettered bool) {
+
+	handler.expired <- expiredMessage{topic, message, deadLettered}
+}
+
+func (handler *recordingHandler) PartitionsAssigned(kafkaConsumer Consumer, partitions []kafka.TopicPartition) {
+}
+
+func (handler *recordingHandler) PartitionsRevoked(kafkaConsumer Consumer, partitions []kafka.TopicPartition) {
+}
+
+func (handler *recordingHandler) PartitionEOF(kafkaConsumer Consumer, topic string, partition int32, offset string) {
+	handler.eof <- topic
+}
+
+func (handler *recordingHandler) ErrorOccurred(kafkaConsumer Consumer, errorCode kafka.ErrorCode, errorMessage string) {
+}
+
+func (handler *recordingHandler) Closed(kafkaConsumer Consumer) {
+}
+
+func (handler *recordingHandler) nextMessage(t *testing.T) receivedMessage {
+	t.Helper()
+
+	select {
+	case message := <-handler.messages:
+		return message
+	case <-time.After(testTimeout):
+		t.Fatal("no message was received")
+	}
+
+	return receivedMessage{}
+}
+
+func (handler *recordingHandler) nextExpired(t *testing.T) expiredMessage {
+	t.Helper()
+
+	select {
+	case message := <-handler.expired:
+		return message
+	case <-time.After(testTimeout):
+		t.Fatal("no message was expired")
+	}
+
+	return expiredMessage{}
+}
+
+// subscribe the topics which must exist, and wait until the consumer reached their ends
+func subscribe(t *testing.T, broker *MemoryBroker, groupName string, handler ConsumerHandler, eof chan string, topics ...string) Consumer {
+	t.Helper()
+
+	consumer, err := broker.NewConsumer(groupName, handler)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	return subscribeConsumer(t, consumer, eof, topics...)
+}
+
+// subscribe the topics by the consumer, and wait until it reached their ends
+func subscribeConsumer(t *testing.T, consumer Consumer, eof chan string, topics ...string) Consumer {
+	t.Helper()
+
+	err := consumer.SubscribeTopics(topics)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	for range topics {
+		select {
+		case <-eof:
+		case <-time.After(testTimeout):
+			t.Fatal("partitions were not assigned")
+		}
+	}
+
+	return consumer
+}
+
+// wait until the partition holds "count" messages
+func waitMessages(t *testing.T, broker *MemoryBroker, topic string, partition int32, count int) []*kafka.Message {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for {
+		messages, _ := broker.GetMessages(topic, partition)
+		if len(messages) >= count {
+			return messages
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d messages in '%s' but got %d", count, topic, len(messages))
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func newTestProducer(t *testing.T, broker *MemoryBroker) Producer {
+	t.Helper()
+
+	producer, err := broker.NewProducer(nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	return producer
+}
+
+func TestMemoryConsumerSeek(t *testing.T) {
+	broker := NewMemoryBroker(false, 1)
+	broker.CreateTopic("topic", 1)
+
+	handler := newRecordingHandler()
+	consumer := subscribe(t, broker, "group", handler, handler.eof, "topic")
+	defer consumer.Close()
+
+	producer := newTestProducer(t, broker)
+	defer producer.Close()
+
+	for _, message := range []string{"a", "b", "c"} {
+		producer.DeliverMessage("topic", 0, "sender", "receiver", MessageTypeRequest, message, 60000)
+		handler.nextMessage(t)
+	}
+
+	tests := []struct {
+		name      string
+		seek      func() error
+		invalid   bool
+		redeliver string
+	}{
+		{"offset", func() error { return consumer.SeekToOffset("topic", 0, 1) }, false, "b"},
+		{"timestamp", func() error { return consumer.SeekToTimestamp("topic", 0) }, false, "a"},
+		{"unassigned partition", func() error { return consumer.SeekToOffset("topic", 1, 0) }, true, ""},
+		{"unknown topic by offset", func() error { return consumer.SeekToOffset("unknown", 0, 0) }, true, ""},
+		{"unknown topic by timestamp", func() error { return consumer.SeekToTimestamp("unknown", 0) }, true, ""},
+	}
+
+	for _, test := range tests {
+		err := test.seek()
+		if test.invalid != (nil != err) {
+			t.Fatalf("%s: unexpected result %v", test.name, err)
+		}
+
+		if "" == test.redeliver {
+			continue
+		}
+
+		message := handler.nextMessage(t)
+		if message.message != test.redeliver {
+			t.Fatalf("%s: expected '%s' but got '%s'", test.name, test.redeliver, message.message)
+		}
+
+		// drain the rest of the partition
+		for "c" != message.message {
+			message = handler.nextMessage(t)
+		}
+	}
+}
+
+func TestMemoryConsumerSeekDeletedTopic(t *testing.T) {
+	broker := NewMemoryBroker(false, 1)
+	broker.CreateTopic("topic", 1)
+
+	handler := newRecordingHandler()
+	consumer := subscribe(t, broker, "group", handler, handler.eof, "topic")
+	defer consumer.Close()
+
+	// the partition stays assigned after deleting the topic
+	if err := broker.DeleteTopic("topic"); nil != err {
+		t.Fatal(err)
+	}
+
+	if err := consumer.SeekToOffset("topic", 0, 0); nil == err {
+		t.Error("seeking to the offset of a deleted topic should fail")
+	}
+
+	if err := consumer.SeekToTimestamp("topic", 0); nil == err {
+		t.Error("seeking to the timestamp of a deleted topic should fail")
+	}
+
+	if err := broker.DeleteTopic("unknown"); nil == err {
+		t.Error("deleting an unknown topic should fail")
+	}
+}
+
+func TestMemoryConsumerExpiration(t *testing.T) {
+	tests := []struct {
+		name               string
+		enforced           bool
+		deadLetterTopic    string
+		expirationInterval int64
+		overdue            bool // the message carries an expiration time which has passed
+		expired            bool
+		deadLettered       bool
+	}{
+		{"not enforced", false, "", 60000, true, false, false},
+		{"not expired", true, "", 60000, false, false, false},
+		{"without expiration", true, "", 0, false, false, false},
+		{"negative interval", true, "", -1000, false, false, false},
+		{"dropped", true, "", 60000, true, true, false},
+		{"dead-lettered", true, "dead-letter", 60000, true, true, true},
+	}
+
+	for _, test := range tests {
+		broker := NewMemoryBroker(true, 1)
+		broker.CreateTopic("topic", 1)
+
+		handler := newRecordingHandler()
+		consumer := subscribe(t, broker, "group", handler, handler.eof, "topic")
+
+		err := consumer.EnforceExpiration(test.enforced, test.deadLetterTopic)
+		if nil != err {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		var headers []kafka.Header
+		if test.overdue {
+			dateTime := datetime.Now()
+			headers = append(headers, kafka.Header{Key: HeaderExpirationTime, Value: int64ToBytes(dateTime.UnixTimestamp() - 1000)})
+		}
+
+		producer := newTestProducer(t, broker)
+		_, err = producer.DeliverAsync(OutboundMessage{
+			Topic:              "topic",
+			SenderID:           "sender",
+			ReceiverID:         "receiver",
+			MessageType:        MessageTypeRequest,
+			Message:            "payload",
+			ExpirationInterval: test.expirationInterval,
+			Headers:            headers,
+		}, nil)
+		if nil != err {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		if test.expired {
+			expired := handler.nextExpired(t)
+			if expired.deadLettered != test.deadLettered || "payload" != expired.message {
+				t.Errorf("%s: unexpected expiration %+v", test.name, expired)
+			}
+		} else if message := handler.nextMessage(t); "payload" != message.message {
+			t.Errorf("%s: unexpected message %+v", test.name, message)
+		} else if false == test.overdue && (test.expirationInterval > 0) != (0 != message.expiration) {
+			// messages sent without a positive interval are stamped with expiration time 0
+			t.Errorf("%s: unexpected expiration time %d", test.name, message.expiration)
+		}
+
+		expiredCount, deadLetteredCount := consumer.GetExpiredCount()
+		if (1 == expiredCount) != test.expired || (1 == deadLetteredCount) != test.deadLettered {
+			t.Errorf("%s: unexpected counts %d, %d", test.name, expiredCount, deadLetteredCount)
+		}
+
+		if test.deadLettered {
+			messages := waitMessages(t, broker, test.deadLetterTopic, 0, 1)
+
+			headers := map[string]string{}
+			for _, header := range messages[0].Headers {
+				headers[header.Key] = string(header.Value)
+			}
+
+			if "topic" != headers[HeaderOriginalTopic] || "EXPIRED" != headers[HeaderDeadLetter] || "payload" != string(messages[0].Value) {
+				t.Errorf("%s: unexpected dead-letter %+v", test.name, headers)
+			}
+		}
+
+		producer.Close()
+		consumer.Close()
+	}
+}
+
+// acknowledgingHandler settles messages by "behavior": "ack", "nack" or "hold" which never settles them
+type acknowledgingHandler struct {
+	*recordingHandler
+
+	behavior string
+	attempts chan int
+	errors   chan string
+}
+
+func newAcknowledgingHandler(behavior string) *acknowledgingHandler {
+	return &acknowledgingHandler{
+		recordingHandler: newRecordingHandler(),
+		behavior:         behavior,
+		attempts:         make(chan int, 64),
+		errors:           make(chan string, 64),
+	}
+}
+
+func (handler *acknowledgingHandler) MessageAcknowledgeable(
+	kafkaConsumer Consumer,
+	topic string,
+	partition int32,
+	offset string,
+	senderID string,
+	receiverID string,
+	deliveryTime int64,
+	expirationTime int64,
+	messageType MessageType,
+	correlationID string,
+	replyTopic string,
+	message string,
+	acknowledgement *Acknowledgement) {
+
+	handler.attempts <- acknowledgement.GetAttempt()
+
+	switch handler.behavior {
+	case "ack":
+		acknowledgement.Ack()
+	case "nack":
+		acknowledgement.Nack(errors.New("FAILED TO PROCESS"))
+	}
+}
+
+func (handler *acknowledgingHandler) ErrorOccurred(kafkaConsumer Consumer, errorCode kafka.ErrorCode, errorMessage string) {
+	select {
+	case handler.errors <- errorMessage:
+	default:
+	}
+}
+
+func TestMemoryConsumerCommitPolicy(t *testing.T) {
+	tests := []struct {
+		name            string
+		behavior        string
+		maxAttempts     int
+		deadLetterTopic string
+		attempts        int  // attempts of the message before checking the results
+		deadLettered    bool // the message was routed to "dead-letter"
+		errorRaised     bool
+		redelivered     bool // the message is consumed again by the next member of the group
+	}{
+		{"acknowledged", "ack", 0, "", 1, false, false, false},
+		{"in flight", "hold", 0, "", 1, false, false, true},
+		{"dropped", "nack", 2, "", 2, false, false, false},
+		{"dead-lettered", "nack", 3, "dead-letter", 3, true, false, false},
+		{"dead-letter failure is retried", "nack", 1, "missing", 2, false, true, true},
+	}
+
+	for _, test := range tests {
+		broker := NewMemoryBroker(false, 1)
+		broker.CreateTopic("topic", 1)
+		broker.CreateTopic("dead-letter", 1)
+
+		handler := newAcknowledgingHandler(test.behavior)
+		consumer, err := broker.NewConsumerWithCommitPolicy("group", handler, CommitPolicy{
+			MaxAttempts:     test.maxAttempts,
+			DeadLetterTopic: test.deadLetterTopic,
+		})
+		if nil != err {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		subscribeConsumer(t, consumer, handler.eof, "topic")
+
+		producer := newTestProducer(t, broker)
+		producer.DeliverMessage("topic", 0, "sender", "receiver", MessageTypeRequest, "payload", 0)
+
+		for attempt := 1; attempt <= test.attempts; attempt++ {
+			select {
+			case value := <-handler.attempts:
+				if attempt != value {
+					t.Errorf("%s: expected attempt %d but got %d", test.name, attempt, value)
+				}
+			case <-time.After(testTimeout):
+				t.Fatalf("%s: attempt %d was not dispatched", test.name, attempt)
+			}
+		}
+
+		if test.deadLettered {
+			messages := waitMessages(t, broker, test.deadLetterTopic, 0, 1)
+			for _, header := range messages[0].Headers {
+				if HeaderDeadLetter == header.Key && false == strings.HasPrefix(string(header.Value), "MAX ATTEMPTS EXCEEDED") {
+					t.Errorf("%s: unexpected reason '%s'", test.name, string(header.Value))
+				}
+			}
+		}
+
+		if test.errorRaised {
+			select {
+			case <-handler.errors:
+			case <-time.After(testTimeout):
+				t.Errorf("%s: no error was raised", test.name)
+			}
+		}
+
+		consumer.Close()
+
+		// the next member of the group begins at the committed offset
+		next := newAcknowledgingHandler("ack")
+		consumer, err = broker.NewConsumerWithCommitPolicy("group", next, CommitPolicy{})
+		if nil != err {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		subscribeConsumer(t, consumer, next.eof, "topic")
+
+		select {
+		case <-next.attempts:
+			if false == test.redelivered {
+				t.Errorf("%s: message was redelivered", test.name)
+			}
+		case <-time.After(time.Millisecond * 300):
+			if test.redelivered {
+				t.Errorf("%s: message was not redelivered", test.name)
+			}
+		}
+
+		consumer.Close()
+		producer.Close()
+	}
+}
+
+// legacyConsumerRecorder is a KafkaConsumerHandler of NewKafkaConsumer
+type legacyConsumerRecorder struct {
+	messages chan string
+	eof      chan string
+}
+
+func (recorder *legacyConsumerRecorder) MessageReceived(
+	kafkaConsumer *KafkaConsumer,
+	topic string,
+	partition int32,
+	offset string,
+	senderID string,
+	receiverID string,
+	deliveryTime int64,
+	expirationTime int64,
+	messageType MessageType,
+	message string) {
+
+	recorder.messages <- message
+}
+
+func (recorder *legacyConsumerRecorder) PartitionEOF(kafkaConsumer *KafkaConsumer, topic string, partition int32, offset string) {
+	recorder.eof <- topic
+}
+
+func (recorder *legacyConsumerRecorder) ErrorOccurred(kafkaConsumer *KafkaConsumer, errorCode kafka.ErrorCode, errorMessage string) {
+}
+
+func (recorder *legacyConsumerRecorder) Closed(kafkaConsumer *KafkaConsumer) {
+}
+
+// legacyProducerRecorder is a KafkaProducerHandler of NewKafkaProducer
+type legacyProducerRecorder struct {
+	delivered chan string
+	closed    chan bool
+}
+
+func (recorder *legacyProducerRecorder) MessageDeliveredResult(
+	kafkaProducer *KafkaProducer,
+	err error,
+	topic string,
+	partition int32,
+	offset string,
+	message string) {
+
+	recorder.delivered <- message
+}
+
+func (recorder *legacyProducerRecorder) ErrorOccurred(kafkaProducer *KafkaProducer, errorCode kafka.ErrorCode, errorMessage string) {
+}
+
+func (recorder *legacyProducerRecorder) Closed(kafkaProducer *KafkaProducer) {
+	recorder.closed <- true
+}
+
+func TestMemoryBrokerKafkaHandlers(t *testing.T) {
+	broker := NewMemoryBroker(false, 1)
+	broker.CreateTopic("topic", 1)
+
+	consumerRecorder := &legacyConsumerRecorder{make(chan string, 16), make(chan string, 16)}
+	consumer, err := broker.NewConsumerWithKafkaHandler("group", consumerRecorder)
+	if nil != err {
+		t.Fatal(err)
+	}
+	subscribeConsumer(t, consumer, consumerRecorder.eof, "topic")
+
+	producerRecorder := &legacyProducerRecorder{make(chan string, 16), make(chan bool, 1)}
+	producer, err := broker.NewProducerWithKafkaHandler(producerRecorder)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	err = producer.DeliverMessage("topic", 0, "sender", "receiver", MessageTypeRequest, "payload", 0)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	for _, events := range []chan string{producerRecorder.delivered, consumerRecorder.messages} {
+		select {
+		case message := <-events:
+			if "payload" != message {
+				t.Errorf("unexpected message '%s'", message)
+			}
+		case <-time.After(testTimeout):
+			t.Fatal("no message was received")
+		}
+	}
+
+	producer.Close()
+	consumer.Close()
+
+	select {
+	case <-producerRecorder.closed:
+	case <-time.After(testTimeout):
+		t.Fatal("producer was not closed")
+	}
+}
@@ -0,0 +1,337 @@
+package kafkaex
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+)
+
+// ClientOptions configures security and tuning of KafkaProducer, KafkaConsumer and KafkaAdmin.
+// Zero values keep the defaults of librdkafka, options which do not apply to the client are ignored
+type ClientOptions struct {
+	// security
+	SecurityProtocol       string // "plaintext", "ssl", "sasl_plaintext" or "sasl_ssl"
+	SaslMechanism          string // "PLAIN", "SCRAM-SHA-256" or "SCRAM-SHA-512"
+	SaslUsername           string
+	SaslPassword           string
+	SaslUsernameFile       string // file which contains the SASL username, it overrides SaslUsername
+	SaslPasswordFile       string // file which contains the SASL password, it overrides SaslPassword
+	SslCaLocation          string // CA certificate file for verifying the broker's certificate
+	SslCertificateLocation string // client's public key file
+	SslKeyLocation         string // client's private key file
+	SslKeyPassword         string
+	SslKeyPasswordFile     string // file which contains the private key passphrase, it overrides SslKeyPassword
+
+	// producer tuning
+	Acks              string // "0", "1", "all" or "-1"
+	CompressionCodec  string // "none", "gzip", "snappy", "lz4" or "zstd"
+	EnableIdempotence bool
+	LingerMs          int // delay to wait for messages to accumulate before sending a batch
+	BatchSize         int // maximum size (in bytes) of a batch
+	BatchNumMessages  int // maximum count of messages of a batch
+	DeliveryTimeoutMs int // "message.timeout.ms", deliveries fail if they are not acknowledged by then, default is 300000
+
+	// consumer tuning
+	AutoOffsetReset  string        // "earliest", "latest" or "none", default is "latest"
+	SessionTimeoutMs int           // default is 6000
+	CommitPolicy     *CommitPolicy // enables at-least-once processing, see CommitPolicy
+
+	// statistics
+	StatisticsIntervalMs int     // interval of librdkafka statistics, see KafkaStatisticsHandler, default is 0 (disabled)
+	Metrics              Metrics // receives gauges and counters of the client, e.g. a Prometheus exporter
+
+	// admin
+	AdminTimeoutMs int // duration of admin operations of KafkaAdmin, default is 5000 (60000 for deleting topics)
+
+	// arbitrary librdkafka properties, they are applied after the options above
+	Extra map[string]interface{}
+}
+
+// properties which are managed by this package and cannot be overridden by ClientOptions.Extra
+var reservedProperties = []string{
+	"bootstrap.servers",
+	"group.id",
+	"go.application.rebalance.enable",
+	"enable.partition.eof",
+	"go.delivery.reports",
+}
+
+func (options *ClientOptions) commonConfigMap(brokerAddr string) (kafka.ConfigMap, error) {
+	if "" == brokerAddr {
+		return nil, fmt.Errorf("INVALID OPTION 'bootstrap.servers': CANNOT BE BLANK")
+	}
+
+	configMap := kafka.ConfigMap{
+		"bootstrap.servers": brokerAddr,
+	}
+
+	if "" != options.SecurityProtocol {
+		err := validateEnum("security.protocol", strings.ToLower(options.SecurityProtocol), "plaintext", "ssl", "sasl_plaintext", "sasl_ssl")
+		if nil != err {
+			return nil, err
+		}
+		configMap["security.protocol"] = strings.ToLower(options.SecurityProtocol)
+	}
+
+	if "" != options.SaslMechanism {
+		err := validateEnum("sasl.mechanism", strings.ToUpper(options.SaslMechanism), "PLAIN", "SCRAM-SHA-256", "SCRAM-SHA-512")
+		if nil != err {
+			return nil, err
+		}
+		configMap["sasl.mechanism"] = strings.ToUpper(options.SaslMechanism)
+	}
+
+	username, err := readSecret("sasl.username", options.SaslUsername, options.SaslUsernameFile)
+	if nil != err {
+		return nil, err
+	}
+
+	password, err := readSecret("sasl.password", options.SaslPassword, options.SaslPasswordFile)
+	if nil != err {
+		return nil, err
+	}
+
+	if strings.HasPrefix(strings.ToLower(options.SecurityProtocol), "sasl") {
+		if "" == options.SaslMechanism {
+			return nil, fmt.Errorf("INVALID OPTION 'sasl.mechanism': REQUIRED BY SECURITY PROTOCOL '%s'", options.SecurityProtocol)
+		}
+
+		if "" == username || "" == password {
+			return nil, fmt.Errorf("INVALID OPTION 'sasl.username/sasl.password': REQUIRED BY SECURITY PROTOCOL '%s'", options.SecurityProtocol)
+		}
+	}
+
+	if "" != username {
+		configMap["sasl.username"] = username
+	}
+
+	if "" != password {
+		configMap["sasl.password"] = password
+	}
+
+	for _, location := range []struct {
+		key  string
+		path string
+	}{
+		{"ssl.ca.location", options.SslCaLocation},
+		{"ssl.certificate.location", options.SslCertificateLocation},
+		{"ssl.key.location", options.SslKeyLocation},
+	} {
+		if "" == location.path {
+			continue
+		}
+
+		if _, err := os.Stat(location.path); nil != err {
+			return nil, fmt.Errorf("INVALID OPTION '%s': %+v", location.key, err)
+		}
+		configMap[location.key] = location.path
+	}
+
+	keyPassword, err := readSecret("ssl.key.password", options.SslKeyPassword, options.SslKeyPasswordFile)
+	if nil != err {
+		return nil, err
+	}
+
+	if "" != keyPassword {
+		configMap["ssl.key.password"] = keyPassword
+	}
+
+	return configMap, nil
+}
+
+func (options *ClientOptions) producerConfigMap(brokerAddr string) (kafka.ConfigMap, error) {
+	configMap, err := options.commonConfigMap(brokerAddr)
+	if nil != err {
+		return nil, err
+	}
+
+	err = options.applyStatistics(configMap)
+	if nil != err {
+		return nil, err
+	}
+
+	configMap["session.timeout.ms"] = 6000 // 6s
+
+	if "" != options.Acks {
+		err = validateEnum("acks", options.Acks, "0", "1", "all", "-1")
+		if nil != err {
+			return nil, err
+		}
+		configMap["acks"] = options.Acks
+	}
+
+	if options.EnableIdempotence {
+		if "" != options.Acks && "all" != options.Acks && "-1" != options.Acks {
+			return nil, fmt.Errorf("INVALID OPTION 'acks': IDEMPOTENCE REQUIRES 'all' BUT '%s' IS GIVEN", options.Acks)
+		}
+		configMap["enable.idempotence"] = true
+	}
+
+	if "" != options.CompressionCodec {
+		err = validateEnum("compression.codec", strings.ToLower(options.CompressionCodec), "none", "gzip", "snappy", "lz4", "zstd")
+		if nil != err {
+			return nil, err
+		}
+		configMap["compression.codec"] = strings.ToLower(options.CompressionCodec)
+	}
+
+	for _, tuning := range []struct {
+		key     string
+		value   int
+		maximum int
+	}{
+		{"linger.ms", options.LingerMs, 900000},
+		{"batch.size", options.BatchSize, 2147483647},
+		{"batch.num.messages", options.BatchNumMessages, 1000000},
+		{"message.timeout.ms", options.DeliveryTimeoutMs, 2147483647},
+	} {
+		if 0 == tuning.value {
+			continue
+		}
+
+		if tuning.value < 0 || tuning.value > tuning.maximum {
+			return nil, fmt.Errorf("INVALID OPTION '%s': %d IS OUT OF RANGE [0, %d]", tuning.key, tuning.value, tuning.maximum)
+		}
+		configMap[tuning.key] = tuning.value
+	}
+
+	err = options.applyExtra(configMap)
+	if nil != err {
+		return nil, err
+	}
+
+	return configMap, nil
+}
+
+// deadLetterConfigMap holds the connection settings of a consumer, including Extra, for its dead-letter producers
+func (options *ClientOptions) deadLetterConfigMap(brokerAddr string) (kafka.ConfigMap, error) {
+	configMap, err := options.commonConfigMap(brokerAddr)
+	if nil != err {
+		return nil, err
+	}
+
+	err = options.applyExtra(configMap)
+	if nil != err {
+		return nil, err
+	}
+
+	return configMap, nil
+}
+
+func (options *ClientOptions) consumerConfigMap(brokerAddr string, groupName string) (kafka.ConfigMap, error) {
+	if "" == groupName {
+		return nil, fmt.Errorf("INVALID OPTION 'group.id': CANNOT BE BLANK")
+	}
+
+	configMap, err := options.commonConfigMap(brokerAddr)
+	if nil != err {
+		return nil, err
+	}
+
+	err = options.applyStatistics(configMap)
+	if nil != err {
+		return nil, err
+	}
+
+	configMap["group.id"] = groupName
+	configMap["go.application.rebalance.enable"] = true
+	configMap["enable.partition.eof"] = true // enable generation of PartitionEOF when the end of a partition is reached.
+	configMap["session.timeout.ms"] = 6000
+	configMap["auto.offset.reset"] = "latest"
+
+	if "" != options.AutoOffsetReset {
+		err = validateEnum("auto.offset.reset", strings.ToLower(options.AutoOffsetReset), "earliest", "latest", "none")
+		if nil != err {
+			return nil, err
+		}
+		configMap["auto.offset.reset"] = strings.ToLower(options.AutoOffsetReset)
+	}
+
+	if 0 != options.SessionTimeoutMs {
+		if options.SessionTimeoutMs < 1 || options.SessionTimeoutMs > 3600000 {
+			return nil, fmt.Errorf("INVALID OPTION 'session.timeout.ms': %d IS OUT OF RANGE [1, 3600000]", options.SessionTimeoutMs)
+		}
+		configMap["session.timeout.ms"] = options.SessionTimeoutMs
+	}
+
+	if nil != options.CommitPolicy {
+		err = options.CommitPolicy.validate()
+		if nil != err {
+			return nil, err
+		}
+
+		// offsets will be committed by KafkaConsumer.commit
+		configMap["enable.auto.commit"] = false
+	}
+
+	err = options.applyExtra(configMap)
+	if nil != err {
+		return nil, err
+	}
+
+	if nil != options.CommitPolicy {
+		if value, ok := configMap["enable.auto.commit"].(bool); false == ok || value {
+			return nil, fmt.Errorf("INVALID OPTION 'enable.auto.commit': CONFLICTS WITH COMMIT POLICY")
+		}
+	}
+
+	return configMap, nil
+}
+
+// statistics are only enabled for producers and consumers, since other clients (e.g. dead-letter producers) never handle them
+func (options *ClientOptions) applyStatistics(configMap kafka.ConfigMap) error {
+	if 0 == options.StatisticsIntervalMs {
+		return nil
+	}
+
+	if options.StatisticsIntervalMs < 0 || options.StatisticsIntervalMs > 86400000 {
+		return fmt.Errorf("INVALID OPTION 'statistics.interval.ms': %d IS OUT OF RANGE [0, 86400000]", options.StatisticsIntervalMs)
+	}
+	configMap["statistics.interval.ms"] = options.StatisticsIntervalMs
+
+	return nil
+}
+
+func (options *ClientOptions) applyExtra(configMap kafka.ConfigMap) error {
+	for key, value := range options.Extra {
+		for _, reserved := range reservedProperties {
+			if key == reserved {
+				return fmt.Errorf("INVALID OPTION '%s': RESERVED BY kafkaex", key)
+			}
+		}
+
+		err := configMap.SetKey(key, value)
+		if nil != err {
+			return fmt.Errorf("INVALID OPTION '%s': %+v", key, err)
+		}
+	}
+
+	return nil
+}
+
+func validateEnum(key string, value string, candidates ...string) error {
+	for _, candidate := range candidates {
+		if value == candidate {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("INVALID OPTION '%s': UNSUPPORTED VALUE '%s', EXPECTED ONE OF %v", key, value, candidates)
+}
+
+// readSecret returns the content of "file" without leading and trailing spaces if "file" is given, otherwise "value"
+func readSecret(key string, value string, file string) (string, error) {
+	if "" == file {
+		return value, nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if nil != err {
+		return "", fmt.Errorf("INVALID OPTION '%s': UNABLE TO READ '%s': %+v", key, file, err)
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
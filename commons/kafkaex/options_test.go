@@ -0,0 +1,33 @@
+package kafkaex
+
+import (
+	"testing"
+)
+
+func TestDeadLetterConfigMap(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  ClientOptions
+		invalid  bool
+		expected map[string]interface{}
+	}{
+		{"default", ClientOptions{}, false, map[string]interface{}{"bootstrap.servers": "localhost:9092"}},
+		{"security", ClientOptions{SecurityProtocol: "SSL"}, false, map[string]interface{}{"security.protocol": "ssl"}},
+		{"extra", ClientOptions{Extra: map[string]interface{}{"ssl.ca.location": "/etc/ca.pem", "client.id": "agent"}}, false, map[string]interface{}{"ssl.ca.location": "/etc/ca.pem", "client.id": "agent"}},
+		{"reserved extra", ClientOptions{Extra: map[string]interface{}{"bootstrap.servers": "elsewhere:9092"}}, true, nil},
+	}
+
+	for _, test := range tests {
+		configMap, err := test.options.deadLetterConfigMap("localhost:9092")
+		if test.invalid != (nil != err) {
+			t.Errorf("%s: unexpected result %v", test.name, err)
+			continue
+		}
+
+		for key, value := range test.expected {
+			if configMap[key] != value {
+				t.Errorf("%s: expected '%s' to be %v but got %v", test.name, key, value, configMap[key])
+			}
+		}
+	}
+}
@@ -4,17 +4,51 @@ import (
 	"context"
 	"fmt"
 	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
-	"sercomm.com/demeter/commons/datetime"
 	"time"
 )
 
+const (
+	// default "message.timeout.ms" of librdkafka
+	defaultDeliveryTimeoutMs int = 300000
+	// extra duration which synchronous deliveries wait for librdkafka to report a timed out message
+	deliveryTimeoutMargin = (time.Second * 5)
+	// interval of retrying to enqueue a message while the queue of librdkafka is full
+	queueFullBackoff = (time.Millisecond * 10)
+)
+
 type KafkaProducer struct {
 	terminated           chan bool
 	producer             *kafka.Producer
-	kafkaProducerHandler KafkaProducerHandler
+	kafkaProducerHandler ProducerHandler
+	inflight             *inflightSet  // messages whose delivery results are still unknown
+	deliveryTimeout      time.Duration // maximum duration of synchronous deliveries
+	metrics              Metrics
+	name                 string // name of the librdkafka instance, for labelling metrics
 	Properties           map[string]interface{}
 }
 
+// ProducerHandler receives delivery results and events of a Producer, it is the handler of producers created by a ClientFactory
+// or NewKafkaProducerWithOptions. Handlers written for NewKafkaProducer implement KafkaProducerHandler instead
+type ProducerHandler interface {
+	// "err" indicates if the message was delivered successfully or not
+	MessageDeliveredResult(
+		kafkaProducer Producer,
+		err error,
+		topic string,
+		partition int32,
+		offset string,
+		message string)
+	// these errors should generally be considered informational
+	// the client will try to automatically recover
+	ErrorOccurred(
+		kafkaProducer Producer,
+		errorCode kafka.ErrorCode,
+		errorMessage string)
+	// kafka session was terminated
+	Closed(kafkaProducer Producer)
+}
+
+// KafkaProducerHandler is the handler of NewKafkaProducer and MemoryBroker.NewProducerWithKafkaHandler
 type KafkaProducerHandler interface {
 	// "err" indicates if the message was delivered successfully or not
 	MessageDeliveredResult(
@@ -35,19 +69,42 @@ type KafkaProducerHandler interface {
 }
 
 func NewKafkaProducer(brokerAddr string, kafkaProducerHandler KafkaProducerHandler) (*KafkaProducer, error) {
-	producer, err := kafka.NewProducer(&kafka.ConfigMap{
-		"bootstrap.servers":  brokerAddr,
-		"session.timeout.ms": 6000, // 6s
-	})
+	var handler ProducerHandler
+	if nil != kafkaProducerHandler {
+		handler = &legacyProducerHandler{kafkaProducerHandler}
+	}
+
+	return NewKafkaProducerWithOptions(brokerAddr, handler, ClientOptions{})
+}
 
+// NewKafkaProducerWithOptions creates a producer with security and tuning "options",
+// invalid options are reported before connecting to the broker
+func NewKafkaProducerWithOptions(brokerAddr string, kafkaProducerHandler ProducerHandler, options ClientOptions) (*KafkaProducer, error) {
+	configMap, err := options.producerConfigMap(brokerAddr)
 	if nil != err {
 		return nil, fmt.Errorf("FAILED TO CREATE PRODUCER: %+v", err)
 	}
 
+	producer, err := kafka.NewProducer(&configMap)
+
+	if nil != err {
+		return nil, fmt.Errorf("FAILED TO CREATE PRODUCER: %+v", err)
+	}
+
+	// "message.timeout.ms" may be given by ClientOptions.Extra as well
+	deliveryTimeoutMs := defaultDeliveryTimeoutMs
+	if value, ok := configMap["message.timeout.ms"].(int); ok && value > 0 {
+		deliveryTimeoutMs = value
+	}
+
 	kafkaProducer := &KafkaProducer{
 		terminated:           make(chan bool),
 		producer:             producer,
 		kafkaProducerHandler: kafkaProducerHandler,
+		inflight:             newInflightSet(),
+		deliveryTimeout:      time.Duration(deliveryTimeoutMs)*time.Millisecond + deliveryTimeoutMargin,
+		metrics:              options.Metrics,
+		name:                 producer.String(),
 		Properties:           make(map[string]interface{}),
 	}
 
@@ -72,10 +129,29 @@ func NewKafkaProducer(brokerAddr string, kafkaProducerHandler KafkaProducerHandl
 						entity.TopicPartition.Partition,
 						entity.TopicPartition.Offset.String(),
 						string(entity.Value))
+				}
+
+				topicLabels := map[string]string{"client": kafkaProducer.name, "topic": *entity.TopicPartition.Topic}
+				if nil == entity.TopicPartition.Error {
+					countMetric(kafkaProducer.metrics, MetricMessagesOut, topicLabels)
+				} else {
+					countMetric(kafkaProducer.metrics, MetricDeliveryFailures, topicLabels)
+				}
 
-					if nil != entity.Opaque {
-						close((entity.Opaque).(chan bool))
-					}
+				if future, ok := entity.Opaque.(*DeliveryFuture); ok {
+					kafkaProducer.inflight.remove(future)
+					future.resolve(
+						entity.TopicPartition.Partition,
+						entity.TopicPartition.Offset.String(),
+						entity.TopicPartition.Error)
+				}
+			case *kafka.Stats:
+				err := handleStatistics(entity.String(), kafkaProducer.metrics, kafkaProducer.kafkaProducerHandler)
+				if nil != err && nil != kafkaProducer.kafkaProducerHandler {
+					kafkaProducer.kafkaProducerHandler.ErrorOccurred(
+						kafkaProducer,
+						kafka.ErrBadMsg,
+						err.Error())
 				}
 			case kafka.Error:
 				if nil != kafkaProducer.kafkaProducerHandler {
@@ -91,170 +167,270 @@ func NewKafkaProducer(brokerAddr string, kafkaProducerHandler KafkaProducerHandl
 	return kafkaProducer, nil
 }
 
+// Close closes the producer, futures of messages which are still in-flight are resolved with an error
 func (kafkaProducer *KafkaProducer) Close() {
 	if nil != kafkaProducer.producer {
 		kafkaProducer.producer.Close()
 	}
 
 	_ = <-kafkaProducer.terminated
-}
 
-func (kafkaProducer *KafkaProducer) CreateTopic(topic string, partitionCount int) error {
-	if nil == kafkaProducer.producer {
-		return fmt.Errorf("INVALID INSTANCE")
+	// the event routine has stopped, delivery results of these messages will never be reported
+	for _, future := range kafkaProducer.inflight.drain() {
+		future.resolve(future.message.Partition, kafka.OffsetInvalid.String(), fmt.Errorf("PRODUCER IS CLOSED"))
 	}
+}
 
-	adminClient, err := kafka.NewAdminClientFromProducer(kafkaProducer.producer)
+func (kafkaProducer *KafkaProducer) CreateTopic(topic string, partitionCount int) error {
+	admin, err := newKafkaAdminFromProducer(kafkaProducer.producer)
 	if nil != err {
 		return err
 	}
-	defer adminClient.Close()
-
-	// contexts are used to abort or limit the amount of time
-	// the admin-call blocks waiting for a result
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	defer admin.Close()
 
-	// duration is 5s defined by Cloud
-	maxDuration := (time.Second * 5)
-
-	results, err := adminClient.CreateTopics(
-		ctx,
-		// multiple topics can be created simultaneously
-		// by providing more TopicSpecification structs here.
-		[]kafka.TopicSpecification{{
-			Topic:             topic,
-			NumPartitions:     partitionCount,
-			ReplicationFactor: 1}},
-		kafka.SetAdminOperationTimeout(maxDuration))
-
-	if err != nil {
-		return fmt.Errorf("FAILED TO CREATE TOPIC: %+v", err)
-	}
-
-	for _, result := range results {
-		if result.Error.Code() != kafka.ErrNoError {
-			err = fmt.Errorf("ERROR RETURNED WHEN CREATING TOPIC: %+v", result.Error)
-			return err
-		}
-	}
-
-	return nil
+	return admin.CreateTopic(topic, partitionCount)
 }
 
 func (kafkaProducer *KafkaProducer) DescribeTopic(topic string) (map[string]kafka.ConfigEntryResult, error) {
-	if nil == kafkaProducer.producer {
-		return nil, fmt.Errorf("INVALID INSTANCE")
+	admin, err := newKafkaAdminFromProducer(kafkaProducer.producer)
+	if nil != err {
+		return nil, err
 	}
+	defer admin.Close()
+
+	return admin.DescribeTopic(topic)
+}
 
-	adminClient, err := kafka.NewAdminClientFromProducer(kafkaProducer.producer)
+func (kafkaProducer *KafkaProducer) DeleteTopic(topic string) error {
+	admin, err := newKafkaAdminFromProducer(kafkaProducer.producer)
 	if nil != err {
-		return nil, err
+		return err
 	}
-	defer adminClient.Close()
+	defer admin.Close()
 
-	// contexts are used to abort or limit the amount of time
-	// the admin-call blocks waiting for a result
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	return admin.DeleteTopic(topic)
+}
+
+func (kafkaProducer *KafkaProducer) DeliverMessage(
+	topic string,
+	partition int32,
+	senderID string,
+	receiverID string,
+	messageType MessageType,
+	message string,
+	expirationInterval int64) error {
 
-	// duration is 5s defined by Cloud
-	maxDuration := (time.Second * 5)
+	return kafkaProducer.DeliverCorrelatedMessage(
+		topic,
+		partition,
+		"",
+		senderID,
+		receiverID,
+		messageType,
+		"",
+		"",
+		message,
+		expirationInterval)
+}
+
+// DeliverCorrelatedMessage delivers a message which belongs to a request/response exchange.
+// "key" is the message key, e.g. device serial number, messages with the same key land on the same partition when "partition" is kafka.PartitionAny.
+// "correlationID" is shared by a request and its response, "replyTopic" is where the response of a request is expected to be delivered.
+// It waits for the delivery result at most ClientOptions.DeliveryTimeoutMs, use DeliverAsync to wait with a context
+func (kafkaProducer *KafkaProducer) DeliverCorrelatedMessage(
+	topic string,
+	partition int32,
+	key string,
+	senderID string,
+	receiverID string,
+	messageType MessageType,
+	correlationID string,
+	replyTopic string,
+	message string,
+	expirationInterval int64) error {
 
-	// query cluster for the resource's current configuration
-	results, err := adminClient.DescribeConfigs(
-		ctx,
-		[]kafka.ConfigResource{{Type: kafka.ResourceTopic, Name: topic}},
-		kafka.SetAdminRequestTimeout(maxDuration))
+	future, err := kafkaProducer.DeliverAsync(OutboundMessage{
+		Topic:              topic,
+		Partition:          partition,
+		Key:                key,
+		SenderID:           senderID,
+		ReceiverID:         receiverID,
+		MessageType:        messageType,
+		CorrelationID:      correlationID,
+		ReplyTopic:         replyTopic,
+		Message:            message,
+		ExpirationInterval: expirationInterval,
+	}, nil)
 
 	if nil != err {
-		return nil, fmt.Errorf("FAILED TO DESCRIBE TOPIC: %+v", err)
+		return err
 	}
 
-	for _, result := range results {
-		if result.Error.Code() != kafka.ErrNoError {
-			err = fmt.Errorf("ERROR RETURNED WHEN DESCRIBING TOPIC: %+v", result.Error)
-			return nil, err
-		}
+	ctx, cancel := context.WithTimeout(context.Background(), kafkaProducer.deliveryTimeout)
+	defer cancel()
 
-		return result.Config, nil
+	_, err = future.Wait(ctx)
+	if nil != err && nil != ctx.Err() {
+		return fmt.Errorf("FAILED TO DELIVER MESSAGE: %+v", err)
 	}
 
-	return nil, fmt.Errorf("FAILED TO DESCRIBE TOPIC: RESULTS IS EMPTY")
+	return err
 }
 
-func (kafkaProducer *KafkaProducer) DeleteTopic(topic string) error {
+// DeliverKeyedMessage delivers a message to the partition which is chosen by "key", e.g. device serial number
+func (kafkaProducer *KafkaProducer) DeliverKeyedMessage(
+	topic string,
+	key string,
+	senderID string,
+	receiverID string,
+	messageType MessageType,
+	message string,
+	expirationInterval int64) error {
+
+	return kafkaProducer.DeliverCorrelatedMessage(
+		topic,
+		kafka.PartitionAny,
+		key,
+		senderID,
+		receiverID,
+		messageType,
+		"",
+		"",
+		message,
+		expirationInterval)
+}
+
+// DeliverAsync enqueues the message without waiting for its delivery.
+// The returned future is resolved, and "callback" is invoked from the event routine if it is not nil,
+// once the delivery result is known. It blocks while the queue of librdkafka is full,
+// and an error is returned if the message cannot be enqueued, e.g. the producer is closed
+func (kafkaProducer *KafkaProducer) DeliverAsync(message OutboundMessage, callback func(report DeliveryReport)) (*DeliveryFuture, error) {
 	if nil == kafkaProducer.producer {
-		return fmt.Errorf("INVALID INSTANCE")
+		return nil, fmt.Errorf("INVALID INSTANCE")
 	}
 
-	adminClient, err := kafka.NewAdminClientFromProducer(kafkaProducer.producer)
-	if nil != err {
-		return err
+	headers := buildHeaders(
+		message.SenderID,
+		message.ReceiverID,
+		message.MessageType,
+		message.CorrelationID,
+		message.ReplyTopic,
+		message.ExpirationInterval)
+	headers = append(headers, message.Headers...)
+
+	var keyBytes []byte
+	if "" != message.Key {
+		keyBytes = []byte(message.Key)
 	}
-	defer adminClient.Close()
 
-	// contexts are used to abort or limit the amount of time
-	// the admin-call blocks waiting for a result
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	future := newDeliveryFuture(message, callback)
+	kafkaProducer.inflight.add(future)
 
-	// duration is 60s defined by Cloud
-	maxDuration := (time.Second * 60)
+	topic := message.Topic
+	err := kafkaProducer.produce(&kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: message.Partition},
+		Key:            keyBytes,
+		Value:          []byte(message.Message),
+		Opaque:         future,
+		Headers:        headers,
+	})
 
-	topics := []string{
-		topic,
+	if nil != err {
+		kafkaProducer.inflight.remove(future)
+		return nil, fmt.Errorf("FAILED TO ENQUEUE MESSAGE: %+v", err)
 	}
 
-	results, err := adminClient.DeleteTopics(ctx, topics, kafka.SetAdminOperationTimeout(maxDuration))
-	if err != nil {
-		return fmt.Errorf("FAILED TO DELETE TOPIC: %+v", err)
-	}
+	return future, nil
+}
 
-	for _, result := range results {
-		if result.Error.Code() != kafka.ErrNoError {
-			err = fmt.Errorf("ERROR RETURNED WHEN CREATING TOPIC: %+v", result.Error)
+// enqueue the message, it keeps retrying while the queue of librdkafka is full until the producer is closed
+func (kafkaProducer *KafkaProducer) produce(message *kafka.Message) error {
+	for {
+		err := kafkaProducer.producer.Produce(message, nil)
+		if kafkaErr, ok := err.(kafka.Error); false == ok || kafka.ErrQueueFull != kafkaErr.Code() {
 			return err
 		}
-	}
 
-	return nil
+		select {
+		case <-kafkaProducer.terminated:
+			return err
+		case <-time.After(queueFullBackoff):
+		}
+	}
 }
 
-func (kafkaProducer *KafkaProducer) DeliverMessage(
-	topic string,
-	partition int32,
-	senderID string,
-	receiverID string,
-	messageType MessageType,
-	message string,
-	expirationInterval int64) error {
+// DeliverBatch enqueues all messages without waiting for their deliveries.
+// It stops at the first message which cannot be enqueued, and returns futures of the enqueued messages with the error
+func (kafkaProducer *KafkaProducer) DeliverBatch(messages []OutboundMessage, callback func(report DeliveryReport)) ([]*DeliveryFuture, error) {
+	futures := make([]*DeliveryFuture, 0, len(messages))
+	for _, message := range messages {
+		future, err := kafkaProducer.DeliverAsync(message, callback)
+		if nil != err {
+			return futures, err
+		}
+		futures = append(futures, future)
+	}
 
+	return futures, nil
+}
+
+// Flush waits for all enqueued messages to be delivered.
+// If "ctx" is done before that, messages whose delivery results are still unknown are returned with the error
+func (kafkaProducer *KafkaProducer) Flush(ctx context.Context) ([]OutboundMessage, error) {
 	if nil == kafkaProducer.producer {
-		return fmt.Errorf("INVALID INSTANCE")
+		return nil, fmt.Errorf("INVALID INSTANCE")
 	}
 
-	dateTime := datetime.Now()
-	deliveryTime := dateTime.UnixTimestamp()
-	expirationTime := deliveryTime + expirationInterval
+	for 0 != kafkaProducer.inflight.size() {
+		select {
+		case <-ctx.Done():
+			return kafkaProducer.inflight.pending(), fmt.Errorf("FAILED TO FLUSH: %+v", ctx.Err())
+		default:
+		}
 
-	headers := []kafka.Header{
-		{Key: HeaderSenderID, Value: []byte(senderID)},
-		{Key: HeaderReceiverID, Value: []byte(receiverID)},
-		{Key: HeaderDeliveryTime, Value: []byte(int64ToBytes(deliveryTime))},
-		{Key: HeaderExpirationTime, Value: []byte(int64ToBytes(expirationTime))},
-		{Key: HeaderMessageType, Value: []byte(messageType.String())},
+		// flush librdkafka's queue in small steps, so that "ctx" is checked frequently
+		if 0 == kafkaProducer.producer.Flush(100) {
+			// delivery reports are being handled by the event routine
+			time.Sleep(time.Millisecond * 10)
+		}
 	}
 
-	blocker := make(chan bool)
-	kafkaProducer.producer.ProduceChannel() <- &kafka.Message{
-		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: partition},
-		Value:          []byte(message),
-		Opaque:         blocker,
-		Headers:        headers,
-	}
+	return nil, nil
+}
 
-	_ = <-blocker
+// legacyProducerHandler adapts a KafkaProducerHandler to ProducerHandler
+type legacyProducerHandler struct {
+	handler KafkaProducerHandler
+}
 
-	return nil
+// the KafkaProducer which raised the event, nil if the Producer is not a KafkaProducer, e.g. a MemoryProducer
+func asKafkaProducer(kafkaProducer Producer) *KafkaProducer {
+	instance, _ := kafkaProducer.(*KafkaProducer)
+	return instance
+}
+
+func (legacy *legacyProducerHandler) MessageDeliveredResult(
+	kafkaProducer Producer,
+	err error,
+	topic string,
+	partition int32,
+	offset string,
+	message string) {
+
+	legacy.handler.MessageDeliveredResult(asKafkaProducer(kafkaProducer), err, topic, partition, offset, message)
+}
+
+func (legacy *legacyProducerHandler) ErrorOccurred(kafkaProducer Producer, errorCode kafka.ErrorCode, errorMessage string) {
+	legacy.handler.ErrorOccurred(asKafkaProducer(kafkaProducer), errorCode, errorMessage)
+}
+
+func (legacy *legacyProducerHandler) Closed(kafkaProducer Producer) {
+	legacy.handler.Closed(asKafkaProducer(kafkaProducer))
+}
+
+// StatisticsReceived forwards statistics if the KafkaProducerHandler implements KafkaStatisticsHandler
+func (legacy *legacyProducerHandler) StatisticsReceived(statistics *Statistics) {
+	if statisticsHandler, ok := legacy.handler.(KafkaStatisticsHandler); ok {
+		statisticsHandler.StatisticsReceived(statistics)
+	}
 }
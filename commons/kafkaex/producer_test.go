@@ -0,0 +1,127 @@
+package kafkaex
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+)
+
+// address where no broker is listening, so that deliveries never complete
+const unreachableBroker = "127.0.0.1:1"
+
+func newUnreachableProducer(t *testing.T, deliveryTimeoutMs int) *KafkaProducer {
+	t.Helper()
+
+	producer, err := NewKafkaProducerWithOptions(unreachableBroker, nil, ClientOptions{DeliveryTimeoutMs: deliveryTimeoutMs})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	return producer
+}
+
+func TestDeliveryFuture(t *testing.T) {
+	tests := []struct {
+		name     string
+		resolved bool
+		err      error
+	}{
+		{"delivered", true, nil},
+		{"failed", true, errors.New("FAILED")},
+		{"pending", false, nil},
+	}
+
+	for _, test := range tests {
+		reports := make(chan DeliveryReport, 1)
+		future := newDeliveryFuture(OutboundMessage{Topic: "topic"}, func(report DeliveryReport) {
+			reports <- report
+		})
+
+		if test.resolved {
+			future.resolve(1, "2", test.err)
+
+			select {
+			case report := <-reports:
+				if 1 != report.Partition || "2" != report.Offset || test.err != report.Err || "topic" != report.Message.Topic {
+					t.Errorf("%s: unexpected report %+v", test.name, report)
+				}
+			default:
+				t.Errorf("%s: callback was not invoked", test.name)
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+		_, err := future.Wait(ctx)
+		cancel()
+
+		switch {
+		case test.resolved && err != test.err:
+			t.Errorf("%s: expected %v but got %v", test.name, test.err, err)
+		case false == test.resolved && context.DeadlineExceeded != err:
+			t.Errorf("%s: expected deadline but got %v", test.name, err)
+		}
+	}
+}
+
+func TestKafkaProducerFlush(t *testing.T) {
+	producer := newUnreachableProducer(t, 0)
+	defer producer.Close()
+
+	_, err := producer.DeliverBatch([]OutboundMessage{
+		{Topic: "topic", Partition: kafka.PartitionAny, Message: "first"},
+		{Topic: "topic", Partition: kafka.PartitionAny, Message: "second"},
+	}, nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+
+	pending, err := producer.Flush(ctx)
+	if nil == err || 2 != len(pending) {
+		t.Fatalf("expected 2 pending messages but got %d, %v", len(pending), err)
+	}
+}
+
+func TestKafkaProducerCloseFailsFutures(t *testing.T) {
+	producer := newUnreachableProducer(t, 0)
+
+	future, err := producer.DeliverAsync(OutboundMessage{Topic: "topic", Partition: kafka.PartitionAny, Message: "payload"}, nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	producer.Close()
+
+	select {
+	case <-future.Done():
+		if report, _ := future.Wait(context.Background()); nil == report.Err {
+			t.Fatal("future of an undelivered message succeeded")
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("future was not resolved by closing")
+	}
+}
+
+func TestKafkaProducerDeliveryTimeout(t *testing.T) {
+	producer := newUnreachableProducer(t, 100)
+	defer producer.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- producer.DeliverMessage("topic", kafka.PartitionAny, "sender", "receiver", MessageTypeRequest, "payload", 0)
+	}()
+
+	select {
+	case err := <-done:
+		if nil == err {
+			t.Fatal("message was delivered without broker")
+		}
+	case <-time.After(producer.deliveryTimeout + time.Second):
+		t.Fatal("delivery did not time out")
+	}
+}
@@ -0,0 +1,325 @@
+package kafkaex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	cmap "github.com/orcaman/concurrent-map"
+	"go.uber.org/zap"
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+	"sercomm.com/demeter/commons/datetime"
+	"sercomm.com/demeter/commons/logger"
+	"sercomm.com/demeter/commons/util"
+)
+
+// default expiration interval (in milliseconds) of a request if its context has no deadline
+const defaultRequestExpiration int64 = 15000
+
+// how long NewRpcClientWithFactory waits for the reply topic to be consumed from its end
+const replyReadyTimeout = 30 * time.Second
+
+var (
+	// ErrRequestTimeout is returned by RpcClient.Request when no response arrived before the request expired
+	ErrRequestTimeout = errors.New("REQUEST TIMEOUT")
+	// ErrClientClosed is returned by RpcClient.Request when the client was closed while waiting for the response
+	ErrClientClosed = errors.New("CLIENT CLOSED")
+)
+
+// RpcResponse is the response correlated to a request
+type RpcResponse struct {
+	SenderID       string
+	DeliveryTime   int64
+	ExpirationTime int64
+	Message        string
+}
+
+// RpcClient performs request/response exchanges over Kafka.
+// Requests are delivered to the request topic with a correlation ID, and the responders
+// are expected to deliver the response with the same correlation ID to the reply topic of this instance
+type RpcClient struct {
+	instanceID   string
+	requestTopic string
+	replyTopic   string
+	producer     Producer
+	consumer     Consumer
+	pendingMap   cmap.ConcurrentMap // pair< correlation ID, chan *RpcResponse >
+	terminated   chan bool
+	ready        chan bool // closed once the position of the reply topic is established
+	readyOnce    sync.Once
+}
+
+// NewRpcClient creates a client which is identified by "instanceID", its responses
+// are consumed from the reply topic "rpc-reply-<instanceID>" which will be created if necessary
+func NewRpcClient(brokerAddr string, instanceID string, requestTopic string) (*RpcClient, error) {
+	return NewRpcClientWithFactory(NewClientFactory(brokerAddr), instanceID, requestTopic)
+}
+
+// NewRpcClientWithFactory creates a client whose Kafka clients are created by "factory", e.g. a MemoryBroker
+func NewRpcClientWithFactory(factory ClientFactory, instanceID string, requestTopic string) (*RpcClient, error) {
+	if "" == instanceID {
+		return nil, fmt.Errorf("'instanceID' CANNOT BE BLANK")
+	}
+
+	rpcClient := &RpcClient{
+		instanceID:   instanceID,
+		requestTopic: requestTopic,
+		replyTopic:   "rpc-reply-" + instanceID,
+		pendingMap:   cmap.New(),
+		terminated:   make(chan bool),
+		ready:        make(chan bool),
+	}
+
+	producer, err := factory.NewProducer(&rpcProducerHandler{rpcClient})
+	if nil != err {
+		return nil, err
+	}
+
+	consumer, err := factory.NewConsumer("rpc-"+instanceID, &rpcConsumerHandler{rpcClient})
+	if nil != err {
+		producer.Close()
+		return nil, err
+	}
+
+	// the topic may exist already
+	err = consumer.CreateTopic(rpcClient.replyTopic, 1)
+	if nil != err {
+		logger.New().Debug("kafka: CANNOT CREATE REPLY TOPIC", zap.String("topic", rpcClient.replyTopic), zap.Error(err))
+	}
+
+	err = consumer.SubscribeTopics([]string{rpcClient.replyTopic})
+	if nil != err {
+		consumer.Close()
+		producer.Close()
+		return nil, err
+	}
+
+	// new groups begin at the end of partitions, responses delivered before the position of
+	// the reply topic is established would be skipped, hence wait for the end of the reply topic
+	select {
+	case <-rpcClient.ready:
+	case <-time.After(replyReadyTimeout):
+		consumer.Close()
+		producer.Close()
+		return nil, fmt.Errorf("REPLY TOPIC '%s' IS NOT READY", rpcClient.replyTopic)
+	}
+
+	rpcClient.producer = producer
+	rpcClient.consumer = consumer
+
+	return rpcClient, nil
+}
+
+// GetReplyTopic returns the topic where responses of this instance are delivered
+func (rpcClient *RpcClient) GetReplyTopic() string {
+	return rpcClient.replyTopic
+}
+
+// Close releases the Kafka clients, pending requests will fail with ErrClientClosed
+func (rpcClient *RpcClient) Close() {
+	select {
+	case <-rpcClient.terminated:
+		return
+	default:
+		close(rpcClient.terminated)
+	}
+
+	rpcClient.consumer.Close()
+	rpcClient.producer.Close()
+}
+
+// Request delivers "payload" to "receiverID" and waits for the correlated response.
+// The request expires at the deadline of "ctx", or after 15 seconds if "ctx" has no deadline,
+// and ErrRequestTimeout is returned if no response arrived by then
+func (rpcClient *RpcClient) Request(ctx context.Context, receiverID string, payload string) (*RpcResponse, error) {
+	expirationInterval := defaultRequestExpiration
+	if deadline, ok := ctx.Deadline(); ok {
+		expirationInterval = int64(time.Until(deadline) / time.Millisecond)
+		if expirationInterval <= 0 {
+			return nil, ErrRequestTimeout
+		}
+	}
+
+	correlationID := util.RandomUUIDString()
+	receiver := make(chan *RpcResponse, 1)
+
+	rpcClient.pendingMap.Set(correlationID, receiver)
+	defer rpcClient.pendingMap.Remove(correlationID)
+
+	err := rpcClient.producer.DeliverCorrelatedMessage(
+		rpcClient.requestTopic,
+		kafka.PartitionAny,
+		receiverID,
+		rpcClient.instanceID,
+		receiverID,
+		MessageTypeRequest,
+		correlationID,
+		rpcClient.replyTopic,
+		payload,
+		expirationInterval)
+
+	if nil != err {
+		return nil, fmt.Errorf("FAILED TO DELIVER REQUEST: %+v", err)
+	}
+
+	timer := time.NewTimer(time.Duration(expirationInterval) * time.Millisecond)
+	defer timer.Stop()
+
+	select {
+	case response := <-receiver:
+		return response, nil
+	case <-timer.C:
+		return nil, ErrRequestTimeout
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, ErrRequestTimeout
+		}
+		return nil, ctx.Err()
+	case <-rpcClient.terminated:
+		return nil, ErrClientClosed
+	}
+}
+
+// handle a response consumed from the reply topic
+func (rpcClient *RpcClient) responseReceived(
+	senderID string,
+	deliveryTime int64,
+	expirationTime int64,
+	messageType MessageType,
+	correlationID string,
+	message string) {
+
+	if messageType != MessageTypeResponse {
+		return
+	}
+
+	object, ok := rpcClient.pendingMap.Get(correlationID)
+	if false == ok {
+		// the request was expired or was raised by another instance
+		return
+	}
+
+	dateTime := datetime.Now()
+	if 0 != expirationTime && expirationTime < dateTime.UnixTimestamp() {
+		logger.New().Debug("kafka: RESPONSE EXPIRED", zap.String("correlationID", correlationID))
+		return
+	}
+
+	receiver := object.(chan *RpcResponse)
+	select {
+	case receiver <- &RpcResponse{
+		SenderID:       senderID,
+		DeliveryTime:   deliveryTime,
+		ExpirationTime: expirationTime,
+		Message:        message}:
+	default:
+		// duplicated response
+	}
+}
+
+// rpcProducerHandler is the ProducerHandler of RpcClient
+type rpcProducerHandler struct {
+	rpcClient *RpcClient
+}
+
+func (handler *rpcProducerHandler) MessageDeliveredResult(
+	kafkaProducer Producer,
+	err error,
+	topic string,
+	partition int32,
+	offset string,
+	message string) {
+
+	if nil != err {
+		logger.New().Error("kafka: DELIVERY FAILED", zap.String("topic", topic), zap.Error(err))
+	}
+}
+
+func (handler *rpcProducerHandler) ErrorOccurred(
+	kafkaProducer Producer,
+	errorCode kafka.ErrorCode,
+	errorMessage string) {
+
+	logger.New().Warn("kafka: PRODUCER ERROR", zap.String("code", errorCode.String()), zap.String("message", errorMessage))
+}
+
+func (handler *rpcProducerHandler) Closed(kafkaProducer Producer) {
+}
+
+// rpcConsumerHandler is the ConsumerHandler of RpcClient
+type rpcConsumerHandler struct {
+	rpcClient *RpcClient
+}
+
+func (handler *rpcConsumerHandler) MessageReceived(
+	kafkaConsumer Consumer,
+	topic string,
+	partition int32,
+	offset string,
+	senderID string,
+	receiverID string,
+	deliveryTime int64,
+	expirationTime int64,
+	messageType MessageType,
+	correlationID string,
+	replyTopic string,
+	message string) {
+
+	handler.rpcClient.responseReceived(
+		senderID,
+		deliveryTime,
+		expirationTime,
+		messageType,
+		correlationID,
+		message)
+}
+
+func (handler *rpcConsumerHandler) MessageExpired(
+	kafkaConsumer Consumer,
+	topic string,
+	partition int32,
+	offset string,
+	senderID string,
+	receiverID string,
+	deliveryTime int64,
+	expirationTime int64,
+	messageType MessageType,
+	message string,
+	deadLettered bool) {
+}
+
+func (handler *rpcConsumerHandler) PartitionsAssigned(
+	kafkaConsumer Consumer,
+	partitions []kafka.TopicPartition) {
+}
+
+func (handler *rpcConsumerHandler) PartitionsRevoked(
+	kafkaConsumer Consumer,
+	partitions []kafka.TopicPartition) {
+}
+
+func (handler *rpcConsumerHandler) PartitionEOF(
+	kafkaConsumer Consumer,
+	topic string,
+	partition int32,
+	offset string) {
+
+	if topic == handler.rpcClient.replyTopic {
+		handler.rpcClient.readyOnce.Do(func() {
+			close(handler.rpcClient.ready)
+		})
+	}
+}
+
+func (handler *rpcConsumerHandler) ErrorOccurred(
+	kafkaConsumer Consumer,
+	errorCode kafka.ErrorCode,
+	errorMessage string) {
+
+	logger.New().Warn("kafka: CONSUMER ERROR", zap.String("code", errorCode.String()), zap.String("message", errorMessage))
+}
+
+func (handler *rpcConsumerHandler) Closed(kafkaConsumer Consumer) {
+}
@@ -0,0 +1,155 @@
+package kafkaex
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+)
+
+// echoResponder answers requests by "reply" which returns the message type and the payload of the response
+type echoResponder struct {
+	*recordingHandler
+
+	producer           Producer
+	reply              func(message string) (MessageType, string)
+	expirationInterval int64 // expiration interval of responses
+}
+
+func (responder *echoResponder) MessageReceived(
+	kafkaConsumer Consumer,
+	topic string,
+	partition int32,
+	offset string,
+	senderID string,
+	receiverID string,
+	deliveryTime int64,
+	expirationTime int64,
+	messageType MessageType,
+	correlationID string,
+	replyTopic string,
+	message string) {
+
+	responseType, response := responder.reply(message)
+	responder.producer.DeliverCorrelatedMessage(
+		replyTopic,
+		kafka.PartitionAny,
+		"",
+		receiverID,
+		senderID,
+		responseType,
+		correlationID,
+		"",
+		response,
+		responder.expirationInterval)
+}
+
+func TestRpcClientRequest(t *testing.T) {
+	echo := func(message string) (MessageType, string) { return MessageTypeResponse, "echo:" + message }
+
+	tests := []struct {
+		name               string
+		responder          func(message string) (MessageType, string)
+		expirationInterval int64
+		timeout            time.Duration
+		response           string
+		err                error
+	}{
+		{"response", echo, 60000, time.Second, "echo:ping", nil},
+		{"response without expiration", echo, 0, time.Second, "echo:ping", nil},
+		{"no responder", nil, 60000, time.Millisecond * 200, "", ErrRequestTimeout},
+		{"requests are not responses", func(message string) (MessageType, string) { return MessageTypeRequest, message }, 60000, time.Millisecond * 200, "", ErrRequestTimeout},
+	}
+
+	for _, test := range tests {
+		broker := NewMemoryBroker(true, 1)
+		broker.CreateTopic("requests", 1)
+
+		var responder *echoResponder
+		var consumer Consumer
+		if nil != test.responder {
+			responder = &echoResponder{newRecordingHandler(), newTestProducer(t, broker), test.responder, test.expirationInterval}
+			consumer = subscribe(t, broker, "responder", responder, responder.eof, "requests")
+		}
+
+		rpcClient, err := NewRpcClientWithFactory(broker, "instance", "requests")
+		if nil != err {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), test.timeout)
+		response, err := rpcClient.Request(ctx, "device", "ping")
+		cancel()
+
+		if err != test.err {
+			t.Errorf("%s: expected error %v but got %v", test.name, test.err, err)
+		}
+
+		if nil == err && (test.response != response.Message || "device" != response.SenderID) {
+			t.Errorf("%s: unexpected response %+v", test.name, response)
+		}
+
+		rpcClient.Close()
+		if nil != responder {
+			consumer.Close()
+			responder.producer.Close()
+		}
+	}
+}
+
+func TestRpcClientReplyTopic(t *testing.T) {
+	broker := NewMemoryBroker(true, 1)
+
+	rpcClient, err := NewRpcClientWithFactory(broker, "instance", "requests")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer rpcClient.Close()
+
+	if "rpc-reply-instance" != rpcClient.GetReplyTopic() {
+		t.Fatalf("unexpected reply topic '%s'", rpcClient.GetReplyTopic())
+	}
+
+	found := false
+	for _, topic := range broker.GetTopics() {
+		found = found || topic == rpcClient.GetReplyTopic()
+	}
+
+	if false == found {
+		t.Fatal("reply topic was not created")
+	}
+
+	if _, err = NewRpcClientWithFactory(broker, "", "requests"); nil == err {
+		t.Fatal("blank instance ID should be rejected")
+	}
+}
+
+func TestRpcClientClose(t *testing.T) {
+	broker := NewMemoryBroker(true, 1)
+	broker.CreateTopic("requests", 1)
+
+	rpcClient, err := NewRpcClientWithFactory(broker, "instance", "requests")
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := rpcClient.Request(context.Background(), "device", "ping")
+		result <- err
+	}()
+
+	// wait until the request was delivered
+	waitMessages(t, broker, "requests", 0, 1)
+	rpcClient.Close()
+
+	select {
+	case err = <-result:
+		if ErrClientClosed != err {
+			t.Fatalf("expected %v but got %v", ErrClientClosed, err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("pending request was not released")
+	}
+}
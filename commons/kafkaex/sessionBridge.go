@@ -0,0 +1,418 @@
+package kafkaex
+
+import (
+	"fmt"
+	"math"
+
+	cmap "github.com/orcaman/concurrent-map"
+	"go.uber.org/zap"
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+	"sercomm.com/demeter/commons/datetime"
+	"sercomm.com/demeter/commons/logger"
+	"sercomm.com/demeter/commons/packet"
+	"sercomm.com/demeter/commons/util"
+	"sercomm.com/demeter/commons/ws"
+)
+
+// default duration (in seconds) to wait for a device to answer a command
+// if the command does not carry any expiration time
+const defaultCommandTimeout int = 15
+
+// SessionBridge connects WebSocket sessions held by this node to Kafka.
+// Datagrams from devices are published to the uplink topic keyed by device serial,
+// commands addressed to devices connected to this node are consumed from the command topic,
+// and results of commands are published to the reply topic of the command with the same correlation ID,
+// so that backend services can reach any device without knowing which node holds its socket
+type SessionBridge struct {
+	nodeID             string
+	uplinkTopic        string // topic where datagrams from devices will be published
+	commandTopic       string // topic where commands to devices will be consumed
+	responseTopic      string // topic where results will be published if the command has no reply topic
+	expirationInterval int64  // expiration interval (in milliseconds) of published messages
+	producer           Producer
+	consumer           Consumer
+	sessionMap         cmap.ConcurrentMap // pair< device serial, ws.Session >
+}
+
+// NewSessionBridge creates a bridge which is identified by "nodeID" in the cluster
+// every node consumes the command topic by its own consumer group, so each command reaches all nodes
+// and only the node which holds the session of the receiver will deliver it
+func NewSessionBridge(
+	brokerAddr string,
+	nodeID string,
+	uplinkTopic string,
+	commandTopic string,
+	responseTopic string,
+	expirationInterval int64) (*SessionBridge, error) {
+
+	return NewSessionBridgeWithFactory(
+		NewClientFactory(brokerAddr),
+		nodeID,
+		uplinkTopic,
+		commandTopic,
+		responseTopic,
+		expirationInterval)
+}
+
+// NewSessionBridgeWithFactory creates a bridge whose Kafka clients are created by "factory", e.g. a MemoryBroker
+func NewSessionBridgeWithFactory(
+	factory ClientFactory,
+	nodeID string,
+	uplinkTopic string,
+	commandTopic string,
+	responseTopic string,
+	expirationInterval int64) (*SessionBridge, error) {
+
+	if "" == nodeID {
+		return nil, fmt.Errorf("'nodeID' CANNOT BE BLANK")
+	}
+
+	sessionBridge := &SessionBridge{
+		nodeID:             nodeID,
+		uplinkTopic:        uplinkTopic,
+		commandTopic:       commandTopic,
+		responseTopic:      responseTopic,
+		expirationInterval: expirationInterval,
+		sessionMap:         cmap.New(),
+	}
+
+	producer, err := factory.NewProducer(&bridgeProducerHandler{sessionBridge})
+	if nil != err {
+		return nil, err
+	}
+
+	consumer, err := factory.NewConsumer("bridge-"+nodeID, &bridgeConsumerHandler{sessionBridge})
+	if nil != err {
+		producer.Close()
+		return nil, err
+	}
+
+	err = consumer.SubscribeTopics([]string{commandTopic})
+	if nil != err {
+		consumer.Close()
+		producer.Close()
+		return nil, err
+	}
+
+	sessionBridge.producer = producer
+	sessionBridge.consumer = consumer
+
+	return sessionBridge, nil
+}
+
+// GetNodeID returns the identifier of this node
+func (sessionBridge *SessionBridge) GetNodeID() string {
+	return sessionBridge.nodeID
+}
+
+// Close stops consuming commands and releases the Kafka clients
+func (sessionBridge *SessionBridge) Close() {
+	if nil != sessionBridge.consumer {
+		sessionBridge.consumer.Close()
+	}
+
+	if nil != sessionBridge.producer {
+		sessionBridge.producer.Close()
+	}
+}
+
+// Attach binds the session of a device to this node, it should be invoked once the device was identified
+func (sessionBridge *SessionBridge) Attach(serial string, session ws.Session) {
+	sessionBridge.sessionMap.Set(serial, session)
+}
+
+// Detach unbinds the session of a device from this node
+// nothing happens if the device has been attached with another session meanwhile
+func (sessionBridge *SessionBridge) Detach(serial string, session ws.Session) {
+	sessionBridge.sessionMap.RemoveCb(serial, func(key string, value interface{}, exists bool) bool {
+		return exists && value.(ws.Session) == session
+	})
+}
+
+// GetSession returns the session of the device if it is attached to this node
+func (sessionBridge *SessionBridge) GetSession(serial string) (ws.Session, bool) {
+	object, ok := sessionBridge.sessionMap.Get(serial)
+	if false == ok {
+		return nil, false
+	}
+
+	return object.(ws.Session), true
+}
+
+// Publish publishes a datagram received from the device to the uplink topic as a DatagramEnvelope
+// backend services may answer a request by delivering a response to the command topic
+func (sessionBridge *SessionBridge) Publish(serial string, datagram *packet.Datagram) error {
+	return PublishDatagram(
+		sessionBridge.producer,
+		sessionBridge.uplinkTopic,
+		serial,
+		&DatagramEnvelope{
+			SenderID:   serial,
+			ReplyTopic: sessionBridge.commandTopic,
+			Datagram:   *datagram,
+		},
+		sessionBridge.expirationInterval)
+}
+
+// handle a command consumed from the command topic
+func (sessionBridge *SessionBridge) commandReceived(command *DatagramEnvelope) {
+	receiverID := command.ReceiverID
+
+	session, ok := sessionBridge.GetSession(receiverID)
+	if false == ok {
+		// the device is not connected to this node
+		return
+	}
+
+	datagram := command.Datagram
+
+	correlationID := command.CorrelationID
+	if "" == correlationID {
+		correlationID = datagram.ID
+	}
+
+	replyTopic := command.ReplyTopic
+	if "" == replyTopic {
+		replyTopic = sessionBridge.responseTopic
+	}
+
+	// responses of requests which were raised by the device
+	if command.MessageType == MessageTypeResponse || datagram.Type != packet.T_REQUEST.String() {
+		err := session.Deliver(&datagram, 0, nil, nil, nil)
+		if nil != err {
+			logger.New().Warn("kafka: CANNOT DELIVER RESPONSE", zap.String("receiverID", receiverID), zap.String("datagramID", datagram.ID), zap.Error(err))
+		}
+		return
+	}
+
+	timeoutInterval := defaultCommandTimeout
+	if 0 != command.ExpirationTime {
+		dateTime := datetime.Now()
+		remaining := command.ExpirationTime - dateTime.UnixTimestamp()
+		if remaining <= 0 {
+			logger.New().Warn("kafka: COMMAND EXPIRED", zap.String("receiverID", receiverID), zap.String("datagramID", datagram.ID))
+			return
+		}
+
+		timeoutInterval = int(math.Ceil(float64(remaining) / 1000))
+	}
+
+	reply := func(result *packet.Datagram) {
+		// the trace of the command continues with its result
+		envelope := &DatagramEnvelope{
+			SenderID:      receiverID,
+			ReceiverID:    command.SenderID,
+			MessageType:   MessageTypeResponse,
+			CorrelationID: correlationID,
+			TraceParent:   command.TraceParent,
+			TraceState:    command.TraceState,
+			Datagram:      *result,
+		}
+
+		// do not block the read routine of the session while waiting for the delivery
+		go sessionBridge.reply(replyTopic, envelope)
+	}
+
+	// backends may reuse datagram IDs, so the command is delivered with an ID of the bridge
+	// and its result carries the ID of the backend again
+	request := datagram
+	request.ID = util.RandomUUIDString()
+
+	err := session.Deliver(&request, timeoutInterval,
+		func(session ws.Session, packetID string, arguments ...interface{}) {
+			result := &packet.Datagram{
+				ID:        datagram.ID,
+				Type:      packet.T_RESULT.String(),
+				Function:  datagram.Function,
+				Arguments: arguments,
+			}
+			reply(result)
+		},
+		func(session ws.Session, packetID string, condition packet.ErrorCondition, errorMessage string) {
+			result := &packet.Datagram{
+				ID:       datagram.ID,
+				Type:     packet.T_ERROR.String(),
+				Function: datagram.Function,
+			}
+			result.Push(condition)
+			result.Push(errorMessage)
+			reply(result)
+		},
+		func(session ws.Session, packetID string, timeoutInterval int) {
+			result := &packet.Datagram{
+				ID:       datagram.ID,
+				Type:     packet.T_ERROR.String(),
+				Function: datagram.Function,
+			}
+			result.Push(packet.E_REMOTE_SERVER_TIMEOUT)
+			result.Push("DEVICE DID NOT RESPOND")
+			reply(result)
+		})
+
+	if nil != err {
+		result := &packet.Datagram{
+			ID:       datagram.ID,
+			Type:     packet.T_ERROR.String(),
+			Function: datagram.Function,
+		}
+		result.Push(packet.E_REMOTE_SERVER_NOT_AVAILABLE)
+		result.Push(err.Error())
+		reply(result)
+	}
+}
+
+// publish the result of a command to the reply topic
+func (sessionBridge *SessionBridge) reply(replyTopic string, envelope *DatagramEnvelope) {
+	if "" == replyTopic {
+		logger.New().Warn("kafka: NO REPLY TOPIC", zap.String("senderID", envelope.SenderID), zap.String("datagramID", envelope.Datagram.ID))
+		return
+	}
+
+	err := PublishDatagram(
+		sessionBridge.producer,
+		replyTopic,
+		envelope.SenderID,
+		envelope,
+		sessionBridge.expirationInterval)
+
+	if nil != err {
+		logger.New().Error("kafka: CANNOT DELIVER RESULT", zap.String("datagramID", envelope.Datagram.ID), zap.Error(err))
+	}
+}
+
+// bridgeProducerHandler is the ProducerHandler of SessionBridge
+type bridgeProducerHandler struct {
+	sessionBridge *SessionBridge
+}
+
+func (handler *bridgeProducerHandler) MessageDeliveredResult(
+	kafkaProducer Producer,
+	err error,
+	topic string,
+	partition int32,
+	offset string,
+	message string) {
+
+	if nil != err {
+		logger.New().Error("kafka: DELIVERY FAILED", zap.String("topic", topic), zap.Error(err))
+	}
+}
+
+func (handler *bridgeProducerHandler) ErrorOccurred(
+	kafkaProducer Producer,
+	errorCode kafka.ErrorCode,
+	errorMessage string) {
+
+	logger.New().Warn("kafka: PRODUCER ERROR", zap.String("code", errorCode.String()), zap.String("message", errorMessage))
+}
+
+func (handler *bridgeProducerHandler) Closed(kafkaProducer Producer) {
+	logger.New().Info("kafka: PRODUCER CLOSED", zap.String("nodeID", handler.sessionBridge.nodeID))
+}
+
+// bridgeConsumerHandler is the ConsumerHandler of SessionBridge
+type bridgeConsumerHandler struct {
+	sessionBridge *SessionBridge
+}
+
+func (handler *bridgeConsumerHandler) MessageReceived(
+	kafkaConsumer Consumer,
+	topic string,
+	partition int32,
+	offset string,
+	senderID string,
+	receiverID string,
+	deliveryTime int64,
+	expirationTime int64,
+	messageType MessageType,
+	correlationID string,
+	replyTopic string,
+	message string) {
+
+	// commands which are not carried by datagram envelopes
+	datagram, err := packet.From(message)
+	if nil != err {
+		logger.New().Warn("kafka: INVALID COMMAND", zap.String("receiverID", receiverID), zap.Error(err))
+		return
+	}
+
+	handler.sessionBridge.commandReceived(&DatagramEnvelope{
+		SenderID:       senderID,
+		ReceiverID:     receiverID,
+		MessageType:    messageType,
+		CorrelationID:  correlationID,
+		ReplyTopic:     replyTopic,
+		Datagram:       datagram,
+		DeliveryTime:   deliveryTime,
+		ExpirationTime: expirationTime,
+		Topic:          topic,
+		Partition:      partition,
+		Offset:         offset,
+	})
+}
+
+func (handler *bridgeConsumerHandler) DatagramReceived(
+	kafkaConsumer Consumer,
+	envelope *DatagramEnvelope,
+	acknowledgement *Acknowledgement) {
+
+	handler.sessionBridge.commandReceived(envelope)
+
+	if nil != acknowledgement {
+		acknowledgement.Ack()
+	}
+}
+
+func (handler *bridgeConsumerHandler) DatagramRejected(
+	kafkaConsumer Consumer,
+	topic string,
+	partition int32,
+	offset string,
+	err error) {
+
+	logger.New().Warn("kafka: INVALID COMMAND", zap.String("topic", topic), zap.String("offset", offset), zap.Error(err))
+}
+
+func (handler *bridgeConsumerHandler) MessageExpired(
+	kafkaConsumer Consumer,
+	topic string,
+	partition int32,
+	offset string,
+	senderID string,
+	receiverID string,
+	deliveryTime int64,
+	expirationTime int64,
+	messageType MessageType,
+	message string,
+	deadLettered bool) {
+	logger.New().Debug("kafka: COMMAND EXPIRED", zap.String("receiverID", receiverID), zap.Bool("deadLettered", deadLettered))
+}
+
+func (handler *bridgeConsumerHandler) PartitionsAssigned(
+	kafkaConsumer Consumer,
+	partitions []kafka.TopicPartition) {
+}
+
+func (handler *bridgeConsumerHandler) PartitionsRevoked(
+	kafkaConsumer Consumer,
+	partitions []kafka.TopicPartition) {
+}
+
+func (handler *bridgeConsumerHandler) PartitionEOF(
+	kafkaConsumer Consumer,
+	topic string,
+	partition int32,
+	offset string) {
+}
+
+func (handler *bridgeConsumerHandler) ErrorOccurred(
+	kafkaConsumer Consumer,
+	errorCode kafka.ErrorCode,
+	errorMessage string) {
+
+	logger.New().Warn("kafka: CONSUMER ERROR", zap.String("code", errorCode.String()), zap.String("message", errorMessage))
+}
+
+func (handler *bridgeConsumerHandler) Closed(kafkaConsumer Consumer) {
+	logger.New().Info("kafka: CONSUMER CLOSED", zap.String("nodeID", handler.sessionBridge.nodeID))
+}
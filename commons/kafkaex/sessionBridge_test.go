@@ -0,0 +1,283 @@
+package kafkaex
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"sercomm.com/demeter/commons/packet"
+	"sercomm.com/demeter/commons/ws"
+)
+
+// fakeSession answers delivered requests by "behavior": "result", "error", "timeout" or "fail"
+type fakeSession struct {
+	ws.Session
+
+	behavior  string
+	delivered chan *packet.Datagram
+}
+
+func newFakeSession(behavior string) *fakeSession {
+	return &fakeSession{
+		behavior:  behavior,
+		delivered: make(chan *packet.Datagram, 16),
+	}
+}
+
+func (session *fakeSession) GetID() string {
+	return "fake"
+}
+
+func (session *fakeSession) GetState() ws.SessionState {
+	return ws.StateConnected
+}
+
+func (session *fakeSession) Deliver(
+	datagram *packet.Datagram,
+	timeoutInterval int,
+	onResult func(session ws.Session, packetID string, arguments ...interface{}),
+	onError func(session ws.Session, packetID string, condition packet.ErrorCondition, errorMessage string),
+	onTimeout func(session ws.Session, packetID string, timeoutInterval int)) error {
+
+	if "fail" == session.behavior {
+		return errors.New("SESSION IS NOT READY")
+	}
+
+	session.delivered <- datagram
+
+	switch {
+	case "result" == session.behavior && nil != onResult:
+		go onResult(session, datagram.ID, "done")
+	case "error" == session.behavior && nil != onError:
+		go onError(session, datagram.ID, packet.E_BAD_REQUEST, "rejected")
+	case "timeout" == session.behavior && nil != onTimeout:
+		go onTimeout(session, datagram.ID, timeoutInterval)
+	}
+
+	return nil
+}
+
+func TestSessionBridgeCommand(t *testing.T) {
+	tests := []struct {
+		name        string
+		behavior    string
+		attached    bool
+		messageType MessageType
+		delivered   bool
+		replyType   string
+		condition   string
+	}{
+		{"result", "result", true, MessageTypeRequest, true, packet.T_RESULT.String(), ""},
+		{"error", "error", true, MessageTypeRequest, true, packet.T_ERROR.String(), packet.E_BAD_REQUEST.String()},
+		{"timeout", "timeout", true, MessageTypeRequest, true, packet.T_ERROR.String(), packet.E_REMOTE_SERVER_TIMEOUT.String()},
+		{"delivery failure", "fail", true, MessageTypeRequest, false, packet.T_ERROR.String(), packet.E_REMOTE_SERVER_NOT_AVAILABLE.String()},
+		{"response to the device", "result", true, MessageTypeResponse, true, "", ""},
+		{"not attached", "result", false, MessageTypeRequest, false, "", ""},
+	}
+
+	for _, test := range tests {
+		broker := NewMemoryBroker(true, 1)
+		for _, topic := range []string{"uplink", "command", "reply"} {
+			broker.CreateTopic(topic, 1)
+		}
+
+		bridge, err := NewSessionBridgeWithFactory(broker, "node", "uplink", "command", "", 60000)
+		if nil != err {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		session := newFakeSession(test.behavior)
+		if test.attached {
+			bridge.Attach("serial", session)
+		}
+
+		producer := newTestProducer(t, broker)
+		err = PublishDatagram(producer, "command", "serial", &DatagramEnvelope{
+			SenderID:      "backend",
+			ReceiverID:    "serial",
+			MessageType:   test.messageType,
+			CorrelationID: "correlation",
+			ReplyTopic:    "reply",
+			Datagram:      packet.Datagram{ID: "1", Type: packet.T_REQUEST.String(), Function: packet.F_UBUS.String()},
+		}, 60000)
+		if nil != err {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		if test.delivered {
+			select {
+			case datagram := <-session.delivered:
+				// requests are delivered with an ID of the bridge
+				if (MessageTypeRequest == test.messageType) == ("1" == datagram.ID) {
+					t.Errorf("%s: unexpected datagram %+v", test.name, datagram)
+				}
+			case <-time.After(testTimeout):
+				t.Fatalf("%s: command was not delivered", test.name)
+			}
+		}
+
+		if "" == test.replyType {
+			time.Sleep(time.Millisecond * 100)
+			if messages, _ := broker.GetMessages("reply", 0); 0 != len(messages) {
+				t.Errorf("%s: unexpected replies %d", test.name, len(messages))
+			}
+		} else {
+			messages := waitMessages(t, broker, "reply", 0, 1)
+
+			// a failure must be replied only once
+			time.Sleep(time.Millisecond * 100)
+			if messages, _ = broker.GetMessages("reply", 0); 1 != len(messages) {
+				t.Fatalf("%s: expected 1 reply but got %d", test.name, len(messages))
+			}
+
+			envelope, err := DecodeDatagram(messages[0])
+			if nil != err {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+
+			if "correlation" != envelope.CorrelationID || "backend" != envelope.ReceiverID || "serial" != envelope.SenderID || MessageTypeResponse != envelope.MessageType {
+				t.Errorf("%s: unexpected envelope %+v", test.name, envelope)
+			}
+
+			if "1" != envelope.Datagram.ID {
+				t.Errorf("%s: unexpected datagram ID '%s'", test.name, envelope.Datagram.ID)
+			}
+
+			if test.replyType != envelope.Datagram.Type {
+				t.Errorf("%s: expected %s but got %s", test.name, test.replyType, envelope.Datagram.Type)
+			}
+
+			if "" != test.condition && (0 == len(envelope.Datagram.Arguments) || test.condition != envelope.Datagram.Arguments[0]) {
+				t.Errorf("%s: expected %s but got %+v", test.name, test.condition, envelope.Datagram.Arguments)
+			}
+		}
+
+		producer.Close()
+		bridge.Close()
+	}
+}
+
+func TestSessionBridgeReusedID(t *testing.T) {
+	broker := NewMemoryBroker(true, 1)
+	for _, topic := range []string{"uplink", "command", "reply"} {
+		broker.CreateTopic(topic, 1)
+	}
+
+	bridge, err := NewSessionBridgeWithFactory(broker, "node", "uplink", "command", "", 60000)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer bridge.Close()
+
+	session := newFakeSession("result")
+	bridge.Attach("serial", session)
+
+	producer := newTestProducer(t, broker)
+	defer producer.Close()
+
+	// two backends which send commands with the same datagram ID
+	backends := []string{"first", "second"}
+	for _, backend := range backends {
+		err = PublishDatagram(producer, "command", "serial", &DatagramEnvelope{
+			SenderID:      backend,
+			ReceiverID:    "serial",
+			MessageType:   MessageTypeRequest,
+			CorrelationID: backend,
+			ReplyTopic:    "reply",
+			Datagram:      packet.Datagram{ID: "1", Type: packet.T_REQUEST.String(), Function: packet.F_UBUS.String()},
+		}, 60000)
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+
+	deliveredIDs := map[string]bool{}
+	for range backends {
+		select {
+		case datagram := <-session.delivered:
+			deliveredIDs[datagram.ID] = true
+		case <-time.After(testTimeout):
+			t.Fatal("command was not delivered")
+		}
+	}
+
+	if len(backends) != len(deliveredIDs) {
+		t.Fatalf("commands were delivered with the same ID %+v", deliveredIDs)
+	}
+
+	replies := map[string]bool{}
+	for _, message := range waitMessages(t, broker, "reply", 0, len(backends)) {
+		envelope, err := DecodeDatagram(message)
+		if nil != err {
+			t.Fatal(err)
+		}
+
+		if "1" != envelope.Datagram.ID || envelope.ReceiverID != envelope.CorrelationID {
+			t.Errorf("unexpected reply %+v", envelope)
+		}
+		replies[envelope.ReceiverID] = true
+	}
+
+	for _, backend := range backends {
+		if false == replies[backend] {
+			t.Errorf("%s did not receive its result", backend)
+		}
+	}
+}
+
+func TestSessionBridgePublish(t *testing.T) {
+	broker := NewMemoryBroker(true, 1)
+
+	bridge, err := NewSessionBridgeWithFactory(broker, "node", "uplink", "command", "", 60000)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer bridge.Close()
+
+	datagram := &packet.Datagram{ID: "1", Type: packet.T_REQUEST.String(), Function: packet.F_UBUS.String()}
+	err = bridge.Publish("serial", datagram)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	messages := waitMessages(t, broker, "uplink", 0, 1)
+	if "serial" != string(messages[0].Key) {
+		t.Errorf("unexpected key '%s'", string(messages[0].Key))
+	}
+
+	envelope, err := DecodeDatagram(messages[0])
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	if "serial" != envelope.SenderID || "command" != envelope.ReplyTopic || MessageTypeRequest != envelope.MessageType || "1" != envelope.CorrelationID {
+		t.Errorf("unexpected envelope %+v", envelope)
+	}
+}
+
+func TestSessionBridgeDetach(t *testing.T) {
+	broker := NewMemoryBroker(true, 1)
+
+	bridge, err := NewSessionBridgeWithFactory(broker, "node", "uplink", "command", "", 60000)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer bridge.Close()
+
+	previous := newFakeSession("result")
+	current := newFakeSession("result")
+
+	bridge.Attach("serial", previous)
+	bridge.Attach("serial", current)
+
+	// the previous session must not detach the current one
+	bridge.Detach("serial", previous)
+	if session, ok := bridge.GetSession("serial"); false == ok || session != current {
+		t.Fatal("current session was detached")
+	}
+
+	bridge.Detach("serial", current)
+	if _, ok := bridge.GetSession("serial"); ok {
+		t.Fatal("session was not detached")
+	}
+}
@@ -0,0 +1,202 @@
+package kafkaex
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// names of metrics published by KafkaProducer and KafkaConsumer,
+// all of them are labelled by "client" which is the name of the librdkafka instance
+const (
+	MetricMessagesOut        = "kafka_messages_out_total"        // counter of delivered messages, labelled by "topic"
+	MetricDeliveryFailures   = "kafka_delivery_failures_total"   // counter of messages failed to be delivered, labelled by "topic"
+	MetricMessagesIn         = "kafka_messages_in_total"         // counter of consumed messages, labelled by "topic"
+	MetricExpirationsDropped = "kafka_expirations_dropped_total" // counter of expired messages, labelled by "topic" and "deadLettered"
+	MetricQueueMessages      = "kafka_queue_messages"            // gauge of messages waiting in the producer queue
+	MetricQueueBytes         = "kafka_queue_bytes"               // gauge of bytes waiting in the producer queue
+	MetricBrokerRttAvg       = "kafka_broker_rtt_avg_seconds"    // gauge of average round-trip time, labelled by "broker"
+	MetricBrokerRttP99       = "kafka_broker_rtt_p99_seconds"    // gauge of 99th percentile round-trip time, labelled by "broker"
+	MetricBrokerOutbuf       = "kafka_broker_outbuf_requests"    // gauge of requests waiting to be sent, labelled by "broker"
+	MetricConsumerLag        = "kafka_consumer_lag"              // gauge of consumer lag, labelled by "topic" and "partition"
+)
+
+// Metrics receives gauges and counters of kafkaex clients, e.g. a Prometheus exporter
+// It is invoked from the event routines of clients, hence implementations must be thread-safe and should not block
+type Metrics interface {
+	SetGauge(name string, labels map[string]string, value float64)
+	AddCounter(name string, labels map[string]string, delta float64)
+}
+
+// KafkaStatisticsHandler may be implemented by a ProducerHandler, ConsumerHandler or their legacy counterparts.
+// StatisticsReceived is raised every ClientOptions.StatisticsIntervalMs from the event routine of the client
+type KafkaStatisticsHandler interface {
+	StatisticsReceived(statistics *Statistics)
+}
+
+// Statistics is emitted by librdkafka, see STATISTICS.md of librdkafka for details of each field
+type Statistics struct {
+	Name          string                      `json:"name"`
+	ClientID      string                      `json:"client_id"`
+	Type          string                      `json:"type"` // "producer" or "consumer"
+	Ts            int64                       `json:"ts"`   // monotonic clock in microseconds
+	Time          int64                       `json:"time"` // UNIX epoch time in seconds
+	ReplyQueue    int64                       `json:"replyq"`
+	MsgCnt        int64                       `json:"msg_cnt"`  // messages waiting in the producer queue
+	MsgSize       int64                       `json:"msg_size"` // bytes waiting in the producer queue
+	MsgMax        int64                       `json:"msg_max"`
+	MsgSizeMax    int64                       `json:"msg_size_max"`
+	Tx            int64                       `json:"tx"`
+	TxBytes       int64                       `json:"tx_bytes"`
+	Rx            int64                       `json:"rx"`
+	RxBytes       int64                       `json:"rx_bytes"`
+	TxMsgs        int64                       `json:"txmsgs"`
+	TxMsgBytes    int64                       `json:"txmsg_bytes"`
+	RxMsgs        int64                       `json:"rxmsgs"`
+	RxMsgBytes    int64                       `json:"rxmsg_bytes"`
+	Brokers       map[string]BrokerStatistics `json:"brokers"`
+	Topics        map[string]TopicStatistics  `json:"topics"`
+	ConsumerGroup *ConsumerGroupStatistics    `json:"cgrp"` // nil for producers
+}
+
+type BrokerStatistics struct {
+	Name           string           `json:"name"`
+	NodeID         int32            `json:"nodeid"`
+	NodeName       string           `json:"nodename"`
+	State          string           `json:"state"` // e.g. "UP", "DOWN"
+	OutbufCnt      int64            `json:"outbuf_cnt"`
+	OutbufMsgCnt   int64            `json:"outbuf_msg_cnt"`
+	WaitrespCnt    int64            `json:"waitresp_cnt"`
+	WaitrespMsgCnt int64            `json:"waitresp_msg_cnt"`
+	Tx             int64            `json:"tx"`
+	TxErrs         int64            `json:"txerrs"`
+	TxRetries      int64            `json:"txretries"`
+	ReqTimeouts    int64            `json:"req_timeouts"`
+	Rx             int64            `json:"rx"`
+	RxErrs         int64            `json:"rxerrs"`
+	Connects       int64            `json:"connects"`
+	Disconnects    int64            `json:"disconnects"`
+	Rtt            WindowStatistics `json:"rtt"`            // round-trip time
+	IntLatency     WindowStatistics `json:"int_latency"`    // internal producer queue latency
+	OutbufLatency  WindowStatistics `json:"outbuf_latency"` // internal request queue latency
+	Throttle       WindowStatistics `json:"throttle"`
+}
+
+// WindowStatistics is a rolling window of latencies (in microseconds) or sizes
+type WindowStatistics struct {
+	Min    int64 `json:"min"`
+	Max    int64 `json:"max"`
+	Avg    int64 `json:"avg"`
+	Sum    int64 `json:"sum"`
+	Cnt    int64 `json:"cnt"`
+	StdDev int64 `json:"stddev"`
+	P50    int64 `json:"p50"`
+	P75    int64 `json:"p75"`
+	P90    int64 `json:"p90"`
+	P95    int64 `json:"p95"`
+	P99    int64 `json:"p99"`
+	P9999  int64 `json:"p99_99"`
+}
+
+type TopicStatistics struct {
+	Topic       string                         `json:"topic"`
+	MetadataAge int64                          `json:"metadata_age"`
+	BatchSize   WindowStatistics               `json:"batchsize"`
+	BatchCnt    WindowStatistics               `json:"batchcnt"`
+	Partitions  map[string]PartitionStatistics `json:"partitions"` // the key "-1" is the internal unassigned partition
+}
+
+type PartitionStatistics struct {
+	Partition       int32  `json:"partition"`
+	Broker          int32  `json:"broker"`
+	Leader          int32  `json:"leader"`
+	MsgqCnt         int64  `json:"msgq_cnt"`
+	MsgqBytes       int64  `json:"msgq_bytes"`
+	XmitMsgqCnt     int64  `json:"xmit_msgq_cnt"`
+	XmitMsgqBytes   int64  `json:"xmit_msgq_bytes"`
+	FetchqCnt       int64  `json:"fetchq_cnt"`
+	FetchState      string `json:"fetch_state"`
+	CommittedOffset int64  `json:"committed_offset"`
+	HiOffset        int64  `json:"hi_offset"`
+	LoOffset        int64  `json:"lo_offset"`
+	ConsumerLag     int64  `json:"consumer_lag"` // -1 if it is unknown
+	TxMsgs          int64  `json:"txmsgs"`
+	RxMsgs          int64  `json:"rxmsgs"`
+	MsgsInflight    int64  `json:"msgs_inflight"`
+}
+
+type ConsumerGroupStatistics struct {
+	State           string `json:"state"`
+	StateAge        int64  `json:"stateage"`
+	JoinState       string `json:"join_state"`
+	RebalanceAge    int64  `json:"rebalance_age"`
+	RebalanceCnt    int64  `json:"rebalance_cnt"`
+	RebalanceReason string `json:"rebalance_reason"`
+	AssignmentSize  int64  `json:"assignment_size"`
+}
+
+// parse the statistics, publish its gauges and raise KafkaStatisticsHandler.StatisticsReceived if "handler" implements it
+func handleStatistics(data string, metrics Metrics, handler interface{}) error {
+	statistics := &Statistics{}
+	err := json.Unmarshal([]byte(data), statistics)
+	if nil != err {
+		return fmt.Errorf("INVALID STATISTICS: %+v", err)
+	}
+
+	if nil != metrics {
+		statistics.publish(metrics)
+	}
+
+	if statisticsHandler, ok := handler.(KafkaStatisticsHandler); ok {
+		statisticsHandler.StatisticsReceived(statistics)
+	}
+
+	return nil
+}
+
+func (statistics *Statistics) publish(metrics Metrics) {
+	client := map[string]string{"client": statistics.Name}
+
+	if "producer" == statistics.Type {
+		metrics.SetGauge(MetricQueueMessages, client, float64(statistics.MsgCnt))
+		metrics.SetGauge(MetricQueueBytes, client, float64(statistics.MsgSize))
+	}
+
+	for _, broker := range statistics.Brokers {
+		// bootstrap brokers are replaced by the ones learned from metadata
+		if broker.NodeID < 0 {
+			continue
+		}
+
+		labels := map[string]string{"client": statistics.Name, "broker": broker.Name}
+		metrics.SetGauge(MetricBrokerRttAvg, labels, float64(broker.Rtt.Avg)/1000000)
+		metrics.SetGauge(MetricBrokerRttP99, labels, float64(broker.Rtt.P99)/1000000)
+		metrics.SetGauge(MetricBrokerOutbuf, labels, float64(broker.OutbufCnt))
+	}
+
+	if "consumer" != statistics.Type {
+		return
+	}
+
+	for _, topic := range statistics.Topics {
+		for _, partition := range topic.Partitions {
+			if partition.Partition < 0 || partition.ConsumerLag < 0 {
+				continue
+			}
+
+			labels := map[string]string{
+				"client":    statistics.Name,
+				"topic":     topic.Topic,
+				"partition": strconv.Itoa(int(partition.Partition)),
+			}
+			metrics.SetGauge(MetricConsumerLag, labels, float64(partition.ConsumerLag))
+		}
+	}
+}
+
+// increase the counter by one if "metrics" is given
+func countMetric(metrics Metrics, name string, labels map[string]string) {
+	if nil != metrics {
+		metrics.AddCounter(name, labels, 1)
+	}
+}
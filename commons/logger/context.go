@@ -0,0 +1,32 @@
+package logger
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+)
+
+// key of the logger in context
+type contextKey struct{}
+
+// With returns a child logger which adds "fields" to every entry
+func (logger *Logger) With(fields ...zap.Field) *Logger {
+	return &Logger{logger.Logger.With(fields...)}
+}
+
+// NewContext returns a copy of "ctx" carrying a child logger with "fields",
+// fields of the logger already carried by "ctx" are kept
+func NewContext(ctx context.Context, fields ...zap.Field) context.Context {
+	return context.WithValue(ctx, contextKey{}, FromContext(ctx).With(fields...))
+}
+
+// FromContext returns the logger carried by "ctx", or the root logger if there is none
+func FromContext(ctx context.Context) *Logger {
+	if nil != ctx {
+		if logger, ok := ctx.Value(contextKey{}).(*Logger); ok {
+			return logger
+		}
+	}
+
+	return New()
+}
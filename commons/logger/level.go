@@ -0,0 +1,107 @@
+package logger
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+var (
+	level       = zap.NewAtomicLevelAt(zapcore.DebugLevel)
+	levelLocker sync.Mutex
+	baseLevel   = zapcore.DebugLevel // level which a temporary level reverts to
+	revertTimer *time.Timer
+	revertTime  time.Time
+)
+
+// SetLevel changes the minimum enabled level at runtime, e.g. "debug", "info", "warn" or "error",
+// it takes effect after the temporary level expires if there is one
+func SetLevel(levelString string) error {
+	zapLevel, err := parseLevel(levelString)
+	if nil != err {
+		return err
+	}
+
+	levelLocker.Lock()
+	defer levelLocker.Unlock()
+
+	baseLevel = zapLevel
+	if nil == revertTimer {
+		level.SetLevel(zapLevel)
+	}
+
+	return nil
+}
+
+// SetTemporaryLevel changes the minimum enabled level for "duration", then it reverts to the level set by SetLevel.
+// The time of reverting is returned, a former temporary level is replaced
+func SetTemporaryLevel(levelString string, duration time.Duration) (time.Time, error) {
+	zapLevel, err := parseLevel(levelString)
+	if nil != err {
+		return time.Time{}, err
+	}
+
+	levelLocker.Lock()
+	defer levelLocker.Unlock()
+
+	if nil != revertTimer {
+		revertTimer.Stop()
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(duration, func() {
+		levelLocker.Lock()
+		if timer != revertTimer {
+			// replaced or reverted already
+			levelLocker.Unlock()
+			return
+		}
+		revertTimer = nil
+		revertTime = time.Time{}
+		level.SetLevel(baseLevel)
+		levelLocker.Unlock()
+
+		New().Info("logger: TEMPORARY LEVEL EXPIRED", zap.String("level", baseLevel.String()))
+	})
+
+	revertTimer = timer
+	revertTime = time.Now().Add(duration)
+	level.SetLevel(zapLevel)
+
+	return revertTime, nil
+}
+
+// RevertLevel cancels the temporary level
+func RevertLevel() {
+	levelLocker.Lock()
+	defer levelLocker.Unlock()
+
+	if nil != revertTimer {
+		revertTimer.Stop()
+		revertTimer = nil
+		revertTime = time.Time{}
+	}
+
+	level.SetLevel(baseLevel)
+}
+
+// GetLevel returns the minimum enabled level and the time it reverts, the time is zero unless the level is temporary
+func GetLevel() (string, time.Time) {
+	levelLocker.Lock()
+	defer levelLocker.Unlock()
+
+	return level.Level().String(), revertTime
+}
+
+func parseLevel(levelString string) (zapcore.Level, error) {
+	var zapLevel zapcore.Level
+	err := zapLevel.UnmarshalText([]byte(levelString))
+	if nil != err {
+		return zapLevel, fmt.Errorf("INVALID LOG LEVEL: %s", levelString)
+	}
+
+	return zapLevel, nil
+}
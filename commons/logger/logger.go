@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 
@@ -22,12 +23,34 @@ type Logger struct {
 	*zap.Logger
 }
 
+// Options of log sinks, they are applied once by New
+type Options struct {
+	Folder     string // folder of the log file
+	Encoding   string // "console" or "json"
+	MaxSize    int    // in MB, the file is rotated once it exceeds
+	MaxBackups int    // number of rotated files to keep
+	MaxAge     int    // in days, rotated files are removed once they are older, 0 to keep them
+	Compress   bool   // gzip rotated files
+	File       bool   // write to the log file, it can be disabled to spare flash storage
+	Stdout     bool   // also write to stdout
+	Syslog     SyslogOptions
+	Ship       ShipOptions
+}
+
 var (
-	logFolder      string
-	logRotateCount int
-	once           sync.Once
-	once1          sync.Once
-	instance       *Logger
+	options = Options{
+		Folder:     defaultLogFolder,
+		Encoding:   "console",
+		MaxSize:    1,
+		MaxBackups: 2,
+		MaxAge:     30,
+		Compress:   false,
+		File:       true,
+		Stdout:     true,
+	}
+	once     sync.Once
+	once1    sync.Once
+	instance *Logger
 )
 
 func customConsoleEncoder() zapcore.Encoder {
@@ -55,6 +78,17 @@ func customJSONEncoder() zapcore.Encoder {
 	return jsonEncoder
 }
 
+// syslog messages carry their own time and severity
+func customSyslogEncoder() zapcore.Encoder {
+	syslogEncoderConfig := zap.NewProductionConfig().EncoderConfig
+	syslogEncoderConfig.TimeKey = ""
+	syslogEncoderConfig.LevelKey = ""
+	syslogEncoderConfig.NameKey = "logger"
+	syslogEncoderConfig.CallerKey = "caller"
+
+	return zapcore.NewConsoleEncoder(syslogEncoderConfig)
+}
+
 func customLevelEncoder(level zapcore.Level, enc zapcore.PrimitiveArrayEncoder) {
 	enc.AppendString(fmt.Sprintf("[%s]", level.String()))
 }
@@ -62,8 +96,15 @@ func customLevelEncoder(level zapcore.Level, enc zapcore.PrimitiveArrayEncoder)
 // SetEnvParam ...
 func SetEnvParam(folderString string, rotateCount int) {
 	once1.Do(func() {
-		logFolder = folderString
-		logRotateCount = rotateCount
+		options.Folder = folderString
+		options.MaxBackups = rotateCount
+	})
+}
+
+// SetOptions replaces the default options, it must be called before New the same as SetEnvParam
+func SetOptions(logOptions Options) {
+	once1.Do(func() {
+		options = logOptions
 	})
 }
 
@@ -71,38 +112,80 @@ func SetEnvParam(folderString string, rotateCount int) {
 // logger.New().Info("This is an Info message", zap.String("customField", "123"))
 func New() *Logger {
 	once.Do(func() {
-		// all of the levels
-		lowPriority := zap.LevelEnablerFunc(func(lvl zapcore.Level) bool {
-			return lvl >= zapcore.DebugLevel
-		})
-
 		appName := getAppName()
-		if _, err := os.Stat(logFolder); os.IsNotExist(err) {
+		if _, err := os.Stat(options.Folder); os.IsNotExist(err) {
 			// does not exist
-			os.MkdirAll(logFolder, os.ModePerm)
+			os.MkdirAll(options.Folder, os.ModePerm)
 		}
 
-		fileRotateHook := zapcore.AddSync(&lumberjack.Logger{
-			Filename:   logFolder + string(os.PathSeparator) + appName + ".log",
-			MaxSize:    1, // MB
-			MaxBackups: logRotateCount,
-			MaxAge:     30, // day
-			Compress:   false,
-		})
-		consoleHook := zapcore.Lock(os.Stdout)
+		var encoder zapcore.Encoder
+		if "json" == options.Encoding {
+			encoder = customJSONEncoder()
+		} else {
+			encoder = customConsoleEncoder()
+		}
 
-		consoleEncoder := customConsoleEncoder()
+		cores := make([]zapcore.Core, 0)
+		if options.File {
+			fileRotateHook := zapcore.AddSync(&lumberjack.Logger{
+				Filename:   options.Folder + string(os.PathSeparator) + appName + ".log",
+				MaxSize:    options.MaxSize,
+				MaxBackups: options.MaxBackups,
+				MaxAge:     options.MaxAge,
+				Compress:   options.Compress,
+			})
+			cores = append(cores, zapcore.NewCore(encoder, fileRotateHook, level))
+		}
 
-		core := zapcore.NewTee(
-			zapcore.NewCore(consoleEncoder, fileRotateHook, lowPriority),
-			zapcore.NewCore(consoleEncoder, consoleHook, lowPriority))
+		if options.Stdout {
+			consoleHook := zapcore.Lock(os.Stdout)
+			cores = append(cores, zapcore.NewCore(encoder, consoleHook, level))
+		}
+
+		if "" != options.Syslog.Network {
+			cores = append(cores, newSyslogCore(customSyslogEncoder(), level, options.Syslog, appName))
+		}
 
-		instance = &Logger{zap.New(core, zap.AddCaller())}
+		if options.Ship.Enabled {
+			minimum, err := parseLevel(options.Ship.Level)
+			if nil != err {
+				minimum = zapcore.WarnLevel
+			}
+
+			shipBuffer = newShipQueue(options.Ship)
+			cores = append(cores, &shipCore{
+				LevelEnabler: shipLevel(minimum),
+				encoder:      customJSONEncoder(),
+				queue:        shipBuffer,
+			})
+		}
+
+		instance = &Logger{zap.New(zapcore.NewTee(cores...), zap.AddCaller())}
 	})
 
 	return instance
 }
 
+// GetFiles returns paths of the current log file and the rotated ones (possibly gzipped), the current one is the first
+func GetFiles() ([]string, error) {
+	appName := getAppName()
+	current := filepath.Join(options.Folder, appName+".log")
+
+	// e.g. cpe_agent-2021-09-01T08-00-00.000.log.gz
+	rotated, err := filepath.Glob(filepath.Join(options.Folder, appName+"-*.log*"))
+	if nil != err {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(rotated)))
+
+	paths := make([]string, 0, len(rotated)+1)
+	if _, err := os.Stat(current); nil == err {
+		paths = append(paths, current)
+	}
+
+	return append(paths, rotated...), nil
+}
+
 func getCurrentDirectory() (string, error) {
 	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
 	if err != nil {
@@ -0,0 +1,220 @@
+package logger
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// ShipOptions of the sink which ships entries to the server
+type ShipOptions struct {
+	Enabled     bool
+	Level       string        // minimum level of shipped entries, "warn" if it is blank
+	MaxBuffer   int           // in bytes, the oldest entries are dropped once the buffer exceeds it while offline
+	BatchSize   int           // entries in each batch
+	FlushPeriod time.Duration // period to ship buffered entries
+}
+
+// Shipper delivers a batch of JSON entries, "dropped" is the number of entries dropped since the former batch.
+// The batch is kept and shipped again later if an error is returned
+type Shipper func(batch []json.RawMessage, dropped int) error
+
+var (
+	shipperLocker sync.Mutex
+	shipper       Shipper
+	shipBuffer    *shipQueue
+)
+
+// SetShipper sets the function which ships entries, e.g. once the session is online, nil while offline
+func SetShipper(entryShipper Shipper) {
+	shipperLocker.Lock()
+	shipper = entryShipper
+	shipperLocker.Unlock()
+
+	if nil != entryShipper && nil != shipBuffer {
+		go shipBuffer.flush()
+	}
+}
+
+// shipQueue buffers encoded entries in memory
+type shipQueue struct {
+	options ShipOptions
+	locker  sync.Mutex
+	entries []json.RawMessage
+	size    int
+	dropped int
+	// sequence of entries[0], entries before "shipping" are in the batch being shipped
+	first    uint64
+	shipping uint64
+	// entries of the batch being shipped which were dropped, they are lost if shipping failed
+	shippingDropped int
+	// only one flush at a time
+	flushLocker sync.Mutex
+}
+
+func newShipQueue(shipOptions ShipOptions) *shipQueue {
+	if shipOptions.MaxBuffer <= 0 {
+		shipOptions.MaxBuffer = 65536
+	}
+	if shipOptions.BatchSize <= 0 {
+		shipOptions.BatchSize = 50
+	}
+	if shipOptions.FlushPeriod <= 0 {
+		shipOptions.FlushPeriod = 10 * time.Second
+	}
+
+	queue := &shipQueue{
+		options: shipOptions,
+		entries: make([]json.RawMessage, 0),
+	}
+
+	go func() {
+		ticker := time.NewTicker(shipOptions.FlushPeriod)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			queue.flush()
+		}
+	}()
+
+	return queue
+}
+
+func (queue *shipQueue) push(entry json.RawMessage) {
+	queue.locker.Lock()
+	queue.entries = append(queue.entries, entry)
+	queue.size += len(entry)
+
+	// cap the memory, the oldest entries are dropped first
+	for queue.size > queue.options.MaxBuffer && len(queue.entries) > 0 {
+		queue.size -= len(queue.entries[0])
+		queue.entries = queue.entries[1:]
+		if queue.first < queue.shipping {
+			queue.shippingDropped++
+		} else {
+			queue.dropped++
+		}
+		queue.first++
+	}
+
+	full := len(queue.entries) >= queue.options.BatchSize
+	queue.locker.Unlock()
+
+	if full {
+		go queue.flush()
+	}
+}
+
+// ship batches until the buffer is empty or shipping failed
+func (queue *shipQueue) flush() {
+	queue.flushLocker.Lock()
+	defer queue.flushLocker.Unlock()
+
+	for {
+		shipperLocker.Lock()
+		entryShipper := shipper
+		shipperLocker.Unlock()
+
+		if nil == entryShipper {
+			return
+		}
+
+		queue.locker.Lock()
+		count := len(queue.entries)
+		if count > queue.options.BatchSize {
+			count = queue.options.BatchSize
+		}
+		batch := make([]json.RawMessage, count)
+		copy(batch, queue.entries)
+		dropped := queue.dropped
+		if 0 == count && 0 == dropped {
+			queue.locker.Unlock()
+			return
+		}
+		queue.shipping = queue.first + uint64(count)
+		queue.shippingDropped = 0
+		queue.locker.Unlock()
+
+		err := entryShipper(batch, dropped)
+
+		queue.locker.Lock()
+		shipping := queue.shipping
+		queue.shipping = 0
+
+		if nil != err {
+			queue.dropped += queue.shippingDropped
+			queue.locker.Unlock()
+			return
+		}
+
+		// entries of the batch may be dropped while shipping, only the buffered ones are removed
+		for queue.first < shipping && len(queue.entries) > 0 {
+			queue.size -= len(queue.entries[0])
+			queue.entries = queue.entries[1:]
+			queue.first++
+		}
+		queue.dropped -= dropped
+		queue.locker.Unlock()
+	}
+}
+
+// shipLevel enables entries which are enabled by both the ship level and the effective level of the logger,
+// including the temporary one
+type shipLevel zapcore.Level
+
+func (minimum shipLevel) Enabled(entryLevel zapcore.Level) bool {
+	return entryLevel >= zapcore.Level(minimum) && level.Enabled(entryLevel)
+}
+
+// shipCore encodes entries in JSON into the ship queue
+type shipCore struct {
+	zapcore.LevelEnabler
+	encoder zapcore.Encoder
+	queue   *shipQueue
+}
+
+func (core *shipCore) With(fields []zapcore.Field) zapcore.Core {
+	encoder := core.encoder.Clone()
+	for _, field := range fields {
+		field.AddTo(encoder)
+	}
+
+	return &shipCore{
+		LevelEnabler: core.LevelEnabler,
+		encoder:      encoder,
+		queue:        core.queue,
+	}
+}
+
+func (core *shipCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if core.Enabled(entry.Level) {
+		return checked.AddCore(entry, core)
+	}
+
+	return checked
+}
+
+func (core *shipCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	buffer, err := core.encoder.EncodeEntry(entry, fields)
+	if nil != err {
+		return err
+	}
+
+	data := make([]byte, 0, buffer.Len())
+	data = append(data, buffer.Bytes()...)
+	buffer.Free()
+
+	// trailing line ending of the encoder
+	for len(data) > 0 && '\n' == data[len(data)-1] {
+		data = data[:len(data)-1]
+	}
+
+	core.queue.push(json.RawMessage(data))
+	return nil
+}
+
+func (core *shipCore) Sync() error {
+	return nil
+}
@@ -0,0 +1,119 @@
+package logger
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+type shippedBatch struct {
+	entries []string
+	dropped int
+}
+
+func TestShipQueueFlush(t *testing.T) {
+	tests := []struct {
+		name     string
+		fail     bool
+		expected []shippedBatch
+	}{
+		// "a" and "b" are dropped while being shipped
+		{"shipped", false, []shippedBatch{{[]string{"a", "b", "c"}, 0}, {[]string{"d", "e"}, 0}}},
+		{"failed", true, []shippedBatch{{[]string{"c", "d", "e"}, 2}}},
+	}
+
+	for _, test := range tests {
+		// 3 entries at most, hence the queue never flushes by itself
+		queue := newShipQueue(ShipOptions{MaxBuffer: 30, BatchSize: 4, FlushPeriod: time.Hour})
+		entry := func(name string) json.RawMessage {
+			return json.RawMessage(`"` + name + `-------"`)
+		}
+
+		for _, name := range []string{"a", "b", "c"} {
+			queue.push(entry(name))
+		}
+
+		batches := make([]shippedBatch, 0)
+		first := true
+		SetShipper(func(batch []json.RawMessage, dropped int) error {
+			if first {
+				first = false
+				queue.push(entry("d"))
+				queue.push(entry("e"))
+
+				if test.fail {
+					return errors.New("OFFLINE")
+				}
+			}
+
+			shipped := shippedBatch{dropped: dropped}
+			for _, raw := range batch {
+				shipped.entries = append(shipped.entries, string(raw[1:2]))
+			}
+			batches = append(batches, shipped)
+			return nil
+		})
+
+		queue.flush()
+		if test.fail {
+			queue.flush()
+		}
+		SetShipper(nil)
+
+		if len(test.expected) != len(batches) {
+			t.Errorf("%s: expected %+v but got %+v", test.name, test.expected, batches)
+			continue
+		}
+
+		for idx, expected := range test.expected {
+			if expected.dropped != batches[idx].dropped || len(expected.entries) != len(batches[idx].entries) {
+				t.Errorf("%s: expected %+v but got %+v", test.name, expected, batches[idx])
+				continue
+			}
+
+			for entryIdx := range expected.entries {
+				if expected.entries[entryIdx] != batches[idx].entries[entryIdx] {
+					t.Errorf("%s: expected %+v but got %+v", test.name, expected, batches[idx])
+				}
+			}
+		}
+
+		if 0 != len(queue.entries) || 0 != queue.size || 0 != queue.dropped {
+			t.Errorf("%s: queue is not empty, %d entries in %d bytes and %d dropped", test.name, len(queue.entries), queue.size, queue.dropped)
+		}
+	}
+}
+
+func TestShipLevel(t *testing.T) {
+	defer SetLevel("debug")
+	defer RevertLevel()
+
+	tests := []struct {
+		name      string
+		level     string
+		temporary string
+		enabled   map[zapcore.Level]bool
+	}{
+		{"ship level", "debug", "", map[zapcore.Level]bool{zapcore.InfoLevel: false, zapcore.WarnLevel: true, zapcore.ErrorLevel: true}},
+		{"effective level", "error", "", map[zapcore.Level]bool{zapcore.WarnLevel: false, zapcore.ErrorLevel: true}},
+		{"temporary level", "debug", "error", map[zapcore.Level]bool{zapcore.WarnLevel: false, zapcore.ErrorLevel: true}},
+		{"verbose temporary level", "error", "debug", map[zapcore.Level]bool{zapcore.InfoLevel: false, zapcore.WarnLevel: true}},
+	}
+
+	for _, test := range tests {
+		SetLevel(test.level)
+		RevertLevel()
+		if "" != test.temporary {
+			SetTemporaryLevel(test.temporary, time.Hour)
+		}
+
+		for entryLevel, enabled := range test.enabled {
+			if enabled != shipLevel(zapcore.WarnLevel).Enabled(entryLevel) {
+				t.Errorf("%s: expected %s to be enabled %v", test.name, entryLevel, enabled)
+			}
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package logger
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// SyslogOptions of the syslog sink
+type SyslogOptions struct {
+	Network  string // "unix" for local socket (e.g. /dev/log), "udp" or "tcp" for RFC 5424, blank to disable
+	Address  string // e.g. "/dev/log" or "10.0.0.1:514"
+	Facility int    // 0 to 23, e.g. 1 is user-level and 16 is local0
+}
+
+// syslogCore sends each entry as a syslog message whose severity follows the level of the entry
+type syslogCore struct {
+	zapcore.LevelEnabler
+	encoder zapcore.Encoder
+	writer  *syslogWriter
+}
+
+func newSyslogCore(encoder zapcore.Encoder, enabler zapcore.LevelEnabler, syslogOptions SyslogOptions, appName string) zapcore.Core {
+	hostname, _ := os.Hostname()
+	if "" == hostname {
+		hostname = "-"
+	}
+
+	writer := &syslogWriter{
+		options:  syslogOptions,
+		hostname: hostname,
+		appName:  appName,
+		packets:  make(chan []byte, syslogQueueSize),
+	}
+	go writer.run()
+
+	return &syslogCore{
+		LevelEnabler: enabler,
+		encoder:      encoder,
+		writer:       writer,
+	}
+}
+
+func (core *syslogCore) With(fields []zapcore.Field) zapcore.Core {
+	encoder := core.encoder.Clone()
+	for _, field := range fields {
+		field.AddTo(encoder)
+	}
+
+	return &syslogCore{
+		LevelEnabler: core.LevelEnabler,
+		encoder:      encoder,
+		writer:       core.writer,
+	}
+}
+
+func (core *syslogCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if core.Enabled(entry.Level) {
+		return checked.AddCore(entry, core)
+	}
+
+	return checked
+}
+
+func (core *syslogCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	buffer, err := core.encoder.EncodeEntry(entry, fields)
+	if nil != err {
+		return err
+	}
+	defer buffer.Free()
+
+	return core.writer.write(severity(entry.Level), entry.Time, strings.TrimSuffix(buffer.String(), "\n"))
+}
+
+func (core *syslogCore) Sync() error {
+	return nil
+}
+
+const (
+	// packets queued while the daemon is slow or unreachable, the newest are dropped beyond it
+	syslogQueueSize = 1024
+	// backoff of dialing once the daemon is unreachable
+	syslogMinBackoff = time.Second
+	syslogMaxBackoff = time.Minute
+)
+
+// syslogWriter queues packets for the routine which keeps the connection to the syslog daemon,
+// logging never waits for dialing or writing
+type syslogWriter struct {
+	options  SyslogOptions
+	hostname string
+	appName  string
+	packets  chan []byte
+}
+
+func (writer *syslogWriter) write(severity int, timestamp time.Time, message string) error {
+	priority := writer.options.Facility*8 + severity
+
+	var packet string
+	if "unix" == writer.options.Network {
+		// local daemons expect RFC 3164
+		packet = fmt.Sprintf("<%d>%s %s[%d]: %s", priority, timestamp.Format(time.Stamp), writer.appName, os.Getpid(), message)
+	} else {
+		packet = fmt.Sprintf("<%d>1 %s %s %s %d - - %s", priority, timestamp.Format(time.RFC3339Nano), writer.hostname, writer.appName, os.Getpid(), message)
+	}
+
+	// octet counting framing of RFC 6587
+	if "tcp" == writer.options.Network {
+		packet = fmt.Sprintf("%d %s", len(packet), packet)
+	}
+
+	// the packet is dropped once the queue is full
+	select {
+	case writer.packets <- []byte(packet):
+	default:
+	}
+
+	return nil
+}
+
+// run sends queued packets, packets are dropped while dialing backs off
+func (writer *syslogWriter) run() {
+	var conn net.Conn
+	var redialTime time.Time
+	backoff := syslogMinBackoff
+
+	for packet := range writer.packets {
+		for retry := 0; retry < 2; retry++ {
+			if nil == conn {
+				if time.Now().Before(redialTime) {
+					break
+				}
+
+				var err error
+				conn, err = writer.dial()
+				if nil != err {
+					conn = nil
+					redialTime = time.Now().Add(backoff)
+					if backoff *= 2; backoff > syslogMaxBackoff {
+						backoff = syslogMaxBackoff
+					}
+
+					break
+				}
+
+				backoff = syslogMinBackoff
+			}
+
+			conn.SetWriteDeadline(time.Now().Add(time.Second))
+			if _, err := conn.Write(packet); nil == err {
+				break
+			}
+
+			// the connection is re-established once
+			conn.Close()
+			conn = nil
+		}
+	}
+}
+
+func (writer *syslogWriter) dial() (net.Conn, error) {
+	if "unix" != writer.options.Network {
+		return net.DialTimeout(writer.options.Network, writer.options.Address, time.Second)
+	}
+
+	// /dev/log is a datagram socket on most systems
+	conn, err := net.Dial("unixgram", writer.options.Address)
+	if nil != err {
+		conn, err = net.Dial("unix", writer.options.Address)
+	}
+
+	return conn, err
+}
+
+// syslog severity of the level
+func severity(level zapcore.Level) int {
+	switch level {
+	case zapcore.DebugLevel:
+		return 7
+	case zapcore.InfoLevel:
+		return 6
+	case zapcore.WarnLevel:
+		return 4
+	case zapcore.ErrorLevel:
+		return 3
+	case zapcore.DPanicLevel, zapcore.PanicLevel:
+		return 2
+	default:
+		return 0
+	}
+}
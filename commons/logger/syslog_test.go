@@ -0,0 +1,64 @@
+package logger
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSyslogWriter(network string, address string) *syslogWriter {
+	writer := &syslogWriter{
+		options:  SyslogOptions{Network: network, Address: address, Facility: 16},
+		hostname: "host",
+		appName:  "app",
+		packets:  make(chan []byte, syslogQueueSize),
+	}
+	go writer.run()
+
+	return writer
+}
+
+func TestSyslogWriterDelivers(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	writer := newTestSyslogWriter("udp", listener.LocalAddr().String())
+	defer close(writer.packets)
+
+	if err = writer.write(3, time.Now(), "message"); nil != err {
+		t.Fatal(err)
+	}
+
+	buffer := make([]byte, 1024)
+	listener.SetReadDeadline(time.Now().Add(time.Second * 3))
+	count, _, err := listener.ReadFrom(buffer)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	// facility 16 and severity 3
+	if packet := string(buffer[:count]); false == strings.HasPrefix(packet, "<131>1 ") || false == strings.HasSuffix(packet, " message") {
+		t.Errorf("unexpected packet '%s'", packet)
+	}
+}
+
+func TestSyslogWriterNeverBlocks(t *testing.T) {
+	// nothing listens on the socket, and the queue overflows
+	writer := newTestSyslogWriter("unix", "/nonexistent/log")
+	defer close(writer.packets)
+
+	start := time.Now()
+	for index := 0; index < syslogQueueSize*2; index++ {
+		if err := writer.write(6, time.Now(), "message"); nil != err {
+			t.Fatal(err)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("writing took %s", elapsed)
+	}
+}
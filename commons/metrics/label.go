@@ -0,0 +1,42 @@
+package metrics
+
+import "sync"
+
+// label values which keep the cardinality of labels bounded
+const (
+	OtherLabel   string = "other"   // values beyond the limit of a BoundedLabel
+	UnknownLabel string = "unknown" // values which cannot be parsed, e.g. unknown functions of datagrams
+)
+
+// BoundedLabel keeps the cardinality of a label whose values come from peers, e.g. paths of ubus calls.
+// The first "limit" distinct values are reported as they are, later ones as OtherLabel
+type BoundedLabel struct {
+	locker sync.Mutex
+	limit  int
+	values map[string]bool
+}
+
+// NewBoundedLabel ...
+func NewBoundedLabel(limit int) *BoundedLabel {
+	return &BoundedLabel{
+		limit:  limit,
+		values: make(map[string]bool),
+	}
+}
+
+// Value returns the label value of "value"
+func (label *BoundedLabel) Value(value string) string {
+	label.locker.Lock()
+	defer label.locker.Unlock()
+
+	if _, ok := label.values[value]; ok {
+		return value
+	}
+
+	if len(label.values) >= label.limit {
+		return OtherLabel
+	}
+
+	label.values[value] = true
+	return value
+}
@@ -0,0 +1,25 @@
+package metrics
+
+import "testing"
+
+func TestBoundedLabel(t *testing.T) {
+	label := NewBoundedLabel(2)
+
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"a", "a"},
+		{"b", "b"},
+		{"c", OtherLabel},
+		{"a", "a"},
+		{"d", OtherLabel},
+		{"b", "b"},
+	}
+
+	for _, test := range tests {
+		if actual := label.Value(test.value); test.expected != actual {
+			t.Errorf("%s: expected '%s' but got '%s'", test.value, test.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"sercomm.com/demeter/commons/logger"
+)
+
+// kinds of metrics
+const (
+	KindCounter   string = "counter"
+	KindGauge     string = "gauge"
+	KindHistogram string = "histogram"
+)
+
+// DefaultBuckets are upper bounds (in seconds) of histograms of latency
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Registry keeps counters, gauges and histograms in memory, it implements kafkaex.Metrics
+type Registry struct {
+	locker   sync.Mutex
+	families map[string]*family // pair< name, family >
+}
+
+// Sample is a value of a series, histograms are flattened into "_bucket" (cumulative, labeled by "le"), "_sum" and "_count"
+type Sample struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value"`
+}
+
+// all series of a metric
+type family struct {
+	name    string
+	help    string
+	kind    string
+	buckets []float64
+	series  map[string]*series // pair< rendered labels, series >
+	// it was used as another kind, which is logged once
+	mismatched bool
+}
+
+type series struct {
+	labels map[string]string
+	value  float64  // counter or gauge
+	counts []uint64 // histogram, count of each bucket (not cumulative)
+	sum    float64  // histogram
+	count  uint64   // histogram
+}
+
+var (
+	once     sync.Once
+	instance *Registry
+)
+
+// Default returns the registry shared by the process
+func Default() *Registry {
+	once.Do(func() {
+		instance = NewRegistry()
+	})
+
+	return instance
+}
+
+// NewRegistry ...
+func NewRegistry() *Registry {
+	return &Registry{
+		families: make(map[string]*family),
+	}
+}
+
+// Describe sets the help text of a metric, it is optional
+func (registry *Registry) Describe(name string, kind string, help string) {
+	registry.locker.Lock()
+	defer registry.locker.Unlock()
+
+	if family := registry.getFamily(name, kind); nil != family {
+		family.help = help
+	}
+}
+
+// AddCounter increases the counter, e.g. AddCounter("ws_connects_total", map[string]string{"result": "success"}, 1)
+func (registry *Registry) AddCounter(name string, labels map[string]string, delta float64) {
+	registry.locker.Lock()
+	defer registry.locker.Unlock()
+
+	if family := registry.getFamily(name, KindCounter); nil != family {
+		registry.getSeries(family, labels).value += delta
+	}
+}
+
+// SetGauge sets the gauge to "value"
+func (registry *Registry) SetGauge(name string, labels map[string]string, value float64) {
+	registry.locker.Lock()
+	defer registry.locker.Unlock()
+
+	if family := registry.getFamily(name, KindGauge); nil != family {
+		registry.getSeries(family, labels).value = value
+	}
+}
+
+// Observe adds "value" into the histogram with DefaultBuckets
+func (registry *Registry) Observe(name string, labels map[string]string, value float64) {
+	registry.locker.Lock()
+	defer registry.locker.Unlock()
+
+	family := registry.getFamily(name, KindHistogram)
+	if nil == family {
+		return
+	}
+	series := registry.getSeries(family, labels)
+
+	for idx, bound := range family.buckets {
+		if value <= bound {
+			series.counts[idx]++
+			break
+		}
+	}
+	series.sum += value
+	series.count++
+}
+
+// ObserveDuration adds the seconds elapsed since "start" into the histogram
+func (registry *Registry) ObserveDuration(name string, labels map[string]string, start time.Time) {
+	registry.Observe(name, labels, time.Since(start).Seconds())
+}
+
+// Snapshot returns current values of all series ordered by name
+func (registry *Registry) Snapshot() []Sample {
+	registry.locker.Lock()
+	defer registry.locker.Unlock()
+
+	samples := make([]Sample, 0)
+	for _, family := range registry.sortedFamilies() {
+		for _, key := range sortedKeys(family.series) {
+			series := family.series[key]
+			if KindHistogram == family.kind {
+				cumulative := uint64(0)
+				for idx, bound := range family.buckets {
+					cumulative += series.counts[idx]
+					samples = append(samples, Sample{Name: family.name + "_bucket", Labels: bucketLabels(series.labels, formatValue(bound)), Value: float64(cumulative)})
+				}
+
+				samples = append(samples,
+					Sample{Name: family.name + "_bucket", Labels: bucketLabels(series.labels, "+Inf"), Value: float64(series.count)},
+					Sample{Name: family.name + "_sum", Labels: series.labels, Value: series.sum},
+					Sample{Name: family.name + "_count", Labels: series.labels, Value: float64(series.count)})
+				continue
+			}
+
+			samples = append(samples, Sample{Name: family.name, Labels: series.labels, Value: series.value})
+		}
+	}
+
+	return samples
+}
+
+// WriteText writes all series in the Prometheus text exposition format
+func (registry *Registry) WriteText(writer io.Writer) error {
+	registry.locker.Lock()
+	defer registry.locker.Unlock()
+
+	buffered := bufio.NewWriter(writer)
+	for _, family := range registry.sortedFamilies() {
+		if "" != family.help {
+			fmt.Fprintf(buffered, "# HELP %s %s\n", family.name, strings.Replace(family.help, "\n", " ", -1))
+		}
+		fmt.Fprintf(buffered, "# TYPE %s %s\n", family.name, family.kind)
+
+		for _, key := range sortedKeys(family.series) {
+			series := family.series[key]
+			if KindHistogram != family.kind {
+				fmt.Fprintf(buffered, "%s%s %s\n", family.name, braces(key), formatValue(series.value))
+				continue
+			}
+
+			cumulative := uint64(0)
+			for idx, bound := range family.buckets {
+				cumulative += series.counts[idx]
+				fmt.Fprintf(buffered, "%s_bucket%s %d\n", family.name, braces(joinLabels(key, "le", formatValue(bound))), cumulative)
+			}
+			fmt.Fprintf(buffered, "%s_bucket%s %d\n", family.name, braces(joinLabels(key, "le", "+Inf")), series.count)
+			fmt.Fprintf(buffered, "%s_sum%s %s\n", family.name, braces(key), formatValue(series.sum))
+			fmt.Fprintf(buffered, "%s_count%s %d\n", family.name, braces(key), series.count)
+		}
+	}
+
+	return buffered.Flush()
+}
+
+// ServeHTTP exposes the registry, e.g. http.Handle("/metrics", registry)
+func (registry *Registry) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	registry.WriteText(writer)
+}
+
+// getFamily returns nil if the metric was described or used as another kind
+func (registry *Registry) getFamily(name string, kind string) *family {
+	target, ok := registry.families[name]
+	if false == ok {
+		target = &family{
+			name:   name,
+			kind:   kind,
+			series: make(map[string]*series),
+		}
+		if KindHistogram == kind {
+			target.buckets = DefaultBuckets
+		}
+		registry.families[name] = target
+	}
+
+	if kind != target.kind {
+		if false == target.mismatched {
+			target.mismatched = true
+			logger.New().Error("metrics: KIND MISMATCH, VALUES ARE IGNORED", zap.String("name", name), zap.String("kind", target.kind), zap.String("usedAs", kind))
+		}
+		return nil
+	}
+
+	return target
+}
+
+// labels of a series with the upper bound "le" of a bucket
+func bucketLabels(labels map[string]string, bound string) map[string]string {
+	copied := make(map[string]string, len(labels)+1)
+	for name, value := range labels {
+		copied[name] = value
+	}
+	copied["le"] = bound
+
+	return copied
+}
+
+func (registry *Registry) getSeries(family *family, labels map[string]string) *series {
+	key := renderLabels(labels)
+
+	target, ok := family.series[key]
+	if false == ok {
+		copied := make(map[string]string, len(labels))
+		for name, value := range labels {
+			copied[name] = value
+		}
+
+		target = &series{labels: copied}
+		if KindHistogram == family.kind {
+			target.counts = make([]uint64, len(family.buckets))
+		}
+		family.series[key] = target
+	}
+
+	return target
+}
+
+func (registry *Registry) sortedFamilies() []*family {
+	names := make([]string, 0, len(registry.families))
+	for name := range registry.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	families := make([]*family, 0, len(names))
+	for _, name := range names {
+		families = append(families, registry.families[name])
+	}
+
+	return families
+}
+
+func sortedKeys(seriesMap map[string]*series) []string {
+	keys := make([]string, 0, len(seriesMap))
+	for key := range seriesMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// e.g. `function="F_UBUS",result="success"` ordered by label names
+func renderLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, name+"=\""+escape(labels[name])+"\"")
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func joinLabels(rendered string, name string, value string) string {
+	pair := name + "=\"" + escape(value) + "\""
+	if "" == rendered {
+		return pair
+	}
+
+	return rendered + "," + pair
+}
+
+func braces(rendered string) string {
+	if "" == rendered {
+		return ""
+	}
+
+	return "{" + rendered + "}"
+}
+
+func escape(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return strings.Replace(value, "\n", `\n`, -1)
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
@@ -0,0 +1,92 @@
+package metrics
+
+import (
+	"testing"
+)
+
+func findSample(samples []Sample, name string, le string) (Sample, bool) {
+	for _, sample := range samples {
+		if name == sample.Name && le == sample.Labels["le"] {
+			return sample, true
+		}
+	}
+
+	return Sample{}, false
+}
+
+func TestRegistryKindMismatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		describe string
+		use      func(registry *Registry)
+	}{
+		{"observed counter", KindCounter, func(registry *Registry) { registry.Observe("metric", nil, 1) }},
+		{"observed gauge", KindGauge, func(registry *Registry) { registry.Observe("metric", nil, 1) }},
+		{"counted histogram", KindHistogram, func(registry *Registry) { registry.AddCounter("metric", nil, 1) }},
+		{"gauged counter", KindCounter, func(registry *Registry) { registry.SetGauge("metric", nil, 1) }},
+	}
+
+	for _, test := range tests {
+		registry := NewRegistry()
+		registry.Describe("metric", test.describe, "help")
+
+		// values of another kind are ignored
+		test.use(registry)
+		test.use(registry)
+
+		if samples := registry.Snapshot(); 0 != len(samples) {
+			t.Errorf("%s: unexpected samples %+v", test.name, samples)
+		}
+	}
+}
+
+func TestRegistrySnapshotHistogram(t *testing.T) {
+	registry := NewRegistry()
+	labels := map[string]string{"path": "Services"}
+
+	for _, value := range []float64{0.001, 0.02, 0.02, 3, 60} {
+		registry.Observe("duration", labels, value)
+	}
+
+	tests := []struct {
+		name     string
+		le       string
+		expected float64
+	}{
+		{"duration_bucket", "0.005", 1},
+		{"duration_bucket", "0.01", 1},
+		{"duration_bucket", "0.025", 3},
+		{"duration_bucket", "2.5", 3},
+		{"duration_bucket", "5", 4},
+		{"duration_bucket", "10", 4},
+		{"duration_bucket", "+Inf", 5},
+		{"duration_count", "", 5},
+		{"duration_sum", "", 63.041},
+	}
+
+	samples := registry.Snapshot()
+	if len(DefaultBuckets)+3 != len(samples) {
+		t.Fatalf("expected %d samples but got %d", len(DefaultBuckets)+3, len(samples))
+	}
+
+	for _, test := range tests {
+		sample, ok := findSample(samples, test.name, test.le)
+		if false == ok {
+			t.Errorf("%s{le=%s}: missing", test.name, test.le)
+			continue
+		}
+
+		if "Services" != sample.Labels["path"] {
+			t.Errorf("%s{le=%s}: unexpected labels %+v", test.name, test.le, sample.Labels)
+		}
+
+		if diff := sample.Value - test.expected; diff > 1e-9 || diff < -1e-9 {
+			t.Errorf("%s{le=%s}: expected %f but got %f", test.name, test.le, test.expected, sample.Value)
+		}
+	}
+
+	// labels of the series are not modified by buckets
+	if 1 != len(labels) {
+		t.Errorf("unexpected labels %+v", labels)
+	}
+}
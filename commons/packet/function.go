@@ -3,12 +3,20 @@ package packet
 type Function string
 
 const (
-	F_UNKNOWN  Function = ""
-	F_PING     Function = "F_PING"
-	F_IDENTIFY Function = "F_IDENTIFY"
-	F_REBOOT   Function = "F_REBOOT"
-	F_UPGRADE  Function = "F_UPGRADE"
-	F_UBUS     Function = "F_UBUS"
+	F_UNKNOWN   Function = ""
+	F_PING      Function = "F_PING"
+	F_IDENTIFY  Function = "F_IDENTIFY"
+	F_REBOOT    Function = "F_REBOOT"
+	F_UPGRADE   Function = "F_UPGRADE"
+	F_UBUS      Function = "F_UBUS"
+	F_CONFIG    Function = "F_CONFIG"
+	F_LOG_LEVEL Function = "F_LOG_LEVEL"
+	F_LOG_FETCH Function = "F_LOG_FETCH"
+	F_LOG_SHIP  Function = "F_LOG_SHIP"
+	F_METRICS   Function = "F_METRICS"
+	F_QUALITY   Function = "F_QUALITY"
+	F_RELAY     Function = "F_RELAY"
+	F_REPLAY    Function = "F_REPLAY"
 )
 
 // String : convert element to string
@@ -24,6 +32,22 @@ func (e Function) String() string {
 		return "F_UPGRADE"
 	case F_UBUS:
 		return "F_UBUS"
+	case F_CONFIG:
+		return "F_CONFIG"
+	case F_LOG_LEVEL:
+		return "F_LOG_LEVEL"
+	case F_LOG_FETCH:
+		return "F_LOG_FETCH"
+	case F_LOG_SHIP:
+		return "F_LOG_SHIP"
+	case F_METRICS:
+		return "F_METRICS"
+	case F_QUALITY:
+		return "F_QUALITY"
+	case F_RELAY:
+		return "F_RELAY"
+	case F_REPLAY:
+		return "F_REPLAY"
 	default:
 		return ""
 	}
@@ -41,6 +65,22 @@ func ParseFunction(functionString string) Function {
 		return F_UPGRADE
 	case "F_UBUS":
 		return F_UBUS
+	case "F_CONFIG":
+		return F_CONFIG
+	case "F_LOG_LEVEL":
+		return F_LOG_LEVEL
+	case "F_LOG_FETCH":
+		return F_LOG_FETCH
+	case "F_LOG_SHIP":
+		return F_LOG_SHIP
+	case "F_METRICS":
+		return F_METRICS
+	case "F_QUALITY":
+		return F_QUALITY
+	case "F_RELAY":
+		return F_RELAY
+	case "F_REPLAY":
+		return F_REPLAY
 	default:
 		return F_UNKNOWN
 	}
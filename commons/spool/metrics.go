@@ -0,0 +1,35 @@
+package spool
+
+import (
+	"sercomm.com/demeter/commons/metrics"
+)
+
+// metrics of spools in metrics.Default()
+const (
+	MetricRecords string = "spool_records"
+	MetricBytes   string = "spool_bytes"
+	MetricDropped string = "spool_dropped_total"
+)
+
+func init() {
+	registry := metrics.Default()
+	registry.Describe(MetricRecords, metrics.KindGauge, "Records which are not acknowledged by class")
+	registry.Describe(MetricBytes, metrics.KindGauge, "Total size of segment files")
+	registry.Describe(MetricDropped, metrics.KindCounter, "Records dropped before acknowledged by class and reason")
+}
+
+func setRecords(className string, count int) {
+	metrics.Default().SetGauge(MetricRecords, map[string]string{"class": className}, float64(count))
+}
+
+func setBytes(size int64) {
+	metrics.Default().SetGauge(MetricBytes, nil, float64(size))
+}
+
+func countDropped(className string, reason string, count int) {
+	if 0 == count {
+		return
+	}
+
+	metrics.Default().AddCounter(MetricDropped, map[string]string{"class": className, "reason": reason}, float64(count))
+}
@@ -0,0 +1,139 @@
+package spool
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// each record is a header followed by the data
+//
+//	0 - 4  : length of the data
+//	4 - 8  : CRC-32 of the rest of the header and the data
+//	8 - 16 : sequence number
+//	16 - 24: time of appending in unix nanoseconds
+const headerSize int = 24
+
+const segmentSuffix string = ".seg"
+
+// segment is an append-only file, it is deleted once all its records are acknowledged or dropped
+type segment struct {
+	path    string
+	size    int64
+	pending int // records which are not acknowledged yet
+}
+
+// entry locates a record which is not acknowledged yet
+type entry struct {
+	seq     uint64
+	time    time.Time
+	segment *segment
+	offset  int64 // offset of the data
+	length  int
+}
+
+func segmentName(firstSeq uint64) string {
+	return fmt.Sprintf("%020d%s", firstSeq, segmentSuffix)
+}
+
+// segment files of the folder in order of their first sequence numbers
+func listSegments(folder string) ([]string, error) {
+	infos, err := ioutil.ReadDir(folder)
+	if nil != err {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if false == info.IsDir() && strings.HasSuffix(info.Name(), segmentSuffix) {
+			paths = append(paths, filepath.Join(folder, info.Name()))
+		}
+	}
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+func encodeRecord(seq uint64, timestamp time.Time, data []byte) []byte {
+	record := make([]byte, headerSize+len(data))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint64(record[8:16], seq)
+	binary.BigEndian.PutUint64(record[16:24], uint64(timestamp.UnixNano()))
+	copy(record[headerSize:], data)
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(record[8:]))
+
+	return record
+}
+
+// load records of the segment file whose sequence numbers are greater than "acked".
+// A torn or corrupted tail (e.g. power loss while appending) is truncated
+func loadSegment(path string, acked uint64) (*segment, []*entry, uint64, error) {
+	content, err := ioutil.ReadFile(path)
+	if nil != err {
+		return nil, nil, 0, err
+	}
+
+	seg := &segment{path: path}
+	entries := make([]*entry, 0)
+	lastSeq := uint64(0)
+
+	offset := 0
+	for offset+headerSize <= len(content) {
+		length := int(binary.BigEndian.Uint32(content[offset : offset+4]))
+		end := offset + headerSize + length
+		if end > len(content) || binary.BigEndian.Uint32(content[offset+4:offset+8]) != crc32.ChecksumIEEE(content[offset+8:end]) {
+			break
+		}
+
+		seq := binary.BigEndian.Uint64(content[offset+8 : offset+16])
+		if seq > lastSeq {
+			lastSeq = seq
+		}
+
+		if seq > acked {
+			entries = append(entries, &entry{
+				seq:     seq,
+				time:    time.Unix(0, int64(binary.BigEndian.Uint64(content[offset+16:offset+24]))),
+				segment: seg,
+				offset:  int64(offset + headerSize),
+				length:  length,
+			})
+		}
+
+		offset = end
+	}
+
+	if offset != len(content) {
+		if err := os.Truncate(path, int64(offset)); nil != err {
+			return nil, nil, 0, err
+		}
+	}
+
+	seg.size = int64(offset)
+	seg.pending = len(entries)
+
+	return seg, entries, lastSeq, nil
+}
+
+// data of the entry
+func readEntry(target *entry) ([]byte, error) {
+	file, err := os.Open(target.segment.path)
+	if nil != err {
+		return nil, err
+	}
+	defer file.Close()
+
+	data := make([]byte, target.length)
+	_, err = file.ReadAt(data, target.offset)
+	if nil != err {
+		return nil, err
+	}
+
+	return data, nil
+}
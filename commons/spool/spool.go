@@ -0,0 +1,436 @@
+package spool
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// file of each class which keeps the sequence numbers of acknowledged records, the last one is effective
+const cursorName string = "acks"
+
+// the cursor file is compacted once it exceeds it
+const maxCursorSize int64 = 4096
+
+// Options of the spool
+type Options struct {
+	Folder      string        // each class is kept in a sub-folder
+	Classes     []string      // priority classes, records of the former classes are peeked first, e.g. [high, normal, low]
+	MaxBytes    int64         // total size of segments, the oldest segments of the last class are dropped beyond it
+	MaxAge      time.Duration // records older than it are dropped, 0 to keep
+	SegmentSize int64         // a new segment is started once the current one exceeds it
+	Sync        bool          // flush each record to the storage, it survives power loss but wears flash
+}
+
+// Record appended to the spool
+type Record struct {
+	Class string
+	Seq   uint64
+	Time  time.Time
+	Data  []byte
+}
+
+// Spool is a persistent queue of records in priority classes, records of each class are kept in order.
+// Records are appended to segment files which are deleted, not rewritten, once all their records are acknowledged
+type Spool struct {
+	options Options
+	locker  sync.Mutex
+	classes []*class // in order of priority
+	size    int64    // total size of segments
+}
+
+type class struct {
+	name       string
+	folder     string
+	segments   []*segment // oldest first
+	entries    []*entry   // records which are not acknowledged, oldest first
+	nextSeq    uint64
+	acked      uint64
+	cursor     *os.File
+	cursorSize int64
+	writer     *os.File // last segment which is opened for appending
+}
+
+// Open the spool, records which are not acknowledged before are loaded
+func Open(options Options) (*Spool, error) {
+	if 0 == len(options.Classes) {
+		return nil, errors.New("NO CLASS IS GIVEN")
+	}
+	if options.SegmentSize <= 0 {
+		options.SegmentSize = 65536
+	}
+
+	spool := &Spool{
+		options: options,
+		classes: make([]*class, 0, len(options.Classes)),
+	}
+
+	for _, name := range options.Classes {
+		target, err := spool.load(name)
+		if nil != err {
+			spool.Close()
+			return nil, err
+		}
+
+		spool.classes = append(spool.classes, target)
+	}
+
+	spool.locker.Lock()
+	spool.enforceSize()
+	spool.updateGauges()
+	spool.locker.Unlock()
+
+	return spool, nil
+}
+
+func (spool *Spool) load(name string) (*class, error) {
+	target := &class{
+		name:     name,
+		folder:   filepath.Join(spool.options.Folder, name),
+		segments: make([]*segment, 0),
+		entries:  make([]*entry, 0),
+	}
+
+	err := os.MkdirAll(target.folder, 0750)
+	if nil != err {
+		return nil, err
+	}
+
+	// the last complete sequence number in the cursor file
+	cursorPath := filepath.Join(target.folder, cursorName)
+	content, err := ioutil.ReadFile(cursorPath)
+	if nil != err && false == os.IsNotExist(err) {
+		return nil, err
+	}
+	if count := len(content) / 8; count > 0 {
+		target.acked = binary.BigEndian.Uint64(content[(count-1)*8 : count*8])
+	}
+
+	paths, err := listSegments(target.folder)
+	if nil != err {
+		return nil, err
+	}
+
+	lastSeq := target.acked
+	for _, path := range paths {
+		seg, entries, segmentLastSeq, err := loadSegment(path, target.acked)
+		if nil != err {
+			return nil, err
+		}
+
+		if segmentLastSeq > lastSeq {
+			lastSeq = segmentLastSeq
+		}
+
+		// all records were acknowledged
+		if 0 == seg.pending {
+			os.Remove(path)
+			continue
+		}
+
+		target.segments = append(target.segments, seg)
+		target.entries = append(target.entries, entries...)
+		spool.size += seg.size
+	}
+	target.nextSeq = lastSeq + 1
+
+	// the cursor is rewritten with the last sequence number only
+	err = writeCursor(cursorPath, target.acked)
+	if nil != err {
+		return nil, err
+	}
+
+	target.cursor, err = os.OpenFile(cursorPath, os.O_WRONLY|os.O_APPEND, 0640)
+	if nil != err {
+		return nil, err
+	}
+	target.cursorSize = 8
+
+	return target, nil
+}
+
+// Append the data to the class, the oldest segments are dropped once the spool exceeds "MaxBytes"
+func (spool *Spool) Append(className string, data []byte) error {
+	spool.locker.Lock()
+	defer spool.locker.Unlock()
+
+	target := spool.find(className)
+	if nil == target {
+		return fmt.Errorf("UNKNOWN CLASS: %s", className)
+	}
+
+	// start a new segment
+	if nil == target.writer || target.segments[len(target.segments)-1].size >= spool.options.SegmentSize {
+		if nil != target.writer {
+			target.writer.Close()
+			target.writer = nil
+		}
+
+		path := filepath.Join(target.folder, segmentName(target.nextSeq))
+		writer, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0640)
+		if nil != err {
+			return err
+		}
+
+		target.writer = writer
+		target.segments = append(target.segments, &segment{path: path})
+	}
+
+	seg := target.segments[len(target.segments)-1]
+	now := time.Now()
+	record := encodeRecord(target.nextSeq, now, data)
+
+	_, err := target.writer.Write(record)
+	if nil == err && spool.options.Sync {
+		err = target.writer.Sync()
+	}
+	if nil != err {
+		// the torn record is truncated by loading
+		target.writer.Close()
+		target.writer = nil
+		return err
+	}
+
+	target.entries = append(target.entries, &entry{
+		seq:     target.nextSeq,
+		time:    now,
+		segment: seg,
+		offset:  seg.size + int64(headerSize),
+		length:  len(data),
+	})
+	target.nextSeq++
+	seg.size += int64(len(record))
+	seg.pending++
+	spool.size += int64(len(record))
+
+	spool.enforceSize()
+	spool.updateGauges()
+
+	return nil
+}
+
+// Peek returns the oldest record of the first class which has records, nil if the spool is empty.
+// Expired records are dropped
+func (spool *Spool) Peek() (*Record, error) {
+	spool.locker.Lock()
+	defer spool.locker.Unlock()
+	defer spool.updateGauges()
+
+	now := time.Now()
+	for _, target := range spool.classes {
+		for 0 != len(target.entries) && spool.options.MaxAge > 0 && now.Sub(target.entries[0].time) > spool.options.MaxAge {
+			spool.done(target, "expired")
+		}
+
+		if 0 == len(target.entries) {
+			continue
+		}
+
+		head := target.entries[0]
+		data, err := readEntry(head)
+		if nil != err {
+			return nil, err
+		}
+
+		return &Record{
+			Class: target.name,
+			Seq:   head.seq,
+			Time:  head.time,
+			Data:  data,
+		}, nil
+	}
+
+	return nil, nil
+}
+
+// Ack removes the record given by Peek, records are acknowledged in order.
+// The record may be dropped meanwhile (e.g. the spool is full), acknowledging it does nothing then
+func (spool *Spool) Ack(record *Record) error {
+	spool.locker.Lock()
+	defer spool.locker.Unlock()
+
+	target := spool.find(record.Class)
+	if nil == target {
+		return fmt.Errorf("UNKNOWN CLASS: %s", record.Class)
+	}
+
+	if record.Seq >= target.nextSeq {
+		return fmt.Errorf("RECORD %d OF %s DOES NOT EXIST", record.Seq, record.Class)
+	}
+
+	// records older than the head are dropped already
+	if 0 == len(target.entries) || target.entries[0].seq > record.Seq {
+		return nil
+	}
+
+	if target.entries[0].seq != record.Seq {
+		return fmt.Errorf("RECORD %d IS NOT THE OLDEST ONE OF %s", record.Seq, record.Class)
+	}
+
+	err := spool.done(target, "")
+	spool.updateGauges()
+
+	return err
+}
+
+// Len returns the number of records which are not acknowledged
+func (spool *Spool) Len() int {
+	spool.locker.Lock()
+	defer spool.locker.Unlock()
+
+	count := 0
+	for _, target := range spool.classes {
+		count += len(target.entries)
+	}
+
+	return count
+}
+
+// Close files of the spool
+func (spool *Spool) Close() {
+	spool.locker.Lock()
+	defer spool.locker.Unlock()
+
+	for _, target := range spool.classes {
+		if nil != target.writer {
+			target.writer.Close()
+			target.writer = nil
+		}
+		if nil != target.cursor {
+			target.cursor.Close()
+			target.cursor = nil
+		}
+	}
+}
+
+func (spool *Spool) find(className string) *class {
+	for _, target := range spool.classes {
+		if target.name == className {
+			return target
+		}
+	}
+
+	return nil
+}
+
+// the oldest record of the class is acknowledged, or dropped for "reason"
+func (spool *Spool) done(target *class, reason string) error {
+	head := target.entries[0]
+	target.entries = target.entries[1:]
+	target.acked = head.seq
+
+	if "" != reason {
+		countDropped(target.name, reason, 1)
+	}
+
+	head.segment.pending--
+	if 0 == head.segment.pending {
+		spool.removeSegment(target, head.segment)
+	}
+
+	_, err := target.cursor.Write(encodeSeq(head.seq))
+	target.cursorSize += 8
+	if nil == err && target.cursorSize > maxCursorSize {
+		err = spool.compactCursor(target)
+	}
+
+	return err
+}
+
+// drop the oldest segments of the last classes until the spool fits "MaxBytes"
+func (spool *Spool) enforceSize() {
+	if spool.options.MaxBytes <= 0 {
+		return
+	}
+
+	for spool.size > spool.options.MaxBytes {
+		var target *class
+		for idx := len(spool.classes) - 1; idx >= 0; idx-- {
+			if 0 != len(spool.classes[idx].segments) {
+				target = spool.classes[idx]
+				break
+			}
+		}
+
+		if nil == target {
+			return
+		}
+
+		oldest := target.segments[0]
+		remaining := make([]*entry, 0, len(target.entries))
+		for _, item := range target.entries {
+			if item.segment != oldest {
+				remaining = append(remaining, item)
+			}
+		}
+		countDropped(target.name, "full", len(target.entries)-len(remaining))
+		target.entries = remaining
+
+		spool.removeSegment(target, oldest)
+	}
+}
+
+func (spool *Spool) removeSegment(target *class, seg *segment) {
+	for idx, item := range target.segments {
+		if item != seg {
+			continue
+		}
+
+		// the last segment is being appended
+		if idx == len(target.segments)-1 && nil != target.writer {
+			target.writer.Close()
+			target.writer = nil
+		}
+
+		target.segments = append(target.segments[:idx], target.segments[idx+1:]...)
+		spool.size -= seg.size
+		os.Remove(seg.path)
+		return
+	}
+}
+
+func (spool *Spool) compactCursor(target *class) error {
+	cursorPath := filepath.Join(target.folder, cursorName)
+
+	target.cursor.Close()
+	target.cursor = nil
+
+	err := writeCursor(cursorPath, target.acked)
+	if nil != err {
+		return err
+	}
+
+	target.cursor, err = os.OpenFile(cursorPath, os.O_WRONLY|os.O_APPEND, 0640)
+	target.cursorSize = 8
+
+	return err
+}
+
+func (spool *Spool) updateGauges() {
+	for _, target := range spool.classes {
+		setRecords(target.name, len(target.entries))
+	}
+	setBytes(spool.size)
+}
+
+// replace the cursor file by a temporary file
+func writeCursor(path string, seq uint64) error {
+	temporaryPath := path + ".tmp"
+	err := ioutil.WriteFile(temporaryPath, encodeSeq(seq), 0640)
+	if nil != err {
+		return err
+	}
+
+	return os.Rename(temporaryPath, path)
+}
+
+func encodeSeq(seq uint64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, seq)
+	return data
+}
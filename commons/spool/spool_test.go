@@ -0,0 +1,296 @@
+package spool
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// each record takes 100 bytes, segments of 250 bytes keep 3 records
+const (
+	testSegmentSize int64 = 250
+	testRecordSize  int64 = 100
+)
+
+func testData(index int) []byte {
+	data := []byte(fmt.Sprintf("%04d", index))
+	return append(data, bytes.Repeat([]byte("."), int(testRecordSize)-headerSize-len(data))...)
+}
+
+func openTestSpool(t *testing.T, folder string, options Options) *Spool {
+	t.Helper()
+
+	options.Folder = folder
+	if 0 == len(options.Classes) {
+		options.Classes = []string{"high", "low"}
+	}
+	if 0 == options.SegmentSize {
+		options.SegmentSize = testSegmentSize
+	}
+
+	spool, err := Open(options)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	return spool
+}
+
+func appendRecords(t *testing.T, spool *Spool, className string, from int, count int) {
+	t.Helper()
+
+	for index := from; index < from+count; index++ {
+		if err := spool.Append(className, testData(index)); nil != err {
+			t.Fatal(err)
+		}
+	}
+}
+
+// peek and acknowledge "count" records, their data must be in order from "from"
+func ackRecords(t *testing.T, spool *Spool, from int, count int) {
+	t.Helper()
+
+	for index := from; index < from+count; index++ {
+		record, err := spool.Peek()
+		if nil != err {
+			t.Fatal(err)
+		}
+
+		if nil == record || false == bytes.Equal(testData(index), record.Data) {
+			t.Fatalf("expected record %d but got %+v", index, record)
+		}
+
+		if err = spool.Ack(record); nil != err {
+			t.Fatal(err)
+		}
+	}
+}
+
+func countSegments(t *testing.T, folder string) int {
+	t.Helper()
+
+	paths, err := listSegments(folder)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	return len(paths)
+}
+
+func newFolder(t *testing.T) string {
+	t.Helper()
+
+	folder, err := ioutil.TempDir("", "spool")
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	return folder
+}
+
+func TestSpoolSegments(t *testing.T) {
+	folder := newFolder(t)
+	defer os.RemoveAll(folder)
+
+	spool := openTestSpool(t, folder, Options{})
+	defer spool.Close()
+
+	appendRecords(t, spool, "low", 0, 7)
+	if count := countSegments(t, filepath.Join(folder, "low")); 3 != count {
+		t.Fatalf("expected 3 segments but got %d", count)
+	}
+
+	// records of the former classes go first
+	appendRecords(t, spool, "high", 100, 1)
+	ackRecords(t, spool, 100, 1)
+
+	// a segment is deleted once all its records are acknowledged
+	ackRecords(t, spool, 0, 3)
+	if count := countSegments(t, filepath.Join(folder, "low")); 2 != count {
+		t.Fatalf("expected 2 segments but got %d", count)
+	}
+
+	ackRecords(t, spool, 3, 4)
+	if 0 != spool.Len() || 0 != countSegments(t, filepath.Join(folder, "low")) {
+		t.Fatalf("unexpected %d records left", spool.Len())
+	}
+
+	if record, err := spool.Peek(); nil != record || nil != err {
+		t.Fatalf("unexpected record %+v, %v", record, err)
+	}
+}
+
+func TestSpoolRecovery(t *testing.T) {
+	folder := newFolder(t)
+	defer os.RemoveAll(folder)
+
+	spool := openTestSpool(t, folder, Options{})
+	appendRecords(t, spool, "low", 0, 5)
+	ackRecords(t, spool, 0, 2)
+	spool.Close()
+
+	// a record torn by power loss
+	paths, _ := listSegments(filepath.Join(folder, "low"))
+	file, err := os.OpenFile(paths[len(paths)-1], os.O_WRONLY|os.O_APPEND, 0640)
+	if nil != err {
+		t.Fatal(err)
+	}
+	file.Write(encodeRecord(6, time.Now(), testData(5))[:50])
+	file.Close()
+
+	spool = openTestSpool(t, folder, Options{})
+	defer spool.Close()
+
+	if 3 != spool.Len() {
+		t.Fatalf("expected 3 records but got %d", spool.Len())
+	}
+
+	// sequence numbers go on after restarting
+	appendRecords(t, spool, "low", 5, 1)
+	ackRecords(t, spool, 2, 4)
+
+	if 0 != spool.Len() {
+		t.Fatalf("unexpected %d records left", spool.Len())
+	}
+}
+
+func TestSpoolLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  Options
+		prepare  func(spool *Spool)
+		left     int
+		nextData []byte
+	}{
+		{
+			"full",
+			Options{MaxBytes: 5 * testRecordSize},
+			func(spool *Spool) {
+				// the oldest segment of the last class is dropped
+				appendRecords(t, spool, "high", 100, 3)
+			},
+			3,
+			testData(100),
+		},
+		{
+			"expired",
+			Options{MaxAge: time.Millisecond * 50},
+			func(spool *Spool) {
+				time.Sleep(time.Millisecond * 100)
+			},
+			0,
+			nil,
+		},
+	}
+
+	for _, test := range tests {
+		folder := newFolder(t)
+		spool := openTestSpool(t, folder, test.options)
+
+		appendRecords(t, spool, "low", 0, 3)
+
+		// the head is being delivered while it is dropped
+		head, err := spool.Peek()
+		if nil != err || nil == head {
+			t.Fatalf("%s: unexpected head %+v, %v", test.name, head, err)
+		}
+
+		test.prepare(spool)
+
+		next, err := spool.Peek()
+		if nil != err {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		if test.left != spool.Len() {
+			t.Errorf("%s: expected %d records but got %d", test.name, test.left, spool.Len())
+		}
+
+		if (nil == test.nextData) != (nil == next) || (nil != next && false == bytes.Equal(test.nextData, next.Data)) {
+			t.Errorf("%s: unexpected record %+v", test.name, next)
+		}
+
+		// the dropped head is acknowledged without touching other records
+		if err = spool.Ack(head); nil != err {
+			t.Errorf("%s: %v", test.name, err)
+		}
+
+		if test.left != spool.Len() {
+			t.Errorf("%s: expected %d records after acknowledging but got %d", test.name, test.left, spool.Len())
+		}
+
+		spool.Close()
+		os.RemoveAll(folder)
+	}
+}
+
+func TestSpoolAck(t *testing.T) {
+	folder := newFolder(t)
+	defer os.RemoveAll(folder)
+
+	spool := openTestSpool(t, folder, Options{})
+	defer spool.Close()
+
+	appendRecords(t, spool, "low", 0, 2)
+	head, _ := spool.Peek()
+
+	tests := []struct {
+		name    string
+		record  *Record
+		invalid bool
+	}{
+		{"unknown class", &Record{Class: "unknown", Seq: head.Seq}, true},
+		{"not the oldest", &Record{Class: "low", Seq: head.Seq + 1}, true},
+		{"not appended", &Record{Class: "low", Seq: head.Seq + 2}, true},
+		{"head", head, false},
+		{"twice", head, false},
+	}
+
+	for _, test := range tests {
+		if err := spool.Ack(test.record); test.invalid != (nil != err) {
+			t.Errorf("%s: unexpected result %v", test.name, err)
+		}
+	}
+
+	if 1 != spool.Len() {
+		t.Fatalf("expected 1 record but got %d", spool.Len())
+	}
+}
+
+func TestSpoolCursorCompaction(t *testing.T) {
+	folder := newFolder(t)
+	defer os.RemoveAll(folder)
+
+	count := int(maxCursorSize/8) * 2
+	spool := openTestSpool(t, folder, Options{})
+	appendRecords(t, spool, "low", 0, count)
+	ackRecords(t, spool, 0, count)
+	spool.Close()
+
+	info, err := os.Stat(filepath.Join(folder, "low", cursorName))
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	if info.Size() > maxCursorSize {
+		t.Fatalf("cursor was not compacted, %d bytes", info.Size())
+	}
+
+	// acknowledged records are not loaded again
+	spool = openTestSpool(t, folder, Options{})
+	defer spool.Close()
+
+	if 0 != spool.Len() {
+		t.Fatalf("unexpected %d records", spool.Len())
+	}
+
+	appendRecords(t, spool, "low", count, 1)
+	record, _ := spool.Peek()
+	if nil == record || uint64(count+1) != record.Seq {
+		t.Fatalf("unexpected record %+v", record)
+	}
+}
@@ -17,6 +17,7 @@ import (
 	cmap "github.com/orcaman/concurrent-map"
 	"go.uber.org/zap"
 	"sercomm.com/demeter/commons/logger"
+	"sercomm.com/demeter/commons/metrics"
 	"sercomm.com/demeter/commons/packet"
 	"sercomm.com/demeter/commons/util"
 )
@@ -32,6 +33,15 @@ type ClientSession struct {
 	locker       *sync.Mutex          // prevent "write message" parallelly
 	ping         Ping                 // timer for "ping"
 	asyncCallMap cmap.ConcurrentMap   // pair< datagram id, asyncCall object >
+	outbox       Outbox               // keeps datagrams which cannot be delivered, nil to drop them
+	registry     *metrics.Registry    // metrics of the session
+}
+
+// Outbox keeps datagrams without callbacks (results, errors and notifications) instead of the session,
+// e.g. while the session is down
+type Outbox interface {
+	// Keep returns true if the datagram is kept, the session does not send it then
+	Keep(datagram *packet.Datagram, connected bool) (bool, error)
 }
 
 // NewClientSession ...
@@ -47,9 +57,11 @@ func NewClientSession(sessionHandler ClientSessionHandler) *ClientSession {
 		connection:   nil,
 		handler:      sessionHandler,
 		state:        StateClosed,
-		asyncCallMap: cmap.New()}
+		asyncCallMap: cmap.New(),
+		registry:     metrics.Default()}
 
 	clientSession.locker = &sync.Mutex{}
+	clientSession.ping.window = newPingWindow()
 
 	return clientSession
 }
@@ -104,15 +116,22 @@ func (clientSession *ClientSession) Open(host string, port int, path string, pin
 
 		clientSession.connection = nil
 		clientSession.state = StateClosed
+		clientSession.registry.AddCounter(MetricConnects, map[string]string{"result": "failure"}, 1)
 		return err
 	}
 
+	clientSession.registry.AddCounter(MetricConnects, map[string]string{"result": "success"}, 1)
+	clientSession.registry.SetGauge(MetricConnected, nil, 1)
+	defer clientSession.registry.SetGauge(MetricConnected, nil, 0)
+
 	clientSession.connection = connection
 	clientSession.connection.SetCloseHandler(clientSession.closeHandler)
 	clientSession.state = StateConnected
 
 	// initialize ping mechanism
 	clientSession.ping.retry = false
+	clientSession.ping.window.reset()
+	clientSession.SetPingPeriod(pingPeriod)
 	clientSession.ping.timer = time.NewTimer(time.Duration(pingPeriod) * time.Second)
 	defer clientSession.ping.timer.Stop()
 	defer clientSession.connection.Close()
@@ -137,29 +156,36 @@ func (clientSession *ClientSession) Open(host string, port int, path string, pin
 				datagram.ID = util.RandomUUIDString()
 			}
 
+			pingTime := time.Now()
 			rSession.Deliver(datagram, 15,
 				func(session Session, datagramID string, arguments ...interface{}) {
 					logger.New().Debug("PING SUCCESS")
+					rSession.registry.ObserveDuration(MetricPingRTT, nil, pingTime)
+					rSession.pingFinished(time.Since(pingTime), false)
 
 					rSession.ping.retry = false
-					rTimer.Reset(time.Duration(pingPeriod) * time.Second)
+					rTimer.Reset(time.Duration(rSession.GetPingPeriod()) * time.Second)
 				},
 				func(session Session, datagramID string, condition packet.ErrorCondition, errorMessage string) {
 					logger.New().Debug("PING ERROR", zap.String("CONDITION", condition.String()), zap.String("MESSAGE", errorMessage))
+					rSession.registry.AddCounter(MetricPingFailures, map[string]string{"reason": "error"}, 1)
+					rSession.pingFinished(0, true)
 
 					if rSession.ping.retry == false {
 						rSession.ping.retry = true
-						rTimer.Reset(time.Duration(pingPeriod) * time.Second)
+						rTimer.Reset(time.Duration(rSession.GetPingPeriod()) * time.Second)
 					} else {
 						rSession.Close(websocket.CloseNormalClosure, "PING ERROR")
 					}
 				},
 				func(session Session, datagramID string, timeoutInterval int) {
 					logger.New().Debug("PING TIMEOUT")
+					rSession.registry.AddCounter(MetricPingFailures, map[string]string{"reason": "timeout"}, 1)
+					rSession.pingFinished(0, true)
 
 					if rSession.ping.retry == false {
 						rSession.ping.retry = true
-						rTimer.Reset(time.Duration(pingPeriod) * time.Second)
+						rTimer.Reset(time.Duration(rSession.GetPingPeriod()) * time.Second)
 					} else {
 						rSession.Close(websocket.CloseNormalClosure, "PING TIMEOUT")
 					}
@@ -191,6 +217,106 @@ func (clientSession *ClientSession) Open(host string, port int, path string, pin
 	return err
 }
 
+// SetPingPeriod changes the ping period (in seconds), it takes effect from the next ping
+func (clientSession *ClientSession) SetPingPeriod(pingPeriod int) {
+	atomic.StoreInt32(&clientSession.ping.period, int32(pingPeriod))
+	clientSession.registry.SetGauge(MetricPingPeriod, nil, float64(pingPeriod))
+}
+
+// SetMetricsRegistry sets the registry of the metrics of the session before Open,
+// e.g. metrics.NewRegistry() isolates the session from others, metrics.Default() is used by default
+func (clientSession *ClientSession) SetMetricsRegistry(registry *metrics.Registry) {
+	if nil == registry {
+		registry = metrics.Default()
+	}
+
+	describeMetrics(registry)
+	clientSession.registry = registry
+}
+
+// SetAdaptivePing lets the ping period adapt between "minPeriod" and "maxPeriod" (in seconds):
+// it is halved once a ping is lost, and lengthened while no ping in the window is lost. 0 to disable.
+// Invalid periods are rejected and the former ones are kept
+func (clientSession *ClientSession) SetAdaptivePing(minPeriod int, maxPeriod int) error {
+	if 0 != minPeriod || 0 != maxPeriod {
+		if minPeriod < 1 {
+			return fmt.Errorf("INVALID ADAPTIVE PING: MIN PERIOD %d IS NOT POSITIVE", minPeriod)
+		}
+
+		if minPeriod > maxPeriod {
+			return fmt.Errorf("INVALID ADAPTIVE PING: MIN PERIOD %d IS GREATER THAN MAX PERIOD %d", minPeriod, maxPeriod)
+		}
+	}
+
+	atomic.StoreInt32(&clientSession.ping.minPeriod, int32(minPeriod))
+	atomic.StoreInt32(&clientSession.ping.maxPeriod, int32(maxPeriod))
+	return nil
+}
+
+// GetPingStatistics returns round-trip time and loss of the latest pings of the connection
+func (clientSession *ClientSession) GetPingStatistics() PingStatistics {
+	return clientSession.ping.window.statistics()
+}
+
+// add the result of a ping into the window, and adapt the ping period by the statistics of the window
+func (clientSession *ClientSession) pingFinished(rtt time.Duration, lost bool) {
+	statistics := clientSession.ping.window.add(rtt, lost)
+
+	clientSession.registry.SetGauge(MetricPingLossRate, nil, statistics.LossRate)
+	clientSession.registry.SetGauge(MetricPingJitter, nil, statistics.Jitter/1000)
+
+	clientSession.adaptPingPeriod(lost, statistics)
+}
+
+// adapt the ping period to the stability of the connection
+func (clientSession *ClientSession) adaptPingPeriod(lost bool, statistics PingStatistics) {
+	minPeriod := int(atomic.LoadInt32(&clientSession.ping.minPeriod))
+	maxPeriod := int(atomic.LoadInt32(&clientSession.ping.maxPeriod))
+	if 0 == maxPeriod {
+		return
+	}
+
+	former := clientSession.GetPingPeriod()
+	period := former
+	switch {
+	case lost:
+		// detect a broken connection sooner
+		period = period / 2
+	case pingWindowSize == statistics.Samples && 0 == statistics.Lost:
+		period = period + period/2 + 1
+	}
+
+	if period < minPeriod {
+		period = minPeriod
+	}
+	if period > maxPeriod {
+		period = maxPeriod
+	}
+
+	if period != former {
+		clientSession.SetPingPeriod(period)
+		logger.New().Debug("PING PERIOD ADAPTED", zap.Int("former", former), zap.Int("period", period), zap.Float64("lossRate", statistics.LossRate))
+	}
+}
+
+// GetPingPeriod returns the ping period (in seconds)
+func (clientSession *ClientSession) GetPingPeriod() int {
+	return int(atomic.LoadInt32(&clientSession.ping.period))
+}
+
+// SetOutbox sets the outbox of undelivered datagrams, nil to drop them
+func (clientSession *ClientSession) SetOutbox(outbox Outbox) {
+	clientSession.locker.Lock()
+	defer clientSession.locker.Unlock()
+
+	clientSession.outbox = outbox
+}
+
+// GetPendingCount returns the number of delivered requests which are waiting for results
+func (clientSession *ClientSession) GetPendingCount() int {
+	return clientSession.asyncCallMap.Count()
+}
+
 // Close ...
 func (clientSession *ClientSession) Close(statusCode int, reason string) error {
 	if clientSession.state == StateClosed {
@@ -233,14 +359,28 @@ func (clientSession *ClientSession) Deliver(
 	clientSession.locker.Lock()
 	defer clientSession.locker.Unlock()
 
-	if StateConnected != clientSession.GetState() {
+	connected := StateConnected == clientSession.GetState()
+
+	// datagrams with callbacks cannot be kept since the callbacks do not survive restarting
+	if nil != clientSession.outbox && nil == onResult && nil == onError && nil == onTimeout {
+		kept, err := clientSession.outbox.Keep(datagram, connected)
+		if nil != err || kept {
+			return err
+		}
+	}
+
+	if false == connected {
 		return errors.New("SESSION IS NOT READY")
 	}
 
-	var err error = nil
+	jsonString, err := packet.String(datagram)
+	if nil != err {
+		return err
+	}
 
+	var timer *time.Timer
 	if datagram.Type == packet.T_REQUEST.String() {
-		timer := time.AfterFunc(time.Duration(timeoutInterval)*time.Second, func() {
+		timer = time.AfterFunc(time.Duration(timeoutInterval)*time.Second, func() {
 			clientSession.asyncCallMap.Remove(datagram.ID)
 
 			if nil != onTimeout {
@@ -257,13 +397,16 @@ func (clientSession *ClientSession) Deliver(
 		clientSession.asyncCallMap.Set(datagram.ID, asyncCall)
 	}
 
-	jsonString, err := packet.String(datagram)
-	if nil != err {
-		return err
+	logMessage("websocket: SEND", clientSession, datagram, jsonString)
+	countMessage(clientSession.registry, "send", datagram)
+	err = clientSession.connection.WriteMessage(websocket.TextMessage, []byte(jsonString))
+	if nil != err && nil != timer {
+		// the request never left, the caller is told by the returned error instead of the callbacks
+		timer.Stop()
+		clientSession.asyncCallMap.Remove(datagram.ID)
 	}
 
-	logger.New().Info("websocket: SEND", zap.String("MESSAGE", jsonString))
-	return clientSession.connection.WriteMessage(websocket.TextMessage, []byte(jsonString))
+	return err
 }
 
 // handle close
@@ -291,15 +434,18 @@ func (clientSession *ClientSession) messageHandler(messageType int, message []by
 	}
 
 	messageString := string(message)
-	logger.New().Info("websocket: RECV", zap.String("MESSAGE", messageString))
 
 	// parse datagram
 	datagram, err := packet.From(messageString)
 	if nil != err {
-		logger.New().Error("websocket: PARSE", zap.String("MESSAGE", messageString), zap.Error(err))
+		logRawMessage("websocket: RECV", messageString)
+		logger.New().Error("websocket: PARSE", zap.String("sessionID", clientSession.GetID()), zap.Error(err))
 		return
 	}
 
+	logMessage("websocket: RECV", clientSession, &datagram, messageString)
+	countMessage(clientSession.registry, "recv", &datagram)
+
 	// remove async call object of the datagram if exists
 	defer func() {
 		object, ok := clientSession.asyncCallMap.Get(datagram.ID)
@@ -0,0 +1,116 @@
+package ws
+
+import (
+	"testing"
+	"time"
+
+	"sercomm.com/demeter/commons/metrics"
+	"sercomm.com/demeter/commons/packet"
+)
+
+type nopClientSessionHandler struct{}
+
+func (handler *nopClientSessionHandler) SessionCreated(session *ClientSession)   {}
+func (handler *nopClientSessionHandler) SessionDestroyed(session *ClientSession) {}
+func (handler *nopClientSessionHandler) SessionMessageReceived(session *ClientSession, datagram *packet.Datagram) {
+}
+
+func gaugeValue(registry *metrics.Registry, name string) (float64, bool) {
+	for _, sample := range registry.Snapshot() {
+		if name == sample.Name {
+			return sample.Value, true
+		}
+	}
+
+	return 0, false
+}
+
+func TestClientSessionSetAdaptivePing(t *testing.T) {
+	tests := []struct {
+		name      string
+		minPeriod int
+		maxPeriod int
+		invalid   bool
+	}{
+		{"valid", 5, 120, false},
+		{"same periods", 30, 30, false},
+		{"disabled", 0, 0, false},
+		{"min is greater than max", 120, 5, true},
+		{"max is missing", 5, 0, true},
+		{"min is missing", 0, 120, true},
+		{"negative", -5, 120, true},
+	}
+
+	for _, test := range tests {
+		clientSession := NewClientSession(&nopClientSessionHandler{})
+		clientSession.SetAdaptivePing(10, 60)
+
+		err := clientSession.SetAdaptivePing(test.minPeriod, test.maxPeriod)
+		if test.invalid != (nil != err) {
+			t.Errorf("%s: unexpected result %v", test.name, err)
+			continue
+		}
+
+		// the former periods are kept if the new ones are rejected
+		minPeriod, maxPeriod := test.minPeriod, test.maxPeriod
+		if test.invalid {
+			minPeriod, maxPeriod = 10, 60
+		}
+
+		if int32(minPeriod) != clientSession.ping.minPeriod || int32(maxPeriod) != clientSession.ping.maxPeriod {
+			t.Errorf("%s: unexpected periods %d to %d", test.name, clientSession.ping.minPeriod, clientSession.ping.maxPeriod)
+		}
+	}
+}
+
+func TestClientSessionAdaptPingPeriod(t *testing.T) {
+	registry := metrics.NewRegistry()
+
+	clientSession := NewClientSession(&nopClientSessionHandler{})
+	clientSession.SetMetricsRegistry(registry)
+	clientSession.SetPingPeriod(30)
+	clientSession.SetAdaptivePing(5, 60)
+
+	steps := []struct {
+		name     string
+		lost     bool
+		count    int
+		expected int
+	}{
+		{"lost", true, 1, 15},
+		{"lost again", true, 1, 7},
+		{"bounded by min", true, 2, 5},
+		// the period is kept until the window is full of received pings
+		{"window with loss", false, pingWindowSize - 5, 5},
+		{"window without loss", false, 4, 5},
+		{"lengthened", false, 1, 8},
+		{"lengthened again", false, 1, 13},
+		{"bounded by max", false, 10, 60},
+	}
+
+	for _, step := range steps {
+		for idx := 0; idx < step.count; idx++ {
+			clientSession.pingFinished(time.Millisecond*10, step.lost)
+		}
+
+		if step.expected != clientSession.GetPingPeriod() {
+			t.Fatalf("%s: expected period %d but got %d", step.name, step.expected, clientSession.GetPingPeriod())
+		}
+
+		// gauges go to the registry of the session
+		if period, ok := gaugeValue(registry, MetricPingPeriod); false == ok || float64(step.expected) != period {
+			t.Fatalf("%s: unexpected gauge of the period %f", step.name, period)
+		}
+	}
+
+	if _, ok := gaugeValue(registry, MetricPingLossRate); false == ok {
+		t.Fatal("loss rate is not reported")
+	}
+
+	// disabled adaptation keeps the period
+	clientSession.SetAdaptivePing(0, 0)
+	clientSession.pingFinished(0, true)
+	if 60 != clientSession.GetPingPeriod() {
+		t.Fatalf("period was adapted while disabled %d", clientSession.GetPingPeriod())
+	}
+}
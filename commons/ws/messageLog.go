@@ -0,0 +1,218 @@
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"sercomm.com/demeter/commons/logger"
+	"sercomm.com/demeter/commons/packet"
+)
+
+// RedactedValue replaces values of redacted keys
+const RedactedValue string = "***"
+
+// MessageLogOptions controls how "websocket: SEND" and "websocket: RECV" log messages
+type MessageLogOptions struct {
+	RedactKeys []string                      // values of JSON keys which contain any of them (case-insensitive) are masked, e.g. "password"
+	MaxLength  int                           // messages longer than it are truncated, 0 to keep the whole message
+	Functions  map[string]FunctionLogOptions // pair< function, options >, e.g. "F_PING"
+}
+
+// FunctionLogOptions of messages of a function
+type FunctionLogOptions struct {
+	Level  string // e.g. "debug", "info" if it is blank
+	Sample int    // log one of every "Sample" messages, 0 or 1 to log all
+}
+
+var messageLogOptions atomic.Value
+
+var (
+	sampleLocker   sync.Mutex
+	sampleCounters = make(map[string]uint64) // pair< function, counter >
+)
+
+func init() {
+	messageLogOptions.Store(&MessageLogOptions{
+		RedactKeys: []string{"password", "passwd", "key", "psk", "secret", "token"},
+		MaxLength:  2048,
+		Functions: map[string]FunctionLogOptions{
+			packet.F_PING.String(): {Level: "debug"},
+		},
+	})
+}
+
+// SetMessageLogOptions replaces the options, it can be called at runtime
+func SetMessageLogOptions(options MessageLogOptions) {
+	redactKeys := make([]string, 0, len(options.RedactKeys))
+	for _, key := range options.RedactKeys {
+		redactKeys = append(redactKeys, strings.ToLower(key))
+	}
+	options.RedactKeys = redactKeys
+
+	messageLogOptions.Store(&options)
+}
+
+// log the message of the datagram if its function is enabled and sampled
+func logMessage(title string, session Session, datagram *packet.Datagram, message string) {
+	options := messageLogOptions.Load().(*MessageLogOptions)
+
+	level := zapcore.InfoLevel
+	functionOptions, ok := options.Functions[datagram.Function]
+	if ok && "" != functionOptions.Level {
+		if err := level.UnmarshalText([]byte(functionOptions.Level)); nil != err {
+			level = zapcore.InfoLevel
+		}
+	}
+
+	// caller is the one which sends or receives the message
+	checkedEntry := logger.New().WithOptions(zap.AddCallerSkip(1)).Check(level, title)
+	if nil == checkedEntry {
+		return
+	}
+
+	if ok && functionOptions.Sample > 1 {
+		sampleLocker.Lock()
+		counter := sampleCounters[datagram.Function]
+		sampleCounters[datagram.Function] = counter + 1
+		sampleLocker.Unlock()
+
+		if 0 != counter%uint64(functionOptions.Sample) {
+			return
+		}
+	}
+
+	checkedEntry.Write(append(DatagramFields(session, datagram), zap.String("MESSAGE", redactMessage(options, datagram, message)))...)
+}
+
+// log a message which cannot be parsed as a datagram, it is dropped unless it is JSON which can be redacted
+func logRawMessage(title string, message string) {
+	options := messageLogOptions.Load().(*MessageLogOptions)
+	logger.New().Info(title, zap.String("MESSAGE", redactRawMessage(options, message)))
+}
+
+func redactMessage(options *MessageLogOptions, datagram *packet.Datagram, message string) string {
+	if 0 == len(options.RedactKeys) {
+		return truncate(options, message)
+	}
+
+	redacted := *datagram
+	if nil != datagram.Arguments {
+		redacted.Arguments = make([]interface{}, len(datagram.Arguments))
+		for idx, argument := range datagram.Arguments {
+			redacted.Arguments[idx] = redactValue(options, argument)
+		}
+	}
+
+	redactedMessage, err := packet.String(&redacted)
+	if nil != err {
+		return dropMessage(message)
+	}
+
+	return truncate(options, redactedMessage)
+}
+
+func redactRawMessage(options *MessageLogOptions, message string) string {
+	if 0 == len(options.RedactKeys) {
+		return truncate(options, message)
+	}
+
+	var decoded interface{}
+	if nil != json.Unmarshal([]byte(message), &decoded) {
+		return dropMessage(message)
+	}
+
+	encoded, err := json.Marshal(redactValue(options, decoded))
+	if nil != err {
+		return dropMessage(message)
+	}
+
+	return truncate(options, string(encoded))
+}
+
+// a message which cannot be redacted is never logged
+func dropMessage(message string) string {
+	return fmt.Sprintf("(DROPPED %d BYTES WHICH CANNOT BE REDACTED)", len(message))
+}
+
+// mask values of redacted keys in maps and slices recursively, JSON strings (e.g. ubus payload) are redacted as well
+func redactValue(options *MessageLogOptions, value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(value))
+		for key, child := range value {
+			if isRedactedKey(options, key) {
+				redacted[key] = RedactedValue
+			} else {
+				redacted[key] = redactValue(options, child)
+			}
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(value))
+		for idx, child := range value {
+			redacted[idx] = redactValue(options, child)
+		}
+		return redacted
+	case string:
+		trimmed := strings.TrimSpace(value)
+		if false == strings.HasPrefix(trimmed, "{") && false == strings.HasPrefix(trimmed, "[") {
+			return value
+		}
+
+		var decoded interface{}
+		if nil != json.Unmarshal([]byte(trimmed), &decoded) {
+			return value
+		}
+
+		encoded, err := json.Marshal(redactValue(options, decoded))
+		if nil != err {
+			return value
+		}
+		return string(encoded)
+	default:
+		// structs are converted to generic JSON values first
+		if nil == value {
+			return nil
+		}
+
+		switch value.(type) {
+		case bool, float64, float32, int, int32, int64, uint, uint32, uint64:
+			return value
+		}
+
+		encoded, err := json.Marshal(value)
+		if nil != err {
+			return value
+		}
+
+		var decoded interface{}
+		if nil != json.Unmarshal(encoded, &decoded) {
+			return value
+		}
+		return redactValue(options, decoded)
+	}
+}
+
+func isRedactedKey(options *MessageLogOptions, key string) bool {
+	lowerKey := strings.ToLower(key)
+	for _, redactKey := range options.RedactKeys {
+		if strings.Contains(lowerKey, redactKey) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func truncate(options *MessageLogOptions, message string) string {
+	if options.MaxLength <= 0 || len(message) <= options.MaxLength {
+		return message
+	}
+
+	return fmt.Sprintf("%s...(TRUNCATED %d BYTES)", message[:options.MaxLength], len(message)-options.MaxLength)
+}
@@ -0,0 +1,72 @@
+package ws
+
+import (
+	"strings"
+	"testing"
+
+	"sercomm.com/demeter/commons/packet"
+)
+
+func TestRedactMessage(t *testing.T) {
+	options := &MessageLogOptions{RedactKeys: []string{"password", "key"}}
+
+	tests := []struct {
+		name      string
+		arguments []interface{}
+		kept      []string
+		masked    []string
+	}{
+		{"plain", []interface{}{"get", "system"}, []string{"get", "system"}, nil},
+		{"map", []interface{}{map[string]interface{}{"Password": "hunter2", "user": "admin"}}, []string{"admin"}, []string{"hunter2"}},
+		{"nested", []interface{}{[]interface{}{map[string]interface{}{"wifi": map[string]interface{}{"psk_key": "s3cr3t"}}}}, []string{"wifi"}, []string{"s3cr3t"}},
+		{"JSON string", []interface{}{"call", `{"password":"hunter2","name":"lan"}`}, []string{"lan"}, []string{"hunter2"}},
+		{"struct", []interface{}{struct {
+			Key  string `json:"key"`
+			Name string `json:"name"`
+		}{"s3cr3t", "lan"}}, []string{"lan"}, []string{"s3cr3t"}},
+	}
+
+	for _, test := range tests {
+		datagram := &packet.Datagram{ID: "1", Type: packet.T_REQUEST.String(), Function: packet.F_UBUS.String(), Arguments: test.arguments}
+		message, err := packet.String(datagram)
+		if nil != err {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		redacted := redactMessage(options, datagram, message)
+		for _, kept := range test.kept {
+			if false == strings.Contains(redacted, kept) {
+				t.Errorf("%s: '%s' is missing in %s", test.name, kept, redacted)
+			}
+		}
+
+		for _, masked := range test.masked {
+			if strings.Contains(redacted, masked) || false == strings.Contains(redacted, RedactedValue) {
+				t.Errorf("%s: '%s' is not masked in %s", test.name, masked, redacted)
+			}
+		}
+	}
+}
+
+func TestRedactRawMessage(t *testing.T) {
+	tests := []struct {
+		name       string
+		redactKeys []string
+		maxLength  int
+		message    string
+		expected   string
+	}{
+		{"JSON", []string{"password"}, 0, `{"password":"hunter2","id":1}`, `{"id":1,"password":"***"}`},
+		{"not JSON", []string{"password"}, 0, `{"password":"hunter2"`, "(DROPPED 21 BYTES WHICH CANNOT BE REDACTED)"},
+		{"no redact keys", nil, 0, `{"password":"hunter2"`, `{"password":"hunter2"`},
+		{"truncated", nil, 4, "abcdefgh", "abcd...(TRUNCATED 4 BYTES)"},
+		{"redacted and truncated", []string{"password"}, 8, `{"password":"hunter2"}`, `{"passwo...(TRUNCATED 10 BYTES)`},
+	}
+
+	for _, test := range tests {
+		options := &MessageLogOptions{RedactKeys: test.redactKeys, MaxLength: test.maxLength}
+		if redacted := redactRawMessage(options, test.message); test.expected != redacted {
+			t.Errorf("%s: expected %s but got %s", test.name, test.expected, redacted)
+		}
+	}
+}
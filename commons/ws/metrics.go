@@ -0,0 +1,66 @@
+package ws
+
+import (
+	"sercomm.com/demeter/commons/metrics"
+	"sercomm.com/demeter/commons/packet"
+	"sercomm.com/demeter/commons/util"
+)
+
+// metrics of sessions in metrics.Default(), or the registry given to ClientSession.SetMetricsRegistry
+const (
+	MetricConnects     string = "ws_connects_total"
+	MetricConnected    string = "ws_connected"
+	MetricMessages     string = "ws_messages_total"
+	MetricErrors       string = "ws_errors_total"
+	MetricPingRTT      string = "ws_ping_rtt_seconds"
+	MetricPingFailures string = "ws_ping_failures_total"
+	MetricPingLossRate string = "ws_ping_loss_ratio"
+	MetricPingJitter   string = "ws_ping_jitter_seconds"
+	MetricPingPeriod   string = "ws_ping_period_seconds"
+)
+
+func init() {
+	describeMetrics(metrics.Default())
+}
+
+func describeMetrics(registry *metrics.Registry) {
+	registry.Describe(MetricConnects, metrics.KindCounter, "Connection attempts of client sessions by result")
+	registry.Describe(MetricConnected, metrics.KindGauge, "1 if the client session is connected")
+	registry.Describe(MetricMessages, metrics.KindCounter, "Datagrams sent and received by direction, type and function")
+	registry.Describe(MetricErrors, metrics.KindCounter, "T_ERROR datagrams sent and received by direction, function and ErrorCondition")
+	registry.Describe(MetricPingRTT, metrics.KindHistogram, "Round-trip time of F_PING")
+	registry.Describe(MetricPingFailures, metrics.KindCounter, "F_PING without result by reason")
+	registry.Describe(MetricPingLossRate, metrics.KindGauge, "Ratio of F_PING without result in the latest pings")
+	registry.Describe(MetricPingJitter, metrics.KindGauge, "Mean difference between consecutive round-trip times of the latest pings")
+	registry.Describe(MetricPingPeriod, metrics.KindGauge, "Current period of F_PING, it may be adapted")
+}
+
+// count the datagram, "direction" is "send" or "recv".
+// Values of labels are parsed, so unknown values from peers share a single label
+func countMessage(registry *metrics.Registry, direction string, datagram *packet.Datagram) {
+	registry.AddCounter(MetricMessages, map[string]string{
+		"direction": direction,
+		"type":      knownLabel(packet.ParseType(datagram.Type).String()),
+		"function":  knownLabel(packet.ParseFunction(datagram.Function).String()),
+	}, 1)
+
+	if packet.T_ERROR.String() != datagram.Type {
+		return
+	}
+
+	condition, _ := util.GetAsObject(datagram.Arguments, 0, "").(string)
+	registry.AddCounter(MetricErrors, map[string]string{
+		"direction": direction,
+		"function":  knownLabel(packet.ParseFunction(datagram.Function).String()),
+		"condition": knownLabel(packet.ParseCondition(condition).String()),
+	}, 1)
+}
+
+// blank values are not parsed
+func knownLabel(value string) string {
+	if "" == value {
+		return metrics.UnknownLabel
+	}
+
+	return value
+}
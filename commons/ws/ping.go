@@ -8,6 +8,10 @@ const pingInterval int = 30
 
 // Ping ...
 type Ping struct {
-	timer *time.Timer
-	retry bool
+	timer     *time.Timer
+	retry     bool
+	period    int32 // in seconds, it can be changed while the session is open
+	minPeriod int32 // in seconds, the period is adapted between minPeriod and maxPeriod if maxPeriod is not 0
+	maxPeriod int32
+	window    *pingWindow
 }
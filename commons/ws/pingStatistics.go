@@ -0,0 +1,123 @@
+package ws
+
+import (
+	"sync"
+	"time"
+)
+
+// pings kept in the rolling window
+const pingWindowSize int = 20
+
+// PingStatistics of the latest pings of the session, durations are in milliseconds
+type PingStatistics struct {
+	Samples  int     `json:"samples"`  // pings in the window
+	Lost     int     `json:"lost"`     // pings without result (error or timeout)
+	LossRate float64 `json:"lossRate"` // 0 to 1
+	Min      float64 `json:"min"`
+	Avg      float64 `json:"avg"`
+	Max      float64 `json:"max"`
+	Jitter   float64 `json:"jitter"` // mean difference between consecutive round-trip times
+}
+
+// pingWindow keeps results of the latest pings
+type pingWindow struct {
+	locker  sync.Mutex
+	results []pingResult // ring buffer
+	next    int
+	full    bool
+}
+
+type pingResult struct {
+	rtt  time.Duration
+	lost bool
+}
+
+func newPingWindow() *pingWindow {
+	return &pingWindow{
+		results: make([]pingResult, pingWindowSize),
+	}
+}
+
+func (window *pingWindow) reset() {
+	window.locker.Lock()
+	defer window.locker.Unlock()
+
+	window.next = 0
+	window.full = false
+}
+
+// add the result of a ping, the statistics of the window are returned
+func (window *pingWindow) add(rtt time.Duration, lost bool) PingStatistics {
+	window.locker.Lock()
+	window.results[window.next] = pingResult{rtt: rtt, lost: lost}
+	window.next = (window.next + 1) % len(window.results)
+	if 0 == window.next {
+		window.full = true
+	}
+	window.locker.Unlock()
+
+	return window.statistics()
+}
+
+func (window *pingWindow) statistics() PingStatistics {
+	window.locker.Lock()
+	defer window.locker.Unlock()
+
+	// from the oldest to the latest
+	count := window.next
+	start := 0
+	if window.full {
+		count = len(window.results)
+		start = window.next
+	}
+
+	statistics := PingStatistics{Samples: count}
+	received := 0
+	jitterCount := 0
+	var minimum, maximum, total, jitter time.Duration
+	var former *pingResult
+	for idx := 0; idx < count; idx++ {
+		result := &window.results[(start+idx)%len(window.results)]
+		if result.lost {
+			statistics.Lost++
+			continue
+		}
+
+		if 0 == received || result.rtt < minimum {
+			minimum = result.rtt
+		}
+		if result.rtt > maximum {
+			maximum = result.rtt
+		}
+		total += result.rtt
+		received++
+
+		if nil != former {
+			difference := result.rtt - former.rtt
+			if difference < 0 {
+				difference = -difference
+			}
+			jitter += difference
+			jitterCount++
+		}
+		former = result
+	}
+
+	if received > 0 {
+		statistics.Min = milliseconds(minimum)
+		statistics.Avg = milliseconds(total / time.Duration(received))
+		statistics.Max = milliseconds(maximum)
+	}
+	if jitterCount > 0 {
+		statistics.Jitter = milliseconds(jitter / time.Duration(jitterCount))
+	}
+	if count > 0 {
+		statistics.LossRate = float64(statistics.Lost) / float64(count)
+	}
+
+	return statistics
+}
+
+func milliseconds(duration time.Duration) float64 {
+	return float64(duration) / float64(time.Millisecond)
+}
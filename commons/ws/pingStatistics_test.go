@@ -0,0 +1,53 @@
+package ws
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPingWindow(t *testing.T) {
+	tests := []struct {
+		name     string
+		rtts     []int // in milliseconds, negative for lost pings
+		expected PingStatistics
+	}{
+		{"empty", nil, PingStatistics{}},
+		{"received", []int{10, 30, 20}, PingStatistics{Samples: 3, Min: 10, Avg: 20, Max: 30, Jitter: 15}},
+		{"lost", []int{10, -1, 30, -1}, PingStatistics{Samples: 4, Lost: 2, LossRate: 0.5, Min: 10, Avg: 20, Max: 30, Jitter: 20}},
+		{"all lost", []int{-1, -1}, PingStatistics{Samples: 2, Lost: 2, LossRate: 1}},
+		// the oldest 5 pings are out of the window
+		{"rolled", append([]int{-1, -1, -1, -1, 100}, repeat(10, pingWindowSize)...), PingStatistics{Samples: pingWindowSize, Min: 10, Avg: 10, Max: 10}},
+	}
+
+	for _, test := range tests {
+		window := newPingWindow()
+
+		statistics := window.statistics()
+		for _, rtt := range test.rtts {
+			if rtt < 0 {
+				statistics = window.add(0, true)
+			} else {
+				statistics = window.add(time.Duration(rtt)*time.Millisecond, false)
+			}
+		}
+
+		if test.expected != statistics {
+			t.Errorf("%s: expected %+v but got %+v", test.name, test.expected, statistics)
+		}
+
+		// nothing is kept after reset
+		window.reset()
+		if statistics = window.statistics(); 0 != statistics.Samples {
+			t.Errorf("%s: unexpected statistics after reset %+v", test.name, statistics)
+		}
+	}
+}
+
+func repeat(value int, count int) []int {
+	values := make([]int, count)
+	for idx := range values {
+		values[idx] = value
+	}
+
+	return values
+}
@@ -1,13 +1,16 @@
 package ws
 
 import (
+	"errors"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 	cmap "github.com/orcaman/concurrent-map"
 	"go.uber.org/zap"
 	"sercomm.com/demeter/commons/logger"
+	"sercomm.com/demeter/commons/metrics"
 	"sercomm.com/demeter/commons/packet"
 )
 
@@ -41,7 +44,10 @@ func NewServerSession(sessionID string, connection *websocket.Conn, sessionHandl
 		connection:   connection,
 		connectionID: connectionID,
 		handler:      sessionHandler,
-		state:        StateConnected} // session has arrived and connected
+		state:        StateConnected, // session has arrived and connected
+		locker:       &sync.Mutex{},
+		asyncCallMap: cmap.New(),
+		propertyMap:  cmap.New()}
 
 	connection.SetCloseHandler(serverSession.closeHandler)
 
@@ -118,6 +124,58 @@ func (serverSession *ServerSession) Serve() error {
 	}
 }
 
+// Deliver ...
+// (public) Implementation of Session interface, deliver message to client
+func (serverSession *ServerSession) Deliver(
+	datagram *packet.Datagram,
+	timeoutInterval int,
+	onResult func(session Session, packetID string, arguments ...interface{}),
+	onError func(session Session, packetID string, condition packet.ErrorCondition, errorMessage string),
+	onTimeout func(session Session, packetID string, timeoutInterval int)) error {
+
+	serverSession.locker.Lock()
+	defer serverSession.locker.Unlock()
+
+	if StateConnected != serverSession.GetState() || nil == serverSession.connection {
+		return errors.New("SESSION IS NOT READY")
+	}
+
+	jsonString, err := packet.String(datagram)
+	if nil != err {
+		return err
+	}
+
+	var timer *time.Timer
+	if datagram.Type == packet.T_REQUEST.String() {
+		timer = time.AfterFunc(time.Duration(timeoutInterval)*time.Second, func() {
+			serverSession.asyncCallMap.Remove(datagram.ID)
+
+			if nil != onTimeout {
+				onTimeout(serverSession, datagram.ID, timeoutInterval)
+			}
+		})
+
+		// allocate async call object
+		asyncCall := asyncCall{
+			Timeout:  timer,
+			OnResult: onResult,
+			OnError:  onError}
+
+		serverSession.asyncCallMap.Set(datagram.ID, asyncCall)
+	}
+
+	logMessage("websocket: SEND", serverSession, datagram, jsonString)
+	countMessage(metrics.Default(), "send", datagram)
+	err = serverSession.connection.WriteMessage(websocket.TextMessage, []byte(jsonString))
+	if nil != err && nil != timer {
+		// the request never left, the caller is told by the returned error instead of the callbacks
+		timer.Stop()
+		serverSession.asyncCallMap.Remove(datagram.ID)
+	}
+
+	return err
+}
+
 // GetProperty ...
 func (serverSession *ServerSession) GetProperty(key string) interface{} {
 	value, _ := serverSession.propertyMap.Get(key)
@@ -154,7 +212,6 @@ func (serverSession *ServerSession) messageHandler(messageType int, message []by
 
 	// convert byte message to string
 	messageString := string(message)
-	logger.New().Info("websocket: RECV", zap.String("MESSAGE", messageString))
 
 	if messageString == "" {
 		// ignore blank message
@@ -164,10 +221,14 @@ func (serverSession *ServerSession) messageHandler(messageType int, message []by
 	// parse datagram
 	datagram, err := packet.From(messageString)
 	if nil != err {
-		logger.New().Error("websocket: PARSE", zap.String("MESSAGE", messageString), zap.Error(err))
+		logRawMessage("websocket: RECV", messageString)
+		logger.New().Error("websocket: PARSE", zap.String("sessionID", serverSession.GetID()), zap.Error(err))
 		return
 	}
 
+	logMessage("websocket: RECV", serverSession, &datagram, messageString)
+	countMessage(metrics.Default(), "recv", &datagram)
+
 	// remove async call object of the datagram if exists
 	defer serverSession.asyncCallMap.Remove(datagram.ID)
 
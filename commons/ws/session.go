@@ -1,7 +1,11 @@
 package ws
 
 import (
+	"context"
+
 	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+	"sercomm.com/demeter/commons/logger"
 	"sercomm.com/demeter/commons/packet"
 )
 
@@ -32,3 +36,18 @@ type Session interface {
 		onError func(session Session, packetID string, condition packet.ErrorCondition, errorMessage string),
 		onTimeout func(session Session, packetID string, timeoutInterval int)) error
 }
+
+// DatagramFields are the log fields which identify the datagram of the session
+func DatagramFields(session Session, datagram *packet.Datagram) []zap.Field {
+	return []zap.Field{
+		zap.String("sessionID", session.GetID()),
+		zap.String("datagramID", datagram.ID),
+		zap.String("function", datagram.Function),
+	}
+}
+
+// NewDatagramContext returns a context for handling the datagram, its logger carries DatagramFields,
+// e.g. logger.FromContext(ctx).Info("...")
+func NewDatagramContext(session Session, datagram *packet.Datagram) context.Context {
+	return logger.NewContext(context.Background(), DatagramFields(session, datagram)...)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"sercomm.com/demeter/cpe_agent/control"
+)
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `usage: cpectl [-s socket] [-t timeout] <command> [arguments...]
+
+commands:
+  status                          connection state, endpoint, identity, pending requests, kept datagrams and version
+  reconnect                       close the session, it is reconnected at once
+  log-level [level|revert] [sec]  query or change the log level, it reverts after "sec" seconds (default 600)
+  ubus <method> <path> [payload]  run a ubus call as F_UBUS from server, e.g. ubus board system
+  help                            commands served by the agent
+
+flags:
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	var socketPath string
+	var timeout int
+	flag.StringVar(&socketPath, "s", control.DefaultSocketPath, "control socket path (control.socket of cpe_agent)")
+	flag.IntVar(&timeout, "t", 30, "timeout in seconds")
+	flag.Usage = usage
+	flag.Parse()
+
+	if 0 == flag.NArg() {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	result, err := control.Call(socketPath, time.Duration(timeout)*time.Second, flag.Arg(0), flag.Args()[1:]...)
+	if nil != err {
+		fmt.Fprintln(os.Stderr, "ERROR: "+err.Error())
+		os.Exit(1)
+	}
+
+	if 0 == len(result) {
+		fmt.Println("OK")
+		return
+	}
+
+	var buffer bytes.Buffer
+	if nil != json.Indent(&buffer, result, "", "  ") {
+		fmt.Println(string(result))
+		return
+	}
+
+	fmt.Println(buffer.String())
+}
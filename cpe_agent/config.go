@@ -0,0 +1,125 @@
+package main
+
+// AgentConfig is the typed form of cpe_agent.yaml, see configger.Bind for the tags
+type AgentConfig struct {
+	Entry   EntryConfig   `yaml:"entry"`
+	Log     LogConfig     `yaml:"log"`
+	Reload  ReloadConfig  `yaml:"reload"`
+	Remote  RemoteConfig  `yaml:"remote"`
+	Metrics MetricsConfig `yaml:"metrics"`
+	Quality QualityConfig `yaml:"quality"`
+	Control ControlConfig `yaml:"control"`
+	Relay   RelayConfig   `yaml:"relay"`
+	Outbox  OutboxConfig  `yaml:"outbox"`
+}
+
+// EntryConfig is the WebSocket endpoint of Demeter server
+type EntryConfig struct {
+	Host       string `yaml:"host" required:"true"`
+	Port       int    `yaml:"port" default:"443" min:"1" max:"65535"`
+	Path       string `yaml:"path" default:"/iface/v1/cpe"`
+	EnableSSL  bool   `yaml:"enableSSL" default:"true"`
+	PingPeriod int    `yaml:"pingPeriod" default:"30" min:"1" max:"3600"` // in seconds
+}
+
+// LogConfig is the log file settings
+type LogConfig struct {
+	Folder      string             `yaml:"folder"` // working directory if it is blank
+	RotateCount int                `yaml:"rotateCount" default:"2" min:"0" max:"100"`
+	Level       string             `yaml:"level" default:"debug" enum:"debug,info,warn,error"` // it can be changed at runtime
+	Encoding    string             `yaml:"encoding" default:"console" enum:"console,json"`
+	MaxSize     int                `yaml:"maxSize" default:"1" min:"1" max:"1024"` // in MB
+	MaxAge      int                `yaml:"maxAge" default:"30" min:"0" max:"3650"` // in days, 0 to keep rotated files
+	Compress    bool               `yaml:"compress" default:"false"`
+	File        bool               `yaml:"file" default:"true"` // false to spare flash storage
+	Stdout      bool               `yaml:"stdout" default:"true"`
+	Syslog      LogSyslogConfig    `yaml:"syslog"`
+	Ship        LogShipConfig      `yaml:"ship"`
+	Websocket   LogWebsocketConfig `yaml:"websocket"`
+}
+
+// LogSyslogConfig is the syslog sink settings
+type LogSyslogConfig struct {
+	Network  string `yaml:"network" default:"none" enum:"none,unix,udp,tcp"` // "unix" for local socket, "udp" or "tcp" for RFC 5424
+	Address  string `yaml:"address" default:"/dev/log"`                      // e.g. "/dev/log" or "10.0.0.1:514"
+	Facility int    `yaml:"facility" default:"1" min:"0" max:"23"`           // 1 is user-level, 16 to 23 are local0 to local7
+}
+
+// LogShipConfig is the settings of shipping entries to Demeter server
+type LogShipConfig struct {
+	Enabled     bool   `yaml:"enabled" default:"false"`
+	Level       string `yaml:"level" default:"warn" enum:"warn,error"`
+	MaxBuffer   int    `yaml:"maxBuffer" default:"65536" min:"1024" max:"1048576"` // in bytes, the oldest entries are dropped while offline
+	BatchSize   int    `yaml:"batchSize" default:"50" min:"1" max:"1000"`
+	FlushPeriod int    `yaml:"flushPeriod" default:"10" min:"1" max:"3600"` // in seconds
+}
+
+// ReloadConfig is the hot-reload settings, configuration is also reloaded by SIGHUP
+type ReloadConfig struct {
+	WatchPeriod int `yaml:"watchPeriod" default:"0" min:"0" max:"3600"` // period (in seconds) to check configuration files for changes, 0 to disable
+}
+
+// RemoteConfig is the settings of configuration pushed by server
+type RemoteConfig struct {
+	RollbackGrace int `yaml:"rollbackGrace" default:"120" min:"10" max:"3600"` // period (in seconds) to be identified again after a change, or the change is rolled back
+}
+
+// LogWebsocketConfig is the logging settings of websocket messages, it can be changed at runtime
+type LogWebsocketConfig struct {
+	RedactKeys []string                     `yaml:"redactKeys" default:"[password, passwd, key, psk, secret, token]"` // values of JSON keys which contain any of them are masked
+	MaxLength  int                          `yaml:"maxLength" default:"2048" min:"0" max:"1048576"`                   // longer messages are truncated, 0 to keep
+	Functions  map[string]LogFunctionConfig `yaml:"functions" default:"{F_PING: {level: debug}, F_LOG_SHIP: {level: debug}}"`
+}
+
+// LogFunctionConfig is the logging settings of messages of a function
+type LogFunctionConfig struct {
+	Level  string `yaml:"level"`  // e.g. "debug", "info" if it is blank
+	Sample int    `yaml:"sample"` // log one of every N messages, 0 or 1 to log all
+}
+
+// MetricsConfig is the settings of exposing metrics
+type MetricsConfig struct {
+	Listen     string `yaml:"listen"`                                     // local HTTP endpoint in Prometheus text format, e.g. "127.0.0.1:9100", blank to disable
+	Path       string `yaml:"path" default:"/metrics"`                    // HTTP path of the endpoint
+	PushPeriod int    `yaml:"pushPeriod" default:"0" min:"0" max:"86400"` // period (in seconds) to push metrics to server by F_METRICS, 0 to disable
+}
+
+// QualityConfig is the settings of connection quality
+type QualityConfig struct {
+	ReportPeriod  int  `yaml:"reportPeriod" default:"300" min:"0" max:"86400"` // period (in seconds) to report ping statistics by F_QUALITY, 0 to disable
+	AdaptivePing  bool `yaml:"adaptivePing" default:"false"`                   // adapt the ping period to the stability of the connection
+	MinPingPeriod int  `yaml:"minPingPeriod" default:"5" min:"1" max:"3600"`   // in seconds
+	MaxPingPeriod int  `yaml:"maxPingPeriod" default:"120" min:"1" max:"3600"` // in seconds
+}
+
+// ControlConfig is the settings of the local control socket used by cpectl
+type ControlConfig struct {
+	Socket string `yaml:"socket" default:"/var/run/cpe_agent.sock"` // unix-domain socket path, blank to disable
+}
+
+// RelayConfig is the settings of the local API which relays messages of other applications to server
+type RelayConfig struct {
+	Socket     string                       `yaml:"socket" default:"/var/run/cpe_agent_relay.sock"` // unix-domain socket path, blank to disable
+	Rate       float64                      `yaml:"rate" default:"5" min:"0.01" max:"1000"`         // messages per second of each client
+	Burst      int                          `yaml:"burst" default:"20" min:"1" max:"10000"`         // messages at once of each client
+	BufferSize int                          `yaml:"bufferSize" default:"100" min:"0" max:"10000"`   // notifications of each client buffered while offline, 0 to disable
+	Clients    map[string]RelayClientConfig `yaml:"clients"`                                        // only listed clients are accepted from their users unless it is empty
+}
+
+// RelayClientConfig binds a client to the user of its processes, and overrides its limits, 0 to follow the relay settings
+type RelayClientConfig struct {
+	UID        int     `yaml:"uid" required:"true" min:"0"` // the client is accepted only from processes of the user
+	Rate       float64 `yaml:"rate" min:"0" max:"1000"`
+	Burst      int     `yaml:"burst" min:"0" max:"10000"`
+	BufferSize int     `yaml:"bufferSize" default:"-1" min:"-1" max:"10000"` // -1 to follow the relay settings, 0 to disable
+}
+
+// OutboxConfig is the settings of the persistent queue of datagrams which cannot be delivered while offline
+type OutboxConfig struct {
+	Folder      string            `yaml:"folder"`                                               // folder on persistent storage, blank to disable
+	MaxSize     int               `yaml:"maxSize" default:"1048576" min:"4096" max:"67108864"`  // in bytes, the oldest segments of the lowest class are dropped beyond it
+	MaxAge      int               `yaml:"maxAge" default:"86400" min:"0" max:"2592000"`         // in seconds, older datagrams are dropped, 0 to keep
+	SegmentSize int               `yaml:"segmentSize" default:"65536" min:"1024" max:"1048576"` // in bytes
+	Sync        bool              `yaml:"sync" default:"false"`                                 // flush each datagram to the storage, it survives power loss but wears flash
+	Priorities  map[string]string `yaml:"priorities" default:"{F_LOG_SHIP: low}"`               // class of each function, "high", "normal" or "low"
+}
@@ -0,0 +1,60 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"time"
+)
+
+// DefaultSocketPath is the unix-domain socket served by cpe_agent
+const DefaultSocketPath string = "/var/run/cpe_agent.sock"
+
+// Request is a line of JSON sent to the control socket, e.g. {"command":"log-level","arguments":["debug","600"]}
+type Request struct {
+	Command   string   `json:"command"`
+	Arguments []string `json:"arguments,omitempty"`
+}
+
+// Response is a line of JSON replied to each request, "error" is blank on success
+type Response struct {
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// Call sends the command to the control socket and waits for the result within "timeout"
+func Call(socketPath string, timeout time.Duration, command string, arguments ...string) (json.RawMessage, error) {
+	conn, err := net.DialTimeout("unix", socketPath, timeout)
+	if nil != err {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	err = json.NewEncoder(conn).Encode(&Request{Command: command, Arguments: arguments})
+	if nil != err {
+		return nil, err
+	}
+
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if nil != err {
+		return nil, err
+	}
+
+	var response struct {
+		Result json.RawMessage `json:"result"`
+		Error  string          `json:"error"`
+	}
+	err = json.Unmarshal(line, &response)
+	if nil != err {
+		return nil, err
+	}
+
+	if "" != response.Error {
+		return nil, errors.New(response.Error)
+	}
+
+	return response.Result, nil
+}
@@ -0,0 +1,167 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"sercomm.com/demeter/commons/logger"
+)
+
+// requests longer than it are rejected
+const maxRequestSize int = 65536
+
+// HandlerFunc handles a command, the result is encoded in JSON
+type HandlerFunc func(arguments []string) (interface{}, error)
+
+// Server serves commands on a unix-domain socket, one request and one response per line
+type Server struct {
+	socketPath string
+	locker     sync.Mutex
+	handlers   map[string]HandlerFunc // pair< command, handler >
+	listener   net.Listener
+}
+
+// NewServer ...
+func NewServer(socketPath string) *Server {
+	server := &Server{
+		socketPath: socketPath,
+		handlers:   make(map[string]HandlerFunc),
+	}
+
+	server.Handle("help", func(arguments []string) (interface{}, error) {
+		return server.commands(), nil
+	})
+
+	return server
+}
+
+// Handle registers the handler of the command
+func (server *Server) Handle(command string, handler HandlerFunc) {
+	server.locker.Lock()
+	defer server.locker.Unlock()
+
+	server.handlers[command] = handler
+}
+
+// Start listens on the socket, only the owner and the group of the process can connect
+func (server *Server) Start() error {
+	listener, err := Listen(server.socketPath)
+	if nil != err {
+		return err
+	}
+
+	server.locker.Lock()
+	server.listener = listener
+	server.locker.Unlock()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if nil != err {
+				return
+			}
+
+			go server.serve(conn)
+		}
+	}()
+
+	logger.New().Info("control: LISTENING", zap.String("socket", server.socketPath))
+	return nil
+}
+
+// Stop closes the socket and removes the socket file
+func (server *Server) Stop() {
+	server.locker.Lock()
+	defer server.locker.Unlock()
+
+	if nil != server.listener {
+		server.listener.Close()
+		server.listener = nil
+		os.Remove(server.socketPath)
+	}
+}
+
+func (server *Server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 4096), maxRequestSize)
+	encoder := json.NewEncoder(conn)
+
+	for scanner.Scan() {
+		var request Request
+		var response Response
+
+		err := json.Unmarshal(scanner.Bytes(), &request)
+		if nil != err {
+			response.Error = "INVALID REQUEST: " + err.Error()
+			encoder.Encode(&response)
+			continue
+		}
+
+		server.locker.Lock()
+		handler, ok := server.handlers[request.Command]
+		server.locker.Unlock()
+
+		if false == ok {
+			response.Error = "UNKNOWN COMMAND: " + request.Command
+			encoder.Encode(&response)
+			continue
+		}
+
+		logger.New().Info("control: COMMAND", zap.String("command", request.Command), zap.Strings("arguments", request.Arguments))
+
+		response.Result, err = handler(request.Arguments)
+		if nil != err {
+			response.Result = nil
+			response.Error = err.Error()
+		}
+
+		encoder.Encode(&response)
+	}
+}
+
+func (server *Server) commands() []string {
+	server.locker.Lock()
+	defer server.locker.Unlock()
+
+	commands := make([]string, 0, len(server.handlers))
+	for command := range server.handlers {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+
+	return commands
+}
+
+// Listen on the unix-domain socket with mode 0660, a stale socket file is replaced
+func Listen(socketPath string) (net.Listener, error) {
+	if _, err := os.Stat(socketPath); nil == err {
+		// refuse to replace the socket of a running process
+		if conn, err := net.DialTimeout("unix", socketPath, time.Second); nil == err {
+			conn.Close()
+			return nil, fmt.Errorf("SOCKET IS IN USE: %s", socketPath)
+		}
+		os.Remove(socketPath)
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if nil != err {
+		return nil, err
+	}
+
+	err = os.Chmod(socketPath, 0660)
+	if nil != err {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
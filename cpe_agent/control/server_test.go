@@ -0,0 +1,152 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startTestServer(t *testing.T) (*Server, string, func()) {
+	t.Helper()
+
+	folder, err := ioutil.TempDir("", "control")
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	socketPath := filepath.Join(folder, "control.sock")
+	server := NewServer(socketPath)
+	server.Handle("echo", func(arguments []string) (interface{}, error) {
+		return arguments, nil
+	})
+	server.Handle("fail", func(arguments []string) (interface{}, error) {
+		return "ignored", errors.New("FAILED ON PURPOSE")
+	})
+
+	err = server.Start()
+	if nil != err {
+		os.RemoveAll(folder)
+		t.Fatal(err)
+	}
+
+	return server, socketPath, func() {
+		server.Stop()
+		os.RemoveAll(folder)
+	}
+}
+
+func TestServerCall(t *testing.T) {
+	_, socketPath, closer := startTestServer(t)
+	defer closer()
+
+	tests := []struct {
+		name      string
+		command   string
+		arguments []string
+		expected  string
+		err       string
+	}{
+		{"echo", "echo", []string{"a", "b"}, `["a","b"]`, ""},
+		{"help", "help", nil, `["echo","fail","help"]`, ""},
+		{"failure", "fail", nil, "", "FAILED ON PURPOSE"},
+		{"unknown", "unknown", nil, "", "UNKNOWN COMMAND: unknown"},
+	}
+
+	for _, test := range tests {
+		result, err := Call(socketPath, time.Second*3, test.command, test.arguments...)
+		if "" != test.err {
+			if nil == err || test.err != err.Error() {
+				t.Errorf("%s: expected error '%s' but got %v", test.name, test.err, err)
+			}
+			continue
+		}
+
+		if nil != err {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if test.expected != string(result) {
+			t.Errorf("%s: expected %s but got %s", test.name, test.expected, string(result))
+		}
+	}
+}
+
+func TestServerConnection(t *testing.T) {
+	_, socketPath, closer := startTestServer(t)
+	defer closer()
+
+	info, err := os.Stat(socketPath)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	if 0660 != info.Mode().Perm() {
+		t.Errorf("unexpected mode %v", info.Mode().Perm())
+	}
+
+	conn, err := net.Dial("unix", socketPath)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 3))
+
+	// a connection serves requests line by line, an invalid one does not close it
+	_, err = conn.Write([]byte("not json\n{\"command\":\"echo\",\"arguments\":[\"x\"]}\n"))
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	for _, expected := range []string{"INVALID REQUEST", ""} {
+		line, err := reader.ReadBytes('\n')
+		if nil != err {
+			t.Fatal(err)
+		}
+
+		var response Response
+		err = json.Unmarshal(line, &response)
+		if nil != err {
+			t.Fatal(err)
+		}
+
+		if false == strings.HasPrefix(response.Error, expected) || ("" == expected) == (nil == response.Result) {
+			t.Errorf("unexpected response %s", string(line))
+		}
+	}
+}
+
+func TestServerListen(t *testing.T) {
+	server, socketPath, closer := startTestServer(t)
+	defer closer()
+
+	// the socket of a running server is never replaced
+	if _, err := Listen(socketPath); nil == err {
+		t.Fatal("socket in use was replaced")
+	}
+
+	server.Stop()
+	if _, err := os.Stat(socketPath); nil == err {
+		t.Fatal("socket file was not removed")
+	}
+
+	// a stale socket file is replaced
+	err := ioutil.WriteFile(socketPath, nil, 0600)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	listener, err := Listen(socketPath)
+	if nil != err {
+		t.Fatal(err)
+	}
+	listener.Close()
+}
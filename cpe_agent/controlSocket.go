@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+	"sercomm.com/demeter/commons/logger"
+	"sercomm.com/demeter/commons/packet"
+	"sercomm.com/demeter/commons/util"
+	"sercomm.com/demeter/commons/ws"
+	"sercomm.com/demeter/cpe_agent/control"
+)
+
+// 1 once the session is identified by server
+var identified int32 = 0
+
+var controlServer *control.Server = nil
+
+// serve commands of cpectl on "control.socket"
+func startControl(controlConfig ControlConfig) {
+	if "" == controlConfig.Socket {
+		return
+	}
+
+	controlServer = control.NewServer(controlConfig.Socket)
+	controlServer.Handle("status", controlStatus)
+	controlServer.Handle("reconnect", controlReconnect)
+	controlServer.Handle("log-level", controlLogLevel)
+	controlServer.Handle("ubus", controlUbus)
+
+	err := controlServer.Start()
+	if nil != err {
+		logger.New().Error("control: UNABLE TO LISTEN", zap.String("socket", controlConfig.Socket), zap.Error(err))
+		controlServer = nil
+	}
+}
+
+func stopControl() {
+	if nil != controlServer {
+		controlServer.Stop()
+	}
+}
+
+// status of the agent, e.g. "cpectl status"
+func controlStatus(arguments []string) (interface{}, error) {
+	entry := currentConfig().Entry
+
+	state := "CLOSED"
+	pending := 0
+	pingPeriod := entry.PingPeriod
+	var statistics ws.PingStatistics
+	if nil != session {
+		switch session.GetState() {
+		case ws.StateConnecting:
+			state = "CONNECTING"
+		case ws.StateConnected:
+			state = "CONNECTED"
+			if 1 == atomic.LoadInt32(&identified) {
+				state = "IDENTIFIED"
+			}
+		}
+
+		pending = session.GetPendingCount()
+		pingPeriod = session.GetPingPeriod()
+		statistics = session.GetPingStatistics()
+	}
+
+	level, revertTime := logger.GetLevel()
+
+	status := map[string]interface{}{
+		"version": VERSION,
+		"state":   state,
+		"endpoint": map[string]interface{}{
+			"host":      entry.Host,
+			"port":      entry.Port,
+			"path":      entry.Path,
+			"enableSSL": entry.EnableSSL,
+		},
+		"identity": map[string]interface{}{
+			"serialNumber":    hardwareInfo.SerialNumber,
+			"macAddress":      hardwareInfo.MAC,
+			"modelName":       hardwareInfo.Model,
+			"firmwareVersion": hardwareInfo.SoftwareVersion,
+		},
+		"pending":    pending,
+		"pingPeriod": pingPeriod,
+		"ping":       statistics,
+		"logLevel":   level,
+	}
+
+	if false == revertTime.IsZero() {
+		status["logLevelRevertTime"] = revertTime
+	}
+
+	if nil != outbox {
+		status["outbox"] = outbox.spool.Len()
+	}
+
+	return status, nil
+}
+
+// close the session, it is reconnected by the main loop
+func controlReconnect(arguments []string) (interface{}, error) {
+	if nil == session || ws.StateClosed == session.GetState() {
+		return nil, errors.New("SESSION IS NOT CONNECTED")
+	}
+
+	logger.New().Warn("control: RECONNECTING BY OPERATOR")
+	return nil, session.Close(websocket.CloseNormalClosure, "RECONNECT BY OPERATOR")
+}
+
+// handled as F_LOG_LEVEL from server
+//
+//	level    - e.g. "debug", blank to query the level, "revert" to cancel the temporary level
+//	duration - in seconds
+func controlLogLevel(arguments []string) (interface{}, error) {
+	datagram := &packet.Datagram{
+		ID:       util.RandomUUIDString(),
+		Type:     packet.T_REQUEST.String(),
+		Function: packet.F_LOG_LEVEL.String(),
+	}
+
+	if len(arguments) > 0 {
+		datagram.Push(arguments[0])
+	}
+	if len(arguments) > 1 {
+		duration, err := strconv.ParseFloat(arguments[1], 64)
+		if nil != err {
+			return nil, fmt.Errorf("INVALID DURATION: %s", arguments[1])
+		}
+		datagram.Push(duration)
+	}
+
+	local := newLocalSession()
+	processLogLevelCommand(ws.NewDatagramContext(local, datagram), local, datagram)
+
+	return local.result()
+}
+
+// handled as F_UBUS from server, e.g. "cpectl ubus board system"
+//
+//	method  - ubus method
+//	path    - ubus object
+//	payload - JSON, optional
+func controlUbus(arguments []string) (interface{}, error) {
+	if len(arguments) < 2 {
+		return nil, errors.New("METHOD AND PATH ARE REQUIRED")
+	}
+
+	payload := ""
+	if len(arguments) > 2 {
+		payload = arguments[2]
+	}
+
+	datagram := &packet.Datagram{
+		ID:       util.RandomUUIDString(),
+		Type:     packet.T_REQUEST.String(),
+		Function: packet.F_UBUS.String(),
+	}
+
+	local := newLocalSession()
+	processUbusCommand(ws.NewDatagramContext(local, datagram), local, datagram.ID, arguments[0], arguments[1], payload)
+
+	return local.result()
+}
+
+// localSession keeps the datagram delivered by a handler instead of sending it to server,
+// commands of cpectl are processed by the same handlers as requests from server
+type localSession struct {
+	ws.Session
+
+	datagram *packet.Datagram
+}
+
+func newLocalSession() *localSession {
+	return &localSession{}
+}
+
+func (local *localSession) GetID() string {
+	return "control"
+}
+
+func (local *localSession) GetConnection() *websocket.Conn {
+	return nil
+}
+
+func (local *localSession) GetState() ws.SessionState {
+	return ws.StateConnected
+}
+
+func (local *localSession) Close(statusCode int, reason string) error {
+	return nil
+}
+
+func (local *localSession) Deliver(
+	datagram *packet.Datagram,
+	timeoutInterval int,
+	onResult func(session ws.Session, packetID string, arguments ...interface{}),
+	onError func(session ws.Session, packetID string, condition packet.ErrorCondition, errorMessage string),
+	onTimeout func(session ws.Session, packetID string, timeoutInterval int)) error {
+	local.datagram = datagram
+	return nil
+}
+
+// arguments of T_RESULT, or the condition and message of T_ERROR
+func (local *localSession) result() (interface{}, error) {
+	if nil == local.datagram {
+		return nil, errors.New("NO RESULT")
+	}
+
+	if packet.T_ERROR.String() == local.datagram.Type {
+		// the condition is not converted to string by JSON yet
+		condition := util.GetAsObject(local.datagram.Arguments, 0, "")
+		message := util.GetAsObject(local.datagram.Arguments, 1, "")
+		return nil, fmt.Errorf("%v: %v", condition, message)
+	}
+
+	return local.datagram.Arguments, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"sercomm.com/demeter/commons/logger"
+	"sercomm.com/demeter/cpe_agent/control"
+)
+
+func TestControlSocket(t *testing.T) {
+	folder, err := ioutil.TempDir("", "control")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+
+	configHolder.Store(&AgentConfig{Entry: EntryConfig{Host: "demeter.local", Port: 443, PingPeriod: 30}})
+	defer logger.RevertLevel()
+
+	socketPath := filepath.Join(folder, "cpe_agent.sock")
+	startControl(ControlConfig{Socket: socketPath})
+	if nil == controlServer {
+		t.Fatal("control socket was not started")
+	}
+	defer stopControl()
+
+	tests := []struct {
+		name      string
+		command   string
+		arguments []string
+		expected  string // a part of the result, or of the error
+		failed    bool
+	}{
+		{"status", "status", nil, `"state":"CLOSED"`, false},
+		{"status of the endpoint", "status", nil, `"host":"demeter.local"`, false},
+		{"query log level", "log-level", nil, `["debug",""]`, false},
+		{"temporary log level", "log-level", []string{"error", "60"}, `"error"`, false},
+		{"revert log level", "log-level", []string{"revert"}, `["debug",""]`, false},
+		{"invalid duration", "log-level", []string{"error", "forever"}, "INVALID DURATION", true},
+		{"duration out of range", "log-level", []string{"error", "0"}, "DURATION MUST BE", true},
+		{"ubus without path", "ubus", []string{"board"}, "METHOD AND PATH ARE REQUIRED", true},
+		{"reconnect while closed", "reconnect", nil, "SESSION IS NOT CONNECTED", true},
+	}
+
+	for _, test := range tests {
+		result, err := control.Call(socketPath, time.Second*3, test.command, test.arguments...)
+		if test.failed {
+			if nil == err || false == strings.Contains(err.Error(), test.expected) {
+				t.Errorf("%s: expected error '%s' but got %v", test.name, test.expected, err)
+			}
+			continue
+		}
+
+		if nil != err {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if false == json.Valid(result) || false == strings.Contains(string(result), test.expected) {
+			t.Errorf("%s: expected '%s' in %s", test.name, test.expected, string(result))
+		}
+	}
+}
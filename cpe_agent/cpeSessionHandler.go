@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"sync/atomic"
+	"time"
 
 	"go.uber.org/zap"
 	"sercomm.com/demeter/commons/logger"
+	"sercomm.com/demeter/commons/metrics"
 	"sercomm.com/demeter/commons/packet"
 	"sercomm.com/demeter/commons/util"
 	"sercomm.com/demeter/commons/ws"
@@ -35,26 +39,48 @@ func (handler *CpeSessionHandler) SessionCreated(session *ws.ClientSession) {
 		datagram.Push(hardwareInfo.Model)
 		datagram.Push(hardwareInfo.SoftwareVersion)
 
+		log := logger.New().With(ws.DatagramFields(session, &datagram)...)
+
 		// deliver identification packet
 		session.Deliver(&datagram, ackTimeout,
 			func(session ws.Session, packetID string, arguments ...interface{}) {
-				logger.New().Info("IDENTIFICATION SUCCESS")
+				log.Info("IDENTIFICATION SUCCESS")
+				atomic.StoreInt32(&identified, 1)
+
+				// a pushed configuration is confirmed once the agent is identified again
+				confirmConfig()
+
+				// buffered log entries are shipped while online
+				logger.SetShipper(shipLogs(session))
+
+				// datagrams kept while offline go first
+				replayOutbox(session)
+
+				// notifications of local applications buffered while offline
+				flushRelay()
 			},
 			func(session ws.Session, packetID string, condition packet.ErrorCondition, errorMessage string) {
-				logger.New().Info("IDENTIFICATION FAILURE", zap.String("REASON", errorMessage))
+				log.Info("IDENTIFICATION FAILURE", zap.String("REASON", errorMessage))
 			},
 			func(session ws.Session, packetID string, timeoutInterval int) {
-				logger.New().Info("IDENTIFICATION TIMEOUT", zap.Int("INTERVAL", timeoutInterval))
+				log.Info("IDENTIFICATION TIMEOUT", zap.Int("INTERVAL", timeoutInterval))
 			})
 	}()
 }
 
 // SessionMessageReceived ...
 func (handler *CpeSessionHandler) SessionMessageReceived(session *ws.ClientSession, datagram *packet.Datagram) {
-	logger.New().Info("websocket: SESSION RECV REQUEST", zap.String("datagramID", datagram.ID))
+	// every entry logged while handling the datagram carries its session ID, datagram ID and function
+	ctx := ws.NewDatagramContext(session, datagram)
+	logger.FromContext(ctx).Info("websocket: SESSION RECV REQUEST")
 
 	function := packet.ParseFunction(datagram.Function)
 
+	// functions are labeled only if they are known
+	labels := map[string]string{"function": functionLabel(function)}
+	metrics.Default().AddCounter(MetricRequests, labels, 1)
+	defer metrics.Default().ObserveDuration(MetricRequestDuration, labels, time.Now())
+
 	// if received F_UNKNOWN
 	if function == packet.F_UNKNOWN {
 		errorDatagram := &packet.Datagram{
@@ -80,12 +106,29 @@ func (handler *CpeSessionHandler) SessionMessageReceived(session *ws.ClientSessi
 		pathString := util.GetAsString(datagram.Arguments, 1, "")
 		requestString := util.GetAsString(datagram.Arguments, 2, "")
 		processUbusCommand(
+			ctx,
 			session,
 			datagram.ID,
 			methodString,
 			pathString,
 			requestString)
 		return
+	case packet.F_LOG_LEVEL:
+		processLogLevelCommand(ctx, session, datagram)
+		return
+	case packet.F_LOG_FETCH:
+		processLogFetchCommand(ctx, session, datagram)
+		return
+	case packet.F_CONFIG:
+		methodString := util.GetAsString(datagram.Arguments, 0, "")
+		values, _ := util.GetAsObject(datagram.Arguments, 1, nil).(map[string]interface{})
+		processConfigCommand(
+			ctx,
+			session,
+			datagram.ID,
+			methodString,
+			values)
+		return
 	default:
 		return
 	}
@@ -94,12 +137,14 @@ func (handler *CpeSessionHandler) SessionMessageReceived(session *ws.ClientSessi
 
 // SessionDestroyed ...
 func (handler *CpeSessionHandler) SessionDestroyed(session *ws.ClientSession) {
+	atomic.StoreInt32(&identified, 0)
+	logger.SetShipper(nil)
 	logger.New().Info("websocket: SESSION DESTROYED")
 }
 
 // process ubus command from server
-func processUbusCommand(session ws.Session, id string, methodString string, pathString string, requestString string) {
-	jsonString, err := caller.Call(methodString, pathString, requestString)
+func processUbusCommand(ctx context.Context, session ws.Session, id string, methodString string, pathString string, requestString string) {
+	jsonString, err := caller.CallContext(ctx, methodString, pathString, requestString)
 
 	var datagram *packet.Datagram
 
@@ -120,7 +165,7 @@ func processUbusCommand(session ws.Session, id string, methodString string, path
 		// deliver the error to server
 		err = session.Deliver(datagram, 0, nil, nil, nil)
 		if nil != err {
-			logger.New().Warn("CANNOT DELIVER RESULT", zap.String("id", id), zap.Error(err))
+			logger.FromContext(ctx).Warn("CANNOT DELIVER RESULT", zap.String("id", id), zap.Error(err))
 		}
 
 		datagram = nil
@@ -155,6 +200,6 @@ func processUbusCommand(session ws.Session, id string, methodString string, path
 	// deliver the result to server
 	err = session.Deliver(datagram, 0, nil, nil, nil)
 	if nil != err {
-		logger.New().Warn("CANNOT DELIVER RESULT", zap.String("id", id), zap.Error(err))
+		logger.FromContext(ctx).Warn("CANNOT DELIVER RESULT", zap.String("id", id), zap.Error(err))
 	}
 }
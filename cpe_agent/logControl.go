@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"sercomm.com/demeter/commons/logger"
+	"sercomm.com/demeter/commons/packet"
+	"sercomm.com/demeter/commons/util"
+	"sercomm.com/demeter/commons/ws"
+)
+
+const (
+	defaultLevelDuration = 600 // in seconds
+	maxLevelDuration     = 86400
+	defaultChunkSize     = 32768 // in bytes
+	maxChunkSize         = 262144
+)
+
+// time format of ISO8601TimeEncoder
+const logTimeLayout string = "2006-01-02T15:04:05.000Z0700"
+
+// process F_LOG_LEVEL from server
+//
+//	level    - e.g. "debug", blank to query the level, "revert" to cancel the temporary level
+//	duration - in seconds, the level reverts to "log.level" after it
+func processLogLevelCommand(ctx context.Context, session ws.Session, datagram *packet.Datagram) {
+	levelString := util.GetAsString(datagram.Arguments, 0, "")
+	duration, ok := util.GetAsObject(datagram.Arguments, 1, float64(defaultLevelDuration)).(float64)
+
+	result := &packet.Datagram{
+		ID:       datagram.ID,
+		Type:     packet.T_RESULT.String(),
+		Function: packet.F_LOG_LEVEL.String(),
+	}
+
+	var err error
+	switch {
+	case false == ok || duration < 1 || duration > maxLevelDuration:
+		err = fmt.Errorf("DURATION MUST BE 1 TO %d SECONDS", maxLevelDuration)
+	case "revert" == levelString:
+		logger.RevertLevel()
+	case "" != levelString:
+		_, err = logger.SetTemporaryLevel(levelString, time.Duration(duration)*time.Second)
+	}
+
+	if nil != err {
+		result.Type = packet.T_ERROR.String()
+		result.Push(packet.E_BAD_REQUEST)
+		result.Push(err.Error())
+	} else {
+		current, revertTime := logger.GetLevel()
+		result.Push(current)
+		if revertTime.IsZero() {
+			result.Push("")
+		} else {
+			result.Push(revertTime.UTC().Format(time.RFC3339))
+			logger.FromContext(ctx).Warn("logger: TEMPORARY LEVEL", zap.String("level", current), zap.Time("revertTime", revertTime))
+		}
+	}
+
+	err = session.Deliver(result, 0, nil, nil, nil)
+	if nil != err {
+		logger.FromContext(ctx).Warn("CANNOT DELIVER RESULT", zap.String("id", datagram.ID), zap.Error(err))
+	}
+}
+
+// process F_LOG_FETCH from server
+//
+//	method - "List" returns the log files, "Get" returns a chunk of a log file
+//	name   - file name given by "List"
+//	offset - offset of the chunk in the (filtered) content
+//	length - size of the chunk, at most 256 KB
+//	gzip   - true to gzip the chunk, it is base64-encoded by JSON
+//	from   - RFC3339 time, blank to ignore, lines logged before it are skipped
+//	to     - RFC3339 time, blank to ignore, lines logged after it are skipped
+//
+// the chunk reports "total" size of the (filtered) content, it is -1 for gzipped or filtered content
+// until the chunk reaches the end, since such content is streamed instead of being read at once
+func processLogFetchCommand(ctx context.Context, session ws.Session, datagram *packet.Datagram) {
+	methodString := util.GetAsString(datagram.Arguments, 0, "")
+
+	result := &packet.Datagram{
+		ID:       datagram.ID,
+		Type:     packet.T_RESULT.String(),
+		Function: packet.F_LOG_FETCH.String(),
+	}
+
+	var condition packet.ErrorCondition
+	var err error
+	switch methodString {
+	case "List":
+		var files []map[string]interface{}
+		files, err = listLogFiles()
+		condition = packet.E_INTERNAL_SERVER_ERROR
+		result.Push(files)
+	case "Get":
+		var chunk map[string]interface{}
+		chunk, condition, err = readLogChunk(datagram.Arguments)
+		result.Push(chunk)
+	default:
+		condition = packet.E_BAD_REQUEST
+		err = fmt.Errorf("UNKNOWN METHOD: %s", methodString)
+	}
+
+	if nil != err {
+		result.Type = packet.T_ERROR.String()
+		result.Arguments = nil
+		result.Push(condition)
+		result.Push(err.Error())
+	}
+
+	err = session.Deliver(result, 0, nil, nil, nil)
+	if nil != err {
+		logger.FromContext(ctx).Warn("CANNOT DELIVER RESULT", zap.String("id", datagram.ID), zap.Error(err))
+	}
+}
+
+func listLogFiles() ([]map[string]interface{}, error) {
+	paths, err := logger.GetFiles()
+	if nil != err {
+		return nil, err
+	}
+
+	files := make([]map[string]interface{}, 0, len(paths))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if nil != err {
+			continue
+		}
+
+		files = append(files, map[string]interface{}{
+			"name":     info.Name(),
+			"size":     info.Size(),
+			"modified": info.ModTime().UTC().Format(time.RFC3339),
+		})
+	}
+
+	return files, nil
+}
+
+func readLogChunk(arguments []interface{}) (map[string]interface{}, packet.ErrorCondition, error) {
+	name := util.GetAsString(arguments, 1, "")
+	offset, offsetOk := util.GetAsObject(arguments, 2, float64(0)).(float64)
+	length, lengthOk := util.GetAsObject(arguments, 3, float64(defaultChunkSize)).(float64)
+	compress, compressOk := util.GetAsObject(arguments, 4, false).(bool)
+	fromString, fromOk := util.GetAsObject(arguments, 5, "").(string)
+	toString, toOk := util.GetAsObject(arguments, 6, "").(string)
+
+	if false == (offsetOk && lengthOk && compressOk && fromOk && toOk) || offset < 0 || length < 1 || length > maxChunkSize {
+		return nil, packet.E_BAD_REQUEST, fmt.Errorf("INVALID ARGUMENTS")
+	}
+
+	var from, to time.Time
+	var err error
+	if "" != fromString {
+		if from, err = time.Parse(time.RFC3339, fromString); nil != err {
+			return nil, packet.E_BAD_REQUEST, fmt.Errorf("INVALID TIME: %s", fromString)
+		}
+	}
+	if "" != toString {
+		if to, err = time.Parse(time.RFC3339, toString); nil != err {
+			return nil, packet.E_BAD_REQUEST, fmt.Errorf("INVALID TIME: %s", toString)
+		}
+	}
+
+	// only the listed files can be read
+	paths, err := logger.GetFiles()
+	if nil != err {
+		return nil, packet.E_INTERNAL_SERVER_ERROR, err
+	}
+
+	path := ""
+	for _, candidate := range paths {
+		if filepath.Base(candidate) == name {
+			path = candidate
+			break
+		}
+	}
+
+	if "" == path {
+		return nil, packet.E_ITEM_NOT_FOUND, fmt.Errorf("LOG FILE NOT FOUND: %s", name)
+	}
+
+	data, start, total, err := readLogRange(path, from, to, int64(offset), int64(length))
+	if nil != err {
+		return nil, packet.E_INTERNAL_SERVER_ERROR, err
+	}
+
+	end := start + int64(len(data))
+	chunk := map[string]interface{}{
+		"name":       name,
+		"offset":     start,
+		"nextOffset": end,
+		"total":      total,
+		"eof":        end == total,
+	}
+
+	if compress {
+		var buffer bytes.Buffer
+		writer := gzip.NewWriter(&buffer)
+		writer.Write(data)
+		writer.Close()
+
+		chunk["encoding"] = "gzip"
+		chunk["data"] = buffer.Bytes()
+	} else {
+		chunk["encoding"] = "plain"
+		chunk["data"] = string(data)
+	}
+
+	return chunk, "", nil
+}
+
+// read at most "length" bytes at "offset" of the (filtered) content of the log file (possibly gzipped),
+// "offset" is moved back to the end of the content if it exceeds the content.
+// Plain files without time range are read at the offset directly, others are streamed up to the chunk,
+// hence "total" size of the content is -1 unless the end of the content was reached
+func readLogRange(path string, from time.Time, to time.Time, offset int64, length int64) ([]byte, int64, int64, error) {
+	file, err := os.Open(path)
+	if nil != err {
+		return nil, 0, 0, err
+	}
+	defer file.Close()
+
+	compressed := strings.HasSuffix(path, ".gz")
+	if false == compressed && from.IsZero() && to.IsZero() {
+		info, err := file.Stat()
+		if nil != err {
+			return nil, 0, 0, err
+		}
+
+		total := info.Size()
+		if offset > total {
+			offset = total
+		}
+		if length > total-offset {
+			length = total - offset
+		}
+
+		// the file may be truncated by rotation meanwhile
+		data := make([]byte, length)
+		count, err := file.ReadAt(data, offset)
+		if nil != err && io.EOF != err {
+			return nil, 0, 0, err
+		}
+
+		return data[:count], offset, total, nil
+	}
+
+	var reader io.Reader = file
+	if compressed {
+		gzipReader, err := gzip.NewReader(file)
+		if nil != err {
+			return nil, 0, 0, err
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+
+	if false == from.IsZero() || false == to.IsZero() {
+		reader = newLogFilter(reader, from, to)
+	}
+
+	skipped, err := io.CopyN(ioutil.Discard, reader, offset)
+	if io.EOF == err {
+		return nil, skipped, skipped, nil
+	} else if nil != err {
+		return nil, 0, 0, err
+	}
+
+	data := make([]byte, length)
+	count, err := io.ReadFull(reader, data)
+	if io.EOF == err || io.ErrUnexpectedEOF == err {
+		return data[:count], offset, offset + int64(count), nil
+	} else if nil != err {
+		return nil, 0, 0, err
+	}
+
+	// check if the chunk reaches the end
+	total := int64(-1)
+	probe := make([]byte, 1)
+	if _, err = io.ReadFull(reader, probe); io.EOF == err {
+		total = offset + length
+	} else if nil != err {
+		return nil, 0, 0, err
+	}
+
+	return data, offset, total, nil
+}
+
+// logFilter streams lines of the log in the time range,
+// lines without timestamp (e.g. stack traces) follow the preceding line
+type logFilter struct {
+	scanner  *bufio.Scanner
+	from     time.Time
+	to       time.Time
+	included bool
+	pending  []byte // the rest of the included line
+}
+
+func newLogFilter(reader io.Reader, from time.Time, to time.Time) *logFilter {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 65536), 1048576)
+
+	return &logFilter{
+		scanner: scanner,
+		from:    from,
+		to:      to,
+	}
+}
+
+func (filter *logFilter) Read(buffer []byte) (int, error) {
+	for 0 == len(filter.pending) {
+		if false == filter.scanner.Scan() {
+			if err := filter.scanner.Err(); nil != err {
+				return 0, err
+			}
+			return 0, io.EOF
+		}
+
+		line := filter.scanner.Bytes()
+		if timestamp, ok := parseLogTime(line); ok {
+			filter.included = (filter.from.IsZero() || false == timestamp.Before(filter.from)) && (filter.to.IsZero() || false == timestamp.After(filter.to))
+		}
+
+		if filter.included {
+			filter.pending = append(append(filter.pending[:0], line...), '\n')
+		}
+	}
+
+	count := copy(buffer, filter.pending)
+	filter.pending = filter.pending[count:]
+	return count, nil
+}
+
+// timestamp of a line written by the console or the JSON encoder
+func parseLogTime(line []byte) (time.Time, bool) {
+	text := string(line)
+	if idx := strings.Index(text, `"time":"`); strings.HasPrefix(text, "{") && idx >= 0 {
+		text = text[idx+len(`"time":"`):]
+		if end := strings.Index(text, `"`); end >= 0 {
+			text = text[:end]
+		}
+	} else if idx := strings.IndexAny(text, "\t "); idx >= 0 {
+		text = text[:idx]
+	}
+
+	timestamp, err := time.Parse(logTimeLayout, text)
+	return timestamp, nil == err
+}
+
+// syslog sink is disabled by "none"
+func syslogOptions(syslogConfig LogSyslogConfig) logger.SyslogOptions {
+	if "none" == syslogConfig.Network {
+		return logger.SyslogOptions{}
+	}
+
+	return logger.SyslogOptions{
+		Network:  syslogConfig.Network,
+		Address:  syslogConfig.Address,
+		Facility: syslogConfig.Facility,
+	}
+}
+
+func messageLogOptions(websocketConfig LogWebsocketConfig) ws.MessageLogOptions {
+	functions := make(map[string]ws.FunctionLogOptions)
+	for function, functionConfig := range websocketConfig.Functions {
+		functions[function] = ws.FunctionLogOptions{
+			Level:  functionConfig.Level,
+			Sample: functionConfig.Sample,
+		}
+	}
+
+	return ws.MessageLogOptions{
+		RedactKeys: websocketConfig.RedactKeys,
+		MaxLength:  websocketConfig.MaxLength,
+		Functions:  functions,
+	}
+}
+
+// ship buffered log entries by F_LOG_SHIP through the session
+//
+//	batch   - entries in JSON
+//	dropped - number of entries dropped as the buffer was full while offline
+func shipLogs(session ws.Session) logger.Shipper {
+	return func(batch []json.RawMessage, dropped int) error {
+		datagram := &packet.Datagram{
+			ID:       util.RandomUUIDString(),
+			Type:     packet.T_REQUEST.String(),
+			Function: packet.F_LOG_SHIP.String(),
+		}
+
+		datagram.Push(batch)
+		datagram.Push(dropped)
+
+		return session.Deliver(datagram, ackTimeout, nil, nil, nil)
+	}
+}
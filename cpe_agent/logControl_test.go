@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testLog = "2026-10-19T04:00:00.000Z\tINFO\tfirst\n" +
+	"2026-10-19T05:00:00.000Z\tERROR\tsecond\n" +
+	"\tstack trace\n" +
+	"2026-10-19T06:00:00.000Z\tINFO\tthird\n"
+
+func TestReadLogRange(t *testing.T) {
+	folder, err := ioutil.TempDir("", "log")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+
+	plainPath := filepath.Join(folder, "agent.log")
+	ioutil.WriteFile(plainPath, []byte(testLog), 0644)
+
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	writer.Write([]byte(testLog))
+	writer.Close()
+	gzipPath := filepath.Join(folder, "agent-1.log.gz")
+	ioutil.WriteFile(gzipPath, buffer.Bytes(), 0644)
+
+	from, _ := time.Parse(time.RFC3339, "2026-10-19T05:00:00Z")
+	to, _ := time.Parse(time.RFC3339, "2026-10-19T05:30:00Z")
+	filtered := "2026-10-19T05:00:00.000Z\tERROR\tsecond\n\tstack trace\n"
+	size := int64(len(testLog))
+
+	tests := []struct {
+		name   string
+		path   string
+		from   time.Time
+		to     time.Time
+		offset int64
+		length int64
+		data   string
+		start  int64
+		total  int64
+	}{
+		{"plain head", plainPath, time.Time{}, time.Time{}, 0, 10, testLog[:10], 0, size},
+		{"plain tail", plainPath, time.Time{}, time.Time{}, size - 5, 10, testLog[size-5:], size - 5, size},
+		{"plain beyond the end", plainPath, time.Time{}, time.Time{}, size + 10, 10, "", size, size},
+		{"gzip head", gzipPath, time.Time{}, time.Time{}, 0, 10, testLog[:10], 0, -1},
+		{"gzip to the end", gzipPath, time.Time{}, time.Time{}, 10, size - 10, testLog[10:], 10, size},
+		{"gzip beyond the end", gzipPath, time.Time{}, time.Time{}, size + 10, 10, "", size, size},
+		{"filtered", plainPath, from, to, 0, 1024, filtered, 0, int64(len(filtered))},
+		{"filtered head", plainPath, from, to, 0, 5, filtered[:5], 0, -1},
+		{"filtered gzip", gzipPath, from, to, 5, 1024, filtered[5:], 5, int64(len(filtered))},
+	}
+
+	for _, test := range tests {
+		data, start, total, err := readLogRange(test.path, test.from, test.to, test.offset, test.length)
+		if nil != err {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if test.data != string(data) || test.start != start || test.total != total {
+			t.Errorf("%s: unexpected chunk %q at %d of %d", test.name, string(data), start, total)
+		}
+	}
+}
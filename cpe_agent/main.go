@@ -10,6 +10,7 @@ import (
 
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 	"time"
 
@@ -41,7 +42,13 @@ const CONF_PATH1 string = string(os.PathSeparator) + "conf" + string(os.PathSepa
 // CONF_PATH2 2nd default configuration file path
 const CONF_PATH2 string = string(os.PathSeparator) + "etc" + string(os.PathSeparator) + "cpe_agent.yaml"
 
-var context *daemon.Context = nil
+// CONF_DROP_IN_DIR directory beside the configuration file whose *.yaml files override it
+const CONF_DROP_IN_DIR string = "conf.d"
+
+// ENV_PREFIX prefix of environment variables which override configuration, e.g. CPE_AGENT_ENTRY_HOST
+const ENV_PREFIX string = "CPE_AGENT"
+
+var daemonContext *daemon.Context = nil
 var session *ws.ClientSession = nil
 var certPool *x509.CertPool = nil
 var isReady bool = false
@@ -53,11 +60,15 @@ func main() {
 	var daemonMode bool
 	var confPath string
 	var standaloneMode bool
+	var checkConfig bool
+	var overrides configger.Overrides
 	flag.BoolVar(&showHelp, "h", false, "help")
 	flag.BoolVar(&showVersion, "v", false, "version")
 	flag.BoolVar(&daemonMode, "d", false, "daemon mode")
 	flag.StringVar(&confPath, "c", "", "configuration file path (must be in YAML format)")
 	flag.BoolVar(&standaloneMode, "s", false, "standalone mode with fake hardware information")
+	flag.BoolVar(&checkConfig, "check-config", false, "validate configuration file and print the effective configuration")
+	flag.Var(&overrides, "o", "override configuration key in form of key=value, e.g. -o entry.host=10.0.0.1 (repeatable)")
 	flag.Parse()
 
 	if showHelp {
@@ -81,13 +92,13 @@ func main() {
 	if confPath == "" {
 		fmt.Println("NO CONFIGURATION FILE SPECIFIED, LOADING DEFAULT CONFIGURATION...")
 		confPath = directory + CONF_PATH1
-		err = configger.Load(confPath)
+		_, err = os.Stat(confPath)
 		if nil != err {
 			confPath = CONF_PATH2
-			err = configger.Load(confPath)
+			_, err = os.Stat(confPath)
 		}
 	} else {
-		err = configger.Load(confPath)
+		_, err = os.Stat(confPath)
 	}
 
 	if nil != err {
@@ -95,13 +106,52 @@ func main() {
 		os.Exit(1)
 	}
 
+	// defaults < YAML file < conf.d/*.yaml < remote.yaml < CPE_AGENT_* environment variables < -o flags
+	overridePath = filepath.Join(filepath.Dir(confPath), CONF_OVERRIDE_FILE)
+
+	agentConfig := &AgentConfig{}
+	reloader, err = configger.NewReloader(configger.Sources{
+		File:         confPath,
+		DropInDir:    filepath.Join(filepath.Dir(confPath), CONF_DROP_IN_DIR),
+		OverrideFile: overridePath,
+		EnvPrefix:    ENV_PREFIX,
+		Overrides:    overrides,
+	}, agentConfig)
+
+	if nil != err {
+		fmt.Println(confPath + ": " + err.Error())
+		os.Exit(1)
+	}
+
+	configHolder.Store(agentConfig)
+
+	if checkConfig {
+		_, origins := reloader.GetCurrent()
+		if "" == agentConfig.Log.Folder {
+			agentConfig.Log.Folder = directory
+			origins["log.folder"] = "WORKING DIRECTORY"
+		}
+
+		effective, err := configger.Marshal(agentConfig)
+		if nil != err {
+			fmt.Println("UNABLE TO PRINT CONFIGURATION: " + err.Error())
+			os.Exit(1)
+		}
+
+		fmt.Println("CONFIGURATION IS VALID: " + confPath)
+		fmt.Print(effective)
+		fmt.Println("\nSOURCES:")
+		fmt.Println(configger.Explain(agentConfig, origins))
+		os.Exit(0)
+	}
+
 	// enable daemon mode
 	if daemonMode {
-		context, err = daemonize(standaloneMode)
+		daemonContext, err = daemonize(standaloneMode)
 		if nil != err {
 			os.Exit(1)
 		}
-		defer context.Release()
+		defer daemonContext.Release()
 	}
 
 	/*
@@ -115,38 +165,55 @@ func main() {
 		}()
 	*/
 
-	logFoler := configger.GetValue("log", "folder")
-	logRotateCount := configger.GetValue("log", "rotateCount")
+	logFolder := agentConfig.Log.Folder
+	if "" == logFolder {
+		logFolder = directory
+	}
 
-	logger.SetEnvParam(logFoler.String(directory), logRotateCount.Int(2))
+	logger.SetOptions(logger.Options{
+		Folder:     logFolder,
+		Encoding:   agentConfig.Log.Encoding,
+		MaxSize:    agentConfig.Log.MaxSize,
+		MaxBackups: agentConfig.Log.RotateCount,
+		MaxAge:     agentConfig.Log.MaxAge,
+		Compress:   agentConfig.Log.Compress,
+		File:       agentConfig.Log.File,
+		Stdout:     agentConfig.Log.Stdout,
+		Syslog:     syslogOptions(agentConfig.Log.Syslog),
+		Ship: logger.ShipOptions{
+			Enabled:     agentConfig.Log.Ship.Enabled,
+			Level:       agentConfig.Log.Ship.Level,
+			MaxBuffer:   agentConfig.Log.Ship.MaxBuffer,
+			BatchSize:   agentConfig.Log.Ship.BatchSize,
+			FlushPeriod: time.Duration(agentConfig.Log.Ship.FlushPeriod) * time.Second,
+		},
+	})
+	logger.SetLevel(agentConfig.Log.Level)
+	ws.SetMessageLogOptions(messageLogOptions(agentConfig.Log.Websocket))
 	logger.New().Info("START PROC: " + VERSION)
 
 	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGKILL, syscall.SIGTERM)
+	signal.Notify(interrupt, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGKILL, syscall.SIGTERM)
 
-	terminated := false
+	// SIGHUP reloads configuration
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
 
-	hostValue := configger.GetValue("entry", "host")
-	portValue := configger.GetValue("entry", "port")
-	pathValue := configger.GetValue("entry", "path")
-	enableSSLValue := configger.GetValue("entry", "enableSSL")
-	pingValue := configger.GetValue("entry", "pingPeriod")
-
-	host := hostValue.String("localhost")
-	port := portValue.Int(443)
-	path := pathValue.String("/iface/v1/cpe")
-	enableSSL := enableSSLValue.Bool(true)
-	ping := pingValue.Int(30)
-
-	var tlsConfig *tls.Config
-	if enableSSL == true {
-		tlsConfig = &tls.Config{
-			InsecureSkipVerify: true,
-		}
-	} else {
-		tlsConfig = nil
+	err = openOutbox(agentConfig.Outbox)
+	if nil != err {
+		logger.New().Error("outbox: UNABLE TO OPEN, DATAGRAMS ARE NOT KEPT WHILE OFFLINE: " + err.Error())
 	}
 
+	reloader.Subscribe(configReloaded)
+	watchConfig(agentConfig.Reload.WatchPeriod)
+	resumeRollback()
+	startMetrics(agentConfig.Metrics)
+	startQualityReport(agentConfig.Quality)
+	startControl(agentConfig.Control)
+	startRelay(agentConfig.Relay)
+
+	terminated := false
+
 	go func() {
 		defer func() {
 			if nil != session {
@@ -175,6 +242,27 @@ func main() {
 			if isReady == true && (session == nil || session.GetState() != ws.StateConnected) {
 				if nil == session {
 					session = ws.NewClientSession(&CpeSessionHandler{})
+					if nil != outbox {
+						session.SetOutbox(outbox)
+					}
+					applyAdaptivePing(session, currentConfig().Quality)
+				}
+
+				// settings may be changed by reloading
+				entry := currentConfig().Entry
+				host := entry.Host
+				port := entry.Port
+				path := entry.Path
+				enableSSL := entry.EnableSSL
+				ping := entry.PingPeriod
+
+				var tlsConfig *tls.Config
+				if enableSSL == true {
+					tlsConfig = &tls.Config{
+						InsecureSkipVerify: true,
+					}
+				} else {
+					tlsConfig = nil
 				}
 
 				logger.New().Info("websocket: CONNECTING TO HOST...", zap.String("host", host), zap.Int("port", port), zap.String("path", path), zap.Bool("enableSSL", enableSSL), zap.Int("pingPeriod", ping))
@@ -197,12 +285,17 @@ func main() {
 
 	for {
 		select {
+		case <-hangup:
+			logger.New().Info("config: RELOADING BY SIGHUP")
+			reloadConfig()
 		case sig := <-interrupt:
 			terminated = true
 			if nil != session && session.GetState() != ws.StateClosed {
 				session.Close(websocket.CloseNormalClosure, "PROCESS INTERRUPTED")
 			}
 
+			stopControl()
+			stopRelay()
 			logger.New().Warn("PROGRAM EXIT: " + sig.String())
 			os.Exit(0)
 		}
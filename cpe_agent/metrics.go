@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+	"sercomm.com/demeter/commons/logger"
+	"sercomm.com/demeter/commons/metrics"
+	"sercomm.com/demeter/commons/packet"
+	"sercomm.com/demeter/commons/util"
+	"sercomm.com/demeter/commons/ws"
+)
+
+// metrics of the agent in metrics.Default()
+const (
+	MetricInfo            string = "agent_info"
+	MetricStartTime       string = "agent_start_time_seconds"
+	MetricRequests        string = "agent_requests_total"
+	MetricRequestDuration string = "agent_request_duration_seconds"
+)
+
+func init() {
+	registry := metrics.Default()
+	registry.Describe(MetricInfo, metrics.KindGauge, "Version of the agent")
+	registry.Describe(MetricStartTime, metrics.KindGauge, "Start time of the agent in seconds since epoch")
+	registry.Describe(MetricRequests, metrics.KindCounter, "Requests received from server by function")
+	registry.Describe(MetricRequestDuration, metrics.KindHistogram, "Time to handle requests from server by function")
+}
+
+// label of the function, unknown functions share a single label
+func functionLabel(function packet.Function) string {
+	if packet.F_UNKNOWN == function {
+		return metrics.UnknownLabel
+	}
+
+	return function.String()
+}
+
+// expose metrics on the local HTTP endpoint and push them to server periodically, according to "metrics.*"
+func startMetrics(metricsConfig MetricsConfig) {
+	metrics.Default().SetGauge(MetricInfo, map[string]string{"version": VERSION}, 1)
+	metrics.Default().SetGauge(MetricStartTime, nil, float64(time.Now().Unix()))
+
+	if "" != metricsConfig.Listen {
+		mux := http.NewServeMux()
+		mux.Handle(metricsConfig.Path, metrics.Default())
+
+		go func() {
+			logger.New().Info("metrics: LISTENING", zap.String("listen", metricsConfig.Listen), zap.String("path", metricsConfig.Path))
+
+			err := http.ListenAndServe(metricsConfig.Listen, mux)
+			logger.New().Error("metrics: ENDPOINT STOPPED", zap.Error(err))
+		}()
+	}
+
+	if metricsConfig.PushPeriod > 0 {
+		go func() {
+			ticker := time.NewTicker(time.Duration(metricsConfig.PushPeriod) * time.Second)
+			defer ticker.Stop()
+
+			for range ticker.C {
+				pushMetrics()
+			}
+		}()
+	}
+}
+
+// deliver a snapshot of all metrics by F_METRICS
+func pushMetrics() {
+	if nil == session || ws.StateConnected != session.GetState() {
+		return
+	}
+
+	datagram := &packet.Datagram{
+		ID:       util.RandomUUIDString(),
+		Type:     packet.T_REQUEST.String(),
+		Function: packet.F_METRICS.String(),
+	}
+
+	datagram.Push(metrics.Default().Snapshot())
+
+	err := session.Deliver(datagram, ackTimeout, nil, nil, nil)
+	if nil != err {
+		logger.New().Debug("metrics: CANNOT PUSH", zap.Error(err))
+	}
+}
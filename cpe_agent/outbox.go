@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"sercomm.com/demeter/commons/logger"
+	"sercomm.com/demeter/commons/packet"
+	"sercomm.com/demeter/commons/spool"
+	"sercomm.com/demeter/commons/util"
+	"sercomm.com/demeter/commons/ws"
+)
+
+// priority classes of the outbox, the former ones are replayed first
+const (
+	classHigh   string = "high"
+	classNormal string = "normal"
+	classLow    string = "low"
+)
+
+var outbox *agentOutbox = nil
+
+// agentOutbox keeps datagrams in the spool while the session is down, they are replayed once identified.
+// Datagrams are kept while connected only during a replay, they are queued behind the kept ones instead of overtaking them.
+// It implements ws.Outbox
+type agentOutbox struct {
+	spool      *spool.Spool
+	priorities map[string]string // pair< function, class >
+	locker     sync.Mutex
+	replaying  bool
+	again      bool       // replay again once the running one stopped, e.g. identified again meanwhile
+	session    ws.Session // session of the latest identification
+}
+
+// open the outbox on "outbox.folder", datagrams kept before restarting are replayed once identified
+func openOutbox(outboxConfig OutboxConfig) error {
+	if "" == outboxConfig.Folder {
+		return nil
+	}
+
+	priorities := make(map[string]string)
+	for function, class := range outboxConfig.Priorities {
+		switch class {
+		case classHigh, classNormal, classLow:
+			priorities[function] = class
+		default:
+			logger.New().Warn("outbox: UNKNOWN CLASS IS IGNORED", zap.String("function", function), zap.String("class", class))
+		}
+	}
+
+	queue, err := spool.Open(spool.Options{
+		Folder:      outboxConfig.Folder,
+		Classes:     []string{classHigh, classNormal, classLow},
+		MaxBytes:    int64(outboxConfig.MaxSize),
+		MaxAge:      time.Duration(outboxConfig.MaxAge) * time.Second,
+		SegmentSize: int64(outboxConfig.SegmentSize),
+		Sync:        outboxConfig.Sync,
+	})
+	if nil != err {
+		return err
+	}
+
+	outbox = &agentOutbox{
+		spool:      queue,
+		priorities: priorities,
+	}
+
+	logger.New().Info("outbox: OPENED", zap.String("folder", outboxConfig.Folder), zap.Int("kept", queue.Len()))
+	return nil
+}
+
+// Keep is the implementation of ws.Outbox.Keep()
+func (box *agentOutbox) Keep(datagram *packet.Datagram, connected bool) (bool, error) {
+	box.locker.Lock()
+	defer box.locker.Unlock()
+
+	// only while the session is down or the kept datagrams are being replayed
+	if connected && false == box.replaying {
+		return false, nil
+	}
+
+	data, err := packet.String(datagram)
+	if nil != err {
+		return false, err
+	}
+
+	err = box.spool.Append(box.classOf(datagram), []byte(data))
+	if nil != err {
+		logger.New().Error("outbox: UNABLE TO KEEP DATAGRAM", zap.String("datagramID", datagram.ID), zap.Error(err))
+		return false, err
+	}
+
+	return true, nil
+}
+
+// results and errors are "high", requests are "normal" unless "outbox.priorities" lists the function
+func (box *agentOutbox) classOf(datagram *packet.Datagram) string {
+	if class, ok := box.priorities[datagram.Function]; ok {
+		return class
+	}
+
+	if packet.T_REQUEST.String() == datagram.Type {
+		return classNormal
+	}
+
+	return classHigh
+}
+
+// replay kept datagrams in order by F_REPLAY once the session is identified,
+// each one is deleted after server acknowledged it. The replay stops once the session is down
+func (box *agentOutbox) replay(session ws.Session) {
+	box.locker.Lock()
+	box.session = session
+	if box.replaying {
+		// the running replay goes on with the session once it stopped
+		box.again = true
+		box.locker.Unlock()
+		return
+	}
+	box.replaying = true
+	box.locker.Unlock()
+
+	for {
+		drained := box.replayKept(session)
+
+		// every way out of the replay ends here
+		box.locker.Lock()
+		if box.again {
+			box.again = false
+			session = box.session
+		} else if false == drained || 0 == box.spool.Len() {
+			box.replaying = false
+			box.locker.Unlock()
+			return
+		}
+		// otherwise datagrams were kept behind the drained ones meanwhile
+		box.locker.Unlock()
+	}
+}
+
+// replay until the outbox is empty, the session is down or the spool failed, true once empty
+func (box *agentOutbox) replayKept(session ws.Session) bool {
+	replayed := 0
+	for {
+		box.locker.Lock()
+		record, err := box.spool.Peek()
+		box.locker.Unlock()
+
+		if nil != err {
+			logger.New().Error("outbox: UNABLE TO READ DATAGRAM", zap.Error(err))
+			return false
+		}
+
+		if nil == record {
+			if replayed > 0 {
+				logger.New().Info("outbox: REPLAY DONE", zap.Int("replayed", replayed))
+			}
+			return true
+		}
+
+		if false == box.deliver(session, record) {
+			if ws.StateConnected != session.GetState() || 0 == atomic.LoadInt32(&identified) {
+				logger.New().Info("outbox: REPLAY SUSPENDED", zap.Int("replayed", replayed))
+				return false
+			}
+
+			// server is busy, try again later
+			time.Sleep(time.Duration(ackTimeout) * time.Second)
+			continue
+		}
+
+		err = box.spool.Ack(record)
+		if nil != err {
+			logger.New().Error("outbox: UNABLE TO DELETE DATAGRAM", zap.Error(err))
+			return false
+		}
+		replayed++
+	}
+}
+
+// deliver the kept datagram and wait for the acknowledgement of server
+//
+//	datagram - kept datagram, its ID is kept for server to detect duplicates
+//	time     - RFC3339 time when the datagram was kept
+//	class    - priority class
+func (box *agentOutbox) deliver(session ws.Session, record *spool.Record) bool {
+	datagram := &packet.Datagram{
+		ID:       util.RandomUUIDString(),
+		Type:     packet.T_REQUEST.String(),
+		Function: packet.F_REPLAY.String(),
+	}
+
+	datagram.Push(json.RawMessage(record.Data))
+	datagram.Push(record.Time.UTC().Format(time.RFC3339))
+	datagram.Push(record.Class)
+
+	// only the first callback counts, e.g. a result arriving while the timeout fires is not waited for
+	acked := make(chan bool, 1)
+	acknowledge := func(ok bool) {
+		select {
+		case acked <- ok:
+		default:
+		}
+	}
+
+	err := session.Deliver(datagram, ackTimeout,
+		func(session ws.Session, packetID string, arguments ...interface{}) {
+			acknowledge(true)
+		},
+		func(session ws.Session, packetID string, condition packet.ErrorCondition, errorMessage string) {
+			// server received the datagram but rejected it, it is not replayed again
+			logger.New().Warn("outbox: REPLAY REJECTED", zap.String("condition", condition.String()), zap.String("message", errorMessage))
+			acknowledge(true)
+		},
+		func(session ws.Session, packetID string, timeoutInterval int) {
+			acknowledge(false)
+		})
+	if nil != err {
+		return false
+	}
+
+	return <-acked
+}
+
+// replay kept datagrams in background once identified
+func replayOutbox(session ws.Session) {
+	if nil != outbox {
+		go outbox.replay(session)
+	}
+}
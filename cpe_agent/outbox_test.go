@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"sercomm.com/demeter/commons/packet"
+	"sercomm.com/demeter/commons/ws"
+)
+
+// replaySession answers F_REPLAY by "behavior": "result", "error", "timeout", "twice" or "fail"
+type replaySession struct {
+	ws.Session
+
+	behavior  string
+	state     ws.SessionState
+	delivered int
+	replayed  []string // IDs of replayed datagrams in order
+	onDeliver func()   // called on each delivery, e.g. to keep a live datagram during the replay
+}
+
+func (session *replaySession) GetState() ws.SessionState {
+	return session.state
+}
+
+func (session *replaySession) Deliver(
+	datagram *packet.Datagram,
+	timeoutInterval int,
+	onResult func(session ws.Session, packetID string, arguments ...interface{}),
+	onError func(session ws.Session, packetID string, condition packet.ErrorCondition, errorMessage string),
+	onTimeout func(session ws.Session, packetID string, timeoutInterval int)) error {
+
+	if nil != session.onDeliver {
+		session.onDeliver()
+	}
+
+	var kept packet.Datagram
+	if data, ok := datagram.Arguments[0].(json.RawMessage); ok && nil == json.Unmarshal(data, &kept) {
+		session.replayed = append(session.replayed, kept.ID)
+	}
+
+	switch session.behavior {
+	case "result":
+		onResult(session, datagram.ID)
+	case "twice":
+		// the result arrives while the timeout fires
+		onResult(session, datagram.ID)
+		onTimeout(session, datagram.ID, timeoutInterval)
+	case "error":
+		onError(session, datagram.ID, packet.E_BAD_REQUEST, "rejected")
+	case "timeout":
+		// the session is down while waiting
+		session.state = ws.StateClosed
+		onTimeout(session, datagram.ID, timeoutInterval)
+	default:
+		session.state = ws.StateClosed
+		return errors.New("SESSION IS NOT READY")
+	}
+
+	session.delivered++
+	return nil
+}
+
+func openTestOutbox(t *testing.T) (*agentOutbox, func()) {
+	t.Helper()
+
+	folder, err := ioutil.TempDir("", "outbox")
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	err = openOutbox(OutboxConfig{
+		Folder:      folder,
+		MaxSize:     1048576,
+		SegmentSize: 65536,
+		Priorities:  map[string]string{packet.F_LOG_SHIP.String(): classLow},
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	box := outbox
+	return box, func() {
+		box.spool.Close()
+		outbox = nil
+		os.RemoveAll(folder)
+	}
+}
+
+func TestOutboxKeep(t *testing.T) {
+	box, closeOutbox := openTestOutbox(t)
+	defer closeOutbox()
+
+	tests := []struct {
+		name      string
+		datagram  *packet.Datagram
+		connected bool
+		kept      bool
+		class     string
+	}{
+		{"live reply", &packet.Datagram{ID: "1", Type: packet.T_RESULT.String(), Function: packet.F_UBUS.String()}, true, false, ""},
+		{"live notification", &packet.Datagram{ID: "2", Type: packet.T_REQUEST.String(), Function: packet.F_RELAY.String()}, true, false, ""},
+		{"result while offline", &packet.Datagram{ID: "3", Type: packet.T_RESULT.String(), Function: packet.F_UBUS.String()}, false, true, classHigh},
+		{"notification while offline", &packet.Datagram{ID: "4", Type: packet.T_REQUEST.String(), Function: packet.F_RELAY.String()}, false, true, classNormal},
+		{"listed function while offline", &packet.Datagram{ID: "5", Type: packet.T_REQUEST.String(), Function: packet.F_LOG_SHIP.String()}, false, true, classLow},
+	}
+
+	for _, test := range tests {
+		before := box.spool.Len()
+
+		kept, err := box.Keep(test.datagram, test.connected)
+		if nil != err || test.kept != kept {
+			t.Errorf("%s: unexpected result %v, %v", test.name, kept, err)
+		}
+
+		if test.kept && before+1 != box.spool.Len() {
+			t.Errorf("%s: datagram was not spooled", test.name)
+		}
+
+		if test.kept && test.class != box.classOf(test.datagram) {
+			t.Errorf("%s: expected class %s but got %s", test.name, test.class, box.classOf(test.datagram))
+		}
+	}
+}
+
+func TestOutboxReplay(t *testing.T) {
+	atomic.StoreInt32(&identified, 1)
+	defer atomic.StoreInt32(&identified, 0)
+
+	tests := []struct {
+		name      string
+		behavior  string
+		left      int
+		delivered int
+	}{
+		{"acknowledged", "result", 0, 3},
+		{"rejected", "error", 0, 3},
+		{"acknowledged twice", "twice", 0, 3},
+		{"timeout", "timeout", 3, 1},
+		{"delivery failure", "fail", 3, 0},
+	}
+
+	for _, test := range tests {
+		box, closeOutbox := openTestOutbox(t)
+
+		for _, id := range []string{"1", "2", "3"} {
+			box.Keep(&packet.Datagram{ID: id, Type: packet.T_RESULT.String(), Function: packet.F_UBUS.String()}, false)
+		}
+
+		session := &replaySession{behavior: test.behavior, state: ws.StateConnected}
+		box.replay(session)
+
+		if test.left != box.spool.Len() || test.delivered != session.delivered {
+			t.Errorf("%s: unexpected %d left and %d delivered", test.name, box.spool.Len(), session.delivered)
+		}
+
+		// the replay is done whichever way it stopped
+		if box.replaying {
+			t.Errorf("%s: replay was not finished", test.name)
+		}
+
+		// replayed again once identified again
+		if 0 != test.left {
+			box.replay(&replaySession{behavior: "result", state: ws.StateConnected})
+			if 0 != box.spool.Len() {
+				t.Errorf("%s: unexpected %d left after replaying again", test.name, box.spool.Len())
+			}
+		}
+
+		closeOutbox()
+	}
+}
+
+func TestOutboxKeepDuringReplay(t *testing.T) {
+	atomic.StoreInt32(&identified, 1)
+	defer atomic.StoreInt32(&identified, 0)
+
+	box, closeOutbox := openTestOutbox(t)
+	defer closeOutbox()
+
+	for _, id := range []string{"1", "2"} {
+		box.Keep(&packet.Datagram{ID: id, Type: packet.T_RESULT.String(), Function: packet.F_UBUS.String()}, false)
+	}
+
+	// a live datagram is sent while each of the first replays is waiting for acknowledgement
+	session := &replaySession{behavior: "result", state: ws.StateConnected}
+	live := 0
+	session.onDeliver = func() {
+		if live < 2 {
+			live++
+			kept, err := box.Keep(&packet.Datagram{ID: fmt.Sprintf("live%d", live), Type: packet.T_RESULT.String(), Function: packet.F_UBUS.String()}, true)
+			if nil != err || false == kept {
+				t.Errorf("live datagram was not kept during the replay: %v, %v", kept, err)
+			}
+		}
+	}
+
+	box.replay(session)
+
+	expected := []string{"1", "2", "live1", "live2"}
+	if fmt.Sprint(expected) != fmt.Sprint(session.replayed) {
+		t.Errorf("expected replay in order %v but got %v", expected, session.replayed)
+	}
+
+	if 0 != box.spool.Len() || box.replaying {
+		t.Errorf("unexpected %d left, replaying %v", box.spool.Len(), box.replaying)
+	}
+
+	// delivered directly once the replay finished
+	kept, err := box.Keep(&packet.Datagram{ID: "live3", Type: packet.T_RESULT.String(), Function: packet.F_UBUS.String()}, true)
+	if nil != err || kept {
+		t.Errorf("live datagram was kept after the replay: %v, %v", kept, err)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+	"sercomm.com/demeter/commons/logger"
+	"sercomm.com/demeter/commons/packet"
+	"sercomm.com/demeter/commons/util"
+	"sercomm.com/demeter/commons/ws"
+)
+
+// let the ping period of the session adapt if "quality.adaptivePing" is enabled, invalid periods disable it
+func applyAdaptivePing(clientSession *ws.ClientSession, qualityConfig QualityConfig) {
+	if qualityConfig.AdaptivePing {
+		err := clientSession.SetAdaptivePing(qualityConfig.MinPingPeriod, qualityConfig.MaxPingPeriod)
+		if nil == err {
+			return
+		}
+
+		logger.New().Warn("quality: " + err.Error())
+	}
+
+	clientSession.SetAdaptivePing(0, 0)
+	clientSession.SetPingPeriod(currentConfig().Entry.PingPeriod)
+}
+
+// report connection quality to server every "quality.reportPeriod"
+func startQualityReport(qualityConfig QualityConfig) {
+	if 0 == qualityConfig.ReportPeriod {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(qualityConfig.ReportPeriod) * time.Second)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			reportQuality()
+		}
+	}()
+}
+
+// deliver ping statistics of the latest pings by F_QUALITY
+func reportQuality() {
+	if nil == session || ws.StateConnected != session.GetState() {
+		return
+	}
+
+	statistics := session.GetPingStatistics()
+	if 0 == statistics.Samples {
+		return
+	}
+
+	datagram := &packet.Datagram{
+		ID:       util.RandomUUIDString(),
+		Type:     packet.T_REQUEST.String(),
+		Function: packet.F_QUALITY.String(),
+	}
+
+	datagram.Push(map[string]interface{}{
+		"pingPeriod": session.GetPingPeriod(),
+		"ping":       statistics,
+	})
+
+	err := session.Deliver(datagram, ackTimeout, nil, nil, nil)
+	if nil != err {
+		logger.New().Debug("quality: CANNOT REPORT", zap.Error(err))
+	}
+}
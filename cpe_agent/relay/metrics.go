@@ -0,0 +1,27 @@
+package relay
+
+import (
+	"sercomm.com/demeter/commons/metrics"
+)
+
+// metrics of the relay in metrics.Default()
+const (
+	MetricMessages string = "relay_messages_total"
+	MetricDropped  string = "relay_dropped_total"
+	MetricBuffered string = "relay_buffered"
+)
+
+func init() {
+	registry := metrics.Default()
+	registry.Describe(MetricMessages, metrics.KindCounter, "Messages of local applications by client, type and outcome")
+	registry.Describe(MetricDropped, metrics.KindCounter, "Buffered notifications dropped as the buffer of the client was full")
+	registry.Describe(MetricBuffered, metrics.KindGauge, "Notifications buffered while the session is down")
+}
+
+func countMessage(client string, messageType string, outcome string) {
+	metrics.Default().AddCounter(MetricMessages, map[string]string{
+		"client":  client,
+		"type":    messageType,
+		"outcome": outcome,
+	}, 1)
+}
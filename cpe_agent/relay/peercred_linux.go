@@ -0,0 +1,34 @@
+package relay
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// uid of the process on the other side of the unix-domain socket, by SO_PEERCRED
+func peerUID(conn net.Conn) (int, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if false == ok {
+		return -1, errors.New("NOT A UNIX-DOMAIN SOCKET")
+	}
+
+	rawConn, err := unixConn.SyscallConn()
+	if nil != err {
+		return -1, err
+	}
+
+	var ucred *syscall.Ucred
+	var credErr error
+	err = rawConn.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if nil != err {
+		return -1, err
+	}
+	if nil != credErr {
+		return -1, credErr
+	}
+
+	return int(ucred.Uid), nil
+}
@@ -0,0 +1,44 @@
+package relay
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPeerUID(t *testing.T) {
+	folder, err := ioutil.TempDir("", "relay")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+
+	listener, err := net.Listen("unix", filepath.Join(folder, "relay.sock"))
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("unix", listener.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := listener.Accept()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	uid, err := peerUID(conn)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	if os.Getuid() != uid {
+		t.Errorf("expected uid %d but got %d", os.Getuid(), uid)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package relay
+
+import (
+	"errors"
+	"net"
+)
+
+// peer credentials are read only on Linux, clients are rejected elsewhere
+func peerUID(conn net.Conn) (int, error) {
+	return -1, errors.New("PEER CREDENTIALS ARE NOT SUPPORTED")
+}
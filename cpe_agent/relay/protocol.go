@@ -0,0 +1,37 @@
+package relay
+
+import (
+	"encoding/json"
+)
+
+// message types sent by local applications
+const (
+	TypeHello   string = "hello"   // declares the identity of the client, it must be the first message
+	TypeNotify  string = "notify"  // forwarded to server without waiting for its result, buffered while offline
+	TypeRequest string = "request" // forwarded to server, the result of server is replied
+)
+
+// Message is a line of JSON sent by a local application, e.g.
+//
+//	{"id":"1","type":"hello","client":"wifi-monitor"}
+//	{"id":"2","type":"notify","topic":"wifi.client.joined","payload":{"mac":"00:11:22:33:44:55"}}
+type Message struct {
+	ID      string          `json:"id"`
+	Type    string          `json:"type"`
+	Client  string          `json:"client,omitempty"`
+	Topic   string          `json:"topic,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Reply is a line of JSON replied to each message, "error" is blank on success
+type Reply struct {
+	ID     string      `json:"id"`
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// results of notifications
+const (
+	ResultSent     string = "SENT"
+	ResultBuffered string = "BUFFERED"
+)
@@ -0,0 +1,407 @@
+package relay
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"sercomm.com/demeter/commons/logger"
+	"sercomm.com/demeter/commons/metrics"
+	"sercomm.com/demeter/cpe_agent/control"
+)
+
+// messages longer than it are rejected
+const maxMessageSize int = 262144
+
+// a client which does not read its replies in time is disconnected
+var writeTimeout = (time.Second * 5)
+
+var clientNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Forwarder delivers messages of local applications to server
+type Forwarder interface {
+	Ready() bool
+	Notify(client string, topic string, payload json.RawMessage) error
+	Request(client string, topic string, payload json.RawMessage, onReply func(result interface{}, err error)) error
+}
+
+// ClientOptions limit messages of each client, listed clients follow Options.Default
+// where Rate or Burst is 0, or BufferSize is negative
+type ClientOptions struct {
+	UID        int     // the client is accepted only from processes of the user, it applies to listed clients
+	Rate       float64 // messages per second in average
+	Burst      int     // messages at once
+	BufferSize int     // notifications buffered while the session is down, the oldest ones are dropped beyond it, 0 to disable
+}
+
+// Options of the relay
+type Options struct {
+	Socket  string
+	Default ClientOptions
+	Clients map[string]ClientOptions // pair< client, options >, only listed clients are accepted from their users unless it is empty,
+	// otherwise a name is bound to the user of its connections while any of them is open
+}
+
+// Server relays messages of local applications through the Forwarder
+type Server struct {
+	options   Options
+	forwarder Forwarder
+	locker    sync.Mutex
+	clients   map[string]*clientState // pair< client, state >, shared by connections of the same client
+	buffer    []*notification         // in order of arrival
+	listener  net.Listener
+	// only one flush at a time
+	flushLocker sync.Mutex
+}
+
+type clientState struct {
+	uid         int // the name is bound to the user of its connections
+	connections int
+	options     ClientOptions
+	limiter     *tokenBucket
+	buffered    int
+}
+
+type notification struct {
+	client  string
+	topic   string
+	payload json.RawMessage
+}
+
+// NewServer ...
+func NewServer(options Options, forwarder Forwarder) *Server {
+	return &Server{
+		options:   options,
+		forwarder: forwarder,
+		clients:   make(map[string]*clientState),
+		buffer:    make([]*notification, 0),
+	}
+}
+
+// Start listens on the socket
+func (server *Server) Start() error {
+	listener, err := control.Listen(server.options.Socket)
+	if nil != err {
+		return err
+	}
+
+	server.locker.Lock()
+	server.listener = listener
+	server.locker.Unlock()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if nil != err {
+				return
+			}
+
+			go server.serve(conn)
+		}
+	}()
+
+	logger.New().Info("relay: LISTENING", zap.String("socket", server.options.Socket))
+	return nil
+}
+
+// Stop closes the socket and removes the socket file, buffered notifications are kept
+func (server *Server) Stop() {
+	server.locker.Lock()
+	defer server.locker.Unlock()
+
+	if nil != server.listener {
+		server.listener.Close()
+		server.listener = nil
+		os.Remove(server.options.Socket)
+	}
+}
+
+// Flush forwards buffered notifications in order until the buffer is empty or forwarding failed,
+// e.g. once the session is identified
+func (server *Server) Flush() {
+	server.flushLocker.Lock()
+	defer server.flushLocker.Unlock()
+
+	for server.forwarder.Ready() {
+		server.locker.Lock()
+		if 0 == len(server.buffer) {
+			server.locker.Unlock()
+			return
+		}
+		item := server.buffer[0]
+		server.locker.Unlock()
+
+		err := server.forwarder.Notify(item.client, item.topic, item.payload)
+		if nil != err {
+			logger.New().Warn("relay: FLUSH SUSPENDED", zap.Error(err))
+			return
+		}
+
+		server.locker.Lock()
+		// the item may be dropped while forwarding
+		server.remove(item)
+		server.locker.Unlock()
+	}
+}
+
+// state of the client connected from the process of "uid", nil if it is not accepted
+func (server *Server) identify(name string, uid int) (*clientState, error) {
+	if false == clientNamePattern.MatchString(name) {
+		return nil, errors.New("INVALID CLIENT NAME")
+	}
+
+	server.locker.Lock()
+	defer server.locker.Unlock()
+
+	state, ok := server.clients[name]
+	if ok {
+		// the name of an open relay is released once all connections of its user are closed,
+		// the state is kept for its limiter and buffered notifications
+		if state.uid != uid && 0 == len(server.options.Clients) && 0 == state.connections {
+			state.uid = uid
+		}
+
+		if state.uid != uid {
+			return nil, fmt.Errorf("CLIENT IS NOT ALLOWED: %s (UID %d)", name, uid)
+		}
+
+		state.connections++
+		return state, nil
+	}
+
+	options := server.options.Default
+	if 0 != len(server.options.Clients) {
+		clientOptions, ok := server.options.Clients[name]
+		if false == ok || clientOptions.UID != uid {
+			return nil, fmt.Errorf("CLIENT IS NOT ALLOWED: %s (UID %d)", name, uid)
+		}
+
+		if clientOptions.Rate > 0 {
+			options.Rate = clientOptions.Rate
+		}
+		if clientOptions.Burst > 0 {
+			options.Burst = clientOptions.Burst
+		}
+		if clientOptions.BufferSize >= 0 {
+			options.BufferSize = clientOptions.BufferSize
+		}
+	}
+
+	state = &clientState{
+		uid:         uid,
+		connections: 1,
+		options:     options,
+		limiter:     newTokenBucket(options.Rate, options.Burst),
+	}
+	server.clients[name] = state
+
+	return state, nil
+}
+
+// a connection of the client is closed
+func (server *Server) release(state *clientState) {
+	server.locker.Lock()
+	defer server.locker.Unlock()
+
+	state.connections--
+}
+
+func (server *Server) allow(state *clientState) bool {
+	server.locker.Lock()
+	defer server.locker.Unlock()
+
+	return state.limiter.allow(time.Now())
+}
+
+// forward the notification at once, or buffer it while the session is down
+func (server *Server) notify(name string, state *clientState, topic string, payload json.RawMessage) (string, error) {
+	server.locker.Lock()
+	pending := len(server.buffer)
+	server.locker.Unlock()
+
+	// buffered notifications go first
+	if 0 == pending && server.forwarder.Ready() {
+		if nil == server.forwarder.Notify(name, topic, payload) {
+			return ResultSent, nil
+		}
+	}
+
+	if state.options.BufferSize <= 0 {
+		return "", errors.New("SESSION IS NOT READY")
+	}
+
+	server.locker.Lock()
+	server.buffer = append(server.buffer, &notification{client: name, topic: topic, payload: payload})
+	state.buffered++
+
+	// drop the oldest notification of the client
+	if state.buffered > state.options.BufferSize {
+		for _, item := range server.buffer {
+			if item.client == name {
+				server.remove(item)
+				metrics.Default().AddCounter(MetricDropped, map[string]string{"client": name}, 1)
+				break
+			}
+		}
+	}
+	metrics.Default().SetGauge(MetricBuffered, nil, float64(len(server.buffer)))
+	server.locker.Unlock()
+
+	if server.forwarder.Ready() {
+		go server.Flush()
+	}
+
+	return ResultBuffered, nil
+}
+
+// remove the item from the buffer, it must be called with the locker
+func (server *Server) remove(target *notification) {
+	for idx, item := range server.buffer {
+		if item != target {
+			continue
+		}
+
+		server.buffer = append(server.buffer[:idx], server.buffer[idx+1:]...)
+		if state, ok := server.clients[item.client]; ok {
+			state.buffered--
+		}
+		break
+	}
+
+	metrics.Default().SetGauge(MetricBuffered, nil, float64(len(server.buffer)))
+}
+
+func (server *Server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	// names are trusted only along with the user of the peer
+	uid, err := peerUID(conn)
+	if nil != err {
+		logger.New().Warn("relay: UNKNOWN PEER", zap.Error(err))
+		return
+	}
+
+	// replies of requests are written asynchronously, a client which stops reading is disconnected
+	// so that neither the read loop nor the callbacks of server block
+	var writeLocker sync.Mutex
+	encoder := json.NewEncoder(conn)
+	reply := func(id string, result interface{}, err error) {
+		response := &Reply{ID: id, Result: result}
+		if nil != err {
+			response.Result = nil
+			response.Error = err.Error()
+		}
+
+		writeLocker.Lock()
+		defer writeLocker.Unlock()
+
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		err = encoder.Encode(response)
+		if nil != err {
+			logger.New().Warn("relay: UNABLE TO REPLY", zap.Error(err))
+			conn.Close()
+		}
+	}
+
+	name := ""
+	var state *clientState
+
+	defer func() {
+		if nil != state {
+			server.release(state)
+			logger.New().Info("relay: CLIENT DISCONNECTED", zap.String("client", name))
+		}
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 4096), maxMessageSize)
+	for scanner.Scan() {
+		var message Message
+		err := json.Unmarshal(scanner.Bytes(), &message)
+		if nil != err {
+			reply("", nil, errors.New("INVALID MESSAGE: "+err.Error()))
+			continue
+		}
+
+		if TypeHello == message.Type {
+			if nil != state {
+				reply(message.ID, nil, errors.New("CLIENT IS IDENTIFIED ALREADY"))
+				continue
+			}
+
+			state, err = server.identify(message.Client, uid)
+			if nil != err {
+				logger.New().Warn("relay: CLIENT REJECTED", zap.String("client", message.Client), zap.Int("uid", uid), zap.Error(err))
+				reply(message.ID, nil, err)
+				continue
+			}
+
+			name = message.Client
+			logger.New().Info("relay: CLIENT CONNECTED", zap.String("client", name), zap.Int("uid", uid))
+			reply(message.ID, name, nil)
+			continue
+		}
+
+		if nil == state {
+			reply(message.ID, nil, errors.New("HELLO IS REQUIRED"))
+			continue
+		}
+
+		if TypeNotify != message.Type && TypeRequest != message.Type {
+			reply(message.ID, nil, fmt.Errorf("UNKNOWN TYPE: %s", message.Type))
+			continue
+		}
+
+		if "" == message.Topic {
+			reply(message.ID, nil, errors.New("TOPIC IS REQUIRED"))
+			continue
+		}
+
+		if false == server.allow(state) {
+			countMessage(name, message.Type, "limited")
+			reply(message.ID, nil, errors.New("RATE LIMIT EXCEEDED"))
+			continue
+		}
+
+		switch message.Type {
+		case TypeNotify:
+			result, err := server.notify(name, state, message.Topic, message.Payload)
+			if nil != err {
+				countMessage(name, message.Type, "failed")
+			} else {
+				countMessage(name, message.Type, strings.ToLower(result))
+			}
+			reply(message.ID, result, err)
+		case TypeRequest:
+			// requests wait for server, they are not buffered
+			if false == server.forwarder.Ready() {
+				countMessage(name, message.Type, "failed")
+				reply(message.ID, nil, errors.New("SESSION IS NOT READY"))
+				continue
+			}
+
+			id := message.ID
+			messageType := message.Type
+			err = server.forwarder.Request(name, message.Topic, message.Payload, func(result interface{}, err error) {
+				if nil != err {
+					countMessage(name, messageType, "failed")
+				} else {
+					countMessage(name, messageType, "replied")
+				}
+				reply(id, result, err)
+			})
+			if nil != err {
+				countMessage(name, message.Type, "failed")
+				reply(message.ID, nil, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package relay
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServerIdentify(t *testing.T) {
+	tests := []struct {
+		name     string
+		clients  map[string]ClientOptions
+		client   string
+		uids     []int // uids of successive connections
+		accepted []bool
+	}{
+		{"open", nil, "monitor", []int{1000}, []bool{true}},
+		{"open rebinding", nil, "monitor", []int{1000, 1001, 1000}, []bool{true, false, true}},
+		{"invalid name", nil, "monitor client", []int{1000}, []bool{false}},
+		{"listed", map[string]ClientOptions{"monitor": {UID: 1000}}, "monitor", []int{1000, 1000}, []bool{true, true}},
+		{"listed root", map[string]ClientOptions{"monitor": {UID: 0}}, "monitor", []int{0, 1000}, []bool{true, false}},
+		{"other user", map[string]ClientOptions{"monitor": {UID: 1000}}, "monitor", []int{1001, 1000}, []bool{false, true}},
+		{"not listed", map[string]ClientOptions{"monitor": {UID: 1000}}, "other", []int{1000}, []bool{false}},
+	}
+
+	for _, test := range tests {
+		server := NewServer(Options{
+			Default: ClientOptions{Rate: 1, Burst: 1},
+			Clients: test.clients,
+		}, nil)
+
+		for index, uid := range test.uids {
+			state, err := server.identify(test.client, uid)
+			if test.accepted[index] != (nil == err) || test.accepted[index] != (nil != state) {
+				t.Errorf("%s: connection %d of uid %d unexpected result %v", test.name, index, uid, err)
+			}
+		}
+	}
+}
+
+func TestServerRelease(t *testing.T) {
+	tests := []struct {
+		name     string
+		clients  map[string]ClientOptions
+		accepted bool
+	}{
+		{"open", nil, true},
+		{"listed", map[string]ClientOptions{"monitor": {UID: 1000}}, false},
+	}
+
+	for _, test := range tests {
+		server := NewServer(Options{
+			Default: ClientOptions{Rate: 1, Burst: 1},
+			Clients: test.clients,
+		}, nil)
+
+		first, err := server.identify("monitor", 1000)
+		if nil != err {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		second, err := server.identify("monitor", 1000)
+		if nil != err {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		// the name is bound while any connection of its user is open
+		server.release(first)
+		if _, err = server.identify("monitor", 1001); nil == err {
+			t.Errorf("%s: name was taken while connected", test.name)
+		}
+
+		server.release(second)
+		state, err := server.identify("monitor", 1001)
+		if test.accepted != (nil == err) {
+			t.Errorf("%s: unexpected result %v", test.name, err)
+		}
+
+		// the limiter is kept for the next user
+		if test.accepted && state != first {
+			t.Errorf("%s: state was not kept", test.name)
+		}
+	}
+}
+
+func TestServerClientOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		client   ClientOptions
+		expected ClientOptions
+	}{
+		{"default", ClientOptions{UID: 1000, BufferSize: -1}, ClientOptions{Rate: 5, Burst: 20, BufferSize: 100}},
+		{"overridden", ClientOptions{UID: 1000, Rate: 1, Burst: 2, BufferSize: 3}, ClientOptions{Rate: 1, Burst: 2, BufferSize: 3}},
+		{"buffer disabled", ClientOptions{UID: 1000, BufferSize: 0}, ClientOptions{Rate: 5, Burst: 20, BufferSize: 0}},
+	}
+
+	for _, test := range tests {
+		server := NewServer(Options{
+			Default: ClientOptions{Rate: 5, Burst: 20, BufferSize: 100},
+			Clients: map[string]ClientOptions{"monitor": test.client},
+		}, nil)
+
+		state, err := server.identify("monitor", 1000)
+		if nil != err {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		options := state.options
+		options.UID = 0
+		if test.expected != options {
+			t.Errorf("%s: expected %+v but got %+v", test.name, test.expected, options)
+		}
+	}
+}
+
+func TestServerWriteTimeout(t *testing.T) {
+	folder, err := ioutil.TempDir("", "relay")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+
+	defer func(timeout time.Duration) {
+		writeTimeout = timeout
+	}(writeTimeout)
+	writeTimeout = time.Millisecond * 200
+
+	server := NewServer(Options{Socket: filepath.Join(folder, "relay.sock")}, nil)
+	err = server.Start()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	conn, err := net.Dial("unix", server.options.Socket)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// every invalid message is replied, but the client never reads the replies
+	go func() {
+		line := []byte("invalid\n")
+		for idx := 0; idx < 100000; idx++ {
+			if _, err := conn.Write(line); nil != err {
+				return
+			}
+		}
+	}()
+
+	time.Sleep(time.Second)
+
+	// the server disconnects (possibly resetting unread messages) instead of blocking forever
+	conn.SetReadDeadline(time.Now().Add(time.Second * 3))
+	_, err = io.Copy(ioutil.Discard, bufio.NewReader(conn))
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Fatalf("connection was not closed by the server: %v", err)
+	}
+}
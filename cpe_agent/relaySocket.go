@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+	"sercomm.com/demeter/commons/logger"
+	"sercomm.com/demeter/commons/packet"
+	"sercomm.com/demeter/commons/util"
+	"sercomm.com/demeter/commons/ws"
+	"sercomm.com/demeter/cpe_agent/relay"
+)
+
+var relayServer *relay.Server = nil
+
+// relay messages of other applications on "relay.socket" to server by F_RELAY
+func startRelay(relayConfig RelayConfig) {
+	if "" == relayConfig.Socket {
+		return
+	}
+
+	clients := make(map[string]relay.ClientOptions)
+	for name, clientConfig := range relayConfig.Clients {
+		clients[name] = relay.ClientOptions{
+			UID:        clientConfig.UID,
+			Rate:       clientConfig.Rate,
+			Burst:      clientConfig.Burst,
+			BufferSize: clientConfig.BufferSize,
+		}
+	}
+
+	relayServer = relay.NewServer(relay.Options{
+		Socket: relayConfig.Socket,
+		Default: relay.ClientOptions{
+			Rate:       relayConfig.Rate,
+			Burst:      relayConfig.Burst,
+			BufferSize: relayConfig.BufferSize,
+		},
+		Clients: clients,
+	}, &relayForwarder{})
+
+	err := relayServer.Start()
+	if nil != err {
+		logger.New().Error("relay: UNABLE TO LISTEN", zap.String("socket", relayConfig.Socket), zap.Error(err))
+		relayServer = nil
+	}
+}
+
+func stopRelay() {
+	if nil != relayServer {
+		relayServer.Stop()
+	}
+}
+
+// forward notifications buffered while offline
+func flushRelay() {
+	if nil != relayServer {
+		go relayServer.Flush()
+	}
+}
+
+// relayForwarder delivers messages of local applications through the session
+//
+//	client  - name declared by the application
+//	type    - "notify" or "request"
+//	topic   - given by the application, e.g. "wifi.client.joined"
+//	payload - JSON given by the application
+type relayForwarder struct {
+}
+
+// messages are forwarded once the session is identified
+func (forwarder *relayForwarder) Ready() bool {
+	return nil != session && ws.StateConnected == session.GetState() && 1 == atomic.LoadInt32(&identified)
+}
+
+func (forwarder *relayForwarder) Notify(client string, topic string, payload json.RawMessage) error {
+	datagram := newRelayDatagram(client, relay.TypeNotify, topic, payload)
+	return session.Deliver(datagram, ackTimeout, nil, nil, nil)
+}
+
+func (forwarder *relayForwarder) Request(client string, topic string, payload json.RawMessage, onReply func(result interface{}, err error)) error {
+	datagram := newRelayDatagram(client, relay.TypeRequest, topic, payload)
+	return session.Deliver(datagram, ackTimeout,
+		func(session ws.Session, packetID string, arguments ...interface{}) {
+			onReply(arguments, nil)
+		},
+		func(session ws.Session, packetID string, condition packet.ErrorCondition, errorMessage string) {
+			onReply(nil, fmt.Errorf("%s: %s", condition, errorMessage))
+		},
+		func(session ws.Session, packetID string, timeoutInterval int) {
+			onReply(nil, errors.New("NO RESULT FROM SERVER"))
+		})
+}
+
+func newRelayDatagram(client string, messageType string, topic string, payload json.RawMessage) *packet.Datagram {
+	datagram := &packet.Datagram{
+		ID:       util.RandomUUIDString(),
+		Type:     packet.T_REQUEST.String(),
+		Function: packet.F_RELAY.String(),
+	}
+
+	datagram.Push(client)
+	datagram.Push(messageType)
+	datagram.Push(topic)
+	datagram.Push(payload)
+
+	return datagram
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+	"sercomm.com/demeter/commons/configger"
+	"sercomm.com/demeter/commons/logger"
+	"sercomm.com/demeter/commons/ws"
+)
+
+var reloader *configger.Reloader = nil
+
+// the latest applied *AgentConfig
+var configHolder atomic.Value
+
+func currentConfig() *AgentConfig {
+	return configHolder.Load().(*AgentConfig)
+}
+
+// reload configuration by SIGHUP
+func reloadConfig() {
+	changedKeys, err := reloader.Reload()
+	if nil != err {
+		logger.New().Warn("config: " + err.Error())
+		return
+	}
+
+	if 0 == len(changedKeys) {
+		logger.New().Info("config: NOTHING CHANGED")
+	}
+}
+
+// start or stop watching configuration files according to "reload.watchPeriod"
+func watchConfig(watchPeriod int) {
+	reloader.StopWatching()
+
+	if watchPeriod > 0 {
+		reloader.Watch(time.Duration(watchPeriod) * time.Second)
+	}
+}
+
+// apply changed keys of the reloaded configuration
+// the session is reconnected only if the endpoint was changed
+func configReloaded(changedKeys []string, config interface{}) {
+	agentConfig := config.(*AgentConfig)
+	configHolder.Store(agentConfig)
+
+	reconnect := false
+	for _, key := range changedKeys {
+		switch {
+		case "entry.pingPeriod" == key:
+			if nil != session {
+				session.SetPingPeriod(agentConfig.Entry.PingPeriod)
+			}
+		case "log.level" == key:
+			logger.SetLevel(agentConfig.Log.Level)
+		case strings.HasPrefix(key, "log.websocket."):
+			ws.SetMessageLogOptions(messageLogOptions(agentConfig.Log.Websocket))
+		case isEndpointKey(key):
+			reconnect = true
+		case "reload.watchPeriod" == key:
+			watchConfig(agentConfig.Reload.WatchPeriod)
+		case "quality.adaptivePing" == key || "quality.minPingPeriod" == key || "quality.maxPingPeriod" == key:
+			if nil != session {
+				applyAdaptivePing(session, agentConfig.Quality)
+			}
+		case strings.HasPrefix(key, "remote."):
+			// read on each pushed change
+		default:
+			logger.New().Warn("config: CHANGE TAKES EFFECT AFTER RESTART", zap.String("key", key))
+		}
+	}
+
+	logger.New().Info("config: APPLIED", zap.Strings("changedKeys", changedKeys))
+
+	if reconnect && nil != session && ws.StateConnected == session.GetState() {
+		logger.New().Info("config: ENDPOINT CHANGED, RECONNECTING...")
+		session.Close(websocket.CloseNormalClosure, "CONFIGURATION CHANGED")
+	}
+}
+
+// the session has to reconnect once the key is changed
+func isEndpointKey(key string) bool {
+	return strings.HasPrefix(key, "entry.") && "entry.pingPeriod" != key
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+	"sercomm.com/demeter/commons/configger"
+	"sercomm.com/demeter/commons/logger"
+	"sercomm.com/demeter/commons/packet"
+	"sercomm.com/demeter/commons/ws"
+)
+
+// CONF_OVERRIDE_FILE file beside the configuration file which persists the configuration pushed by server
+const CONF_OVERRIDE_FILE string = "remote.yaml"
+
+// suffix of the file which keeps the overrides before an unconfirmed change
+const rollbackSuffix string = ".rollback"
+
+var overridePath string = ""
+
+// an applied change which is rolled back unless the agent is identified again in time
+var pendingLocker sync.Mutex
+var pendingTimer *time.Timer = nil
+
+// the pending change took effect, identifications before it do not confirm the change
+var pendingApplied bool = false
+
+// process F_CONFIG from server
+//
+//	method - "Get" returns effective values and their sources, "Set" changes values
+//	values - pair< key, value > for "Set", e.g. { "entry.pingPeriod": 60 }, null value removes the pushed value of the key
+func processConfigCommand(ctx context.Context, session ws.Session, id string, methodString string, values map[string]interface{}) {
+	datagram := &packet.Datagram{
+		ID:       id,
+		Type:     packet.T_RESULT.String(),
+		Function: packet.F_CONFIG.String(),
+	}
+
+	switch methodString {
+	case "Get":
+		config, origins := reloader.GetCurrent()
+		datagram.Push(configger.Values(config))
+		datagram.Push(origins)
+	case "Set":
+		changedKeys, condition, err := pushConfig(ctx, values)
+		if nil != err {
+			datagram.Type = packet.T_ERROR.String()
+			datagram.Push(condition)
+			datagram.Push(err.Error())
+			break
+		}
+
+		datagram.Push(changedKeys)
+
+		// reply before applying since the session may be reconnected
+		defer applyConfig(changedKeys)
+	default:
+		datagram.Type = packet.T_ERROR.String()
+		datagram.Push(packet.E_BAD_REQUEST)
+		datagram.Push("UNKNOWN METHOD: " + methodString)
+	}
+
+	err := session.Deliver(datagram, 0, nil, nil, nil)
+	if nil != err {
+		logger.FromContext(ctx).Warn("CANNOT DELIVER RESULT", zap.String("id", id), zap.Error(err))
+	}
+}
+
+// validate and persist pushed values, keys whose effective values will be changed are returned
+func pushConfig(ctx context.Context, values map[string]interface{}) ([]string, packet.ErrorCondition, error) {
+	pendingLocker.Lock()
+	defer pendingLocker.Unlock()
+
+	if nil != pendingTimer {
+		return nil, packet.E_CONFLICT, fmt.Errorf("PREVIOUS CHANGE IS NOT CONFIRMED YET")
+	}
+
+	if 0 == len(values) {
+		return nil, packet.E_BAD_REQUEST, fmt.Errorf("NO VALUE IS GIVEN")
+	}
+
+	previous, err := configger.ReadOverrides(overridePath)
+	if nil != err {
+		return nil, packet.E_INTERNAL_SERVER_ERROR, err
+	}
+
+	candidate := make(configger.Overrides)
+	for key, value := range previous {
+		candidate[key] = value
+	}
+
+	for key, value := range values {
+		if nil == value {
+			delete(candidate, key)
+			continue
+		}
+
+		switch value := value.(type) {
+		case string:
+			candidate[key] = value
+		case float64:
+			candidate[key] = strconv.FormatFloat(value, 'f', -1, 64)
+		case bool:
+			candidate[key] = strconv.FormatBool(value)
+		default:
+			return nil, packet.E_BAD_REQUEST, fmt.Errorf("'%s': SCALAR VALUE IS EXPECTED", key)
+		}
+	}
+
+	// validate the candidate with all other sources
+	candidatePath := overridePath + ".candidate"
+	err = configger.WriteOverrides(candidatePath, candidate)
+	if nil != err {
+		return nil, packet.E_INTERNAL_SERVER_ERROR, err
+	}
+	defer os.Remove(candidatePath)
+
+	sources := reloader.GetSources()
+	sources.OverrideFile = candidatePath
+
+	agentConfig := &AgentConfig{}
+	_, err = configger.BindSources(sources, agentConfig)
+	if nil != err {
+		return nil, packet.E_NOT_ACCEPTABLE, fmt.Errorf("%s", strings.Replace(err.Error(), candidatePath, CONF_OVERRIDE_FILE, -1))
+	}
+
+	current, _ := reloader.GetCurrent()
+	changedKeys := configger.DiffKeys(current, agentConfig)
+
+	// keep the previous overrides until the change is confirmed, it survives restarting
+	err = configger.WriteOverrides(overridePath+rollbackSuffix, previous)
+	if nil != err {
+		return nil, packet.E_INTERNAL_SERVER_ERROR, err
+	}
+
+	err = os.Rename(candidatePath, overridePath)
+	if nil != err {
+		os.Remove(overridePath + rollbackSuffix)
+		return nil, packet.E_INTERNAL_SERVER_ERROR, err
+	}
+
+	logger.FromContext(ctx).Info("config: REMOTE CHANGE PERSISTED", zap.String("file", overridePath), zap.Strings("changedKeys", changedKeys))
+
+	watchRollback()
+	pendingApplied = false
+
+	return changedKeys, "", nil
+}
+
+// reload the persisted change, it is confirmed by the next identification after it took effect,
+// hence the session is reconnected even if the endpoint is kept
+func applyConfig(changedKeys []string) {
+	reloadConfig()
+
+	pendingLocker.Lock()
+	pendingApplied = true
+	pendingLocker.Unlock()
+
+	// nothing took effect
+	if 0 == len(changedKeys) {
+		confirmConfig()
+		return
+	}
+
+	// the session is reconnected by configReloaded if the endpoint was changed
+	for _, key := range changedKeys {
+		if isEndpointKey(key) {
+			return
+		}
+	}
+
+	if nil != session && ws.StateConnected == session.GetState() {
+		logger.New().Info("config: RECONNECTING TO CONFIRM REMOTE CHANGE")
+		session.Close(websocket.CloseNormalClosure, "CONFIGURATION CHANGED")
+	}
+}
+
+// start the grace period of an unconfirmed change
+func watchRollback() {
+	grace := currentConfig().Remote.RollbackGrace
+
+	logger.New().Info("config: WAITING FOR CONFIRMATION", zap.Int("grace", grace))
+	pendingTimer = time.AfterFunc(time.Duration(grace)*time.Second, rollbackConfig)
+}
+
+// resume the grace period of a change which was not confirmed before restarting
+func resumeRollback() {
+	if _, err := os.Stat(overridePath + rollbackSuffix); nil != err {
+		return
+	}
+
+	pendingLocker.Lock()
+	defer pendingLocker.Unlock()
+
+	// the change was loaded on startup
+	watchRollback()
+	pendingApplied = true
+}
+
+// the agent was identified after the change took effect, the previous overrides are dropped
+func confirmConfig() {
+	pendingLocker.Lock()
+	defer pendingLocker.Unlock()
+
+	if nil == pendingTimer || false == pendingApplied {
+		return
+	}
+
+	pendingTimer.Stop()
+	pendingTimer = nil
+
+	os.Remove(overridePath + rollbackSuffix)
+	logger.New().Info("config: REMOTE CHANGE CONFIRMED")
+}
+
+// the agent was not identified in time, the previous overrides are restored
+func rollbackConfig() {
+	pendingLocker.Lock()
+
+	if nil == pendingTimer {
+		pendingLocker.Unlock()
+		return
+	}
+	pendingTimer = nil
+
+	previous, err := configger.ReadOverrides(overridePath + rollbackSuffix)
+	if nil == err {
+		err = configger.WriteOverrides(overridePath, previous)
+	}
+
+	if nil != err {
+		pendingLocker.Unlock()
+		logger.New().Error("config: FAILED TO ROLL BACK REMOTE CHANGE: " + err.Error())
+		return
+	}
+
+	os.Remove(overridePath + rollbackSuffix)
+	pendingLocker.Unlock()
+
+	logger.New().Warn("config: REMOTE CHANGE ROLLED BACK AS IDENTIFICATION FAILED")
+	reloadConfig()
+}
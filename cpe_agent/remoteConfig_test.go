@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"sercomm.com/demeter/commons/configger"
+	"sercomm.com/demeter/commons/packet"
+)
+
+func openTestRemoteConfig(t *testing.T) func() {
+	t.Helper()
+
+	folder, err := ioutil.TempDir("", "remote")
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	confPath := filepath.Join(folder, "cpe_agent.yaml")
+	err = ioutil.WriteFile(confPath, []byte("entry:\n  host: demeter.local\n"), 0644)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	overridePath = filepath.Join(folder, CONF_OVERRIDE_FILE)
+
+	agentConfig := &AgentConfig{}
+	reloader, err = configger.NewReloader(configger.Sources{File: confPath, OverrideFile: overridePath}, agentConfig)
+	if nil != err {
+		t.Fatal(err)
+	}
+	configHolder.Store(agentConfig)
+	reloader.Subscribe(configReloaded)
+
+	return func() {
+		pendingLocker.Lock()
+		if nil != pendingTimer {
+			pendingTimer.Stop()
+			pendingTimer = nil
+		}
+		pendingLocker.Unlock()
+
+		os.RemoveAll(folder)
+	}
+}
+
+func rollbackExists() bool {
+	_, err := os.Stat(overridePath + rollbackSuffix)
+	return nil == err
+}
+
+func TestPushConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		values    map[string]interface{}
+		condition packet.ErrorCondition
+		changed   int
+	}{
+		{"changed", map[string]interface{}{"entry.pingPeriod": float64(60)}, "", 1},
+		{"unchanged", map[string]interface{}{"entry.pingPeriod": float64(30)}, "", 0},
+		{"invalid", map[string]interface{}{"entry.pingPeriod": float64(0)}, packet.E_NOT_ACCEPTABLE, 0},
+		{"not scalar", map[string]interface{}{"entry.pingPeriod": []interface{}{}}, packet.E_BAD_REQUEST, 0},
+		{"empty", map[string]interface{}{}, packet.E_BAD_REQUEST, 0},
+	}
+
+	for _, test := range tests {
+		closer := openTestRemoteConfig(t)
+
+		changedKeys, condition, err := pushConfig(context.Background(), test.values)
+		if test.condition != condition || ("" == test.condition) != (nil == err) {
+			t.Errorf("%s: unexpected result %s %v", test.name, condition, err)
+		} else if "" != test.condition {
+			// a rejected change is neither persisted nor watched
+			if _, err = os.Stat(overridePath); nil == err || rollbackExists() || nil != pendingTimer {
+				t.Errorf("%s: rejected change was persisted", test.name)
+			}
+		} else if test.changed != len(changedKeys) || false == rollbackExists() || nil == pendingTimer {
+			t.Errorf("%s: unexpected changed keys %+v", test.name, changedKeys)
+		}
+
+		closer()
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		values    map[string]interface{}
+		apply     bool
+		identify  bool
+		rollback  bool
+		confirmed bool
+		period    int
+	}{
+		{"identified after applying", map[string]interface{}{"entry.pingPeriod": float64(60)}, true, true, false, true, 60},
+		{"identified before applying", map[string]interface{}{"entry.pingPeriod": float64(60)}, false, true, false, false, 30},
+		{"applied but not identified", map[string]interface{}{"entry.pingPeriod": float64(60)}, true, false, false, false, 60},
+		{"rolled back without identification", map[string]interface{}{"entry.pingPeriod": float64(60)}, true, false, true, false, 30},
+		{"identification after rollback", map[string]interface{}{"entry.pingPeriod": float64(60)}, true, true, true, false, 30},
+		{"nothing changed", map[string]interface{}{"entry.pingPeriod": float64(30)}, true, false, false, true, 30},
+	}
+
+	for _, test := range tests {
+		closer := openTestRemoteConfig(t)
+
+		changedKeys, _, err := pushConfig(context.Background(), test.values)
+		if nil != err {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		if test.apply {
+			applyConfig(changedKeys)
+		}
+
+		if test.rollback {
+			rollbackConfig()
+		}
+
+		if test.identify {
+			confirmConfig()
+		}
+
+		// the rollback file is kept until the change is confirmed or rolled back
+		if (test.confirmed || test.rollback) == rollbackExists() {
+			t.Errorf("%s: rollback file exists %v", test.name, rollbackExists())
+		}
+
+		if test.period != currentConfig().Entry.PingPeriod {
+			t.Errorf("%s: expected ping period %d but got %d", test.name, test.period, currentConfig().Entry.PingPeriod)
+		}
+
+		overrides, err := configger.ReadOverrides(overridePath)
+		if nil != err {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		// the previous overrides are restored by the rollback
+		if _, ok := overrides["entry.pingPeriod"]; ok == test.rollback {
+			t.Errorf("%s: unexpected overrides %+v", test.name, overrides)
+		}
+
+		closer()
+	}
+}
+
+func TestResumeRollback(t *testing.T) {
+	closer := openTestRemoteConfig(t)
+	defer closer()
+
+	// nothing to resume
+	resumeRollback()
+	if nil != pendingTimer {
+		t.Fatal("rollback without unconfirmed change")
+	}
+
+	_, _, err := pushConfig(context.Background(), map[string]interface{}{"entry.pingPeriod": float64(60)})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	// restart with the persisted change, the rollback file is kept
+	pendingTimer.Stop()
+	pendingTimer = nil
+	pendingApplied = false
+	reloadConfig()
+
+	resumeRollback()
+	if nil == pendingTimer {
+		t.Fatal("rollback was not resumed")
+	}
+
+	// the agent is not identified in time
+	rollbackConfig()
+	if rollbackExists() || 30 != currentConfig().Entry.PingPeriod {
+		t.Fatalf("change was not rolled back, ping period is %d", currentConfig().Entry.PingPeriod)
+	}
+
+	_, _, err = pushConfig(context.Background(), map[string]interface{}{"entry.pingPeriod": float64(90)})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	pendingTimer.Stop()
+	pendingTimer = nil
+	reloadConfig()
+
+	// the change loaded on startup is confirmed by the first identification
+	resumeRollback()
+	confirmConfig()
+	if rollbackExists() || 90 != currentConfig().Entry.PingPeriod {
+		t.Fatalf("change was not confirmed, ping period is %d", currentConfig().Entry.PingPeriod)
+	}
+}
@@ -1,22 +1,67 @@
 package caller
 
 import (
+	"context"
 	"errors"
 	"io/ioutil"
 	"os/exec"
 	"runtime/debug"
+	"strings"
 	"time"
 
 	"go.uber.org/zap"
 	"sercomm.com/demeter/commons/logger"
+	"sercomm.com/demeter/commons/metrics"
 )
 
+// metrics of ubus calls in metrics.Default()
+const (
+	MetricCallDuration string = "ubus_call_duration_seconds"
+	MetricCallErrors   string = "ubus_call_errors_total"
+)
+
+// paths and methods come from the server, the root object of the path is the label, e.g. "Services"
+var (
+	pathLabel   = metrics.NewBoundedLabel(32)
+	methodLabel = metrics.NewBoundedLabel(32)
+)
+
+func init() {
+	metrics.Default().Describe(MetricCallDuration, metrics.KindHistogram, "Duration of ubus subprocess by root object of the path and method")
+	metrics.Default().Describe(MetricCallErrors, metrics.KindCounter, "Failed ubus calls by root object of the path and method")
+}
+
 // Call ... Execute ubus CLI
 //    method   - method of target ubus path depends on definitions of each ubus command. E.g. "Get","Install","Delete" etc.
 //    path     - ubus command path. E.g. "Services.Management.LCM.ExecutionEnvironments"
 //    payload  - payload JSON string. Please refer to Sercomm_LCM_UBUS_API.xlsx or any up-to-date document
 func Call(method string, path string, payloadString string) (string, error) {
+	return CallContext(context.Background(), method, path, payloadString)
+}
+
+// CallContext ... the same as Call, entries are logged by the logger carried by "ctx"
+func CallContext(ctx context.Context, method string, path string, payloadString string) (string, error) {
 	//logger.New().Info("UBUS CALL: ", zap.String("PATH", path), zap.String("METHOD", method), zap.String("PAYLOAD", payloadString))
+	log := logger.FromContext(ctx).With(zap.String("path", path), zap.String("method", method))
+	start := time.Now()
+
+	responseString, err := execute(log, method, path, payloadString)
+
+	labels := map[string]string{
+		"path":   pathLabel.Value(strings.SplitN(path, ".", 2)[0]),
+		"method": methodLabel.Value(method),
+	}
+	metrics.Default().ObserveDuration(MetricCallDuration, labels, start)
+	if nil != err {
+		metrics.Default().AddCounter(MetricCallErrors, labels, 1)
+	}
+
+	log.Info("UBUS CALL FINISHED", zap.Duration("duration", time.Since(start)), zap.Bool("success", nil == err))
+	return responseString, err
+}
+
+// execute ubus CLI
+func execute(log *logger.Logger, method string, path string, payloadString string) (string, error) {
 
 	var responseString string
 	var err error
@@ -31,20 +76,20 @@ func Call(method string, path string, payloadString string) (string, error) {
 	stdout, err := cmd.StdoutPipe()
 	defer stdout.Close()
 	if err != nil {
-		logger.New().Info("UBUS ERROR: ", zap.String("MESSAGE", err.Error()))
+		log.Info("UBUS ERROR: ", zap.String("MESSAGE", err.Error()))
 		return responseString, err
 	}
 
 	stderr, err := cmd.StderrPipe()
 	defer stderr.Close()
 	if err != nil {
-		logger.New().Info("UBUS ERROR: ", zap.String("MESSAGE", err.Error()))
+		log.Info("UBUS ERROR: ", zap.String("MESSAGE", err.Error()))
 		return responseString, err
 	}
 
 	// execute the command
 	if err := cmd.Start(); err != nil {
-		logger.New().Info("UBUS ERROR: ", zap.String("MESSAGE", err.Error()))
+		log.Info("UBUS ERROR: ", zap.String("MESSAGE", err.Error()))
 		return responseString, err
 	}
 
@@ -54,14 +99,14 @@ func Call(method string, path string, payloadString string) (string, error) {
 	if nil == err {
 		errMsg := string(buffer)
 		if errMsg != "" {
-			logger.New().Info("UBUS RESPONSE: ", zap.String("ERROR", errMsg))
+			log.Info("UBUS RESPONSE: ", zap.String("ERROR", errMsg))
 			err = errors.New(errMsg)
 		} else {
 			// read stdout
 			buffer, err = ioutil.ReadAll(stdout)
 			if nil == err {
 				responseString = string(buffer)
-				logger.New().Info("UBUS RESPONSE: ", zap.String("RESPONSE", responseString))
+				log.Info("UBUS RESPONSE: ", zap.String("RESPONSE", responseString))
 			}
 		}
 	}
@@ -69,10 +114,10 @@ func Call(method string, path string, payloadString string) (string, error) {
 	// force killing the process if it cannot exit normally
 	timer := time.AfterFunc(time.Duration(3)*time.Second, func() {
 		if err := cmd.Process.Kill(); err != nil {
-			logger.New().Info("UBUS FAILED TO KILL PROCESS: ", zap.String("MESSAGE", err.Error()))
+			log.Info("UBUS FAILED TO KILL PROCESS: ", zap.String("MESSAGE", err.Error()))
 		}
 
-		logger.New().Info("UBUS PROCESS KILLED AS TIMEOUT REACHED")
+		log.Info("UBUS PROCESS KILLED AS TIMEOUT REACHED")
 	})
 
 	// wait for the process to finish or kill it after 3 seconds (whichever happens first):
@@ -89,7 +134,7 @@ func Call(method string, path string, payloadString string) (string, error) {
 	select {
 	case err := <-done:
 		if err != nil {
-			logger.New().Info("UBUS PROCESS FINISHED WITH ERROR: ", zap.String("MESSAGE", err.Error()))
+			log.Info("UBUS PROCESS FINISHED WITH ERROR: ", zap.String("MESSAGE", err.Error()))
 		}
 	}
 
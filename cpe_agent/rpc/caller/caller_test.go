@@ -0,0 +1,107 @@
+package caller
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"sercomm.com/demeter/commons/metrics"
+)
+
+// fake ubus CLI which fails on paths under "Fail"
+const fakeUbus string = `#!/bin/sh
+case "$2" in
+Fail.*)
+	echo "Not found" >&2
+	exit 4
+	;;
+esac
+echo '{"result":"ok"}'
+`
+
+func sampleValue(name string, labels map[string]string) float64 {
+	for _, sample := range metrics.Default().Snapshot() {
+		if name != sample.Name || len(labels) != len(sample.Labels) {
+			continue
+		}
+
+		matched := true
+		for key, value := range labels {
+			if sample.Labels[key] != value {
+				matched = false
+			}
+		}
+
+		if matched {
+			return sample.Value
+		}
+	}
+
+	return 0
+}
+
+func TestCallContextMetrics(t *testing.T) {
+	folder, err := ioutil.TempDir("", "caller")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+
+	err = ioutil.WriteFile(filepath.Join(folder, "ubus"), []byte(fakeUbus), 0755)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", folder)
+
+	// two distinct values of each label are reported as they are
+	defer func(path *metrics.BoundedLabel, method *metrics.BoundedLabel) {
+		pathLabel = path
+		methodLabel = method
+	}(pathLabel, methodLabel)
+	pathLabel = metrics.NewBoundedLabel(2)
+	methodLabel = metrics.NewBoundedLabel(2)
+
+	tests := []struct {
+		name   string
+		path   string
+		method string
+		fail   bool
+		labels map[string]string
+	}{
+		{"root object", "Services.Management.LCM", "Get", false, map[string]string{"path": "Services", "method": "Get"}},
+		{"another root object", "Device", "Set", false, map[string]string{"path": "Device", "method": "Set"}},
+		{"same root object", "Services.Management", "Get", false, map[string]string{"path": "Services", "method": "Get"}},
+		{"failure", "Fail.Path", "Get", true, map[string]string{"path": metrics.OtherLabel, "method": "Get"}},
+		{"beyond the limits", "Extra.Path", "Delete", false, map[string]string{"path": metrics.OtherLabel, "method": metrics.OtherLabel}},
+	}
+
+	for _, test := range tests {
+		count := sampleValue(MetricCallDuration+"_count", test.labels)
+		errors := sampleValue(MetricCallErrors, test.labels)
+
+		response, err := CallContext(context.Background(), test.method, test.path, "")
+		if test.fail != (nil != err) {
+			t.Errorf("%s: unexpected result '%s' %v", test.name, response, err)
+		}
+
+		if count+1 != sampleValue(MetricCallDuration+"_count", test.labels) {
+			t.Errorf("%s: duration of %+v was not observed", test.name, test.labels)
+		}
+
+		if sum := sampleValue(MetricCallDuration+"_sum", test.labels); sum <= 0 {
+			t.Errorf("%s: unexpected duration %f", test.name, sum)
+		}
+
+		expected := errors
+		if test.fail {
+			expected++
+		}
+		if expected != sampleValue(MetricCallErrors, test.labels) {
+			t.Errorf("%s: expected %f errors but got %f", test.name, expected, sampleValue(MetricCallErrors, test.labels))
+		}
+	}
+}